@@ -4,6 +4,9 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,6 +14,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -26,19 +30,32 @@ var (
 	maxInFlight      = flag.Int("max-in-flight", 100, "max number of messages to allow in flight")
 	nsqdTCPAddrs     = util.StringArray{}
 	lookupdHTTPAddrs = util.StringArray{}
+	pubNSQDTCPAddrs  = util.StringArray{}
+	allowedOrigins   = util.StringArray{}
 )
 
 func init() {
 	flag.Var(&nsqdTCPAddrs, "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
+	flag.Var(&pubNSQDTCPAddrs, "publish-nsqd-tcp-address", "nsqd TCP address /pub publishes to (may be given multiple times, defaults to --nsqd-tcp-address)")
+	flag.Var(&allowedOrigins, "allowed-origin", "origin (ie. https://example.com, or * for any) allowed to open WebSockets from a browser (may be given multiple times, defaults to same origin only)")
 }
 
+var (
+	errAckDisabled    = errors.New("E_INVALID subscription was not made with ack=true")
+	errUnknownMessage = errors.New("E_INVALID unknown message id")
+	errInvalidCommand = errors.New("E_INVALID invalid command")
+)
+
 type StreamServer struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	messageCount uint64
+	messageCount   uint64
+	publishedCount uint64
+	publishIndex   uint64
 
 	sync.RWMutex // embed a r/w mutex
 	clients      []*StreamReader
+	producers    []*nsq.Producer
 }
 
 func (s *StreamServer) Set(sr *StreamReader) {
@@ -50,7 +67,7 @@ func (s *StreamServer) Set(sr *StreamReader) {
 func (s *StreamServer) Del(sr *StreamReader) {
 	s.Lock()
 	defer s.Unlock()
-	n := make([]*StreamReader, len(s.clients)-1)
+	n := make([]*StreamReader, 0, len(s.clients)-1)
 	for _, x := range s.clients {
 		if x != sr {
 			n = append(n, x)
@@ -59,17 +76,40 @@ func (s *StreamServer) Del(sr *StreamReader) {
 	s.clients = n
 }
 
+func (s *StreamServer) Get(id string) *StreamReader {
+	s.RLock()
+	defer s.RUnlock()
+	for _, sr := range s.clients {
+		if sr.id == id {
+			return sr
+		}
+	}
+	return nil
+}
+
 var streamServer *StreamServer
 
 type StreamReader struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	messageCount uint64
+	finishCount  uint64
+	requeueCount uint64
+
 	sync.RWMutex // embed a r/w mutex
+	id           string
 	topic        string
 	channel      string
+	transport    string
 	consumer     *nsq.Consumer
 	req          *http.Request
-	conn         net.Conn
-	bufrw        *bufio.ReadWriter
+	remoteAddr   string
+	writer       streamWriter
 	connectTime  time.Time
+
+	// with ack, messages are only finished (or requeued) by the client
+	ack      bool
+	inFlight map[nsq.MessageID]*nsq.Message
+	stopped  bool
 }
 
 func ConnectToNSQAndLookupd(r *nsq.Consumer, nsqAddrs []string, lookupd []string) error {
@@ -91,34 +131,53 @@ func ConnectToNSQAndLookupd(r *nsq.Consumer, nsqAddrs []string, lookupd []string
 	return nil
 }
 
+func newSubscriptionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func StatsHandler(w http.ResponseWriter, req *http.Request) {
 	totalMessages := atomic.LoadUint64(&streamServer.messageCount)
-	io.WriteString(w, fmt.Sprintf("Total Messages: %d\n\n", totalMessages))
+	io.WriteString(w, fmt.Sprintf("Total Messages: %d\n", totalMessages))
+	totalPublished := atomic.LoadUint64(&streamServer.publishedCount)
+	io.WriteString(w, fmt.Sprintf("Total Published: %d\n\n", totalPublished))
 
+	streamServer.RLock()
+	defer streamServer.RUnlock()
 	now := time.Now()
 	for _, sr := range streamServer.clients {
 		duration := now.Sub(sr.connectTime).Seconds()
 		secondsDuration := time.Duration(int64(duration)) * time.Second // turncate to the second
 
-		io.WriteString(w, fmt.Sprintf("[%s] [%s : %s] connected: %s\n",
-			sr.conn.RemoteAddr().String(),
+		io.WriteString(w, fmt.Sprintf("[%s] [%s : %s] %s msgs: %-8d fin: %-8d re-q: %-8d connected: %s\n",
+			sr.remoteAddr,
 			sr.topic,
 			sr.channel,
+			sr.transport,
+			atomic.LoadUint64(&sr.messageCount),
+			atomic.LoadUint64(&sr.finishCount),
+			atomic.LoadUint64(&sr.requeueCount),
 			secondsDuration))
 	}
 }
 
 func (s *StreamServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	path := req.URL.Path
-	if path == "/stats" {
+	switch req.URL.Path {
+	case "/stats":
 		StatsHandler(w, req)
-		return
-	}
-	if path != "/sub" {
+	case "/sub":
+		s.subHandler(w, req)
+	case "/pub":
+		s.pubHandler(w, req)
+	case "/fin", "/req", "/touch":
+		s.ackHandler(w, req)
+	default:
 		w.WriteHeader(404)
-		return
 	}
+}
 
+func (s *StreamServer) subHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -131,14 +190,32 @@ func (s *StreamServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "httpserver doesn't support hijacking", http.StatusInternalServerError)
-		return
+	var ack bool
+	if ackStr, err := reqParams.Get("ack"); err == nil {
+		ack, err = strconv.ParseBool(ackStr)
+		if err != nil {
+			http.Error(w, "INVALID_ACK", http.StatusBadRequest)
+			return
+		}
 	}
-	conn, bufrw, err := hj.Hijack()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	bodyEncoding := "text"
+	if enc, err := reqParams.Get("body_encoding"); err == nil {
+		if enc != "text" && enc != "base64" {
+			http.Error(w, "INVALID_BODY_ENCODING", http.StatusBadRequest)
+			return
+		}
+		bodyEncoding = enc
+	}
+
+	transport := "http"
+	if isWebsocketRequest(req) {
+		transport = "websocket"
+	} else if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		transport = "sse"
+	}
+	if ack && transport == "http" {
+		http.Error(w, "ACK_UNSUPPORTED", http.StatusBadRequest)
 		return
 	}
 
@@ -153,44 +230,297 @@ func (s *StreamServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	r.SetLogger(log.New(os.Stderr, "", log.LstdFlags), nsq.LogLevelInfo)
 
 	sr := &StreamReader{
+		id:          newSubscriptionID(),
 		topic:       topicName,
 		channel:     channelName,
+		transport:   transport,
 		consumer:    r,
 		req:         req,
-		conn:        conn,
-		bufrw:       bufrw, // TODO: latency writer
+		remoteAddr:  req.RemoteAddr,
 		connectTime: time.Now(),
+		ack:         ack,
+		inFlight:    make(map[nsq.MessageID]*nsq.Message),
+	}
+
+	var ws *wsConn
+	var sse *sseStreamWriter
+	var bufrw *bufio.ReadWriter
+	switch transport {
+	case "websocket":
+		ws, err = upgradeWebsocket(w, req, allowedOrigins)
+		if err != nil {
+			log.Printf("[%s] websocket handshake failed - %s", req.RemoteAddr, err)
+			return
+		}
+		sr.writer = &wsStreamWriter{ws, bodyEncoding}
+	case "sse":
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "httpserver doesn't support flushing", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+		sse = &sseStreamWriter{w: w, flusher: flusher, bodyEncoding: bodyEncoding, doneChan: make(chan int)}
+		sr.writer = sse
+		// the subscription is needed to FIN/REQ over HTTP
+		sse.writeEvent("subscribed", "", []byte(fmt.Sprintf("{\"subscription\":%q}", sr.id)))
+	default:
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "httpserver doesn't support hijacking", http.StatusInternalServerError)
+			return
+		}
+		var conn net.Conn
+		conn, bufrw, err = hj.Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		bufrw.WriteString("HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+		bufrw.Flush()
+		sr.writer = &httpStreamWriter{conn, bufrw, bodyEncoding} // TODO: latency writer
 	}
 	s.Set(sr)
 
-	log.Printf("[%s] new connection", conn.RemoteAddr().String())
-	bufrw.WriteString("HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
-	bufrw.Flush()
+	log.Printf("[%s] new %s connection", req.RemoteAddr, transport)
 
 	r.AddHandler(sr)
 
 	// TODO: handle the error cases better (ie. at all :) )
-	errors := ConnectToNSQAndLookupd(r, nsqdTCPAddrs, lookupdHTTPAddrs)
-	log.Printf("connected to NSQ %v", errors)
+	err = ConnectToNSQAndLookupd(r, nsqdTCPAddrs, lookupdHTTPAddrs)
+	log.Printf("connected to NSQ %v", err)
+
+	go sr.HeartbeatLoop()
+
+	switch transport {
+	case "websocket":
+		go sr.commandLoop(ws)
+	case "sse":
+		closeChan := w.(http.CloseNotifier).CloseNotify()
+		select {
+		case <-closeChan:
+			log.Printf("[%s] client disconnected", req.RemoteAddr)
+			sr.Stop()
+		case <-sse.doneChan:
+		}
+		// the handler must outlive every write to the response
+		<-sse.doneChan
+	default:
+		// this read allows us to detect clients that disconnect
+		go func(rw *bufio.ReadWriter) {
+			b, err := rw.ReadByte()
+			if err != nil {
+				log.Printf("got connection err %s", err.Error())
+			} else {
+				log.Printf("unexpected data on request socket (%c); closing", b)
+			}
+			sr.Stop()
+		}(bufrw)
+	}
+}
+
+// pubHandler publishes each message of a WebSocket to ?topic=, responding
+// to each with OK (or an error)
+func (s *StreamServer) pubHandler(w http.ResponseWriter, req *http.Request) {
+	if len(s.producers) == 0 {
+		http.Error(w, "PUBLISHING_DISABLED", http.StatusNotFound)
+		return
+	}
+
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil || !util.IsValidTopicName(topicName) {
+		http.Error(w, "INVALID_TOPIC", http.StatusBadRequest)
+		return
+	}
+
+	if !isWebsocketRequest(req) {
+		http.Error(w, "WEBSOCKET_REQUIRED", http.StatusBadRequest)
+		return
+	}
+	ws, err := upgradeWebsocket(w, req, allowedOrigins)
+	if err != nil {
+		log.Printf("[%s] websocket handshake failed - %s", req.RemoteAddr, err)
+		return
+	}
+	defer ws.Close()
+
+	log.Printf("[%s] new publisher to %s", req.RemoteAddr, topicName)
+	for {
+		_, body, err := ws.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[%s] publisher err %s", req.RemoteAddr, err)
+			}
+			return
+		}
+
+		response := []byte("OK")
+		err = s.publish(topicName, body)
+		if err != nil {
+			log.Printf("[%s] failed to publish to %s - %s", req.RemoteAddr, topicName, err)
+			response = []byte("E_PUB_FAILED " + err.Error())
+		}
+		err = ws.WriteMessage(wsOpText, response)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// publish tries each nsqd (round robin) until the message is published
+func (s *StreamServer) publish(topic string, body []byte) error {
+	var err error
+	idx := atomic.AddUint64(&s.publishIndex, 1)
+	for i := 0; i < len(s.producers); i++ {
+		p := s.producers[(idx+uint64(i))%uint64(len(s.producers))]
+		err = p.Publish(topic, body)
+		if err == nil {
+			atomic.AddUint64(&s.publishedCount, 1)
+			return nil
+		}
+	}
+	return err
+}
+
+// ackHandler finishes, requeues or touches a message of an ack=true
+// subscription (ie. POST /fin?subscription=...&id=...)
+func (s *StreamServer) ackHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "INVALID_REQUEST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	subscription, _ := reqParams.Get("subscription")
+	sr := s.Get(subscription)
+	if sr == nil {
+		http.Error(w, "SUBSCRIPTION_NOT_FOUND", http.StatusNotFound)
+		return
+	}
+
+	id, err := reqParams.Get("id")
+	if err != nil {
+		http.Error(w, "MISSING_ARG_ID", http.StatusBadRequest)
+		return
+	}
 
-	// this read allows us to detect clients that disconnect
-	go func(rw *bufio.ReadWriter) {
-		b, err := rw.ReadByte()
+	var delay time.Duration
+	if delayStr, err := reqParams.Get("delay"); err == nil {
+		delayMs, err := strconv.Atoi(delayStr)
+		if err != nil || delayMs < 0 {
+			http.Error(w, "INVALID_DELAY", http.StatusBadRequest)
+			return
+		}
+		delay = time.Duration(delayMs) * time.Millisecond
+	}
+
+	cmd := strings.ToUpper(strings.TrimPrefix(req.URL.Path, "/"))
+	err = sr.Respond(cmd, id, delay)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	io.WriteString(w, "OK")
+}
+
+// commandLoop reads FIN <id>, REQ <id> [<delay_ms>] and TOUCH <id> commands
+// from a WebSocket subscriber until it disconnects
+func (sr *StreamReader) commandLoop(ws *wsConn) {
+	defer sr.Stop()
+	for {
+		_, data, err := ws.ReadMessage()
 		if err != nil {
 			log.Printf("got connection err %s", err.Error())
-		} else {
-			log.Printf("unexpected data on request socket (%c); closing", b)
+			return
 		}
-		sr.consumer.Stop()
-	}(bufrw)
 
-	go sr.HeartbeatLoop()
+		err = errInvalidCommand
+		params := strings.Fields(string(data))
+		if len(params) == 2 || (len(params) == 3 && params[0] == "REQ") {
+			var delay time.Duration
+			if len(params) == 3 {
+				delayMs, convErr := strconv.Atoi(params[2])
+				if convErr == nil && delayMs >= 0 {
+					delay = time.Duration(delayMs) * time.Millisecond
+					err = sr.Respond(params[0], params[1], delay)
+				}
+			} else {
+				err = sr.Respond(params[0], params[1], delay)
+			}
+		}
+		if err != nil {
+			ws.WriteMessage(wsOpText, []byte(fmt.Sprintf("{\"_error_\":%q}", err.Error())))
+		}
+	}
+}
+
+// Respond finishes (FIN), requeues (REQ) or touches (TOUCH) an in-flight message
+func (sr *StreamReader) Respond(cmd string, id string, delay time.Duration) error {
+	if !sr.ack {
+		return errAckDisabled
+	}
+
+	var msgID nsq.MessageID
+	if len(id) != len(msgID) {
+		return errUnknownMessage
+	}
+	copy(msgID[:], id)
+
+	sr.Lock()
+	message, ok := sr.inFlight[msgID]
+	if ok && cmd != "TOUCH" {
+		delete(sr.inFlight, msgID)
+	}
+	sr.Unlock()
+	if !ok {
+		return errUnknownMessage
+	}
+
+	switch cmd {
+	case "FIN":
+		message.Finish()
+		atomic.AddUint64(&sr.finishCount, 1)
+	case "REQ":
+		message.Requeue(delay)
+		atomic.AddUint64(&sr.requeueCount, 1)
+	case "TOUCH":
+		message.Touch()
+	default:
+		return errInvalidCommand
+	}
+	return nil
+}
+
+// Stop requeues any messages the client didn't respond to and stops consuming
+func (sr *StreamReader) Stop() {
+	sr.Lock()
+	// the consumer stops gracefully, so it can still be handed messages
+	sr.stopped = true
+	for id, message := range sr.inFlight {
+		message.RequeueWithoutBackoff(0)
+		delete(sr.inFlight, id)
+	}
+	sr.Unlock()
+	sr.consumer.Stop()
 }
 
 func (sr *StreamReader) HeartbeatLoop() {
 	heartbeatTicker := time.NewTicker(30 * time.Second)
 	defer func() {
-		sr.conn.Close()
+		sr.writer.Close()
 		heartbeatTicker.Stop()
 		streamServer.Del(sr)
 	}()
@@ -200,8 +530,7 @@ func (sr *StreamReader) HeartbeatLoop() {
 			return
 		case ts := <-heartbeatTicker.C:
 			sr.Lock()
-			sr.bufrw.WriteString(fmt.Sprintf("{\"_heartbeat_\":%d}\n", ts.Unix()))
-			sr.bufrw.Flush()
+			sr.writer.WriteHeartbeat(ts)
 			sr.Unlock()
 		}
 	}
@@ -209,10 +538,27 @@ func (sr *StreamReader) HeartbeatLoop() {
 
 func (sr *StreamReader) HandleMessage(message *nsq.Message) error {
 	sr.Lock()
-	sr.bufrw.Write(message.Body)
-	sr.bufrw.WriteString("\n")
-	sr.bufrw.Flush()
+	if sr.stopped {
+		// the client is gone, give the message back right away
+		message.DisableAutoResponse()
+		message.RequeueWithoutBackoff(0)
+		sr.Unlock()
+		return nil
+	}
+	if sr.ack {
+		message.DisableAutoResponse()
+		sr.inFlight[message.ID] = message
+	}
+	err := sr.writer.WriteMessage(message)
+	if err != nil && sr.ack {
+		delete(sr.inFlight, message.ID)
+		message.RequeueWithoutBackoff(0)
+	}
 	sr.Unlock()
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&sr.messageCount, 1)
 	atomic.AddUint64(&streamServer.messageCount, 1)
 	return nil
 }
@@ -248,6 +594,21 @@ func main() {
 	log.Printf("listening on %s", httpAddr.String())
 
 	streamServer = &StreamServer{}
+
+	if len(pubNSQDTCPAddrs) == 0 {
+		pubNSQDTCPAddrs = nsqdTCPAddrs
+	}
+	cfg := nsq.NewConfig()
+	cfg.UserAgent = fmt.Sprintf("nsq_pubsub/%s go-nsq/%s", util.BINARY_VERSION, nsq.VERSION)
+	for _, addr := range pubNSQDTCPAddrs {
+		producer, err := nsq.NewProducer(addr, cfg)
+		if err != nil {
+			log.Fatalf("failed creating producer %s", err)
+		}
+		producer.SetLogger(log.New(os.Stderr, "", log.LstdFlags), nsq.LogLevelInfo)
+		streamServer.producers = append(streamServer.producers, producer)
+	}
+
 	server := &http.Server{Handler: streamServer}
 	err = server.Serve(httpListener)
 
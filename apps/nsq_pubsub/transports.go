@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+// streamWriter writes messages (and heartbeats) to a subscriber framed
+// for its transport
+type streamWriter interface {
+	WriteMessage(message *nsq.Message) error
+	WriteHeartbeat(ts time.Time) error
+	Close() error
+}
+
+// jsonMessage is how messages are framed for WebSocket and SSE subscribers
+type jsonMessage struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Attempts  uint16 `json:"attempts"`
+	Body      string `json:"body"`
+}
+
+// encodeBody returns a message body as sent to subscribers, "text" bodies
+// are sent as is (which is only lossless for UTF-8) and "base64" bodies are
+// base64 encoded so that binary bodies survive
+func encodeBody(body []byte, bodyEncoding string) []byte {
+	if bodyEncoding != "base64" {
+		return body
+	}
+	buf := make([]byte, base64.StdEncoding.EncodedLen(len(body)))
+	base64.StdEncoding.Encode(buf, body)
+	return buf
+}
+
+func marshalMessage(message *nsq.Message, bodyEncoding string) ([]byte, error) {
+	return json.Marshal(&jsonMessage{
+		ID:        string(message.ID[:]),
+		Timestamp: message.Timestamp,
+		Attempts:  message.Attempts,
+		Body:      string(encodeBody(message.Body, bodyEncoding)),
+	})
+}
+
+// httpStreamWriter streams raw newline delimited message bodies over a
+// hijacked HTTP connection
+type httpStreamWriter struct {
+	conn         net.Conn
+	bufrw        *bufio.ReadWriter
+	bodyEncoding string
+}
+
+func (w *httpStreamWriter) WriteMessage(message *nsq.Message) error {
+	w.bufrw.Write(encodeBody(message.Body, w.bodyEncoding))
+	w.bufrw.WriteString("\n")
+	return w.bufrw.Flush()
+}
+
+func (w *httpStreamWriter) WriteHeartbeat(ts time.Time) error {
+	w.bufrw.WriteString(fmt.Sprintf("{\"_heartbeat_\":%d}\n", ts.Unix()))
+	return w.bufrw.Flush()
+}
+
+func (w *httpStreamWriter) Close() error {
+	return w.conn.Close()
+}
+
+// sseStreamWriter streams JSON messages as Server-Sent Events, the
+// request handler must not return until doneChan is closed
+type sseStreamWriter struct {
+	w            http.ResponseWriter
+	flusher      http.Flusher
+	bodyEncoding string
+	doneChan     chan int
+	once         sync.Once
+}
+
+func (w *sseStreamWriter) writeEvent(event string, id string, data []byte) error {
+	if id != "" {
+		fmt.Fprintf(w.w, "id: %s\n", id)
+	}
+	_, err := fmt.Fprintf(w.w, "event: %s\ndata: %s\n\n", event, data)
+	if err != nil {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
+
+func (w *sseStreamWriter) WriteMessage(message *nsq.Message) error {
+	data, err := marshalMessage(message, w.bodyEncoding)
+	if err != nil {
+		return err
+	}
+	return w.writeEvent("message", string(message.ID[:]), data)
+}
+
+func (w *sseStreamWriter) WriteHeartbeat(ts time.Time) error {
+	return w.writeEvent("heartbeat", "", []byte(fmt.Sprintf("{\"_heartbeat_\":%d}", ts.Unix())))
+}
+
+func (w *sseStreamWriter) Close() error {
+	w.once.Do(func() { close(w.doneChan) })
+	return nil
+}
+
+// wsStreamWriter sends JSON messages as WebSocket text messages
+type wsStreamWriter struct {
+	ws           *wsConn
+	bodyEncoding string
+}
+
+func (w *wsStreamWriter) WriteMessage(message *nsq.Message) error {
+	data, err := marshalMessage(message, w.bodyEncoding)
+	if err != nil {
+		return err
+	}
+	return w.ws.WriteMessage(wsOpText, data)
+}
+
+func (w *wsStreamWriter) WriteHeartbeat(ts time.Time) error {
+	return w.ws.WriteMessage(wsOpText, []byte(fmt.Sprintf("{\"_heartbeat_\":%d}", ts.Unix())))
+}
+
+func (w *wsStreamWriter) Close() error {
+	return w.ws.Close()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// this is a minimal server side implementation of RFC 6455 (WebSockets),
+// enough to exchange text and binary messages with browsers
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// the largest (reassembled) message a client may send
+const wsMaxMessageSize = 1024 * 1024
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+var (
+	errWSMessageTooLarge = errors.New("websocket message too large")
+	errWSClosed          = errors.New("websocket closed")
+)
+
+type wsConn struct {
+	sync.Mutex // serializes writes
+	conn       net.Conn
+	bufrw      *bufio.ReadWriter
+	closeSent  bool
+}
+
+func isWebsocketRequest(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, token := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedOrigin checks the Origin of a (browser) WebSocket handshake so
+// that other sites can't use their visitors' access to nsq_pubsub, without
+// allowedOrigins only same origin requests are accepted
+func isAllowedOrigin(req *http.Request, allowedOrigins []string) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		// not a browser
+		return true
+	}
+	if len(allowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, req.Host)
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeWebsocket completes the opening handshake and hijacks the connection
+func upgradeWebsocket(w http.ResponseWriter, req *http.Request, allowedOrigins []string) (*wsConn, error) {
+	if req.Method != "GET" {
+		http.Error(w, "INVALID_REQUEST", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket handshake must be a GET")
+	}
+	if !isAllowedOrigin(req, allowedOrigins) {
+		http.Error(w, "ORIGIN_NOT_ALLOWED", http.StatusForbidden)
+		return nil, fmt.Errorf("origin %s not allowed", req.Header.Get("Origin"))
+	}
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "UNSUPPORTED_VERSION", http.StatusBadRequest)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := req.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "httpserver doesn't support hijacking", http.StatusInternalServerError)
+		return nil, errors.New("hijacking unsupported")
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	err = bufrw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, bufrw: bufrw}, nil
+}
+
+// ReadMessage returns the next (reassembled) text or binary message,
+// answering pings along the way, io.EOF is returned once the client closes
+// the connection
+func (c *wsConn) ReadMessage() (int, []byte, error) {
+	var opcode int
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsOpPing:
+			err = c.WriteMessage(wsOpPong, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.WriteMessage(wsOpClose, payload)
+			return 0, nil, io.EOF
+		case wsOpContinuation:
+			if message == nil {
+				return 0, nil, errors.New("unexpected websocket continuation frame")
+			}
+		case wsOpText, wsOpBinary:
+			if message != nil {
+				return 0, nil, errors.New("expected websocket continuation frame")
+			}
+			opcode = op
+			message = make([]byte, 0, len(payload))
+		default:
+			return 0, nil, fmt.Errorf("unknown websocket opcode %#x", op)
+		}
+
+		if len(message)+len(payload) > wsMaxMessageSize {
+			return 0, nil, errWSMessageTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(c.bufrw, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("websocket extensions are not supported")
+	}
+	// clients must mask every frame
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked websocket frame")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		_, err = io.ReadFull(c.bufrw, b[:])
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		_, err = io.ReadFull(c.bufrw, b[:])
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if length > wsMaxMessageSize {
+		return false, 0, nil, errWSMessageTooLarge
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(c.bufrw, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.bufrw, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends data as a single (unmasked) frame
+func (c *wsConn) WriteMessage(opcode int, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+
+	// nothing may be sent after a close frame
+	if c.closeSent {
+		return errWSClosed
+	}
+	if opcode == wsOpClose {
+		c.closeSent = true
+	}
+
+	header := []byte{0x80 | byte(opcode)}
+	length := len(data)
+	switch {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	_, err := c.bufrw.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = c.bufrw.Write(data)
+	if err != nil {
+		return err
+	}
+	return c.bufrw.Flush()
+}
+
+func (c *wsConn) Close() error {
+	c.WriteMessage(wsOpClose, []byte{0x03, 0xe8}) // 1000 normal closure
+	return c.conn.Close()
+}
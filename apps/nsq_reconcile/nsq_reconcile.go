@@ -0,0 +1,462 @@
+// This is a utility application that reconciles the topics and channels of a
+// cluster (and their settings) with those described in a topology file
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+var (
+	showVersion       = flag.Bool("version", false, "print version")
+	topologyFile      = flag.String("topology", "", "path to the topology file (.json or .toml, YAML is not supported)")
+	apply             = flag.Bool("apply", false, "apply the changes (otherwise they are only printed)")
+	deleteUndeclared  = flag.Bool("delete", false, "delete topics and channels that are not in the topology file")
+	lookupdAuthSecret = flag.String("lookupd-auth-secret", "", "secret sent with admin actions to lookupd when it requires auth")
+	nsqdHTTPAddrs     = util.StringArray{}
+	lookupdHTTPAddrs  = util.StringArray{}
+)
+
+func init() {
+	flag.Var(&nsqdHTTPAddrs, "nsqd-http-address", "nsqd HTTP address (may be given multiple times)")
+	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
+}
+
+// change is a difference between the topology file and the cluster along
+// with the requests that resolve it
+type change struct {
+	op          string
+	description string
+	apply       func() error
+}
+
+func (c *change) String() string {
+	return fmt.Sprintf("%s %s", c.op, c.description)
+}
+
+// adminRequest POSTs an administrative request (ie. /topic/create) to an
+// nsqd or, if isLookupd, to an nsqlookupd
+func adminRequest(addr string, path string, params url.Values, isLookupd bool) error {
+	var opts *util.RequestOptions
+	if isLookupd && *lookupdAuthSecret != "" {
+		opts = &util.RequestOptions{Header: http.Header{}}
+		opts.Header.Set(util.AuthSecretHeader, *lookupdAuthSecret)
+	}
+	endpoint := fmt.Sprintf("http://%s%s?%s", addr, path, params.Encode())
+	_, err := util.APIRequestNegotiateV1WithOptions("POST", endpoint, nil, opts)
+	if err != nil {
+		return fmt.Errorf("%s%s - %s", addr, path, err)
+	}
+	return nil
+}
+
+func lookupdRequests(path string, params url.Values) error {
+	for _, addr := range lookupdHTTPAddrs {
+		err := adminRequest(addr, path, params, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settingsDiff returns the settings (as nsqd /topic/create and
+// /channel/create params) that differ from the live values along with a
+// description of each difference
+func settingsDiff(maxDepth *int64, maxBytes *int64, overflowPolicy *string, filter *string,
+	liveMaxDepth int64, liveMaxBytes int64, liveOverflowPolicy string, liveFilter string) (url.Values, []string) {
+	params := url.Values{}
+	var diffs []string
+	if maxDepth != nil && *maxDepth != liveMaxDepth {
+		params.Set("max_depth", strconv.FormatInt(*maxDepth, 10))
+		diffs = append(diffs, fmt.Sprintf("max_depth %d -> %d", liveMaxDepth, *maxDepth))
+	}
+	if maxBytes != nil && *maxBytes != liveMaxBytes {
+		params.Set("max_bytes", strconv.FormatInt(*maxBytes, 10))
+		diffs = append(diffs, fmt.Sprintf("max_bytes %d -> %d", liveMaxBytes, *maxBytes))
+	}
+	if overflowPolicy != nil && *overflowPolicy != liveOverflowPolicy {
+		params.Set("overflow_policy", *overflowPolicy)
+		diffs = append(diffs, fmt.Sprintf("overflow_policy %q -> %q", liveOverflowPolicy, *overflowPolicy))
+	}
+	if filter != nil && *filter != liveFilter {
+		params.Set("filter", *filter)
+		diffs = append(diffs, fmt.Sprintf("filter %q -> %q", liveFilter, *filter))
+	}
+	return params, diffs
+}
+
+// settingsParams returns every specified setting as nsqd /topic/create and
+// /channel/create params
+func settingsParams(maxDepth *int64, maxBytes *int64, overflowPolicy *string, filter *string) url.Values {
+	params := url.Values{}
+	if maxDepth != nil {
+		params.Set("max_depth", strconv.FormatInt(*maxDepth, 10))
+	}
+	if maxBytes != nil {
+		params.Set("max_bytes", strconv.FormatInt(*maxBytes, 10))
+	}
+	if overflowPolicy != nil {
+		params.Set("overflow_policy", *overflowPolicy)
+	}
+	if filter != nil {
+		params.Set("filter", *filter)
+	}
+	return params
+}
+
+func pauseDiff(paused *bool, livePaused bool) (string, []string) {
+	if paused == nil || *paused == livePaused {
+		return "", nil
+	}
+	verb := "unpause"
+	if *paused {
+		verb = "pause"
+	}
+	return verb, []string{fmt.Sprintf("paused %t -> %t", livePaused, *paused)}
+}
+
+// pendingSettings describes the specified settings of a topic or channel
+// that is only being registered with nsqlookupd, they can't be applied
+// until the topic exists on an nsqd
+func pendingSettings(paused *bool, maxDepth *int64, maxBytes *int64,
+	overflowPolicy *string, filter *string) string {
+	var settings []string
+	if paused != nil {
+		settings = append(settings, fmt.Sprintf("paused %t", *paused))
+	}
+	if maxDepth != nil {
+		settings = append(settings, fmt.Sprintf("max_depth %d", *maxDepth))
+	}
+	if maxBytes != nil {
+		settings = append(settings, fmt.Sprintf("max_bytes %d", *maxBytes))
+	}
+	if overflowPolicy != nil {
+		settings = append(settings, fmt.Sprintf("overflow_policy %q", *overflowPolicy))
+	}
+	if filter != nil {
+		settings = append(settings, fmt.Sprintf("filter %q", *filter))
+	}
+	if len(settings) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (pending until the topic is on an nsqd: %s)", strings.Join(settings, ", "))
+}
+
+func sortedHosts(t *liveTopic) []string {
+	var hosts []string
+	for host := range t.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func isEphemeral(name string) bool {
+	return strings.HasSuffix(name, "#ephemeral")
+}
+
+// plan returns the changes that make the cluster match the topology
+func plan(topology *Topology, live map[string]*liveTopic) []*change {
+	var changes []*change
+
+	for _, ts := range topology.Topics {
+		ts := ts
+		topicParams := url.Values{"topic": []string{ts.Name}}
+
+		t, ok := live[ts.Name]
+		if !ok {
+			t = &liveTopic{
+				name:       ts.Name,
+				channels:   make(map[string]bool),
+				hosts:      make(map[string]*lookupd.TopicStats),
+				hostsChans: make(map[string]map[string]*lookupd.ChannelStats),
+			}
+		}
+
+		if len(lookupdHTTPAddrs) != 0 {
+			if !ok {
+				pending := pendingSettings(ts.Paused, ts.MaxDepth, ts.MaxBytes, ts.OverflowPolicy, nil)
+				changes = append(changes, &change{"+", fmt.Sprintf("topic %s%s", ts.Name, pending), func() error {
+					return lookupdRequests("/topic/create", topicParams)
+				}})
+			}
+		} else {
+			// without nsqlookupd the topic is expected on every nsqd
+			for _, addr := range nsqdHTTPAddrs {
+				if _, ok := t.hosts[addr]; ok {
+					continue
+				}
+				addr := addr
+				params := settingsParams(ts.MaxDepth, ts.MaxBytes, ts.OverflowPolicy, nil)
+				params.Set("topic", ts.Name)
+				changes = append(changes, &change{"+", fmt.Sprintf("topic %s on %s", ts.Name, addr), func() error {
+					err := adminRequest(addr, "/topic/create", params, false)
+					if err != nil || ts.Paused == nil || !*ts.Paused {
+						return err
+					}
+					return adminRequest(addr, "/topic/pause", topicParams, false)
+				}})
+				t.hosts[addr] = &lookupd.TopicStats{}
+				t.hostsChans[addr] = make(map[string]*lookupd.ChannelStats)
+			}
+		}
+
+		hosts := sortedHosts(t)
+		for _, addr := range hosts {
+			hs := t.hosts[addr]
+			if hs.HostAddress == "" {
+				// being created (with its settings) above
+				continue
+			}
+			addr := addr
+			params, diffs := settingsDiff(ts.MaxDepth, ts.MaxBytes, ts.OverflowPolicy, nil,
+				hs.MaxDepth, hs.MaxBytes, hs.OverflowPolicy, "")
+			verb, pauseDiffs := pauseDiff(ts.Paused, hs.Paused)
+			diffs = append(diffs, pauseDiffs...)
+			if len(diffs) == 0 {
+				continue
+			}
+			hasSettings := len(params) > 0
+			params.Set("topic", ts.Name)
+			changes = append(changes, &change{"~",
+				fmt.Sprintf("topic %s on %s: %s", ts.Name, addr, strings.Join(diffs, ", ")),
+				func() error {
+					if hasSettings {
+						err := adminRequest(addr, "/topic/create", params, false)
+						if err != nil {
+							return err
+						}
+					}
+					if verb != "" {
+						return adminRequest(addr, "/topic/"+verb, topicParams, false)
+					}
+					return nil
+				}})
+		}
+
+		declared := make(map[string]bool)
+		for _, cs := range ts.Channels {
+			cs := cs
+			declared[cs.Name] = true
+			channelParams := url.Values{"topic": []string{ts.Name}, "channel": []string{cs.Name}}
+
+			if len(lookupdHTTPAddrs) != 0 && !t.channels[cs.Name] {
+				var pending string
+				if len(hosts) == 0 {
+					// otherwise it's created (with its settings) on each nsqd below
+					pending = pendingSettings(cs.Paused, cs.MaxDepth, cs.MaxBytes, cs.OverflowPolicy, cs.Filter)
+				}
+				changes = append(changes, &change{"+", fmt.Sprintf("channel %s/%s%s", ts.Name, cs.Name, pending),
+					func() error {
+						return lookupdRequests("/channel/create", channelParams)
+					}})
+			}
+
+			for _, addr := range hosts {
+				addr := addr
+				hcs, ok := t.hostsChans[addr][cs.Name]
+				if !ok {
+					params := settingsParams(cs.MaxDepth, cs.MaxBytes, cs.OverflowPolicy, cs.Filter)
+					params.Set("topic", ts.Name)
+					params.Set("channel", cs.Name)
+					changes = append(changes, &change{"+",
+						fmt.Sprintf("channel %s/%s on %s", ts.Name, cs.Name, addr),
+						func() error {
+							err := adminRequest(addr, "/channel/create", params, false)
+							if err != nil || cs.Paused == nil || !*cs.Paused {
+								return err
+							}
+							return adminRequest(addr, "/channel/pause", channelParams, false)
+						}})
+					continue
+				}
+
+				params, diffs := settingsDiff(cs.MaxDepth, cs.MaxBytes, cs.OverflowPolicy, cs.Filter,
+					hcs.MaxDepth, hcs.MaxBytes, hcs.OverflowPolicy, hcs.Filter)
+				verb, pauseDiffs := pauseDiff(cs.Paused, hcs.Paused)
+				diffs = append(diffs, pauseDiffs...)
+				if len(diffs) == 0 {
+					continue
+				}
+				hasSettings := len(params) > 0
+				params.Set("topic", ts.Name)
+				params.Set("channel", cs.Name)
+				changes = append(changes, &change{"~",
+					fmt.Sprintf("channel %s/%s on %s: %s", ts.Name, cs.Name, addr, strings.Join(diffs, ", ")),
+					func() error {
+						if hasSettings {
+							err := adminRequest(addr, "/channel/create", params, false)
+							if err != nil {
+								return err
+							}
+						}
+						if verb != "" {
+							return adminRequest(addr, "/channel/"+verb, channelParams, false)
+						}
+						return nil
+					}})
+			}
+		}
+
+		if *deleteUndeclared {
+			channelNames := t.channelNames()
+			sort.Strings(channelNames)
+			for _, channelName := range channelNames {
+				if declared[channelName] || isEphemeral(channelName) {
+					continue
+				}
+				channelParams := url.Values{"topic": []string{ts.Name}, "channel": []string{channelName}}
+				var channelHosts []string
+				for _, addr := range hosts {
+					if _, ok := t.hostsChans[addr][channelName]; ok {
+						channelHosts = append(channelHosts, addr)
+					}
+				}
+				changes = append(changes, &change{"-", fmt.Sprintf("channel %s/%s", ts.Name, channelName), func() error {
+					if len(lookupdHTTPAddrs) != 0 {
+						err := lookupdRequests("/channel/delete", channelParams)
+						if err != nil {
+							return err
+						}
+					}
+					for _, addr := range channelHosts {
+						err := adminRequest(addr, "/channel/delete", channelParams, false)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				}})
+			}
+		}
+	}
+
+	if *deleteUndeclared {
+		declared := make(map[string]bool)
+		for _, ts := range topology.Topics {
+			declared[ts.Name] = true
+		}
+		var topicNames []string
+		for topicName := range live {
+			topicNames = append(topicNames, topicName)
+		}
+		sort.Strings(topicNames)
+		for _, topicName := range topicNames {
+			if declared[topicName] || isEphemeral(topicName) {
+				continue
+			}
+			topicParams := url.Values{"topic": []string{topicName}}
+			hosts := sortedHosts(live[topicName])
+			changes = append(changes, &change{"-", fmt.Sprintf("topic %s", topicName), func() error {
+				if len(lookupdHTTPAddrs) != 0 {
+					err := lookupdRequests("/topic/delete", topicParams)
+					if err != nil {
+						return err
+					}
+				}
+				for _, addr := range hosts {
+					err := adminRequest(addr, "/topic/delete", topicParams, false)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}})
+		}
+	}
+
+	return changes
+}
+
+func checkAddrs(addrs []string) error {
+	for _, a := range addrs {
+		if strings.HasPrefix(a, "http") {
+			return errors.New("address should not contain scheme")
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsq_reconcile v%s\n", util.BINARY_VERSION)
+		return
+	}
+
+	if *topologyFile == "" {
+		log.Fatal("--topology is required")
+	}
+
+	if len(nsqdHTTPAddrs) == 0 && len(lookupdHTTPAddrs) == 0 {
+		log.Fatal("--nsqd-http-address or --lookupd-http-address required")
+	}
+	if len(nsqdHTTPAddrs) > 0 && len(lookupdHTTPAddrs) > 0 {
+		log.Fatal("use --nsqd-http-address or --lookupd-http-address not both")
+	}
+
+	if err := checkAddrs(nsqdHTTPAddrs); err != nil {
+		log.Fatalf("--nsqd-http-address error - %s", err)
+	}
+
+	if err := checkAddrs(lookupdHTTPAddrs); err != nil {
+		log.Fatalf("--lookupd-http-address error - %s", err)
+	}
+
+	topology, err := loadTopology(*topologyFile)
+	if err != nil {
+		log.Fatalf("ERROR: failed to load topology %s - %s", *topologyFile, err)
+	}
+
+	log.SetOutput(ioutil.Discard)
+	live, err := getLiveTopology(lookupdHTTPAddrs, nsqdHTTPAddrs)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	changes := plan(topology, live)
+	if len(changes) == 0 {
+		fmt.Println("no changes")
+		return
+	}
+
+	failed := 0
+	for _, c := range changes {
+		fmt.Println(c)
+		if !*apply {
+			continue
+		}
+		log.SetOutput(ioutil.Discard)
+		err := c.apply()
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			log.Printf("ERROR: failed to apply %q - %s", c, err)
+			failed++
+		}
+	}
+
+	if !*apply {
+		fmt.Printf("%d change(s), run with --apply to apply them\n", len(changes))
+		return
+	}
+	if failed > 0 {
+		log.Fatalf("ERROR: %d of %d change(s) failed", failed, len(changes))
+	}
+	fmt.Printf("applied %d change(s)\n", len(changes))
+}
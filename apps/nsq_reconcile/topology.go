@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+// Topology is the desired state of the cluster, settings that are not
+// specified (nil) are left as they are
+type Topology struct {
+	Topics []*TopicSpec `json:"topics" toml:"topics"`
+}
+
+type TopicSpec struct {
+	Name           string  `json:"name" toml:"name"`
+	Paused         *bool   `json:"paused" toml:"paused"`
+	MaxDepth       *int64  `json:"max_depth" toml:"max_depth"`
+	MaxBytes       *int64  `json:"max_bytes" toml:"max_bytes"`
+	OverflowPolicy *string `json:"overflow_policy" toml:"overflow_policy"`
+
+	Channels []*ChannelSpec `json:"channels" toml:"channels"`
+}
+
+type ChannelSpec struct {
+	Name           string  `json:"name" toml:"name"`
+	Paused         *bool   `json:"paused" toml:"paused"`
+	MaxDepth       *int64  `json:"max_depth" toml:"max_depth"`
+	MaxBytes       *int64  `json:"max_bytes" toml:"max_bytes"`
+	OverflowPolicy *string `json:"overflow_policy" toml:"overflow_policy"`
+	Filter         *string `json:"filter" toml:"filter"`
+}
+
+// loadTopology reads the desired topology from a .json or .toml file
+func loadTopology(path string) (*Topology, error) {
+	t := &Topology{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, t)
+		if err != nil {
+			return nil, err
+		}
+	case ".toml":
+		_, err := toml.DecodeFile(path, t)
+		if err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		// there's no YAML package among our dependencies
+		return nil, errors.New("YAML is not supported, convert the topology to .json or .toml")
+	default:
+		return nil, fmt.Errorf("unsupported format %q (must be .json or .toml)", filepath.Ext(path))
+	}
+
+	topics := make(map[string]bool)
+	for _, topic := range t.Topics {
+		if !util.IsValidTopicName(topic.Name) {
+			return nil, fmt.Errorf("invalid topic name %q", topic.Name)
+		}
+		if topics[topic.Name] {
+			return nil, fmt.Errorf("topic %q is specified more than once", topic.Name)
+		}
+		topics[topic.Name] = true
+
+		channels := make(map[string]bool)
+		for _, channel := range topic.Channels {
+			if !util.IsValidChannelName(channel.Name) {
+				return nil, fmt.Errorf("invalid channel name %q for topic %q", channel.Name, topic.Name)
+			}
+			if channels[channel.Name] {
+				return nil, fmt.Errorf("channel %q is specified more than once for topic %q",
+					channel.Name, topic.Name)
+			}
+			channels[channel.Name] = true
+		}
+	}
+
+	return t, nil
+}
+
+// liveTopic is the current state of a topic, as registered with nsqlookupd
+// and as reported by each nsqd that has it
+type liveTopic struct {
+	name       string
+	channels   map[string]bool
+	hosts      map[string]*lookupd.TopicStats
+	hostsChans map[string]map[string]*lookupd.ChannelStats
+}
+
+// channelNames returns every channel of the topic, whether it is only
+// registered with nsqlookupd or only exists on some nsqd
+func (t *liveTopic) channelNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for name := range t.channels {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for _, channels := range t.hostsChans {
+		for name := range channels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// getLiveTopology returns the current state of every topic in the cluster
+func getLiveTopology(lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) (map[string]*liveTopic, error) {
+	var topicNames []string
+	var err error
+	if len(lookupdHTTPAddrs) != 0 {
+		topicNames, err = lookupd.GetLookupdTopics(lookupdHTTPAddrs)
+	} else {
+		topicNames, err = lookupd.GetNSQDTopics(nsqdHTTPAddrs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get topics - %s", err)
+	}
+
+	topics := make(map[string]*liveTopic)
+	for _, topicName := range topicNames {
+		t := &liveTopic{
+			name:       topicName,
+			channels:   make(map[string]bool),
+			hosts:      make(map[string]*lookupd.TopicStats),
+			hostsChans: make(map[string]map[string]*lookupd.ChannelStats),
+		}
+
+		var producers []string
+		if len(lookupdHTTPAddrs) != 0 {
+			channels, err := lookupd.GetLookupdTopicChannels(topicName, lookupdHTTPAddrs)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get channels of topic(%s) - %s", topicName, err)
+			}
+			for _, channelName := range channels {
+				t.channels[channelName] = true
+			}
+			producers, err = lookupd.GetLookupdTopicProducers(topicName, lookupdHTTPAddrs)
+		} else {
+			producers, err = lookupd.GetNSQDTopicProducers(topicName, nsqdHTTPAddrs)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get producers of topic(%s) - %s", topicName, err)
+		}
+
+		if len(producers) != 0 {
+			topicStats, channelStats, err := lookupd.GetNSQDStats(producers, topicName)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get stats of topic(%s) - %s", topicName, err)
+			}
+			for _, ts := range topicStats {
+				t.hosts[ts.HostAddress] = ts
+				t.hostsChans[ts.HostAddress] = make(map[string]*lookupd.ChannelStats)
+			}
+			for _, cs := range channelStats {
+				for _, hcs := range cs.HostStats {
+					t.hostsChans[hcs.HostAddress][hcs.ChannelName] = hcs
+				}
+			}
+		}
+
+		topics[topicName] = t
+	}
+
+	return topics, nil
+}
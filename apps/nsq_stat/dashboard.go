@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+// the dashboard displays every channel matching the filters, refreshing
+// every interval, instead of scrolling the stats of a single channel
+
+type e2ePercentile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"` // nanoseconds
+}
+
+type channelRow struct {
+	Topic        string          `json:"topic"`
+	Channel      string          `json:"channel"`
+	Host         string          `json:"host"`
+	Paused       bool            `json:"paused"`
+	Ingress      float64         `json:"ingress"`
+	Egress       float64         `json:"egress"`
+	Depth        int64           `json:"depth"`
+	MemoryDepth  int64           `json:"memory_depth"`
+	BackendDepth int64           `json:"backend_depth"`
+	InFlight     int64           `json:"in_flight_count"`
+	Deferred     int64           `json:"deferred_count"`
+	Requeue      int64           `json:"requeue_count"`
+	Timeout      int64           `json:"timeout_count"`
+	Messages     int64           `json:"message_count"`
+	Clients      int             `json:"client_count"`
+	E2e          []e2ePercentile `json:"e2e_processing_latency"`
+	Nodes        []*channelRow   `json:"nodes,omitempty"`
+}
+
+func (r *channelRow) key() string {
+	return fmt.Sprintf("%s:%s:%s", r.Topic, r.Channel, r.Host)
+}
+
+type dashboard struct {
+	topic        string
+	topicPattern *regexp.Regexp
+	channel      string
+	format       string
+	sortBy       string
+	perNode      bool
+
+	nsqdHTTPAddrs    []string
+	lookupdHTTPAddrs []string
+
+	printedHeader bool
+}
+
+// rowLess orders rows by the --sort column, numeric columns descending,
+// falling back to the topic/channel name
+func rowLess(sortBy string) func(a, b *channelRow) bool {
+	byName := func(a, b *channelRow) bool {
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Channel < b.Channel
+	}
+	var value func(r *channelRow) float64
+	switch sortBy {
+	case "depth":
+		value = func(r *channelRow) float64 { return float64(r.Depth) }
+	case "in-flight":
+		value = func(r *channelRow) float64 { return float64(r.InFlight) }
+	case "deferred":
+		value = func(r *channelRow) float64 { return float64(r.Deferred) }
+	case "requeue":
+		value = func(r *channelRow) float64 { return float64(r.Requeue) }
+	case "timeout":
+		value = func(r *channelRow) float64 { return float64(r.Timeout) }
+	case "ingress":
+		value = func(r *channelRow) float64 { return r.Ingress }
+	case "egress":
+		value = func(r *channelRow) float64 { return r.Egress }
+	case "messages":
+		value = func(r *channelRow) float64 { return float64(r.Messages) }
+	case "clients":
+		value = func(r *channelRow) float64 { return float64(r.Clients) }
+	default:
+		return byName
+	}
+	return func(a, b *channelRow) bool {
+		va, vb := value(a), value(b)
+		if va != vb {
+			return va > vb
+		}
+		return byName(a, b)
+	}
+}
+
+type rowSorter struct {
+	rows []*channelRow
+	less func(a, b *channelRow) bool
+}
+
+func (s rowSorter) Len() int           { return len(s.rows) }
+func (s rowSorter) Swap(i, j int)      { s.rows[i], s.rows[j] = s.rows[j], s.rows[i] }
+func (s rowSorter) Less(i, j int) bool { return s.less(s.rows[i], s.rows[j]) }
+
+var validSorts = []string{"name", "depth", "in-flight", "deferred", "requeue",
+	"timeout", "ingress", "egress", "messages", "clients"}
+
+func isValidSort(s string) bool {
+	for _, v := range validSorts {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dashboard) nodes() ([]string, error) {
+	if len(d.lookupdHTTPAddrs) == 0 {
+		return d.nsqdHTTPAddrs, nil
+	}
+	if d.topic != "" {
+		return lookupd.GetLookupdTopicProducers(d.topic, d.lookupdHTTPAddrs)
+	}
+	producers, err := lookupd.GetLookupdProducers(d.lookupdHTTPAddrs)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, p := range producers {
+		addrs = append(addrs, p.HTTPAddress())
+	}
+	return addrs, nil
+}
+
+func (d *dashboard) matches(c *lookupd.ChannelStats) bool {
+	if d.topic != "" && c.TopicName != d.topic {
+		return false
+	}
+	if d.topicPattern != nil && !d.topicPattern.MatchString(c.TopicName) {
+		return false
+	}
+	if d.channel != "" && c.ChannelName != d.channel {
+		return false
+	}
+	return true
+}
+
+// fetch returns a row for each matching channel, with a row for each node
+// that has the channel in Nodes
+func (d *dashboard) fetch() ([]*channelRow, error) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	addrs, err := d.nodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nsqd producers - %s", err)
+	}
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	_, allChannelStats, err := lookupd.GetNSQDStats(addrs, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nsqd stats - %s", err)
+	}
+
+	var rows []*channelRow
+	for _, c := range allChannelStats {
+		if !d.matches(c) {
+			continue
+		}
+		row := newChannelRow(c, "*")
+		for _, h := range c.HostStats {
+			row.Nodes = append(row.Nodes, newChannelRow(h, h.HostAddress))
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func newChannelRow(c *lookupd.ChannelStats, host string) *channelRow {
+	r := &channelRow{
+		Topic:        c.TopicName,
+		Channel:      c.ChannelName,
+		Host:         host,
+		Paused:       c.Paused,
+		Depth:        c.Depth,
+		MemoryDepth:  c.MemoryDepth,
+		BackendDepth: c.BackendDepth,
+		InFlight:     c.InFlightCount,
+		Deferred:     c.DeferredCount,
+		Requeue:      c.RequeueCount,
+		Timeout:      c.TimeoutCount,
+		Messages:     c.MessageCount,
+		Clients:      c.ClientCount,
+		E2e:          []e2ePercentile{},
+	}
+	if c.E2eProcessingLatency != nil {
+		for _, p := range c.E2eProcessingLatency.Percentiles {
+			r.E2e = append(r.E2e, e2ePercentile{p["quantile"], p["average"]})
+		}
+		sort.Sort(e2ePercentiles(r.E2e))
+	}
+	return r
+}
+
+type e2ePercentiles []e2ePercentile
+
+func (p e2ePercentiles) Len() int           { return len(p) }
+func (p e2ePercentiles) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p e2ePercentiles) Less(i, j int) bool { return p[i].Quantile < p[j].Quantile }
+
+func quantileName(q float64) string {
+	return "p" + strconv.FormatFloat(q*100, 'f', -1, 64)
+}
+
+// computeRates sets ingress and egress (msgs/sec) from the previous sample
+func computeRates(r *channelRow, prev map[string]*channelRow, elapsed time.Duration) {
+	o, ok := prev[r.key()]
+	if !ok || elapsed <= 0 {
+		return
+	}
+	secs := elapsed.Seconds()
+	r.Ingress = float64(r.Messages-o.Messages) / secs
+	r.Egress = float64(r.Messages-o.Messages-(r.Depth-o.Depth)) / secs
+}
+
+func dashboardLoop(d *dashboard, interval time.Duration, count int) {
+	prev := make(map[string]*channelRow)
+	var prevTime time.Time
+	less := rowLess(d.sortBy)
+	for i := 0; count == 0 || i <= count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+
+		rows, err := d.fetch()
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			continue
+		}
+		now := time.Now()
+
+		cur := make(map[string]*channelRow)
+		for _, r := range rows {
+			computeRates(r, prev, now.Sub(prevTime))
+			cur[r.key()] = r
+			for _, n := range r.Nodes {
+				computeRates(n, prev, now.Sub(prevTime))
+				cur[n.key()] = n
+			}
+			sort.Sort(rowSorter{r.Nodes, func(a, b *channelRow) bool { return a.Host < b.Host }})
+			if !d.perNode {
+				r.Nodes = nil
+			}
+		}
+		sort.Sort(rowSorter{rows, less})
+
+		// rates need two samples
+		if i > 0 {
+			switch d.format {
+			case "csv":
+				d.printCSV(now, rows)
+			case "json":
+				d.printJSON(now, rows)
+			default:
+				d.printTable(now, rows)
+			}
+		}
+
+		prev = cur
+		prevTime = now
+	}
+}
+
+func (d *dashboard) printTable(now time.Time, rows []*channelRow) {
+	// clear the screen
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("nsq_stat - %s - every %s - sorted by %s\n\n",
+		now.Format("2006-01-02 15:04:05"), *statusEvery, d.sortBy)
+	if len(rows) == 0 {
+		fmt.Println("no matching channels")
+		return
+	}
+
+	var quantiles []float64
+	for _, r := range rows {
+		if len(r.E2e) > len(quantiles) {
+			quantiles = quantiles[:0]
+			for _, p := range r.E2e {
+				quantiles = append(quantiles, p.Quantile)
+			}
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	header := []string{"topic", "channel", "host", "paused", "ingress", "egress",
+		"total", "mem", "disk", "inflt", "def", "req", "t-o", "msgs", "clients"}
+	for _, q := range quantiles {
+		header = append(header, quantileName(q))
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t")+"\t")
+
+	printRow := func(r *channelRow) {
+		paused := ""
+		if r.Paused {
+			paused = "yes"
+		}
+		fields := []string{r.Topic, r.Channel, r.Host, paused,
+			fmt.Sprintf("%.0f", r.Ingress), fmt.Sprintf("%.0f", r.Egress),
+			strconv.FormatInt(r.Depth, 10),
+			strconv.FormatInt(r.MemoryDepth, 10),
+			strconv.FormatInt(r.BackendDepth, 10),
+			strconv.FormatInt(r.InFlight, 10),
+			strconv.FormatInt(r.Deferred, 10),
+			strconv.FormatInt(r.Requeue, 10),
+			strconv.FormatInt(r.Timeout, 10),
+			strconv.FormatInt(r.Messages, 10),
+			strconv.Itoa(r.Clients)}
+		for _, q := range quantiles {
+			v := "-"
+			for _, p := range r.E2e {
+				if p.Quantile == q {
+					v = util.NanoSecondToHuman(p.Value)
+				}
+			}
+			fields = append(fields, v)
+		}
+		fmt.Fprintln(w, strings.Join(fields, "\t")+"\t")
+	}
+	for _, r := range rows {
+		printRow(r)
+		for _, n := range r.Nodes {
+			printRow(n)
+		}
+	}
+	w.Flush()
+}
+
+func (d *dashboard) printCSV(now time.Time, rows []*channelRow) {
+	w := csv.NewWriter(os.Stdout)
+	if !d.printedHeader {
+		w.Write([]string{"timestamp", "topic", "channel", "host", "paused",
+			"ingress", "egress", "depth", "memory_depth", "backend_depth",
+			"in_flight_count", "deferred_count", "requeue_count", "timeout_count",
+			"message_count", "client_count", "e2e_processing_latency"})
+		d.printedHeader = true
+	}
+
+	ts := strconv.FormatInt(now.Unix(), 10)
+	writeRow := func(r *channelRow) {
+		var e2e []string
+		for _, p := range r.E2e {
+			e2e = append(e2e, fmt.Sprintf("%s=%.0f", quantileName(p.Quantile), p.Value))
+		}
+		w.Write([]string{ts, r.Topic, r.Channel, r.Host,
+			strconv.FormatBool(r.Paused),
+			strconv.FormatFloat(r.Ingress, 'f', 2, 64),
+			strconv.FormatFloat(r.Egress, 'f', 2, 64),
+			strconv.FormatInt(r.Depth, 10),
+			strconv.FormatInt(r.MemoryDepth, 10),
+			strconv.FormatInt(r.BackendDepth, 10),
+			strconv.FormatInt(r.InFlight, 10),
+			strconv.FormatInt(r.Deferred, 10),
+			strconv.FormatInt(r.Requeue, 10),
+			strconv.FormatInt(r.Timeout, 10),
+			strconv.FormatInt(r.Messages, 10),
+			strconv.Itoa(r.Clients),
+			strings.Join(e2e, ";")})
+	}
+	for _, r := range rows {
+		writeRow(r)
+		for _, n := range r.Nodes {
+			writeRow(n)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Fatalf("ERROR: failed to write CSV - %s", err)
+	}
+}
+
+func (d *dashboard) printJSON(now time.Time, rows []*channelRow) {
+	if rows == nil {
+		rows = []*channelRow{}
+	}
+	data, err := json.Marshal(struct {
+		Timestamp int64         `json:"timestamp"`
+		Channels  []*channelRow `json:"channels"`
+	}{now.Unix(), rows})
+	if err != nil {
+		log.Fatalf("ERROR: failed to marshal JSON - %s", err)
+	}
+	fmt.Println(string(data))
+}
@@ -1,5 +1,7 @@
 // This is a utility application that polls /stats for all the producers
-// of the specified topic/channel and displays aggregate stats
+// of the specified topic/channel and displays aggregate stats, or of all
+// the channels matching the given filters as a refreshing table (or as
+// CSV/JSON)
 
 package main
 
@@ -11,6 +13,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"regexp"
 	"strings"
 	"syscall"
 	"time"
@@ -22,8 +25,13 @@ import (
 var (
 	showVersion      = flag.Bool("version", false, "print version")
 	topic            = flag.String("topic", "", "NSQ topic")
+	topicPattern     = flag.String("topic-pattern", "", "display the channels of the topics matching this regular expression")
 	channel          = flag.String("channel", "", "NSQ channel")
 	statusEvery      = flag.Duration("status-every", 2*time.Second, "duration of time between polling/printing output")
+	count            = flag.Int("count", 0, "number of updates to print before exiting (0 for no limit)")
+	format           = flag.String("format", "table", "output format (table, csv, json)")
+	sortBy           = flag.String("sort", "name", "column to sort channels by (name, depth, in-flight, deferred, requeue, timeout, ingress, egress, messages, clients)")
+	perNode          = flag.Bool("per-node", false, "display the stats of each nsqd as well as the aggregate")
 	nsqdHTTPAddrs    = util.StringArray{}
 	lookupdHTTPAddrs = util.StringArray{}
 )
@@ -33,10 +41,10 @@ func init() {
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 }
 
-func statLoop(interval time.Duration, topic string, channel string,
+func statLoop(interval time.Duration, count int, topic string, channel string,
 	nsqdTCPAddrs []string, lookupdHTTPAddrs []string) {
 	var o *lookupd.ChannelStats
-	for i := 0; ; i++ {
+	for i, n := 0, 0; count == 0 || n < count; i++ {
 		var producers []string
 		var err error
 
@@ -50,6 +58,14 @@ func statLoop(interval time.Duration, topic string, channel string,
 		if err != nil {
 			log.Fatalf("ERROR: failed to get topic producers - %s", err)
 		}
+		if len(producers) == 0 {
+			// the topic may not have been created yet
+			fmt.Printf("topic(%s) not found\n", topic)
+			o = nil
+			i = -1
+			time.Sleep(interval)
+			continue
+		}
 
 		log.SetOutput(ioutil.Discard)
 		_, allChannelStats, err := lookupd.GetNSQDStats(producers, topic)
@@ -60,18 +76,23 @@ func statLoop(interval time.Duration, topic string, channel string,
 
 		c, ok := allChannelStats[channel]
 		if !ok {
-			log.Fatalf("ERROR: failed to find channel(%s) in stats metadata for topic(%s)", channel, topic)
+			// the channel may not have been created yet
+			fmt.Printf("channel(%s) not found for topic(%s)\n", channel, topic)
+			o = nil
+			i = -1
+			time.Sleep(interval)
+			continue
 		}
 
 		if i%25 == 0 {
 			fmt.Printf("%s+%s+%s\n",
 				"------rate------",
 				"----------------depth----------------",
-				"--------------metadata---------------")
-			fmt.Printf("%7s %7s | %7s %7s %7s %5s %5s | %7s %7s %12s %7s\n",
+				"-----------------metadata-----------------")
+			fmt.Printf("%7s %7s | %7s %7s %7s %5s %5s | %7s %7s %12s %7s %4s\n",
 				"ingress", "egress",
 				"total", "mem", "disk", "inflt",
-				"def", "req", "t-o", "msgs", "clients")
+				"def", "req", "t-o", "msgs", "clients", "P")
 		}
 
 		if o == nil {
@@ -80,8 +101,11 @@ func statLoop(interval time.Duration, topic string, channel string,
 			continue
 		}
 
-		// TODO: paused
-		fmt.Printf("%7d %7d | %7d %7d %7d %5d %5d | %7d %7d %12d %7d\n",
+		paused := ""
+		if c.Paused {
+			paused = "P"
+		}
+		fmt.Printf("%7d %7d | %7d %7d %7d %5d %5d | %7d %7d %12d %7d %4s\n",
 			(c.MessageCount-o.MessageCount)/int64(interval.Seconds()),
 			(c.MessageCount-o.MessageCount-(c.Depth-o.Depth))/int64(interval.Seconds()),
 			c.Depth,
@@ -92,7 +116,9 @@ func statLoop(interval time.Duration, topic string, channel string,
 			c.RequeueCount,
 			c.TimeoutCount,
 			c.MessageCount,
-			c.ClientCount)
+			c.ClientCount,
+			paused)
+		n++
 
 		o = c
 		time.Sleep(interval)
@@ -116,8 +142,26 @@ func main() {
 		return
 	}
 
-	if *topic == "" || *channel == "" {
-		log.Fatal("--topic and --channel are required")
+	if *topic != "" && *topicPattern != "" {
+		log.Fatal("use --topic or --topic-pattern not both")
+	}
+	var pattern *regexp.Regexp
+	if *topicPattern != "" {
+		var err error
+		pattern, err = regexp.Compile(*topicPattern)
+		if err != nil {
+			log.Fatalf("--topic-pattern error - %s", err)
+		}
+	}
+
+	if *format != "table" && *format != "csv" && *format != "json" {
+		log.Fatalf("--format must be one of table, csv or json")
+	}
+	if !isValidSort(*sortBy) {
+		log.Fatalf("--sort must be one of %s", strings.Join(validSorts, ", "))
+	}
+	if *count < 0 {
+		log.Fatal("--count must be >= 0")
 	}
 
 	if len(nsqdHTTPAddrs) == 0 && len(lookupdHTTPAddrs) == 0 {
@@ -138,7 +182,29 @@ func main() {
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
-	go statLoop(*statusEvery, *topic, *channel, nsqdHTTPAddrs, lookupdHTTPAddrs)
+	doneChan := make(chan int)
+	go func() {
+		// a single channel keeps the original scrolling output
+		if *topic != "" && *channel != "" && *format == "table" && !*perNode {
+			statLoop(*statusEvery, *count, *topic, *channel, nsqdHTTPAddrs, lookupdHTTPAddrs)
+		} else {
+			d := &dashboard{
+				topic:            *topic,
+				topicPattern:     pattern,
+				channel:          *channel,
+				format:           *format,
+				sortBy:           *sortBy,
+				perNode:          *perNode,
+				nsqdHTTPAddrs:    nsqdHTTPAddrs,
+				lookupdHTTPAddrs: lookupdHTTPAddrs,
+			}
+			dashboardLoop(d, *statusEvery, *count)
+		}
+		close(doneChan)
+	}()
 
-	<-termChan
+	select {
+	case <-termChan:
+	case <-doneChan:
+	}
 }
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"os/signal"
+	"regexp"
+	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/bitly/go-nsq"
@@ -17,17 +22,25 @@ import (
 var (
 	showVersion = flag.Bool("version", false, "print version string")
 
-	topic         = flag.String("topic", "", "NSQ topic")
-	channel       = flag.String("channel", "", "NSQ channel")
+	channel       = flag.String("channel", "", "NSQ channel (defaults to an ephemeral channel)")
 	maxInFlight   = flag.Int("max-in-flight", 200, "max number of messages to allow in flight")
 	totalMessages = flag.Int("n", 0, "total messages to show (will wait if starved)")
 
+	grep         = flag.String("grep", "", "only show messages whose body matches this regular expression")
+	pretty       = flag.Bool("pretty", false, "pretty print JSON message bodies")
+	templateText = flag.String("template", "", "output template for each message, eg. '{{.ID}} {{.Timestamp}} {{.Attempts}} {{.NSQDAddress}} {{.Topic}} {{.Body}}' (defaults to the body, prefixed with the topic when tailing multiple topics, .NSQDAddress is only set with --nsqd-tcp-address)")
+
+	topics           = util.StringArray{}
+	filters          = util.StringArray{}
 	consumerOpts     = util.StringArray{}
 	nsqdTCPAddrs     = util.StringArray{}
 	lookupdHTTPAddrs = util.StringArray{}
 )
 
 func init() {
+	flag.Var(&topics, "topic", "NSQ topic (may be given multiple times)")
+	flag.Var(&filters, "filter", "only show JSON messages in which <field>=<value> or <field>~<regexp> (may be given multiple times)")
+
 	// TODO: remove, deprecated
 	flag.Var(&consumerOpts, "reader-opt", "(deprecated) use --consumer-opt")
 	flag.Var(&consumerOpts, "consumer-opt", "option to passthrough to nsq.Consumer (may be given multiple times, http://godoc.org/github.com/bitly/go-nsq#Config)")
@@ -36,18 +49,84 @@ func init() {
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 }
 
+// tailMessage is what is passed to the output template
+type tailMessage struct {
+	Topic       string
+	ID          string
+	Timestamp   time.Time
+	Attempts    uint16
+	NSQDAddress string
+	Body        string
+}
+
+// TailHandler prints the messages of all the topics being tailed
 type TailHandler struct {
+	sync.Mutex
 	totalMessages int
 	messagesShown int
+
+	grep    *regexp.Regexp
+	filters []*util.JSONFilter
+	pretty  bool
+	tmpl    *template.Template
 }
 
-func (th *TailHandler) HandleMessage(m *nsq.Message) error {
-	th.messagesShown++
-	_, err := os.Stdout.Write(m.Body)
+func (th *TailHandler) match(body []byte) bool {
+	if th.grep != nil && !th.grep.Match(body) {
+		return false
+	}
+	for _, f := range th.filters {
+		if !f.Match(body) {
+			return false
+		}
+	}
+	return true
+}
+
+// topicHandler adds the topic name (and nsqd address, when it's known) to
+// the messages of one consumer
+type topicHandler struct {
+	*TailHandler
+	topic       string
+	nsqdAddress string
+}
+
+func (h *topicHandler) HandleMessage(m *nsq.Message) error {
+	th := h.TailHandler
+	if !th.match(m.Body) {
+		return nil
+	}
+
+	body := m.Body
+	if th.pretty {
+		var buf bytes.Buffer
+		// bodies that aren't JSON are shown as they are
+		if json.Indent(&buf, m.Body, "", "  ") == nil {
+			body = buf.Bytes()
+		}
+	}
+
+	var buf bytes.Buffer
+	err := th.tmpl.Execute(&buf, &tailMessage{
+		Topic:       h.topic,
+		ID:          string(m.ID[:]),
+		Timestamp:   time.Unix(0, m.Timestamp),
+		Attempts:    m.Attempts,
+		NSQDAddress: h.nsqdAddress,
+		Body:        string(body),
+	})
 	if err != nil {
-		log.Fatalf("ERROR: failed to write to os.Stdout - %s", err)
+		log.Fatalf("ERROR: failed to execute template - %s", err)
+	}
+	buf.WriteString("\n")
+
+	th.Lock()
+	defer th.Unlock()
+	if th.totalMessages > 0 && th.messagesShown >= th.totalMessages {
+		return nil
 	}
-	_, err = os.Stdout.WriteString("\n")
+	th.messagesShown++
+	_, err = os.Stdout.Write(buf.Bytes())
 	if err != nil {
 		log.Fatalf("ERROR: failed to write to os.Stdout - %s", err)
 	}
@@ -70,9 +149,14 @@ func main() {
 		*channel = fmt.Sprintf("tail%06d#ephemeral", rand.Int()%999999)
 	}
 
-	if *topic == "" {
+	if len(topics) == 0 {
 		log.Fatal("--topic is required")
 	}
+	for _, t := range topics {
+		if !util.IsValidTopicName(t) {
+			log.Fatalf("--topic %q is not a valid topic name", t)
+		}
+	}
 
 	if len(nsqdTCPAddrs) == 0 && len(lookupdHTTPAddrs) == 0 {
 		log.Fatal("--nsqd-tcp-address or --lookupd-http-address required")
@@ -81,6 +165,36 @@ func main() {
 		log.Fatal("use --nsqd-tcp-address or --lookupd-http-address not both")
 	}
 
+	handler := &TailHandler{
+		totalMessages: *totalMessages,
+		pretty:        *pretty,
+	}
+	if *grep != "" {
+		re, err := regexp.Compile(*grep)
+		if err != nil {
+			log.Fatalf("--grep error - %s", err)
+		}
+		handler.grep = re
+	}
+	for _, expr := range filters {
+		f, err := util.NewJSONFilter(expr)
+		if err != nil {
+			log.Fatalf("--filter %q error - %s", expr, err)
+		}
+		handler.filters = append(handler.filters, f)
+	}
+	if *templateText == "" {
+		*templateText = "{{.Body}}"
+		if len(topics) > 1 {
+			*templateText = "{{.Topic}}: {{.Body}}"
+		}
+	}
+	tmpl, err := template.New("message").Parse(*templateText)
+	if err != nil {
+		log.Fatalf("--template error - %s", err)
+	}
+	handler.tmpl = tmpl
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -91,35 +205,52 @@ func main() {
 
 	cfg := nsq.NewConfig()
 	cfg.UserAgent = fmt.Sprintf("nsq_tail/%s go-nsq/%s", util.BINARY_VERSION, nsq.VERSION)
-	err := util.ParseOpts(cfg, consumerOpts)
+	err = util.ParseOpts(cfg, consumerOpts)
 	if err != nil {
 		log.Fatal(err)
 	}
 	cfg.MaxInFlight = *maxInFlight
 
-	consumer, err := nsq.NewConsumer(*topic, *channel, cfg)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	consumer.AddHandler(&TailHandler{totalMessages: *totalMessages})
-
-	err = consumer.ConnectToNSQDs(nsqdTCPAddrs)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// go-nsq doesn't expose which nsqd a message came from, so there is a
+	// consumer per nsqd when they're given directly
+	var consumers []*nsq.Consumer
+	for _, t := range topics {
+		if len(nsqdTCPAddrs) == 0 {
+			consumer, err := nsq.NewConsumer(t, *channel, cfg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			consumer.AddHandler(&topicHandler{handler, t, ""})
+			err = consumer.ConnectToNSQLookupds(lookupdHTTPAddrs)
+			if err != nil {
+				log.Fatal(err)
+			}
+			consumers = append(consumers, consumer)
+			continue
+		}
 
-	err = consumer.ConnectToNSQLookupds(lookupdHTTPAddrs)
-	if err != nil {
-		log.Fatal(err)
+		for _, addr := range nsqdTCPAddrs {
+			consumer, err := nsq.NewConsumer(t, *channel, cfg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			consumer.AddHandler(&topicHandler{handler, t, addr})
+			err = consumer.ConnectToNSQD(addr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			consumers = append(consumers, consumer)
+		}
 	}
 
-	for {
-		select {
-		case <-consumer.StopChan:
-			return
-		case <-sigChan:
+	go func() {
+		<-sigChan
+		for _, consumer := range consumers {
 			consumer.Stop()
 		}
+	}()
+
+	for _, consumer := range consumers {
+		<-consumer.StopChan
 	}
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/go-simplejson"
+)
+
+// messageDatetime returns the <DATETIME> of the file a message is written
+// to, according to --datetime-source
+func messageDatetime(m *nsq.Message) string {
+	var t time.Time
+	switch *datetimeSource {
+	case "timestamp":
+		t = time.Unix(0, m.Timestamp)
+	case "field":
+		var err error
+		t, err = fieldTime(m.Body, *datetimeField, *datetimeFieldLayout)
+		if err != nil {
+			// rather than dropping the message, fall back to when it was published
+			log.Printf("WARNING: message %s - %s, using the message timestamp", m.ID[:], err)
+			t = time.Unix(0, m.Timestamp)
+		}
+	default:
+		t = time.Now()
+	}
+	return strftime(*datetimeFormat, t.Local())
+}
+
+// fieldTime parses the time in field (nested fields separated by ".") of a
+// JSON object, either a string in layout or a number of seconds since the
+// epoch
+func fieldTime(body []byte, field string, layout string) (time.Time, error) {
+	js, err := simplejson.NewJson(body)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	val := js
+	for _, f := range strings.Split(field, ".") {
+		var ok bool
+		val, ok = val.CheckGet(f)
+		if !ok {
+			return time.Time{}, errors.New("missing " + field)
+		}
+	}
+
+	if s, err := val.String(); err == nil {
+		return time.Parse(layout, s)
+	}
+	if n, err := val.Float64(); err == nil {
+		sec := int64(n)
+		return time.Unix(sec, int64((n-float64(sec))*1e9)), nil
+	}
+	return time.Time{}, errors.New("invalid " + field)
+}
@@ -43,6 +43,11 @@ var (
 	rotateSize     = flag.Int64("rotate-size", 0, "rotate the file when it grows bigger than `rotate-size` bytes")
 	rotateInterval = flag.Duration("rotate-interval", 0*time.Second, "rotate the file every duration")
 
+	datetimeSource      = flag.String("datetime-source", "now", "time used for <DATETIME> in filename format (now, timestamp = the message timestamp, field = the --datetime-field of JSON messages)")
+	datetimeField       = flag.String("datetime-field", "", "field (nested fields separated by '.') of JSON messages to use with --datetime-source=field, either a string in --datetime-field-layout or a number of seconds since the epoch")
+	datetimeFieldLayout = flag.String("datetime-field-layout", time.RFC3339, "Go time layout of the --datetime-field")
+	idleTimeout         = flag.Duration("idle-timeout", 5*time.Minute, "close files that haven't been written to for this duration (with --datetime-source=timestamp or field)")
+
 	consumerOpts     = util.StringArray{}
 	nsqdTCPAddrs     = util.StringArray{}
 	lookupdHTTPAddrs = util.StringArray{}
@@ -63,21 +68,31 @@ func init() {
 }
 
 type FileLogger struct {
-	out              *os.File
-	writer           io.Writer
-	gzipWriter       *gzip.Writer
 	logChan          chan *nsq.Message
 	compressionLevel int
 	gzipEnabled      bool
 	filenameFormat   string
 
+	// the open files keyed by <DATETIME>
+	files map[string]*outputFile
+
 	ExitChan chan int
 	termChan chan bool
 	hupChan  chan bool
+}
+
+// outputFile is the file written to for one <DATETIME>
+type outputFile struct {
+	logger     *FileLogger
+	datetime   string
+	out        *os.File
+	writer     io.Writer
+	gzipWriter *gzip.Writer
 
 	// for rotation
 	lastFilename string
 	lastOpenTime time.Time
+	lastWrite    time.Time
 	filesize     int64
 	rev          uint
 }
@@ -132,27 +147,23 @@ func (f *FileLogger) router(r *nsq.Consumer) {
 			sync = true
 			closeFile = true
 		case <-ticker.C:
-			if f.needsFileRotate() {
-				if *skipEmptyFiles {
-					closeFile = true
-				} else {
-					f.updateFile()
-				}
-			}
+			f.rotateFiles()
 			sync = true
 		case m := <-f.logChan:
-			if f.needsFileRotate() {
-				f.updateFile()
+			of := f.file(messageDatetime(m))
+			if of.needsFileRotate() {
+				of.updateFile()
 				sync = true
 			}
-			_, err := f.writer.Write(m.Body)
+			_, err := of.writer.Write(m.Body)
 			if err != nil {
 				log.Fatalf("ERROR: writing message to disk - %s", err)
 			}
-			_, err = f.writer.Write([]byte("\n"))
+			_, err = of.writer.Write([]byte("\n"))
 			if err != nil {
 				log.Fatalf("ERROR: writing newline to disk - %s", err)
 			}
+			of.lastWrite = time.Now()
 			output[pos] = m
 			pos++
 			if pos == cap(output) {
@@ -188,7 +199,78 @@ func (f *FileLogger) router(r *nsq.Consumer) {
 	}
 }
 
+// file returns the file for datetime, in wall clock mode only the file for
+// the current datetime is kept open
+func (f *FileLogger) file(datetime string) *outputFile {
+	of, ok := f.files[datetime]
+	if ok {
+		return of
+	}
+	if *datetimeSource == "now" {
+		for datetime, of := range f.files {
+			of.Close()
+			delete(f.files, datetime)
+		}
+	}
+	of = &outputFile{logger: f, datetime: datetime}
+	f.files[datetime] = of
+	return of
+}
+
+// rotateFiles rotates the files that need it and closes files that are no
+// longer being written to
+func (f *FileLogger) rotateFiles() {
+	if *datetimeSource == "now" {
+		// open the file for the new datetime when the clock rolls over
+		// (or just close the old one when skipping empty files)
+		datetime := strftime(*datetimeFormat, time.Now())
+		if _, ok := f.files[datetime]; !ok {
+			if *skipEmptyFiles {
+				f.Close()
+			} else {
+				f.file(datetime).updateFile()
+			}
+		}
+	}
+
+	for datetime, of := range f.files {
+		if *datetimeSource != "now" && time.Since(of.lastWrite) > *idleTimeout {
+			if of.out != nil {
+				log.Printf("INFO: %s idle for %s, closing", of.out.Name(), *idleTimeout)
+			}
+			of.Close()
+			delete(f.files, datetime)
+			continue
+		}
+		if of.needsFileRotate() {
+			if *skipEmptyFiles {
+				of.Close()
+			} else {
+				of.updateFile()
+			}
+		}
+	}
+}
+
+// Close closes all the files, they're kept so that they're reopened with
+// the next <REV>
 func (f *FileLogger) Close() {
+	for _, of := range f.files {
+		of.Close()
+	}
+}
+
+func (f *FileLogger) Sync() error {
+	for _, of := range f.files {
+		err := of.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *outputFile) Close() {
 	if f.out != nil {
 		f.out.Sync()
 		if f.gzipWriter != nil {
@@ -199,17 +281,20 @@ func (f *FileLogger) Close() {
 	}
 }
 
-func (f *FileLogger) Write(p []byte) (n int, err error) {
+func (f *outputFile) Write(p []byte) (n int, err error) {
 	f.filesize += int64(len(p))
 	return f.out.Write(p)
 }
 
-func (f *FileLogger) Sync() error {
+func (f *outputFile) Sync() error {
+	if f.out == nil {
+		return nil
+	}
 	var err error
 	if f.gzipWriter != nil {
 		f.gzipWriter.Close()
 		err = f.out.Sync()
-		f.gzipWriter, _ = gzip.NewWriterLevel(f, f.compressionLevel)
+		f.gzipWriter, _ = gzip.NewWriterLevel(f, f.logger.compressionLevel)
 		f.writer = f.gzipWriter
 	} else {
 		err = f.out.Sync()
@@ -217,13 +302,11 @@ func (f *FileLogger) Sync() error {
 	return err
 }
 
-func (f *FileLogger) calculateCurrentFilename() string {
-	t := time.Now()
-	datetime := strftime(*datetimeFormat, t)
-	return strings.Replace(f.filenameFormat, "<DATETIME>", datetime, -1)
+func (f *outputFile) calculateCurrentFilename() string {
+	return strings.Replace(f.logger.filenameFormat, "<DATETIME>", f.datetime, -1)
 }
 
-func (f *FileLogger) needsFileRotate() bool {
+func (f *outputFile) needsFileRotate() bool {
 	if f.out == nil {
 		return true
 	}
@@ -248,7 +331,7 @@ func (f *FileLogger) needsFileRotate() bool {
 	return false
 }
 
-func (f *FileLogger) updateFile() {
+func (f *outputFile) updateFile() {
 	filename := f.calculateCurrentFilename()
 	if filename != f.lastFilename {
 		f.rev = 0 // reset revsion to 0 if it is a new filename
@@ -257,6 +340,7 @@ func (f *FileLogger) updateFile() {
 	}
 	f.lastFilename = filename
 	f.lastOpenTime = time.Now()
+	f.lastWrite = f.lastOpenTime
 
 	fullPath := path.Join(*outputDir, filename)
 	dir, _ := filepath.Split(fullPath)
@@ -274,7 +358,7 @@ func (f *FileLogger) updateFile() {
 	for ; ; f.rev += 1 {
 		absFilename := strings.Replace(fullPath, "<REV>", fmt.Sprintf("-%06d", f.rev), -1)
 		openFlag := os.O_WRONLY | os.O_CREATE
-		if f.gzipEnabled {
+		if f.logger.gzipEnabled {
 			openFlag |= os.O_EXCL
 		} else {
 			openFlag |= os.O_APPEND
@@ -302,8 +386,8 @@ func (f *FileLogger) updateFile() {
 		break // ok, don't need rotate
 	}
 
-	if f.gzipEnabled {
-		f.gzipWriter, _ = gzip.NewWriterLevel(f, f.compressionLevel)
+	if f.logger.gzipEnabled {
+		f.gzipWriter, _ = gzip.NewWriterLevel(f, f.logger.compressionLevel)
 		f.writer = f.gzipWriter
 	} else {
 		f.writer = f
@@ -343,6 +427,7 @@ func NewFileLogger(gzipEnabled bool, compressionLevel int, filenameFormat, topic
 		compressionLevel: compressionLevel,
 		filenameFormat:   filenameFormat,
 		gzipEnabled:      gzipEnabled,
+		files:            make(map[string]*outputFile),
 		ExitChan:         make(chan int),
 		termChan:         make(chan bool),
 		hupChan:          make(chan bool),
@@ -485,6 +570,16 @@ func main() {
 		log.Fatal("use --nsqd-tcp-address or --lookupd-http-address not both")
 	}
 
+	switch *datetimeSource {
+	case "now", "timestamp":
+	case "field":
+		if *datetimeField == "" {
+			log.Fatal("--datetime-field is required with --datetime-source=field")
+		}
+	default:
+		log.Fatalf("invalid --datetime-source value (%s), should be now, timestamp or field", *datetimeSource)
+	}
+
 	if *gzipLevel < 1 || *gzipLevel > 9 {
 		log.Fatalf("invalid --gzip-level value (%d), should be 1-9", *gzipLevel)
 	}
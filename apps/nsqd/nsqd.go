@@ -31,8 +31,10 @@ var (
 	tcpAddress        = flagSet.String("tcp-address", "0.0.0.0:4150", "<addr>:<port> to listen on for TCP clients")
 	authHttpAddresses = util.StringArray{}
 
-	broadcastAddress = flagSet.String("broadcast-address", "", "address that will be registered with lookupd (defaults to the OS hostname)")
-	lookupdTCPAddrs  = util.StringArray{}
+	broadcastAddress  = flagSet.String("broadcast-address", "", "address that will be registered with lookupd (defaults to the OS hostname)")
+	lookupdTCPAddrs   = util.StringArray{}
+	lookupdAuthSecret = flagSet.String("lookupd-auth-secret", "", "secret sent to lookupd when it requires auth")
+	labels            = util.StringArray{}
 
 	// diskqueue options
 	dataPath        = flagSet.String("data-path", "", "path to store disk-backed messages")
@@ -40,16 +42,30 @@ var (
 	maxBytesPerFile = flagSet.Int64("max-bytes-per-file", 104857600, "number of bytes per diskqueue file before rolling")
 	syncEvery       = flagSet.Int64("sync-every", 2500, "number of messages per diskqueue fsync")
 	syncTimeout     = flagSet.Duration("sync-timeout", 2*time.Second, "duration of time per diskqueue fsync")
+	backendQueue    = flagSet.String("backend-queue", "disk", "default backend queue implementation for topics and channels (overridable per topic via /topic/create?backend=)")
+	journalInFlight = flagSet.Bool("journal-in-flight", false, "journal in-flight and deferred messages to disk so that they survive a crash (they are always persisted on a clean exit)")
+
+	// backlog limits
+	maxTopicDepth   = flagSet.Int64("max-topic-depth", 0, "maximum number of messages queued per topic (0 is unlimited, overridable per topic via /topic/create?max_depth=)")
+	maxTopicBytes   = flagSet.Int64("max-topic-bytes", 0, "maximum number of message body bytes queued per topic (0 is unlimited, overridable per topic via /topic/create?max_bytes=)")
+	maxChannelDepth = flagSet.Int64("max-channel-depth", 0, "maximum number of messages queued per channel (0 is unlimited, overridable per channel via /channel/create?max_depth=)")
+	maxChannelBytes = flagSet.Int64("max-channel-bytes", 0, "maximum number of message body bytes queued per channel (0 is unlimited, overridable per channel via /channel/create?max_bytes=)")
+	overflowPolicy  = flagSet.String("overflow-policy", "reject", "what happens when a topic/channel is full: reject (publishes fail), drop-oldest or drop-newest")
 
 	// msg and command options
 	msgTimeout    = flagSet.String("msg-timeout", "60s", "duration to wait before auto-requeing a message")
 	maxMsgTimeout = flagSet.Duration("max-msg-timeout", 15*time.Minute, "maximum duration before a message will timeout")
 	maxMsgSize    = flagSet.Int64("max-msg-size", 1024768, "maximum size of a single message in bytes")
 	maxReqTimeout = flagSet.Duration("max-req-timeout", 1*time.Hour, "maximum requeuing timeout for a message")
+	msgTTL        = flagSet.Duration("msg-ttl", 0, "default duration after which published messages expire (0 disables, overridable per topic via /topic/create?msg_ttl=)")
 	// remove, deprecated
 	maxMessageSize = flagSet.Int64("max-message-size", 1024768, "(deprecated use --max-msg-size) maximum size of a single message in bytes")
 	maxBodySize    = flagSet.Int64("max-body-size", 5*1024768, "maximum size of a single command body")
 
+	// dead-letter options
+	maxAttempts     = flagSet.Int("max-attempts", 0, "number of delivery attempts after which a message is moved to the dead-letter topic (0 disables)")
+	deadLetterTopic = flagSet.String("dead-letter-topic", "%s.dlq", "topic that messages exceeding --max-attempts are moved to (%s is replaced by the topic name)")
+
 	// client overridable configuration options
 	maxHeartbeatInterval   = flagSet.Duration("max-heartbeat-interval", 60*time.Second, "maximum client configurable duration of time between client heartbeats")
 	maxRdyCount            = flagSet.Int64("max-rdy-count", 2500, "maximum RDY count for a client")
@@ -73,6 +89,12 @@ var (
 	tlsRootCAFile       = flagSet.String("tls-root-ca-file", "", "path to private certificate authority pem")
 	tlsRequired         tlsRequiredOption
 
+	// TLS config for connections to lookupd
+	lookupdTLS           = flagSet.Bool("lookupd-tls", false, "connect to lookupd with TLS")
+	lookupdTLSCert       = flagSet.String("lookupd-tls-cert", "", "path to client certificate file presented to lookupd")
+	lookupdTLSKey        = flagSet.String("lookupd-tls-key", "", "path to client private key file")
+	lookupdTLSRootCAFile = flagSet.String("lookupd-tls-root-ca-file", "", "path to certificate authority pem to verify lookupd with (defaults to the system roots)")
+
 	// compression
 	deflateEnabled  = flagSet.Bool("deflate", true, "enable deflate feature negotiation (client compression)")
 	maxDeflateLevel = flagSet.Int("max-deflate-level", 6, "max deflate compression level a client can negotiate (> values == > nsqd CPU usage)")
@@ -112,6 +134,7 @@ func (t *tlsRequiredOption) IsBoolFlag() bool { return true }
 
 func init() {
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
+	flagSet.Var(&labels, "label", "key=value topology label (ie. zone=us-east-1a) advertised to lookupd (may be given multiple times)")
 	flagSet.Var(&e2eProcessingLatencyPercentiles, "e2e-processing-latency-percentile", "message processing time percentiles to keep track of (can be specified multiple times or comma separated, default none)")
 	flagSet.Var(&authHttpAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times)")
 	flagSet.Var(&tlsRequired, "tls-required", "require TLS for client connections (true, false, tcp-https)")
@@ -155,6 +178,20 @@ func main() {
 		log.Fatalf("ERROR: failed to persist metadata - %s", err.Error())
 	}
 	nsqd.Main()
-	<-signalChan
+
+	if len(drainSignals) > 0 {
+		drainSignalChan := make(chan os.Signal, 1)
+		signal.Notify(drainSignalChan, drainSignals...)
+		go func() {
+			for _ = range drainSignalChan {
+				nsqd.Drain()
+			}
+		}()
+	}
+
+	select {
+	case <-signalChan:
+	case <-nsqd.Drained():
+	}
 	nsqd.Exit()
 }
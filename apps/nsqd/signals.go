@@ -0,0 +1,11 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// signals that start draining nsqd (as does POST /drain)
+var drainSignals = []os.Signal{syscall.SIGUSR1}
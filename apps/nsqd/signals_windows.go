@@ -0,0 +1,10 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// there is no signal to start draining nsqd on windows, use /drain instead
+var drainSignals []os.Signal
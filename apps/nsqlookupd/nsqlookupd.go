@@ -24,12 +24,31 @@ var (
 
 	tcpAddress       = flagSet.String("tcp-address", "0.0.0.0:4160", "<addr>:<port> to listen on for TCP clients")
 	httpAddress      = flagSet.String("http-address", "0.0.0.0:4161", "<addr>:<port> to listen on for HTTP clients")
+	httpsAddress     = flagSet.String("https-address", "", "<addr>:<port> to listen on for HTTPS clients")
 	broadcastAddress = flagSet.String("broadcast-address", "", "address of this lookupd node, (default to the OS hostname)")
+	dataPath         = flagSet.String("data-path", "", "path to persist created topics/channels and tombstones (default none)")
 
 	inactiveProducerTimeout = flagSet.Duration("inactive-producer-timeout", 300*time.Second, "duration of time a producer will remain in the active list since its last ping")
 	tombstoneLifetime       = flagSet.Duration("tombstone-lifetime", 45*time.Second, "duration of time a producer will remain tombstoned if registration remains")
+
+	peerHTTPAddrs    = util.StringArray{}
+	peerSyncInterval = flagSet.Duration("peer-sync-interval", 15*time.Second, "duration of time between replicating registrations from peer nsqlookupd")
+
+	authSecret        = flagSet.String("auth-secret", "", "shared secret granting nsqd registration and admin HTTP access (enables auth)")
+	authHTTPAddresses = util.StringArray{}
+
+	tlsCert             = flagSet.String("tls-cert", "", "path to certificate file")
+	tlsKey              = flagSet.String("tls-key", "", "path to private key file")
+	tlsClientAuthPolicy = flagSet.String("tls-client-auth-policy", "", "client certificate auth policy ('require' or 'require-verify')")
+	tlsRootCAFile       = flagSet.String("tls-root-ca-file", "", "path to private certificate authority pem")
+	tlsRequired         = flagSet.Bool("tls-required", false, "require TLS for TCP (nsqd) connections")
 )
 
+func init() {
+	flagSet.Var(&peerHTTPAddrs, "peer-http-address", "peer nsqlookupd HTTP address (or https:// URL) to replicate registrations with (may be given multiple times, peers share --auth-secret when auth is enabled)")
+	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times, enables auth)")
+}
+
 func main() {
 	flagSet.Parse(os.Args[1:])
 
@@ -53,6 +72,11 @@ func main() {
 	options.Resolve(opts, flagSet, cfg)
 	daemon := nsqlookupd.NewNSQLookupd(opts)
 
+	daemon.LoadMetadata()
+	err := daemon.PersistMetadata()
+	if err != nil {
+		log.Fatalf("ERROR: failed to persist metadata - %s", err.Error())
+	}
 	daemon.Main()
 	<-signalChan
 	daemon.Exit()
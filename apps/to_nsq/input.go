@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// how often a followed file is checked for new data (or rotation)
+const followInterval = 250 * time.Millisecond
+
+// record is a delimited chunk of input, start and end are the offsets
+// of the record (including its delimiter) in the input, a record without
+// a body marks the input having been reset to the start of a file
+type record struct {
+	body  []byte
+	input *input
+	start int64
+	end   int64
+}
+
+// input reads delimited records from stdin or a file, following the file
+// as it grows (and is rotated or truncated) when follow is set
+type input struct {
+	path   string // empty for stdin
+	follow bool
+	delim  byte
+
+	f       *os.File
+	r       *bufio.Reader
+	offset  int64 // offset of the start of the next record
+	partial []byte
+	rotated *os.File // the file that replaced f, once f is drained
+	reset   bool     // whether the input was reset to the start of a file
+
+	// only used by the publisher loop
+	received int64
+}
+
+func newInput(path string, delim byte, follow bool, offset int64) (*input, error) {
+	in := &input{path: path, delim: delim, follow: follow}
+	if path == "" {
+		in.f = os.Stdin
+		in.r = bufio.NewReader(os.Stdin)
+		return in, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// start over if the file was truncated (or replaced) since the checkpoint
+	if offset > fi.Size() {
+		log.Printf("%s: checkpoint offset %d is past the end of the file, reading from the start", path, offset)
+		offset = 0
+	}
+	_, err = f.Seek(offset, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	in.f = f
+	in.r = bufio.NewReader(f)
+	in.offset = offset
+	in.received = offset
+	return in, nil
+}
+
+func (in *input) String() string {
+	if in.path == "" {
+		return "stdin"
+	}
+	return in.path
+}
+
+// next returns the next (non-empty) record, io.EOF is returned once the
+// input is exhausted (which never happens when following a file)
+func (in *input) next() (*record, error) {
+	for {
+		if in.reset {
+			in.reset = false
+			return &record{input: in}, nil
+		}
+
+		line, err := in.r.ReadBytes(in.delim)
+		in.partial = append(in.partial, line...)
+		if err == nil {
+			rec := in.take(len(in.partial) - 1)
+			if rec != nil {
+				return rec, nil
+			}
+			continue
+		}
+		if err != io.EOF {
+			return nil, err
+		}
+
+		if !in.follow || in.path == "" {
+			// the last record need not be delimited
+			rec := in.take(len(in.partial))
+			if rec != nil {
+				return rec, nil
+			}
+			return nil, io.EOF
+		}
+
+		if in.rotated != nil {
+			// the old file is drained, any partial record in it is complete
+			rec := in.take(len(in.partial))
+			in.f.Close()
+			in.f = in.rotated
+			in.r = bufio.NewReader(in.f)
+			in.offset = 0
+			in.rotated = nil
+			in.reset = true
+			log.Printf("%s: reopened after rotation", in)
+			if rec != nil {
+				return rec, nil
+			}
+			continue
+		}
+
+		time.Sleep(followInterval)
+		err = in.checkRotation()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// take returns the first n bytes of the partial record as a record (or nil
+// if it's empty) and moves past the whole partial record
+func (in *input) take(n int) *record {
+	rec := &record{
+		body:  in.partial[:n],
+		input: in,
+		start: in.offset,
+		end:   in.offset + int64(len(in.partial)),
+	}
+	in.offset = rec.end
+	in.partial = nil
+	if len(rec.body) == 0 {
+		return nil
+	}
+	return rec
+}
+
+// checkRotation looks for the file at path having been replaced (in which
+// case the current file is drained before switching) or truncated
+func (in *input) checkRotation() error {
+	fi, err := os.Stat(in.path)
+	if err != nil {
+		// the file may be in the middle of being rotated
+		return nil
+	}
+	cur, err := in.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(fi, cur) {
+		f, err := os.Open(in.path)
+		if err != nil {
+			return nil
+		}
+		in.rotated = f
+		return nil
+	}
+
+	if fi.Size() < in.offset+int64(len(in.partial)) {
+		log.Printf("%s: truncated, reading from the start", in)
+		_, err = in.f.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+		in.r.Reset(in.f)
+		in.offset = 0
+		in.partial = nil
+		in.reset = true
+	}
+	return nil
+}
+
+// checkpoints are the offsets up to which each file has been published
+type checkpoints map[string]int64
+
+func loadCheckpoints(path string) (checkpoints, error) {
+	c := make(checkpoints)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// save atomically replaces the checkpoint file
+func (c checkpoints) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/bitly/go-simplejson"
+	"github.com/bitly/nsq/util"
+)
+
+// the longest wait between attempts to publish a batch
+const maxBackoff = 30 * time.Second
+
+type topicStats struct {
+	published int64
+	failed    int64
+	batches   int64
+}
+
+// publisher batches records by topic and publishes them to every producer,
+// it is only used from the main loop
+type publisher struct {
+	producers   map[string]*nsq.Producer
+	batchSize   int
+	rate        float64
+	nextTime    time.Time
+	maxAttempts int
+	exitChan    chan int
+
+	topic      string
+	topicField string
+	json       bool
+
+	inputs         []*input
+	checkpoints    checkpoints
+	checkpointFile string
+
+	pending    map[string][]*record
+	numPending int
+
+	// once a batch fails to publish, publishing stops and the checkpoint
+	// never moves past its records
+	unpublished []*record
+	stopped     bool
+
+	stats   map[string]*topicStats
+	invalid int64
+}
+
+// route returns the topic to publish a record to
+func (p *publisher) route(body []byte) (string, error) {
+	if !p.json {
+		return p.topic, nil
+	}
+
+	js, err := simplejson.NewJson(body)
+	if err != nil {
+		return "", err
+	}
+	if _, err := js.Map(); err != nil {
+		return "", errors.New("not a JSON object")
+	}
+	if len(p.topicField) == 0 {
+		return p.topic, nil
+	}
+
+	val := js
+	for _, f := range strings.Split(p.topicField, ".") {
+		var ok bool
+		val, ok = val.CheckGet(f)
+		if !ok {
+			val = nil
+			break
+		}
+	}
+	if val == nil {
+		if len(p.topic) == 0 {
+			return "", errors.New("missing topic field")
+		}
+		return p.topic, nil
+	}
+
+	topic, err := val.String()
+	if err != nil || !util.IsValidTopicName(topic) {
+		return "", errors.New("invalid topic field")
+	}
+	return topic, nil
+}
+
+func (p *publisher) add(rec *record) {
+	in := rec.input
+	in.received = rec.end
+	if rec.body == nil {
+		// the input was reset, there's nothing to publish
+		p.checkpoint()
+		return
+	}
+
+	topic, err := p.route(rec.body)
+	if err != nil {
+		log.Printf("ERROR: skipping message at %s:%d - %s", in, rec.start, err)
+		p.invalid++
+		p.checkpoint()
+		return
+	}
+
+	p.pending[topic] = append(p.pending[topic], rec)
+	p.numPending++
+	if len(p.pending[topic]) >= p.batchSize {
+		p.flushTopic(topic)
+		p.checkpoint()
+	}
+}
+
+// flush publishes all the pending batches
+func (p *publisher) flush() {
+	if p.numPending == 0 {
+		return
+	}
+	for topic := range p.pending {
+		if p.stopped {
+			break
+		}
+		p.flushTopic(topic)
+	}
+	p.checkpoint()
+}
+
+func (p *publisher) flushTopic(topic string) {
+	batch := p.pending[topic]
+	delete(p.pending, topic)
+	p.numPending -= len(batch)
+	if len(batch) == 0 {
+		return
+	}
+
+	s, ok := p.stats[topic]
+	if !ok {
+		s = &topicStats{}
+		p.stats[topic] = s
+	}
+
+	p.wait(len(batch))
+
+	bodies := make([][]byte, len(batch))
+	for i, rec := range batch {
+		bodies[i] = rec.body
+	}
+	// only the nsqd that failed are retried
+	remaining := make(map[string]*nsq.Producer)
+	for addr, producer := range p.producers {
+		remaining[addr] = producer
+	}
+	for attempt := 1; ; attempt++ {
+		for addr, producer := range remaining {
+			var err error
+			if len(bodies) == 1 {
+				err = producer.Publish(topic, bodies[0])
+			} else {
+				err = producer.MultiPublish(topic, bodies)
+			}
+			if err != nil {
+				log.Printf("ERROR: failed to publish %d message(s) to %s on %s (attempt %d of %d) - %s",
+					len(bodies), topic, addr, attempt, p.maxAttempts, err)
+				continue
+			}
+			delete(remaining, addr)
+		}
+		if len(remaining) == 0 || attempt >= p.maxAttempts {
+			break
+		}
+
+		backoff := time.Duration(1<<uint(attempt-1)) * time.Second
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-p.exitChan:
+			attempt = p.maxAttempts
+		}
+	}
+
+	s.batches++
+	if len(remaining) > 0 {
+		log.Printf("ERROR: giving up on %d message(s) to %s, stopping", len(batch), topic)
+		s.failed += int64(len(batch))
+		p.unpublished = append(p.unpublished, batch...)
+		p.stopped = true
+	} else {
+		s.published += int64(len(batch))
+	}
+}
+
+// wait blocks until n more messages may be published under the rate limit
+func (p *publisher) wait(n int) {
+	if p.rate <= 0 {
+		return
+	}
+	now := time.Now()
+	if p.nextTime.Before(now) {
+		p.nextTime = now
+	}
+	time.Sleep(p.nextTime.Sub(now))
+	p.nextTime = p.nextTime.Add(time.Duration(float64(n) / p.rate * float64(time.Second)))
+}
+
+// checkpoint saves, for each file, the offset before which every message has
+// been published (or skipped as invalid)
+func (p *publisher) checkpoint() {
+	if len(p.checkpointFile) == 0 {
+		return
+	}
+
+	offsets := make(map[*input]int64)
+	for _, in := range p.inputs {
+		offsets[in] = in.received
+	}
+	unpublished := p.unpublished
+	for _, batch := range p.pending {
+		unpublished = append(unpublished, batch...)
+	}
+	for _, rec := range unpublished {
+		if rec.start < offsets[rec.input] {
+			offsets[rec.input] = rec.start
+		}
+	}
+
+	changed := false
+	for in, offset := range offsets {
+		if p.checkpoints[in.path] != offset {
+			p.checkpoints[in.path] = offset
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	err := p.checkpoints.save(p.checkpointFile)
+	if err != nil {
+		log.Printf("ERROR: failed to save checkpoints - %s", err)
+	}
+}
+
+func (p *publisher) failed() bool {
+	if p.invalid > 0 {
+		return true
+	}
+	for _, s := range p.stats {
+		if s.failed > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *publisher) logSummary() {
+	var topics []string
+	for topic := range p.stats {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	var total topicStats
+	for _, topic := range topics {
+		s := p.stats[topic]
+		log.Printf("%s: %d published, %d failed (%d batches)", topic, s.published, s.failed, s.batches)
+		total.published += s.published
+		total.failed += s.failed
+		total.batches += s.batches
+	}
+	log.Printf("total: %d published, %d failed (%d batches), %d invalid", total.published, total.failed, total.batches, p.invalid)
+}
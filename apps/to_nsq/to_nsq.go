@@ -1,31 +1,45 @@
 // This is an NSQ client that publishes incoming messages from
-// stdin to the specified topic.
+// stdin (or files) to the specified topic.
 
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/bitly/nsq/util"
 )
 
 var (
-	topic     = flag.String("topic", "", "NSQ topic to publish to")
+	topic     = flag.String("topic", "", "NSQ topic to publish to (the default topic when --topic-field is given)")
 	delimiter = flag.String("delimiter", "\n", "character to split input from stdin (defaults to '\n')")
 
+	batchSize   = flag.Int("batch-size", 1, "number of messages to publish at once (using MPUB)")
+	batchLinger = flag.Duration("batch-linger", 100*time.Millisecond, "max time to wait for a batch to fill before publishing it")
+	rate        = flag.Float64("rate", 0, "max number of messages to publish per second (0 for no limit)")
+
+	publishAttempts = flag.Int("publish-attempts", 5, "number of times to try publishing a batch to each nsqd (backing off in between) before giving up and exiting")
+
+	inputFormat    = flag.String("input-format", "text", "input format (text, json), with json each message must be a JSON object")
+	topicField     = flag.String("topic-field", "", "field (nested fields separated by '.') of JSON messages that selects the topic to publish to")
+	follow         = flag.Bool("follow", false, "keep reading --file as it grows, reopening it when it's rotated (like tail -F)")
+	checkpointFile = flag.String("checkpoint-file", "", "file to save the offset published up to in each --file, and to resume from")
+
+	files            = util.StringArray{}
 	destNsqdTCPAddrs = util.StringArray{}
 	producerOpts     = util.StringArray{}
 )
 
 func init() {
+	flag.Var(&files, "file", "file to read messages from instead of stdin (may be given multiple times)")
 	flag.Var(&producerOpts, "producer-opt", "option to passthrough to nsq.Producer (may be given multiple times, http://godoc.org/github.com/bitly/go-nsq#Config)")
 	flag.Var(&destNsqdTCPAddrs, "nsqd-tcp-address", "destination nsqd TCP address (may be given multiple times)")
 }
@@ -33,17 +47,45 @@ func init() {
 func main() {
 	flag.Parse()
 
-	if len(*topic) == 0 {
-		log.Fatal("--topic required")
+	if len(*topic) == 0 && len(*topicField) == 0 {
+		log.Fatal("--topic or --topic-field required")
+	}
+	if len(*topic) > 0 && !util.IsValidTopicName(*topic) {
+		log.Fatal("--topic is invalid")
 	}
 
 	if len(*delimiter) != 1 {
 		log.Fatal("--delimiter must be a single byte")
 	}
 
-	stopChan := make(chan bool)
+	if *inputFormat != "text" && *inputFormat != "json" {
+		log.Fatal("--input-format must be text or json")
+	}
+	if len(*topicField) > 0 && *inputFormat != "json" {
+		log.Fatal("--topic-field requires --input-format=json")
+	}
+
+	if *batchSize < 1 {
+		log.Fatal("--batch-size must be >= 1")
+	}
+	if *rate < 0 {
+		log.Fatal("--rate must be >= 0")
+	}
+	if *publishAttempts < 1 {
+		log.Fatal("--publish-attempts must be >= 1")
+	}
+
+	if len(files) == 0 && (*follow || len(*checkpointFile) > 0) {
+		log.Fatal("--follow and --checkpoint-file require --file")
+	}
+
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
+	exitChan := make(chan int)
+	go func() {
+		<-termChan
+		close(exitChan)
+	}()
 
 	cfg := nsq.NewConfig()
 	cfg.UserAgent = fmt.Sprintf("to_nsq/%s go-nsq/%s", util.BINARY_VERSION, nsq.VERSION)
@@ -67,51 +109,99 @@ func main() {
 		log.Fatal("--nsqd-tcp-address required")
 	}
 
-	r := bufio.NewReader(os.Stdin)
-	delim := (*delimiter)[0]
-	go func() {
-		for {
-			err := readAndPublish(r, delim, producers)
-			if err != nil {
-				if err != io.EOF {
-					log.Fatal(err)
-				}
-				close(stopChan)
-				break
-			}
+	var cp checkpoints
+	if len(*checkpointFile) > 0 {
+		cp, err = loadCheckpoints(*checkpointFile)
+		if err != nil {
+			log.Fatalf("failed to load checkpoints - %s", err)
 		}
-	}()
-
-	select {
-	case <-termChan:
-	case <-stopChan:
 	}
 
-	for _, producer := range producers {
-		producer.Stop()
+	delim := (*delimiter)[0]
+	var inputs []*input
+	if len(files) == 0 {
+		in, _ := newInput("", delim, false, 0)
+		inputs = append(inputs, in)
+	}
+	for _, path := range files {
+		in, err := newInput(path, delim, *follow, cp[path])
+		if err != nil {
+			log.Fatalf("failed to open %s - %s", path, err)
+		}
+		inputs = append(inputs, in)
 	}
-}
 
-// readAndPublish reads to the delim from r and publishes the bytes
-// to the map of producers.
-func readAndPublish(r *bufio.Reader, delim byte, producers map[string]*nsq.Producer) error {
-	line, readErr := r.ReadBytes(delim)
+	recordChan := make(chan *record)
+	var wg sync.WaitGroup
+	for _, in := range inputs {
+		wg.Add(1)
+		go func(in *input) {
+			defer wg.Done()
+			for {
+				rec, err := in.next()
+				if err != nil {
+					if err != io.EOF {
+						log.Fatalf("failed to read %s - %s", in, err)
+					}
+					return
+				}
+				recordChan <- rec
+			}
+		}(in)
+	}
+	go func() {
+		wg.Wait()
+		close(recordChan)
+	}()
 
-	if len(line) > 0 {
-		// trim the delimiter
-		line = line[:len(line)-1]
+	p := &publisher{
+		producers:      producers,
+		batchSize:      *batchSize,
+		rate:           *rate,
+		maxAttempts:    *publishAttempts,
+		exitChan:       exitChan,
+		topic:          *topic,
+		topicField:     *topicField,
+		json:           *inputFormat == "json",
+		inputs:         inputs,
+		checkpoints:    cp,
+		checkpointFile: *checkpointFile,
+		pending:        make(map[string][]*record),
+		stats:          make(map[string]*topicStats),
 	}
 
-	if len(line) == 0 {
-		return readErr
+	var lingerChan <-chan time.Time
+	for running := true; running; {
+		select {
+		case rec, ok := <-recordChan:
+			if !ok {
+				running = false
+				break
+			}
+			p.add(rec)
+			if p.numPending == 0 {
+				lingerChan = nil
+			} else if lingerChan == nil {
+				lingerChan = time.After(*batchLinger)
+			}
+		case <-lingerChan:
+			lingerChan = nil
+			p.flush()
+		case <-exitChan:
+			running = false
+		}
+		if p.stopped {
+			running = false
+		}
 	}
+	p.flush()
 
 	for _, producer := range producers {
-		err := producer.Publish(*topic, line)
-		if err != nil {
-			return err
-		}
+		producer.Stop()
 	}
 
-	return readErr
+	p.logSummary()
+	if p.failed() {
+		os.Exit(1)
+	}
 }
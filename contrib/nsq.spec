@@ -46,4 +46,5 @@ make PREFIX=/${path} DESTDIR=$RPM_BUILD_ROOT install
 /%{path}/bin/nsq_to_nsq
 /%{path}/bin/nsq_tail
 /%{path}/bin/nsq_stat
+/%{path}/bin/nsq_reconcile
 /%{path}/bin/to_nsq
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+// nodeRequest is an administrative request to a single nsqlookupd or nsqd,
+// deprecatedURI is used for nodes older than v1EndpointVersion
+type nodeRequest struct {
+	role          string
+	addr          string
+	deprecatedURI string
+	v1URI         string
+	query         url.Values
+}
+
+// NodeResult is the outcome of an administrative request to a single node
+type NodeResult struct {
+	Node     string `json:"node"`
+	Role     string `json:"role"`
+	Endpoint string `json:"endpoint"`
+	Success  bool   `json:"success"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ClusterActionResult is the response of the cluster API, Success is only
+// true when the action succeeded on every node
+type ClusterActionResult struct {
+	Action  string        `json:"action"`
+	Topic   string        `json:"topic"`
+	Channel string        `json:"channel,omitempty"`
+	Success bool          `json:"success"`
+	Nodes   []*NodeResult `json:"nodes"`
+}
+
+func (r *ClusterActionResult) add(results []*NodeResult) {
+	r.Nodes = append(r.Nodes, results...)
+	for _, result := range results {
+		if !result.Success {
+			r.Success = false
+		}
+	}
+}
+
+// isTransient returns whether a failed request is worth retrying, ie. it
+// never reached the node or the node responded with a 5xx
+func isTransient(err error) bool {
+	if statusErr, ok := err.(*util.StatusError); ok {
+		return statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+// isNotFound returns whether a node responded that the topic (or channel)
+// doesn't exist
+func isNotFound(err error) bool {
+	statusErr, ok := err.(*util.StatusError)
+	return ok && statusErr.StatusCode == 404
+}
+
+// do performs r, retrying transient failures up to --cluster-request-attempts
+// times, a delete of a topic or channel that is already gone is a success
+func (s *httpServer) do(r *nodeRequest, isDelete bool) *NodeResult {
+	opts := s.ctx.nsqadmin.opts
+	result := &NodeResult{Node: r.addr, Role: r.role}
+
+	for {
+		result.Attempts++
+
+		uri := r.deprecatedURI
+		version, err := lookupd.GetVersion(r.addr)
+		if err == nil {
+			if !version.Less(v1EndpointVersion) {
+				uri = r.v1URI
+			}
+			result.Endpoint = "/" + uri
+
+			var reqOpts *util.RequestOptions
+			if r.role == "nsqlookupd" && opts.NSQLookupdAuthSecret != "" {
+				reqOpts = &util.RequestOptions{Header: http.Header{}}
+				reqOpts.Header.Set(util.AuthSecretHeader, opts.NSQLookupdAuthSecret)
+			}
+
+			endpoint := fmt.Sprintf("http://%s/%s?%s", r.addr, uri, r.query.Encode())
+			s.ctx.nsqadmin.logf("%s: querying %s", strings.ToUpper(r.role), endpoint)
+			_, err = util.APIRequestNegotiateV1WithOptions("POST", endpoint, nil, reqOpts)
+		}
+
+		if err == nil || (isDelete && isNotFound(err)) {
+			result.Success = true
+			result.Error = ""
+			return result
+		}
+
+		s.ctx.nsqadmin.logf("ERROR: %s %s%s (attempt %d) - %s",
+			r.role, r.addr, result.Endpoint, result.Attempts, err)
+		result.Error = err.Error()
+		if !isTransient(err) || result.Attempts >= opts.ClusterRequestAttempts {
+			return result
+		}
+		time.Sleep(time.Duration(result.Attempts) * opts.ClusterRequestBackoff)
+	}
+}
+
+// doAll performs the requests concurrently, returning their results in order
+func (s *httpServer) doAll(requests []*nodeRequest, isDelete bool) []*NodeResult {
+	var wg sync.WaitGroup
+	results := make([]*NodeResult, len(requests))
+	for i, r := range requests {
+		wg.Add(1)
+		go func(i int, r *nodeRequest) {
+			results[i] = s.do(r, isDelete)
+			wg.Done()
+		}(i, r)
+	}
+	wg.Wait()
+	return results
+}
+
+// producers looks up the nsqd producing the topic, retrying failures like
+// do, a failed lookup is reported as a failed node (ie. the nsqlookupd)
+func (s *httpServer) producers(topicName string) ([]string, *NodeResult) {
+	opts := s.ctx.nsqadmin.opts
+	result := &NodeResult{
+		Node:     strings.Join(opts.NSQLookupdHTTPAddresses, ","),
+		Role:     "nsqlookupd",
+		Endpoint: "/lookup",
+	}
+	if len(opts.NSQLookupdHTTPAddresses) == 0 {
+		result.Node = strings.Join(opts.NSQDHTTPAddresses, ",")
+		result.Role = "nsqd"
+		result.Endpoint = "/stats"
+	}
+
+	for {
+		result.Attempts++
+
+		producers, err := s.lookupProducers(topicName)
+		if err == nil {
+			result.Success = true
+			result.Error = ""
+			return producers, result
+		}
+
+		s.ctx.nsqadmin.logf("ERROR: %s %s%s (attempt %d) - %s",
+			result.Role, result.Node, result.Endpoint, result.Attempts, err)
+		result.Error = err.Error()
+		if result.Attempts >= opts.ClusterRequestAttempts {
+			return nil, result
+		}
+		time.Sleep(time.Duration(result.Attempts) * opts.ClusterRequestBackoff)
+	}
+}
+
+func (s *httpServer) lookupdRequests(deprecatedURI string, v1URI string, query url.Values) []*nodeRequest {
+	var requests []*nodeRequest
+	for _, addr := range s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses {
+		requests = append(requests, &nodeRequest{"nsqlookupd", addr, deprecatedURI, v1URI, query})
+	}
+	return requests
+}
+
+func nsqdRequests(addrs []string, deprecatedURI string, v1URI string, query url.Values) []*nodeRequest {
+	var requests []*nodeRequest
+	for _, addr := range addrs {
+		requests = append(requests, &nodeRequest{"nsqd", addr, deprecatedURI, v1URI, query})
+	}
+	return requests
+}
+
+// apiHandler serves the JSON API for performing an administrative action
+// across the cluster (ie. POST /api/topic/delete?topic=...), every node
+// involved is reported on and the response is a 502 if any of them failed
+func (s *httpServer) apiHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		util.V1ApiResponse(w, 405, "METHOD_NOT_ALLOWED")
+		return
+	}
+
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqadmin.logf("ERROR: failed to parse request params - %s", err)
+		util.V1ApiResponse(w, 400, "INVALID_REQUEST")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/"), "/")
+	if len(parts) != 2 {
+		util.V1ApiResponse(w, 404, "NOT_FOUND")
+		return
+	}
+	category, verb := parts[0], parts[1]
+
+	var topicName, channelName string
+	switch category {
+	case "topic":
+		topicName, err = reqParams.Get("topic")
+		if err != nil || !util.IsValidTopicName(topicName) {
+			util.V1ApiResponse(w, 400, "INVALID_TOPIC")
+			return
+		}
+	case "channel":
+		topicName, channelName, err = util.GetTopicChannelArgs(reqParams)
+		if err != nil {
+			util.V1ApiResponse(w, 400, err.Error())
+			return
+		}
+	default:
+		util.V1ApiResponse(w, 404, "NOT_FOUND")
+		return
+	}
+
+	result := &ClusterActionResult{
+		Action:  verb + "_" + category,
+		Topic:   topicName,
+		Channel: channelName,
+		Success: true,
+		Nodes:   make([]*NodeResult, 0),
+	}
+	query := url.Values{"topic": []string{topicName}}
+	if category == "channel" {
+		query.Set("channel", channelName)
+	}
+
+	switch verb {
+	case "create":
+		result.add(s.doAll(s.lookupdRequests("create_topic", "topic/create",
+			url.Values{"topic": []string{topicName}}), false))
+		if category == "channel" {
+			result.add(s.doAll(s.lookupdRequests("create_channel", "channel/create", query), false))
+			// TODO: we can remove this when we push new channel information from nsqlookupd -> nsqd
+			producerAddrs, lookupResult := s.producers(topicName)
+			if !lookupResult.Success {
+				result.add([]*NodeResult{lookupResult})
+				break
+			}
+			result.add(s.doAll(nsqdRequests(producerAddrs,
+				"create_channel", "channel/create", query), false))
+		}
+	case "delete":
+		// for topic removal, you need to get all the producers *first*
+		// (and without them the nsqd would be left behind)
+		producerAddrs, lookupResult := s.producers(topicName)
+		if !lookupResult.Success {
+			result.add([]*NodeResult{lookupResult})
+			break
+		}
+		result.add(s.doAll(s.lookupdRequests("delete_"+category, category+"/delete", query), true))
+		result.add(s.doAll(nsqdRequests(producerAddrs,
+			"delete_"+category, category+"/delete", query), true))
+	case "pause", "unpause":
+		producerAddrs, lookupResult := s.producers(topicName)
+		if !lookupResult.Success {
+			result.add([]*NodeResult{lookupResult})
+			break
+		}
+		result.add(s.doAll(nsqdRequests(producerAddrs,
+			verb+"_"+category, category+"/"+verb, query), false))
+	default:
+		util.V1ApiResponse(w, 404, "NOT_FOUND")
+		return
+	}
+
+	s.notifyAdminAction(result.Action, topicName, channelName, "", req)
+
+	code := 200
+	if !result.Success {
+		code = 502
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		util.V1ApiResponse(w, 500, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(response)
+}
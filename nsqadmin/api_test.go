@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func equal(t *testing.T, act, exp interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		t.Logf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n",
+			filepath.Base(file), line, exp, act)
+		t.FailNow()
+	}
+}
+
+type tbLog interface {
+	Log(...interface{})
+}
+
+type testLogger struct {
+	tbLog
+}
+
+func (tl *testLogger) Output(maxdepth int, s string) error {
+	tl.Log(s)
+	return nil
+}
+
+func newTestLogger(tbl tbLog) logger {
+	return &testLogger{tbl}
+}
+
+// testNode is a fake nsqd or nsqlookupd that responds to each path with the
+// given status codes in turn (repeating the last one), or 200 and data
+type testNode struct {
+	*httptest.Server
+	sync.Mutex
+	statuses map[string][]int
+	data     map[string]interface{}
+	requests map[string]int
+}
+
+func newTestNode(statuses map[string][]int, data map[string]interface{}) *testNode {
+	n := &testNode{
+		statuses: statuses,
+		data:     data,
+		requests: make(map[string]int),
+	}
+	n.Server = httptest.NewServer(n)
+	return n
+}
+
+func (n *testNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	n.Lock()
+	attempt := n.requests[req.URL.Path]
+	n.requests[req.URL.Path]++
+	n.Unlock()
+
+	code := 200
+	if statuses, ok := n.statuses[req.URL.Path]; ok {
+		if attempt >= len(statuses) {
+			attempt = len(statuses) - 1
+		}
+		code = statuses[attempt]
+	}
+
+	var data interface{} = n.data[req.URL.Path]
+	if req.URL.Path == "/info" {
+		data = map[string]string{"version": "0.3.0"}
+	}
+	response, _ := json.Marshal(data)
+
+	w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+	w.WriteHeader(code)
+	if code != 200 {
+		w.Write([]byte(http.StatusText(code)))
+		return
+	}
+	w.Write(response)
+}
+
+func (n *testNode) addr() string {
+	return strings.TrimPrefix(n.URL, "http://")
+}
+
+func (n *testNode) count(path string) int {
+	n.Lock()
+	defer n.Unlock()
+	return n.requests[path]
+}
+
+// lookupData is the /lookup response of an nsqlookupd with the nsqd as producers
+func lookupData(t *testing.T, nsqds ...*testNode) map[string]interface{} {
+	producers := make([]map[string]interface{}, 0)
+	for _, n := range nsqds {
+		host, port, err := net.SplitHostPort(n.addr())
+		equal(t, err, nil)
+		httpPort, _ := strconv.Atoi(port)
+		producers = append(producers, map[string]interface{}{
+			"broadcast_address": host,
+			"http_port":         httpPort,
+		})
+	}
+	return map[string]interface{}{"/lookup": map[string]interface{}{"producers": producers}}
+}
+
+func apiRequest(t *testing.T, opts *nsqadminOptions, path string) (int, *ClusterActionResult) {
+	s := &httpServer{ctx: &Context{&NSQAdmin{opts: opts}}}
+	req, err := http.NewRequest("POST", path, bytes.NewReader(nil))
+	equal(t, err, nil)
+	w := httptest.NewRecorder()
+	s.apiHandler(w, req)
+
+	var result ClusterActionResult
+	err = json.Unmarshal(w.Body.Bytes(), &result)
+	equal(t, err, nil)
+	return w.Code, &result
+}
+
+func testOptions(t *testing.T) *nsqadminOptions {
+	opts := NewNSQAdminOptions()
+	opts.Logger = newTestLogger(t)
+	opts.ClusterRequestBackoff = time.Millisecond
+	return opts
+}
+
+func TestAPIDeleteNodeResults(t *testing.T) {
+	// a topic that is already gone is deleted
+	nsqd1 := newTestNode(map[string][]int{"/topic/delete": {404}}, nil)
+	defer nsqd1.Close()
+	nsqd2 := newTestNode(nil, nil)
+	defer nsqd2.Close()
+	lookupd := newTestNode(nil, lookupData(t, nsqd1, nsqd2))
+	defer lookupd.Close()
+
+	opts := testOptions(t)
+	opts.NSQLookupdHTTPAddresses = []string{lookupd.addr()}
+
+	code, result := apiRequest(t, opts, "/api/topic/delete?topic=test")
+	equal(t, code, 200)
+	equal(t, result.Action, "delete_topic")
+	equal(t, result.Success, true)
+	equal(t, len(result.Nodes), 3)
+	equal(t, *result.Nodes[0], NodeResult{lookupd.addr(), "nsqlookupd", "/topic/delete", true, 1, ""})
+	equal(t, *result.Nodes[1], NodeResult{nsqd1.addr(), "nsqd", "/topic/delete", true, 1, ""})
+	equal(t, *result.Nodes[2], NodeResult{nsqd2.addr(), "nsqd", "/topic/delete", true, 1, ""})
+}
+
+func TestAPIRetry(t *testing.T) {
+	nsqd1 := newTestNode(map[string][]int{"/channel/pause": {500, 503, 200}}, nil)
+	defer nsqd1.Close()
+	// client errors aren't retried
+	nsqd2 := newTestNode(map[string][]int{"/channel/pause": {400}}, nil)
+	defer nsqd2.Close()
+
+	opts := testOptions(t)
+	opts.NSQDHTTPAddresses = []string{nsqd1.addr(), nsqd2.addr()}
+	nsqd1.data = map[string]interface{}{"/stats": map[string]interface{}{
+		"topics": []map[string]string{{"topic_name": "test"}},
+	}}
+	nsqd2.data = nsqd1.data
+
+	code, result := apiRequest(t, opts, "/api/channel/pause?topic=test&channel=ch")
+	equal(t, code, 502)
+	equal(t, result.Success, false)
+	equal(t, len(result.Nodes), 2)
+	results := make(map[string]*NodeResult)
+	for _, r := range result.Nodes {
+		results[r.Node] = r
+	}
+	equal(t, results[nsqd1.addr()].Success, true)
+	equal(t, results[nsqd1.addr()].Attempts, 3)
+	equal(t, results[nsqd2.addr()].Success, false)
+	equal(t, results[nsqd2.addr()].Attempts, 1)
+	equal(t, nsqd1.count("/channel/pause"), 3)
+	equal(t, nsqd2.count("/channel/pause"), 1)
+}
+
+func TestAPIProducerLookupFailure(t *testing.T) {
+	lookupd := newTestNode(map[string][]int{"/lookup": {500}}, nil)
+	defer lookupd.Close()
+
+	opts := testOptions(t)
+	opts.NSQLookupdHTTPAddresses = []string{lookupd.addr()}
+
+	code, result := apiRequest(t, opts, "/api/topic/delete?topic=test")
+	equal(t, code, 502)
+	equal(t, result.Success, false)
+	equal(t, len(result.Nodes), 1)
+	equal(t, result.Nodes[0].Role, "nsqlookupd")
+	equal(t, result.Nodes[0].Success, false)
+	equal(t, result.Nodes[0].Attempts, opts.ClusterRequestAttempts)
+	equal(t, lookupd.count("/lookup"), opts.ClusterRequestAttempts)
+	// without the producers, the topic isn't deleted anywhere
+	equal(t, lookupd.count("/topic/delete"), 0)
+
+	// the retry succeeds
+	lookupd.statuses["/lookup"] = []int{500, 200}
+	lookupd.requests["/lookup"] = 0
+	lookupd.data = lookupData(t)
+
+	code, result = apiRequest(t, opts, "/api/topic/pause?topic=test")
+	equal(t, code, 200)
+	equal(t, result.Success, true)
+	equal(t, len(result.Nodes), 0)
+	equal(t, lookupd.count("/lookup"), 2)
+
+	// a topic the nsqlookupd doesn't know of has no producers
+	lookupd.statuses["/lookup"] = []int{404}
+	lookupd.statuses["/topic/delete"] = []int{404}
+
+	code, result = apiRequest(t, opts, "/api/topic/delete?topic=test")
+	equal(t, code, 200)
+	equal(t, result.Success, true)
+	equal(t, len(result.Nodes), 1)
+	equal(t, result.Nodes[0].Role, "nsqlookupd")
+	equal(t, result.Nodes[0].Endpoint, "/topic/delete")
+}
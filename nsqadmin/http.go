@@ -85,6 +85,9 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	} else if strings.HasPrefix(req.URL.Path, "/topic/") {
 		s.topicHandler(w, req)
 		return
+	} else if strings.HasPrefix(req.URL.Path, "/api/") {
+		s.apiHandler(w, req)
+		return
 	} else if strings.HasPrefix(req.URL.Path, "/static/") {
 		if req.Method != "GET" {
 			s.ctx.nsqadmin.logf("ERROR: invalid %s to GET only method", req.Method)
@@ -100,6 +103,8 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		s.indexHandler(w, req)
 	case "/ping":
 		s.pingHandler(w, req)
+	case "/metrics":
+		s.metricsHandler(w, req)
 	case "/nodes":
 		s.nodesHandler(w, req)
 	case "/tombstone_topic_producer":
@@ -254,11 +259,14 @@ func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request) {
 		firstTopic = topicStats[0]
 	}
 
+	metadata, _, _ := s.getMetadata(topicName)
+
 	p := struct {
 		Title            string
 		GraphOptions     *GraphOptions
 		Version          string
 		Topic            string
+		Metadata         map[string]string
 		TopicProducers   []string
 		TopicStats       []*lookupd.TopicStats
 		FirstTopic       *lookupd.TopicStats
@@ -270,6 +278,7 @@ func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request) {
 		GraphOptions:     NewGraphOptions(w, req, reqParams, s.ctx),
 		Version:          util.BINARY_VERSION,
 		Topic:            topicName,
+		Metadata:         metadata,
 		TopicProducers:   producers,
 		TopicStats:       topicStats,
 		FirstTopic:       firstTopic,
@@ -310,12 +319,15 @@ func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, to
 		firstHost = channelStats.HostStats[0]
 	}
 
+	_, channelMetadata, _ := s.getMetadata(topicName)
+
 	p := struct {
 		Title          string
 		GraphOptions   *GraphOptions
 		Version        string
 		Topic          string
 		Channel        string
+		Metadata       map[string]string
 		TopicProducers []string
 		ChannelStats   *lookupd.ChannelStats
 		FirstHost      *lookupd.ChannelStats
@@ -326,6 +338,7 @@ func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, to
 		Version:        util.BINARY_VERSION,
 		Topic:          topicName,
 		Channel:        channelName,
+		Metadata:       channelMetadata[channelName],
 		TopicProducers: producers,
 		ChannelStats:   channelStats,
 		FirstHost:      firstHost,
@@ -411,8 +424,7 @@ func (s *httpServer) createTopicChannelHandler(w http.ResponseWriter, req *http.
 
 		endpoint := fmt.Sprintf("http://%s/%s?topic=%s", addr,
 			uri, url.QueryEscape(topicName))
-		s.ctx.nsqadmin.logf("LOOKUPD: querying %s", endpoint)
-		_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+		err = s.lookupdAdminRequest(endpoint)
 		if err != nil {
 			s.ctx.nsqadmin.logf("ERROR: lookupd %s - %s", endpoint, err)
 			continue
@@ -427,8 +439,7 @@ func (s *httpServer) createTopicChannelHandler(w http.ResponseWriter, req *http.
 				addr, uri,
 				url.QueryEscape(topicName),
 				url.QueryEscape(channelName))
-			s.ctx.nsqadmin.logf("LOOKUPD: querying %s", endpoint)
-			_, err := util.APIRequestNegotiateV1("POST", endpoint, nil)
+			err := s.lookupdAdminRequest(endpoint)
 			if err != nil {
 				s.ctx.nsqadmin.logf("ERROR: lookupd %s - %s", endpoint, err)
 				continue
@@ -497,8 +508,7 @@ func (s *httpServer) tombstoneTopicProducerHandler(w http.ResponseWriter, req *h
 		endpoint := fmt.Sprintf("http://%s/%s?topic=%s&node=%s",
 			addr, uri,
 			url.QueryEscape(topicName), url.QueryEscape(node))
-		s.ctx.nsqadmin.logf("LOOKUPD: querying %s", endpoint)
-		_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+		err = s.lookupdAdminRequest(endpoint)
 		if err != nil {
 			s.ctx.nsqadmin.logf("ERROR: lookupd %s - %s", endpoint, err)
 		}
@@ -563,8 +573,7 @@ func (s *httpServer) deleteTopicHandler(w http.ResponseWriter, req *http.Request
 		}
 
 		endpoint := fmt.Sprintf("http://%s/%s?topic=%s", addr, uri, topicName)
-		s.ctx.nsqadmin.logf("LOOKUPD: querying %s", endpoint)
-		_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+		err = s.lookupdAdminRequest(endpoint)
 		if err != nil {
 			s.ctx.nsqadmin.logf("ERROR: lookupd %s - %s", endpoint, err)
 			continue
@@ -617,8 +626,7 @@ func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Reque
 			addr, uri,
 			url.QueryEscape(topicName),
 			url.QueryEscape(channelName))
-		s.ctx.nsqadmin.logf("LOOKUPD: querying %s", endpoint)
-		_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+		err = s.lookupdAdminRequest(endpoint)
 		if err != nil {
 			s.ctx.nsqadmin.logf("ERROR: lookupd %s - %s", endpoint, err)
 			continue
@@ -1025,13 +1033,24 @@ func graphiteGet(url string) ([]byte, error) {
 }
 
 func (s *httpServer) getProducers(topicName string) []string {
-	var producers []string
+	producers, _ := s.lookupProducers(topicName)
+	return producers
+}
+
+func (s *httpServer) lookupProducers(topicName string) ([]string, error) {
 	if len(s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses) != 0 {
-		producers, _ = lookupd.GetLookupdTopicProducers(topicName, s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses)
-	} else {
-		producers, _ = lookupd.GetNSQDTopicProducers(topicName, s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+		return lookupd.GetLookupdTopicProducers(topicName, s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses)
 	}
-	return producers
+	return lookupd.GetNSQDTopicProducers(topicName, s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+}
+
+// getMetadata returns the metadata of a topic and its channels (which
+// is only available when nsqadmin is configured with nsqlookupd)
+func (s *httpServer) getMetadata(topicName string) (map[string]string, map[string]map[string]string, error) {
+	if len(s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses) == 0 {
+		return nil, nil, nil
+	}
+	return lookupd.GetLookupdTopicMetadata(topicName, s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses)
 }
 
 func producerSearch(producers []*lookupd.Producer, needle string) *lookupd.Producer {
@@ -1044,6 +1063,19 @@ func producerSearch(producers []*lookupd.Producer, needle string) *lookupd.Produ
 	return nil
 }
 
+// lookupdAdminRequest POSTs an administrative request (ie. /topic/create)
+// to nsqlookupd, adding the secret for nsqlookupd that require auth
+func (s *httpServer) lookupdAdminRequest(endpoint string) error {
+	s.ctx.nsqadmin.logf("LOOKUPD: querying %s", endpoint)
+	var opts *util.RequestOptions
+	if s.ctx.nsqadmin.opts.NSQLookupdAuthSecret != "" {
+		opts = &util.RequestOptions{Header: http.Header{}}
+		opts.Header.Set(util.AuthSecretHeader, s.ctx.nsqadmin.opts.NSQLookupdAuthSecret)
+	}
+	_, err := util.APIRequestNegotiateV1WithOptions("POST", endpoint, nil, opts)
+	return err
+}
+
 func (s *httpServer) performVersionNegotiatedRequestsToNSQD(
 	nsqlookupdAddrs []string, nsqdAddrs []string,
 	deprecatedURI string, v1URI string, queryString string) {
@@ -32,8 +32,12 @@ var (
 
 	notificationHTTPEndpoint = flagSet.String("notification-http-endpoint", "", "HTTP endpoint (fully qualified) to which POST notifications of admin actions will be sent")
 
+	clusterRequestAttempts = flagSet.Int("cluster-request-attempts", 3, "number of attempts made for each node by the cluster API when requests to it fail transiently")
+	clusterRequestBackoff  = flagSet.Duration("cluster-request-backoff", 500*time.Millisecond, "time to wait before retrying a failed request by the cluster API (multiplied by the attempt)")
+
 	nsqlookupdHTTPAddresses = util.StringArray{}
 	nsqdHTTPAddresses       = util.StringArray{}
+	lookupdAuthSecret       = flagSet.String("lookupd-auth-secret", "", "secret sent with admin actions to lookupd when it requires auth")
 )
 
 func init() {
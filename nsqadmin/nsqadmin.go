@@ -70,6 +70,11 @@ func NewNSQAdmin(opts *nsqadminOptions) *NSQAdmin {
 		n.graphiteURL = url
 	}
 
+	if opts.ClusterRequestAttempts < 1 {
+		n.logf("FATAL: --cluster-request-attempts must be at least 1")
+		os.Exit(1)
+	}
+
 	n.logf(util.Version("nsqlookupd"))
 
 	return n
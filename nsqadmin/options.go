@@ -18,9 +18,13 @@ type nsqadminOptions struct {
 
 	NSQLookupdHTTPAddresses []string `flag:"lookupd-http-address" cfg:"nsqlookupd_http_addresses"`
 	NSQDHTTPAddresses       []string `flag:"nsqd-http-address" cfg:"nsqd_http_addresses"`
+	NSQLookupdAuthSecret    string   `flag:"lookupd-auth-secret" cfg:"nsqlookupd_auth_secret"`
 
 	NotificationHTTPEndpoint string `flag:"notification-http-endpoint"`
 
+	ClusterRequestAttempts int           `flag:"cluster-request-attempts"`
+	ClusterRequestBackoff  time.Duration `flag:"cluster-request-backoff"`
+
 	Logger logger
 }
 
@@ -31,5 +35,8 @@ func NewNSQAdminOptions() *nsqadminOptions {
 		StatsdPrefix:      "nsq.%s",
 		StatsdInterval:    60 * time.Second,
 		Logger:            log.New(os.Stderr, "[nsqadmin] ", log.Ldate|log.Ltime|log.Lmicroseconds),
+
+		ClusterRequestAttempts: 3,
+		ClusterRequestBackoff:  500 * time.Millisecond,
 	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bitly/nsq/util"
+	"github.com/bitly/nsq/util/lookupd"
+)
+
+// metricsHandler exposes the stats of every nsqd in the cluster to
+// Prometheus, labeled by the node they were collected from
+func (s *httpServer) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	var nodes []string
+	if len(s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses) != 0 {
+		producers, _ := lookupd.GetLookupdProducers(s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses)
+		for _, p := range producers {
+			nodes = append(nodes, p.HTTPAddress())
+		}
+	} else {
+		nodes = s.ctx.nsqadmin.opts.NSQDHTTPAddresses
+	}
+
+	m := util.NewPrometheusMetrics("nsqadmin_")
+	m.Gauge("nodes", "Number of nsqd nodes in the cluster.", float64(len(nodes)))
+
+	topicStats, _, err := lookupd.GetNSQDStats(nodes, "")
+	if err != nil {
+		s.ctx.nsqadmin.logf("ERROR: failed to get nsqd stats - %s", err)
+	}
+
+	for _, t := range topicStats {
+		labels := []string{"node", t.HostAddress, "topic", t.TopicName}
+		m.Gauge("topic_depth", "Number of messages queued in the topic.",
+			float64(t.Depth), labels...)
+		m.Gauge("topic_backend_depth", "Number of messages queued in the topic's backend.",
+			float64(t.BackendDepth), labels...)
+		m.Counter("topic_message_count", "Number of messages published to the topic.",
+			float64(t.MessageCount), labels...)
+		m.Gauge("topic_channels", "Number of channels in the topic.",
+			float64(t.ChannelCount), labels...)
+		addLatencyMetrics(m, "topic_e2e_processing_latency_seconds",
+			"End to end processing latency of the topic's channels.",
+			t.E2eProcessingLatency, labels)
+
+		for _, c := range t.Channels {
+			labels := []string{"node", t.HostAddress, "topic", t.TopicName, "channel", c.ChannelName}
+			m.Gauge("channel_depth", "Number of messages queued in the channel.",
+				float64(c.Depth), labels...)
+			m.Gauge("channel_backend_depth", "Number of messages queued in the channel's backend.",
+				float64(c.BackendDepth), labels...)
+			m.Gauge("channel_in_flight_count", "Number of messages in-flight to clients.",
+				float64(c.InFlightCount), labels...)
+			m.Gauge("channel_deferred_count", "Number of deferred messages.",
+				float64(c.DeferredCount), labels...)
+			m.Counter("channel_message_count", "Number of messages put to the channel.",
+				float64(c.MessageCount), labels...)
+			m.Counter("channel_requeue_count", "Number of messages requeued.",
+				float64(c.RequeueCount), labels...)
+			m.Counter("channel_timeout_count", "Number of in-flight messages that timed out.",
+				float64(c.TimeoutCount), labels...)
+			m.Gauge("channel_clients", "Number of clients subscribed to the channel.",
+				float64(c.ClientCount), labels...)
+			addLatencyMetrics(m, "channel_e2e_processing_latency_seconds",
+				"End to end processing latency of the channel.",
+				c.E2eProcessingLatency, labels)
+
+			for _, client := range c.Clients {
+				clientLabels := append(labels[:6:6],
+					"client_id", client.ClientID,
+					"hostname", client.Hostname,
+					"remote_address", client.RemoteAddress)
+				m.Gauge("client_ready_count", "Number of messages the client is ready to receive.",
+					float64(client.ReadyCount), clientLabels...)
+				m.Gauge("client_in_flight_count", "Number of messages in-flight to the client.",
+					float64(client.InFlightCount), clientLabels...)
+				m.Counter("client_message_count", "Number of messages sent to the client.",
+					float64(client.MessageCount), clientLabels...)
+				m.Counter("client_finish_count", "Number of messages finished by the client.",
+					float64(client.FinishCount), clientLabels...)
+				m.Counter("client_requeue_count", "Number of messages requeued by the client.",
+					float64(client.RequeueCount), clientLabels...)
+			}
+		}
+	}
+
+	m.AddMemStats()
+
+	util.PrometheusResponse(w, m)
+}
+
+func addLatencyMetrics(m *util.PrometheusMetrics, name string, help string,
+	e2e *util.E2eProcessingLatencyAggregate, labels []string) {
+	if e2e == nil {
+		return
+	}
+	for _, item := range e2e.Percentiles {
+		m.Gauge(name, help, item["average"]/1e9,
+			append(labels[:len(labels):len(labels)],
+				"quantile", util.FormatPrometheusValue(item["quantile"]))...)
+	}
+}
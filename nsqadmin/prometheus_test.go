@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bitly/nsq/util"
+)
+
+func TestAddLatencyMetrics(t *testing.T) {
+	e2e := &util.E2eProcessingLatencyAggregate{
+		Count: 1,
+		Percentiles: []map[string]float64{
+			{"quantile": 0.5, "min": 1e9, "max": 3e9, "average": 2e9, "count": 1},
+			{"quantile": 0.99, "min": 4e9, "max": 6e9, "average": 5e9, "count": 1},
+		},
+	}
+
+	m := util.NewPrometheusMetrics("nsqadmin_")
+	addLatencyMetrics(m, "channel_e2e_processing_latency_seconds", "latency", e2e,
+		[]string{"node", "127.0.0.1:4151"})
+	addLatencyMetrics(m, "topic_e2e_processing_latency_seconds", "latency", nil, nil)
+
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	equal(t, err, nil)
+	out := buf.String()
+	equal(t, strings.Contains(out,
+		`nsqadmin_channel_e2e_processing_latency_seconds{node="127.0.0.1:4151",quantile="0.5"} 2`+"\n"), true)
+	equal(t, strings.Contains(out,
+		`nsqadmin_channel_e2e_processing_latency_seconds{node="127.0.0.1:4151",quantile="0.99"} 5`+"\n"), true)
+	equal(t, strings.Contains(out, "topic_e2e_processing_latency_seconds"), false)
+}
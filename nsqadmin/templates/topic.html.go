@@ -20,6 +20,24 @@ func init() {
     </div>
 </div>
 
+{{if .Metadata}}
+<div class="row-fluid">
+    <div class="span6">
+        <table class="table table-bordered table-condensed">
+            <tr>
+                <th colspan="2">Metadata</th>
+            </tr>
+            {{range $k, $v := .Metadata}}
+            <tr>
+                <td>{{$k}}</td>
+                <td>{{$v}}</td>
+            </tr>
+            {{end}}
+        </table>
+    </div>
+</div>
+{{end}}
+
 <div class="row-fluid">
     <div class="span2">
         <form action="/empty_topic" method="POST">
@@ -1,5 +1,12 @@
 package nsqd
 
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
 // BackendQueue represents the behavior for the secondary message
 // storage system
 type BackendQueue interface {
@@ -10,3 +17,85 @@ type BackendQueue interface {
 	Depth() int64
 	Empty() error
 }
+
+// BackendQueueConfig is the configuration passed to a BackendQueueFactory
+//
+// Name is unique per topic/channel and stable across restarts, a backend
+// instantiated with the Name of a queue that was previously closed is
+// expected to resume with its contents
+type BackendQueueConfig struct {
+	Name            string
+	DataPath        string
+	MaxBytesPerFile int64
+	SyncEvery       int64
+	SyncTimeout     time.Duration
+	Logger          logger
+}
+
+// BackendQueueFactory instantiates a BackendQueue
+type BackendQueueFactory func(cfg BackendQueueConfig) BackendQueue
+
+var backendQueueFactories = struct {
+	sync.RWMutex
+	m map[string]BackendQueueFactory
+}{
+	m: map[string]BackendQueueFactory{
+		"disk": func(cfg BackendQueueConfig) BackendQueue {
+			return newDiskQueue(cfg.Name, cfg.DataPath, cfg.MaxBytesPerFile,
+				cfg.SyncEvery, cfg.SyncTimeout, cfg.Logger)
+		},
+	},
+}
+
+// RegisterBackendQueue makes a BackendQueue implementation available by
+// the provided name (for --backend-queue and /topic/create?backend=)
+//
+// it is intended to be called from an init function and panics if
+// the name is already registered
+func RegisterBackendQueue(name string, factory BackendQueueFactory) {
+	backendQueueFactories.Lock()
+	defer backendQueueFactories.Unlock()
+	if factory == nil {
+		panic("nsqd: RegisterBackendQueue factory is nil")
+	}
+	if _, dup := backendQueueFactories.m[name]; dup {
+		panic(fmt.Sprintf("nsqd: RegisterBackendQueue called twice for %q", name))
+	}
+	backendQueueFactories.m[name] = factory
+}
+
+// BackendQueues returns the sorted names of the registered BackendQueue implementations
+func BackendQueues() []string {
+	backendQueueFactories.RLock()
+	defer backendQueueFactories.RUnlock()
+	names := make([]string, 0, len(backendQueueFactories.m))
+	for name := range backendQueueFactories.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getBackendQueueFactory(backendType string) (BackendQueueFactory, bool) {
+	backendQueueFactories.RLock()
+	defer backendQueueFactories.RUnlock()
+	factory, ok := backendQueueFactories.m[backendType]
+	return factory, ok
+}
+
+// newBackendQueue instantiates the named BackendQueue implementation
+// configured from the nsqd options
+func newBackendQueue(backendType string, name string, opts *nsqdOptions) (BackendQueue, error) {
+	factory, ok := getBackendQueueFactory(backendType)
+	if !ok {
+		return nil, fmt.Errorf("unknown backend queue %q", backendType)
+	}
+	return factory(BackendQueueConfig{
+		Name:            name,
+		DataPath:        opts.DataPath,
+		MaxBytesPerFile: opts.MaxBytesPerFile,
+		SyncEvery:       opts.SyncEvery,
+		SyncTimeout:     opts.SyncTimeout,
+		Logger:          opts.Logger,
+	}), nil
+}
@@ -0,0 +1,374 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memoryQueue is an (unbounded) in-memory BackendQueue used to exercise
+// the BackendQueue registry, its contents survive Close() for the life
+// of the process so that it passes the conformance suite
+type memoryQueue struct {
+	name     string
+	store    *memoryQueueStore
+	readChan chan []byte
+	exitChan chan int
+	wg       sync.WaitGroup
+}
+
+type memoryQueueStore struct {
+	sync.Mutex
+	msgs   [][]byte
+	popped uint64 // the number of messages ever removed from the front of msgs
+	notify chan int
+}
+
+var memoryQueueStores = struct {
+	sync.Mutex
+	m map[string]*memoryQueueStore
+}{m: make(map[string]*memoryQueueStore)}
+
+func init() {
+	RegisterBackendQueue("test_memory", newMemoryQueue)
+}
+
+func newMemoryQueue(cfg BackendQueueConfig) BackendQueue {
+	memoryQueueStores.Lock()
+	store, ok := memoryQueueStores.m[cfg.Name]
+	if !ok {
+		store = &memoryQueueStore{notify: make(chan int, 1)}
+		memoryQueueStores.m[cfg.Name] = store
+	}
+	memoryQueueStores.Unlock()
+
+	q := &memoryQueue{
+		name:     cfg.Name,
+		store:    store,
+		readChan: make(chan []byte),
+		exitChan: make(chan int),
+	}
+	q.wg.Add(1)
+	go q.ioLoop()
+	return q
+}
+
+func (q *memoryQueue) Put(data []byte) error {
+	q.store.Lock()
+	q.store.msgs = append(q.store.msgs, append([]byte(nil), data...))
+	q.store.Unlock()
+	select {
+	case q.store.notify <- 1:
+	default:
+	}
+	return nil
+}
+
+func (q *memoryQueue) ReadChan() chan []byte {
+	return q.readChan
+}
+
+func (q *memoryQueue) Close() error {
+	close(q.exitChan)
+	q.wg.Wait()
+	return nil
+}
+
+func (q *memoryQueue) Delete() error {
+	q.Close()
+	memoryQueueStores.Lock()
+	delete(memoryQueueStores.m, q.name)
+	memoryQueueStores.Unlock()
+	return nil
+}
+
+func (q *memoryQueue) Depth() int64 {
+	q.store.Lock()
+	defer q.store.Unlock()
+	return int64(len(q.store.msgs))
+}
+
+func (q *memoryQueue) Empty() error {
+	q.store.Lock()
+	q.store.popped += uint64(len(q.store.msgs))
+	q.store.msgs = nil
+	q.store.Unlock()
+	return nil
+}
+
+func (q *memoryQueue) ioLoop() {
+	defer q.wg.Done()
+	for {
+		var readChan chan []byte
+		var head []byte
+		q.store.Lock()
+		popped := q.store.popped
+		if len(q.store.msgs) > 0 {
+			readChan = q.readChan
+			head = q.store.msgs[0]
+		}
+		q.store.Unlock()
+
+		select {
+		case readChan <- head:
+			q.store.Lock()
+			// the queue may have been emptied while we were blocked
+			if q.store.popped == popped {
+				q.store.msgs = q.store.msgs[1:]
+				q.store.popped++
+			}
+			q.store.Unlock()
+		case <-q.store.notify:
+		case <-time.After(100 * time.Millisecond):
+		case <-q.exitChan:
+			return
+		}
+	}
+}
+
+func newTestBackendQueue(t *testing.T, backendType string, name string) BackendQueue {
+	factory, ok := getBackendQueueFactory(backendType)
+	equal(t, ok, true)
+	bq := factory(BackendQueueConfig{
+		Name:            name,
+		DataPath:        os.TempDir(),
+		MaxBytesPerFile: 1024,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		Logger:          newTestLogger(t),
+	})
+	nequal(t, bq, nil)
+	return bq
+}
+
+func waitForDepth(bq BackendQueue, depth int64) {
+	for bq.Depth() != depth {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestBackendQueueConformance runs every registered BackendQueue
+// implementation through the behavior nsqd relies on
+func TestBackendQueueConformance(t *testing.T) {
+	for _, backendType := range BackendQueues() {
+		t.Logf("testing backend queue %s", backendType)
+		testBackendQueuePutRead(t, backendType)
+		testBackendQueueOrder(t, backendType)
+		testBackendQueueEmpty(t, backendType)
+		testBackendQueueDelete(t, backendType)
+		testBackendQueueTorture(t, backendType)
+	}
+}
+
+func testBackendQueuePutRead(t *testing.T, backendType string) {
+	name := fmt.Sprintf("test_bq_put_read_%s_%d", backendType, time.Now().UnixNano())
+	bq := newTestBackendQueue(t, backendType, name)
+	defer bq.Delete()
+	equal(t, bq.Depth(), int64(0))
+
+	msg := []byte("test")
+	err := bq.Put(msg)
+	equal(t, err, nil)
+	equal(t, bq.Depth(), int64(1))
+
+	msgOut := <-bq.ReadChan()
+	equal(t, msgOut, msg)
+	waitForDepth(bq, 0)
+}
+
+func testBackendQueueOrder(t *testing.T, backendType string) {
+	name := fmt.Sprintf("test_bq_order_%s_%d", backendType, time.Now().UnixNano())
+	bq := newTestBackendQueue(t, backendType, name)
+	defer bq.Delete()
+
+	for i := 0; i < 100; i++ {
+		err := bq.Put([]byte(strconv.Itoa(i)))
+		equal(t, err, nil)
+		equal(t, bq.Depth(), int64(i+1))
+	}
+
+	for i := 0; i < 100; i++ {
+		equal(t, <-bq.ReadChan(), []byte(strconv.Itoa(i)))
+	}
+	waitForDepth(bq, 0)
+}
+
+func testBackendQueueEmpty(t *testing.T, backendType string) {
+	name := fmt.Sprintf("test_bq_empty_%s_%d", backendType, time.Now().UnixNano())
+	bq := newTestBackendQueue(t, backendType, name)
+	defer bq.Delete()
+
+	msg := []byte("aaaaaaaaaa")
+	for i := 0; i < 100; i++ {
+		err := bq.Put(msg)
+		equal(t, err, nil)
+	}
+
+	for i := 0; i < 3; i++ {
+		<-bq.ReadChan()
+	}
+	waitForDepth(bq, 97)
+
+	err := bq.Empty()
+	equal(t, err, nil)
+	equal(t, bq.Depth(), int64(0))
+
+	for i := 0; i < 100; i++ {
+		err := bq.Put(msg)
+		equal(t, err, nil)
+		equal(t, bq.Depth(), int64(i+1))
+	}
+
+	for i := 0; i < 100; i++ {
+		<-bq.ReadChan()
+	}
+	waitForDepth(bq, 0)
+}
+
+func testBackendQueueDelete(t *testing.T, backendType string) {
+	name := fmt.Sprintf("test_bq_delete_%s_%d", backendType, time.Now().UnixNano())
+	bq := newTestBackendQueue(t, backendType, name)
+
+	for i := 0; i < 10; i++ {
+		err := bq.Put([]byte("test"))
+		equal(t, err, nil)
+	}
+	equal(t, bq.Depth(), int64(10))
+
+	err := bq.Delete()
+	equal(t, err, nil)
+
+	bq = newTestBackendQueue(t, backendType, name)
+	defer bq.Delete()
+	equal(t, bq.Depth(), int64(0))
+}
+
+func testBackendQueueTorture(t *testing.T, backendType string) {
+	var wg sync.WaitGroup
+
+	name := fmt.Sprintf("test_bq_torture_%s_%d", backendType, time.Now().UnixNano())
+	bq := newTestBackendQueue(t, backendType, name)
+	equal(t, bq.Depth(), int64(0))
+
+	msg := []byte("aaaaaaaaaabbbbbbbbbbccccccccccddddddddddeeeeeeeeeeffffffffff")
+
+	numWriters := 4
+	numReaders := 4
+	readExitChan := make(chan int)
+	writeExitChan := make(chan int)
+
+	var depth int64
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				time.Sleep(100000 * time.Nanosecond)
+				select {
+				case <-writeExitChan:
+					return
+				default:
+					err := bq.Put(msg)
+					if err == nil {
+						atomic.AddInt64(&depth, 1)
+					}
+				}
+			}
+		}()
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	bq.Close()
+
+	close(writeExitChan)
+	wg.Wait()
+
+	// the contents must survive a restart
+	bq = newTestBackendQueue(t, backendType, name)
+	defer bq.Delete()
+	equal(t, bq.Depth(), depth)
+
+	var read int64
+	for i := 0; i < numReaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				time.Sleep(100000 * time.Nanosecond)
+				select {
+				case m := <-bq.ReadChan():
+					equal(t, msg, m)
+					atomic.AddInt64(&read, 1)
+				case <-readExitChan:
+					return
+				}
+			}
+		}()
+	}
+
+	waitForDepth(bq, 0)
+
+	close(readExitChan)
+	wg.Wait()
+
+	equal(t, read, depth)
+}
+
+func TestTopicBackendQueue(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+
+	topicName := "test_topic_backend_queue" + strconv.Itoa(int(time.Now().Unix()))
+
+	url := fmt.Sprintf("http://%s/topic/create?topic=%s&backend=bogus", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 400)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/topic/create?topic=%s&backend=test_memory", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+
+	// the topic already exists with a different backend
+	url = fmt.Sprintf("http://%s/topic/create?topic=%s&backend=disk", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 400)
+	resp.Body.Close()
+
+	topic := nsqd.GetTopic(topicName)
+	_, ok := topic.backend.(*memoryQueue)
+	equal(t, ok, true)
+	channel := topic.GetChannel("ch")
+	_, ok = channel.backend.(*memoryQueue)
+	equal(t, ok, true)
+
+	err = channel.backend.Put(bytes.Repeat([]byte("a"), 26))
+	equal(t, err, nil)
+
+	nsqd.Exit()
+
+	_, _, nsqd = mustStartNSQD(opts)
+	nsqd.LoadMetadata()
+
+	topic, err = nsqd.GetExistingTopic(topicName)
+	equal(t, err, nil)
+	equal(t, topic.backendType, "test_memory")
+	channel, err = topic.GetExistingChannel("ch")
+	equal(t, err, nil)
+	equal(t, channel.backend.Depth(), int64(1))
+
+	nsqd.DeleteExistingTopic(topicName)
+	nsqd.Exit()
+}
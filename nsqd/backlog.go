@@ -0,0 +1,181 @@
+package nsqd
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// overflow policies, applied when a topic or channel reaches its limits
+const (
+	// publishes are rejected until the backlog is drained
+	OverflowReject = "reject"
+	// the oldest queued message is discarded to make room
+	OverflowDropOldest = "drop-oldest"
+	// the incoming message is discarded
+	OverflowDropNewest = "drop-newest"
+)
+
+var errBacklogFull = errors.New("backlog full")
+
+func isValidOverflowPolicy(policy string) bool {
+	switch policy {
+	case OverflowReject, OverflowDropOldest, OverflowDropNewest:
+		return true
+	}
+	return false
+}
+
+// backlogLimits bounds the number of messages and/or (body) bytes queued
+// in a topic or channel, zero values are unlimited
+type backlogLimits struct {
+	maxDepth int64
+	maxBytes int64
+	policy   string
+}
+
+// withDefaults returns the limits with unset values taken from defaults
+func (l backlogLimits) withDefaults(defaults backlogLimits) backlogLimits {
+	if l.maxDepth == 0 {
+		l.maxDepth = defaults.maxDepth
+	}
+	if l.maxBytes == 0 {
+		l.maxBytes = defaults.maxBytes
+	}
+	if l.policy == "" {
+		l.policy = defaults.policy
+	}
+	return l
+}
+
+// merge returns the limits with the values not in has taken from current
+func (l backlogLimits) merge(current backlogLimits, has map[string]bool) backlogLimits {
+	if !has["max_depth"] {
+		l.maxDepth = current.maxDepth
+	}
+	if !has["max_bytes"] {
+		l.maxBytes = current.maxBytes
+	}
+	if !has["overflow_policy"] {
+		l.policy = current.policy
+	}
+	return l
+}
+
+// exceeded returns whether or not queueing count more messages totaling
+// size bytes on top of the current depth/bytes would exceed the limits
+func (l backlogLimits) exceeded(depth int64, bytes int64, count int64, size int64) bool {
+	return (l.maxDepth > 0 && depth+count > l.maxDepth) ||
+		(l.maxBytes > 0 && bytes+size > l.maxBytes)
+}
+
+// backlog tracks the (body) bytes queued in the memory and backend
+// queues of a topic or channel, and the messages dropped by its policy
+type backlog struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	bytes        int64
+	droppedCount uint64
+}
+
+func (b *backlog) Bytes() int64 {
+	return atomic.LoadInt64(&b.bytes)
+}
+
+func (b *backlog) DroppedCount() uint64 {
+	return atomic.LoadUint64(&b.droppedCount)
+}
+
+func (b *backlog) queued(m *Message) {
+	atomic.AddInt64(&b.bytes, int64(len(m.Body)))
+}
+
+// dequeued accounts for a message leaving the queue, depth is the depth
+// remaining which is used to correct drift in the byte count (ie. messages
+// queued before a restart) once the queue is empty
+func (b *backlog) dequeued(m *Message, depth int64) {
+	if depth == 0 {
+		atomic.StoreInt64(&b.bytes, 0)
+		return
+	}
+	if atomic.AddInt64(&b.bytes, -int64(len(m.Body))) < 0 {
+		atomic.StoreInt64(&b.bytes, 0)
+	}
+}
+
+func (b *backlog) dropped() {
+	atomic.AddUint64(&b.droppedCount, 1)
+}
+
+// makeRoom applies the drop policies before m is queued, it returns false
+// if m itself should be dropped (rejections happen at publish time)
+func (b *backlog) makeRoom(limits backlogLimits, m *Message, depth func() int64,
+	memoryMsgChan chan *Message, backend BackendQueue) bool {
+	size := int64(len(m.Body))
+	for limits.exceeded(depth(), b.Bytes(), 1, size) {
+		switch limits.policy {
+		case OverflowDropNewest:
+			b.dropped()
+			return false
+		case OverflowDropOldest:
+			msg, ok := dropOldest(memoryMsgChan, backend)
+			if !ok {
+				// everything queued is on its way out
+				return true
+			}
+			b.dequeued(msg, depth())
+			b.dropped()
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+func (b *backlog) reset() {
+	atomic.StoreInt64(&b.bytes, 0)
+}
+
+// restore seeds the byte count of messages queued before a restart
+func (b *backlog) restore(bytes int64) {
+	atomic.StoreInt64(&b.bytes, bytes)
+}
+
+// addBacklogMetadata records the limits (when overridden) and
+// the byte count of a topic or channel for PersistMetadata
+func addBacklogMetadata(data map[string]interface{}, limits backlogLimits, b *backlog) {
+	if limits.maxDepth > 0 {
+		data["max_depth"] = limits.maxDepth
+	}
+	if limits.maxBytes > 0 {
+		data["max_bytes"] = limits.maxBytes
+	}
+	if limits.policy != "" {
+		data["overflow_policy"] = limits.policy
+	}
+	if bytes := b.Bytes(); bytes > 0 {
+		data["backlog_bytes"] = bytes
+	}
+}
+
+// dropOldest discards a message from the front of the memory or backend
+// queue to make room, memory is preferred because it fills up before
+// messages overflow to the backend
+func dropOldest(memoryMsgChan chan *Message, backend BackendQueue) (*Message, bool) {
+	select {
+	case msg := <-memoryMsgChan:
+		return msg, true
+	default:
+	}
+
+	select {
+	case buf := <-backend.ReadChan():
+		msg, err := decodeMessage(buf)
+		if err != nil {
+			// it's gone regardless
+			return &Message{}, true
+		}
+		return msg, true
+	default:
+	}
+
+	return nil, false
+}
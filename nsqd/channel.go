@@ -36,9 +36,13 @@ type Consumer interface {
 // messages, timeouts, requeuing, etc.
 type Channel struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	requeueCount uint64
-	messageCount uint64
-	timeoutCount uint64
+	requeueCount    uint64
+	messageCount    uint64
+	timeoutCount    uint64
+	deadLetterCount uint64
+	expiredCount    uint64
+	msgTTL          int64
+	backlog         backlog
 
 	sync.RWMutex
 
@@ -47,6 +51,7 @@ type Channel struct {
 	ctx       *context
 
 	backend BackendQueue
+	journal *journal
 
 	memoryMsgChan chan *Message
 	clientMsgChan chan *Message
@@ -61,6 +66,20 @@ type Channel struct {
 	deleteCallback func(*Channel)
 	deleter        sync.Once
 
+	// overrides the nsqd defaults when set
+	maxAttempts     uint16
+	deadLetterTopic string
+
+	// overrides the nsqd defaults when set
+	limits backlogLimits
+
+	// only messages matching the filter (if any) are put to the channel
+	filter *util.JSONFilter
+
+	// for replaying from the topic's retention log
+	replayExitChan chan int
+	replayDoneChan chan int
+
 	// Stats tracking
 	e2eProcessingLatencyStream *util.Quantile
 
@@ -77,7 +96,7 @@ type Channel struct {
 }
 
 // NewChannel creates a new instance of the Channel type and returns a pointer
-func NewChannel(topicName string, channelName string, ctx *context,
+func NewChannel(topicName string, channelName string, backendType string, ctx *context,
 	deleteCallback func(*Channel)) *Channel {
 
 	c := &Channel{
@@ -105,12 +124,26 @@ func NewChannel(topicName string, channelName string, ctx *context,
 	} else {
 		// backend names, for uniqueness, automatically include the topic...
 		backendName := getBackendName(topicName, channelName)
-		c.backend = newDiskQueue(backendName,
+		backend, err := newBackendQueue(backendType, backendName, ctx.nsqd.opts)
+		if err != nil {
+			// backend types are validated before topics are created
+			panic(err)
+		}
+		c.backend = backend
+		c.journal = newJournal(backendName,
 			ctx.nsqd.opts.DataPath,
-			ctx.nsqd.opts.MaxBytesPerFile,
 			ctx.nsqd.opts.SyncEvery,
 			ctx.nsqd.opts.SyncTimeout,
 			ctx.nsqd.opts.Logger)
+		c.restoreJournal()
+	}
+
+	// the nsqd-wide dead-letter topic is only validated against a short
+	// topic name, so it can expand to an invalid name for this topic
+	if maxAttempts, deadLetterTopic := c.configuredDeadLetterPolicy(); maxAttempts > 0 &&
+		!util.IsValidTopicName(deadLetterTopic) {
+		c.ctx.nsqd.logf("CHANNEL(%s) ERROR: dead-lettering disabled - invalid dead-letter topic(%s)",
+			c.name, deadLetterTopic)
 	}
 
 	go c.messagePump()
@@ -123,6 +156,31 @@ func NewChannel(topicName string, channelName string, ctx *context,
 	return c
 }
 
+// restoreJournal defers all messages that were in-flight or deferred when
+// this channel was last closed until the time they would have been requeued
+func (c *Channel) restoreJournal() {
+	entries := c.journal.Entries()
+	if len(entries) > 0 {
+		c.ctx.nsqd.logf("CHANNEL(%s): restoring %d in-flight/deferred messages from journal",
+			c.name, len(entries))
+	}
+
+	for _, e := range entries {
+		item := &pqueue.Item{Value: e.msg, Priority: e.pri}
+		c.deferredMessages[e.msg.ID] = item
+		heap.Push(&c.deferredPQ, item)
+	}
+
+	if !c.ctx.nsqd.opts.JournalInFlight {
+		// we only journal on exit, start over so that messages
+		// aren't restored a second time
+		err := c.journal.Empty()
+		if err != nil {
+			c.ctx.nsqd.logf("CHANNEL(%s) ERROR: failed to empty journal - %s", c.name, err)
+		}
+	}
+}
+
 func (c *Channel) initPQ() {
 	pqSize := int(math.Max(1, float64(c.ctx.nsqd.opts.MemQueueSize)/10))
 
@@ -183,11 +241,20 @@ func (c *Channel) exit(deleted bool) error {
 	if deleted {
 		// empty the queue (deletes the backend files, too)
 		c.Empty()
+		if c.journal != nil {
+			c.journal.Delete()
+		}
 		return c.backend.Delete()
 	}
 
 	// write anything leftover to disk
 	c.flush()
+	if c.journal != nil {
+		err := c.journal.Close()
+		if err != nil {
+			c.ctx.nsqd.logf("ERROR: failed to close journal - %s", err)
+		}
+	}
 	return c.backend.Close()
 }
 
@@ -200,6 +267,13 @@ func (c *Channel) Empty() error {
 		client.Empty()
 	}
 
+	if c.journal != nil {
+		err := c.journal.Empty()
+		if err != nil {
+			return err
+		}
+	}
+
 	clientMsgChan := c.clientMsgChan
 	for {
 		select {
@@ -216,11 +290,33 @@ func (c *Channel) Empty() error {
 	}
 
 finish:
+	c.backlog.reset()
+	return c.backend.Empty()
+}
+
+// emptyQueue discards the messages in the memory and backend queues,
+// unlike Empty it leaves in-flight and deferred messages alone
+func (c *Channel) emptyQueue() error {
+	c.Lock()
+	defer c.Unlock()
+
+	for {
+		select {
+		case <-c.memoryMsgChan:
+		default:
+			goto finish
+		}
+	}
+
+finish:
+	c.backlog.reset()
 	return c.backend.Empty()
 }
 
 // flush persists all the messages in internal memory buffers to the backend
-// it does not drain inflight/deferred because it is only called in Close()
+// and records in-flight/deferred messages in the journal (so that their
+// timeouts are honored on restart), it does not drain inflight/deferred
+// because it is only called in Close()
 func (c *Channel) flush() error {
 	var msgBuf bytes.Buffer
 
@@ -229,10 +325,11 @@ func (c *Channel) flush() error {
 	for msg := range c.clientMsgChan {
 		c.ctx.nsqd.logf("CHANNEL(%s): recovered buffered message from clientMsgChan", c.name)
 		writeMessageToBackend(&msgBuf, msg, c.backend)
+		c.backlog.queued(msg)
 	}
 
 	if len(c.memoryMsgChan) > 0 || len(c.inFlightMessages) > 0 || len(c.deferredMessages) > 0 {
-		c.ctx.nsqd.logf("CHANNEL(%s): flushing %d memory %d in-flight %d deferred messages to backend",
+		c.ctx.nsqd.logf("CHANNEL(%s): flushing %d memory %d in-flight %d deferred messages to backend/journal",
 			c.name, len(c.memoryMsgChan), len(c.inFlightMessages), len(c.deferredMessages))
 	}
 
@@ -249,18 +346,22 @@ func (c *Channel) flush() error {
 	}
 
 finish:
+	if c.journal == nil {
+		return nil
+	}
+
 	for _, msg := range c.inFlightMessages {
-		err := writeMessageToBackend(&msgBuf, msg, c.backend)
+		err := c.journal.Add(msg, msg.pri)
 		if err != nil {
-			c.ctx.nsqd.logf("ERROR: failed to write message to backend - %s", err)
+			c.ctx.nsqd.logf("ERROR: failed to write message to journal - %s", err)
 		}
 	}
 
 	for _, item := range c.deferredMessages {
 		msg := item.Value.(*Message)
-		err := writeMessageToBackend(&msgBuf, msg, c.backend)
+		err := c.journal.Add(msg, item.Priority)
 		if err != nil {
-			c.ctx.nsqd.logf("ERROR: failed to write message to backend - %s", err)
+			c.ctx.nsqd.logf("ERROR: failed to write message to journal - %s", err)
 		}
 	}
 
@@ -307,6 +408,268 @@ func (c *Channel) IsPaused() bool {
 	return atomic.LoadInt32(&c.paused) == 1
 }
 
+// SetDeadLetterPolicy overrides the maximum number of attempts after which
+// a message is moved to the dead-letter topic (%s expands to the topic name),
+// zero values revert to the nsqd defaults
+func (c *Channel) SetDeadLetterPolicy(maxAttempts uint16, deadLetterTopic string) error {
+	c.setDeadLetterPolicy(maxAttempts, deadLetterTopic)
+
+	c.ctx.nsqd.Lock()
+	defer c.ctx.nsqd.Unlock()
+	// pro-actively persist metadata so in case of process failure
+	// nsqd won't lose the channel's policy
+	return c.ctx.nsqd.PersistMetadata()
+}
+
+func (c *Channel) setDeadLetterPolicy(maxAttempts uint16, deadLetterTopic string) {
+	c.Lock()
+	c.maxAttempts = maxAttempts
+	c.deadLetterTopic = deadLetterTopic
+	c.Unlock()
+}
+
+// SetMsgTTL sets the lifetime of messages in the channel (from when they
+// were published), expired messages are discarded rather than delivered
+func (c *Channel) SetMsgTTL(ttl time.Duration) error {
+	c.setMsgTTL(ttl)
+
+	c.ctx.nsqd.Lock()
+	defer c.ctx.nsqd.Unlock()
+	// pro-actively persist metadata so in case of process failure
+	// nsqd won't lose the channel's TTL
+	return c.ctx.nsqd.PersistMetadata()
+}
+
+func (c *Channel) setMsgTTL(ttl time.Duration) {
+	atomic.StoreInt64(&c.msgTTL, int64(ttl))
+}
+
+// MsgTTL returns the lifetime of messages in the channel (zero if unset)
+func (c *Channel) MsgTTL() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.msgTTL))
+}
+
+// discardExpired returns true (and counts the message as expired) if
+// the message has expired and should not be delivered
+func (c *Channel) discardExpired(msg *Message) bool {
+	if !msg.isExpired(time.Now().UnixNano(), c.MsgTTL()) {
+		return false
+	}
+	atomic.AddUint64(&c.expiredCount, 1)
+	return true
+}
+
+// SetBacklogLimits overrides the maximum depth and bytes of the channel and the
+// policy applied when they are reached, zero values revert to the nsqd defaults
+func (c *Channel) SetBacklogLimits(maxDepth int64, maxBytes int64, policy string) error {
+	c.setBacklogLimits(maxDepth, maxBytes, policy)
+
+	c.ctx.nsqd.Lock()
+	defer c.ctx.nsqd.Unlock()
+	// pro-actively persist metadata so in case of process failure
+	// nsqd won't lose the channel's limits
+	return c.ctx.nsqd.PersistMetadata()
+}
+
+func (c *Channel) setBacklogLimits(maxDepth int64, maxBytes int64, policy string) {
+	c.Lock()
+	c.limits = backlogLimits{maxDepth, maxBytes, policy}
+	c.Unlock()
+}
+
+// effectiveBacklogLimits returns the limits in effect for this channel,
+// it must be called with the channel's lock held
+func (c *Channel) effectiveBacklogLimits() backlogLimits {
+	opts := c.ctx.nsqd.opts
+	return c.limits.withDefaults(backlogLimits{
+		maxDepth: opts.MaxChannelDepth,
+		maxBytes: opts.MaxChannelBytes,
+		policy:   opts.OverflowPolicy,
+	})
+}
+
+// SetFilter restricts the messages put to the channel to those
+// matching the filter expression, an empty expression removes the filter
+func (c *Channel) SetFilter(expr string) error {
+	err := c.setFilter(expr)
+	if err != nil {
+		return err
+	}
+
+	c.ctx.nsqd.Lock()
+	defer c.ctx.nsqd.Unlock()
+	// pro-actively persist metadata so in case of process failure
+	// nsqd won't lose the channel's filter
+	return c.ctx.nsqd.PersistMetadata()
+}
+
+func (c *Channel) setFilter(expr string) error {
+	var filter *util.JSONFilter
+	if expr != "" {
+		var err error
+		filter, err = util.NewJSONFilter(expr)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Lock()
+	c.filter = filter
+	c.Unlock()
+	return nil
+}
+
+// Filter returns the channel's filter expression (if any)
+func (c *Channel) Filter() string {
+	c.RLock()
+	defer c.RUnlock()
+	if c.filter == nil {
+		return ""
+	}
+	return c.filter.String()
+}
+
+// matchesFilter returns whether or not a message should be put to the channel
+func (c *Channel) matchesFilter(msg *Message) bool {
+	c.RLock()
+	filter := c.filter
+	c.RUnlock()
+	return filter == nil || filter.Match(msg.Body)
+}
+
+// startReplay stops any replay in progress, empties the channel's queue, and
+// replays the messages in the range [from, to) of the retention log
+//
+// in-flight and deferred messages are left alone, they're delivered (or
+// requeued) as usual in addition to the replayed messages
+func (c *Channel) startReplay(l *retentionLog, from int64, to int64) {
+	exitChan := make(chan int)
+	doneChan := make(chan int)
+
+	c.Lock()
+	prevExitChan := c.replayExitChan
+	prevDoneChan := c.replayDoneChan
+	c.replayExitChan = exitChan
+	c.replayDoneChan = doneChan
+	c.Unlock()
+
+	if prevExitChan != nil {
+		close(prevExitChan)
+		<-prevDoneChan
+	}
+
+	err := c.emptyQueue()
+	if err != nil {
+		c.ctx.nsqd.logf("CHANNEL(%s) ERROR: failed to empty queue before replay - %s", c.name, err)
+	}
+
+	c.ctx.nsqd.logf("CHANNEL(%s): replaying offsets %d-%d", c.name, from, to)
+	go c.replay(l, from, to, exitChan, doneChan)
+}
+
+func (c *Channel) replay(l *retentionLog, from int64, to int64, exitChan chan int, doneChan chan int) {
+	defer close(doneChan)
+
+	var replayed int64
+	err := l.Read(from, to, func(offset int64, msg *Message) bool {
+		// only replay as fast as the channel is consumed, rather than
+		// copying the entire history to the channel's backend
+		for c.Depth() > c.ctx.nsqd.opts.MemQueueSize {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-exitChan:
+				return false
+			case <-c.exitChan:
+				return false
+			}
+		}
+
+		select {
+		case <-exitChan:
+			return false
+		case <-c.exitChan:
+			return false
+		default:
+		}
+
+		// the retention log has every message published to the topic
+		if !c.matchesFilter(msg) || c.discardExpired(msg) {
+			return true
+		}
+
+		err := c.PutMessage(msg)
+		if err != nil {
+			c.ctx.nsqd.logf("CHANNEL(%s) ERROR: failed to replay msg(%s) - %s",
+				c.name, msg.ID, err)
+			return false
+		}
+		replayed++
+		return true
+	})
+	if err != nil {
+		c.ctx.nsqd.logf("CHANNEL(%s) ERROR: replay failed - %s", c.name, err)
+	}
+
+	c.ctx.nsqd.logf("CHANNEL(%s): replayed %d messages", c.name, replayed)
+}
+
+// deadLetterPolicy returns the maximum number of attempts and the
+// dead-letter topic name in effect for this channel, dead-lettering is
+// disabled (zero attempts) when the topic name is invalid
+func (c *Channel) deadLetterPolicy() (uint16, string) {
+	maxAttempts, deadLetterTopic := c.configuredDeadLetterPolicy()
+	if !util.IsValidTopicName(deadLetterTopic) {
+		return 0, ""
+	}
+	return maxAttempts, deadLetterTopic
+}
+
+// configuredDeadLetterPolicy returns the maximum number of attempts and the
+// (expanded) dead-letter topic name configured for this channel
+func (c *Channel) configuredDeadLetterPolicy() (uint16, string) {
+	c.RLock()
+	maxAttempts := c.maxAttempts
+	deadLetterTopic := c.deadLetterTopic
+	c.RUnlock()
+
+	if maxAttempts == 0 {
+		maxAttempts = c.ctx.nsqd.opts.MaxAttempts
+	}
+	if deadLetterTopic == "" {
+		deadLetterTopic = c.ctx.nsqd.opts.DeadLetterTopic
+	}
+	return maxAttempts, deadLetterTopicName(deadLetterTopic, c.topicName)
+}
+
+// maybeDeadLetter hands a message that has exhausted its attempts off to
+// the dead-letter topic, it returns false if the message should be requeued
+func (c *Channel) maybeDeadLetter(msg *Message) bool {
+	maxAttempts, topicName := c.deadLetterPolicy()
+	if maxAttempts == 0 || msg.Attempts < maxAttempts {
+		return false
+	}
+
+	dl, err := newDeadLetter(c.topicName, c.name, topicName, msg)
+	if err != nil {
+		c.ctx.nsqd.logf("CHANNEL(%s) ERROR: failed to dead-letter msg(%s) - %s",
+			c.name, msg.ID, err)
+		return false
+	}
+
+	select {
+	case c.ctx.nsqd.deadLetterChan <- dl:
+	case <-c.ctx.nsqd.deadLetterExitChan:
+		return false
+	case <-c.exitChan:
+		return false
+	}
+
+	c.ctx.nsqd.logf("CHANNEL(%s): msg(%s) exceeded %d attempts, moved to topic(%s)",
+		c.name, msg.ID, maxAttempts, topicName)
+	atomic.AddUint64(&c.deadLetterCount, 1)
+	return true
+}
+
 // PutMessage writes a Message to the queue
 func (c *Channel) PutMessage(m *Message) error {
 	c.RLock()
@@ -315,6 +678,10 @@ func (c *Channel) PutMessage(m *Message) error {
 		return errors.New("exiting")
 	}
 
+	if !c.backlog.makeRoom(c.effectiveBacklogLimits(), m, c.Depth, c.memoryMsgChan, c.backend) {
+		return nil
+	}
+
 	err := c.put(m)
 	if err != nil {
 		return err
@@ -337,6 +704,42 @@ func (c *Channel) put(m *Message) error {
 			return err
 		}
 	}
+	c.backlog.queued(m)
+	return nil
+}
+
+// rejectsBacklog returns whether or not queueing count more messages totaling
+// size bytes would exceed the channel's limits when the policy in effect
+// is to reject publishes to its topic
+func (c *Channel) rejectsBacklog(count int64, size int64) bool {
+	c.RLock()
+	limits := c.effectiveBacklogLimits()
+	c.RUnlock()
+	return limits.policy == OverflowReject &&
+		limits.exceeded(c.Depth(), c.backlog.Bytes(), count, size)
+}
+
+// PutMessageDeferred writes a Message to the deferred queue, it will
+// be delivered once the specified timeout has elapsed
+func (c *Channel) PutMessageDeferred(m *Message, timeout time.Duration) error {
+	c.RLock()
+	if atomic.LoadInt32(&c.exitFlag) == 1 {
+		c.RUnlock()
+		return errors.New("exiting")
+	}
+	ok := c.backlog.makeRoom(c.effectiveBacklogLimits(), m, c.Depth, c.memoryMsgChan, c.backend)
+	c.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	// the deferral is over once the message is queued
+	m.deferred = 0
+	err := c.StartDeferredTimeout(m, timeout)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.messageCount, 1)
 	return nil
 }
 
@@ -402,12 +805,21 @@ func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Dura
 		msg.Delegate.OnRequeue(msg, timeout)
 	}
 
+	if c.maybeDeadLetter(msg) {
+		return nil
+	}
+
 	if timeout == 0 {
 		return c.doRequeue(msg)
 	}
 
 	// deferred requeue
-	return c.StartDeferredTimeout(msg, timeout)
+	err = c.StartDeferredTimeout(msg, timeout)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.requeueCount, 1)
+	return nil
 }
 
 // AddClient adds a client to the Channel's client list
@@ -464,12 +876,7 @@ func (c *Channel) StartDeferredTimeout(msg *Message, timeout time.Duration) erro
 
 // doRequeue performs the low level operations to requeue a message
 func (c *Channel) doRequeue(m *Message) error {
-	c.RLock()
-	defer c.RUnlock()
-	if atomic.LoadInt32(&c.exitFlag) == 1 {
-		return errors.New("exiting")
-	}
-	err := c.put(m)
+	err := c.doPut(m)
 	if err != nil {
 		return err
 	}
@@ -477,6 +884,17 @@ func (c *Channel) doRequeue(m *Message) error {
 	return nil
 }
 
+// doPut writes a message that has already been accounted for
+// (ie. a deferred message whose timeout has elapsed) back to the queue
+func (c *Channel) doPut(m *Message) error {
+	c.RLock()
+	defer c.RUnlock()
+	if atomic.LoadInt32(&c.exitFlag) == 1 {
+		return errors.New("exiting")
+	}
+	return c.put(m)
+}
+
 // pushInFlightMessage atomically adds a message to the in-flight dictionary
 func (c *Channel) pushInFlightMessage(msg *Message) error {
 	c.Lock()
@@ -486,6 +904,7 @@ func (c *Channel) pushInFlightMessage(msg *Message) error {
 		return errors.New("ID already in flight")
 	}
 	c.inFlightMessages[msg.ID] = msg
+	c.journalAdd(msg, msg.pri)
 	c.Unlock()
 	return nil
 }
@@ -503,6 +922,7 @@ func (c *Channel) popInFlightMessage(clientID int64, id MessageID) (*Message, er
 		return nil, errors.New("client does not own message")
 	}
 	delete(c.inFlightMessages, id)
+	c.journalRemove(id)
 	c.Unlock()
 	return msg, nil
 }
@@ -535,6 +955,7 @@ func (c *Channel) pushDeferredMessage(item *pqueue.Item) error {
 		return errors.New("ID already deferred")
 	}
 	c.deferredMessages[id] = item
+	c.journalAdd(item.Value.(*Message), item.Priority)
 
 	return nil
 }
@@ -549,10 +970,33 @@ func (c *Channel) popDeferredMessage(id MessageID) (*pqueue.Item, error) {
 		return nil, errors.New("ID not deferred")
 	}
 	delete(c.deferredMessages, id)
+	c.journalRemove(id)
 
 	return item, nil
 }
 
+// journalAdd records a message in the journal when in-flight journaling is enabled
+func (c *Channel) journalAdd(msg *Message, pri int64) {
+	if c.journal == nil || !c.ctx.nsqd.opts.JournalInFlight {
+		return
+	}
+	err := c.journal.Add(msg, pri)
+	if err != nil {
+		c.ctx.nsqd.logf("CHANNEL(%s) ERROR: failed to journal msg(%s) - %s", c.name, msg.ID, err)
+	}
+}
+
+// journalRemove removes a message from the journal when in-flight journaling is enabled
+func (c *Channel) journalRemove(id MessageID) {
+	if c.journal == nil || !c.ctx.nsqd.opts.JournalInFlight {
+		return
+	}
+	err := c.journal.Remove(id)
+	if err != nil {
+		c.ctx.nsqd.logf("CHANNEL(%s) ERROR: failed to journal msg(%s) - %s", c.name, id, err)
+	}
+}
+
 func (c *Channel) addToDeferredPQ(item *pqueue.Item) {
 	c.deferredMutex.Lock()
 	defer c.deferredMutex.Unlock()
@@ -589,6 +1033,11 @@ func (c *Channel) messagePump() {
 		case <-c.exitChan:
 			goto exit
 		}
+		c.backlog.dequeued(msg, c.Depth())
+
+		if c.discardExpired(msg) {
+			continue
+		}
 
 		msg.Attempts++
 
@@ -610,7 +1059,7 @@ func (c *Channel) deferredWorker() {
 		if err != nil {
 			return
 		}
-		c.doRequeue(msg)
+		c.doPut(msg)
 	})
 }
 
@@ -643,6 +1092,9 @@ func (c *Channel) inFlightWorker() {
 			if ok {
 				client.TimedOutMessage()
 			}
+			if c.maybeDeadLetter(msg) {
+				continue
+			}
 			c.doRequeue(msg)
 		}
 	}
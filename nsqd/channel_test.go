@@ -2,8 +2,11 @@ package nsqd
 
 import (
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/bitly/nsq/util"
 )
 
 // ensure that we can push a message through a topic and get it out of a channel
@@ -161,3 +164,203 @@ func TestChannelEmptyConsumer(t *testing.T) {
 	}
 
 }
+
+func TestChannelJournalRestore(t *testing.T) {
+	for _, journalInFlight := range []bool{false, true} {
+		opts := NewNSQDOptions()
+		opts.Logger = newTestLogger(t)
+		opts.JournalInFlight = journalInFlight
+		_, _, nsqd := mustStartNSQD(opts)
+
+		topicName := "test_channel_journal_restore" + strconv.Itoa(int(time.Now().UnixNano()))
+		topic := nsqd.GetTopic(topicName)
+		channel := topic.GetChannel("ch")
+
+		msg := NewMessage(<-nsqd.idChan, []byte("in-flight"))
+		msg.Attempts = 1
+		channel.StartInFlightTimeout(msg, 0, time.Hour)
+		inFlightPri := msg.pri
+
+		deferredMsg := NewMessage(<-nsqd.idChan, []byte("deferred"))
+		channel.StartDeferredTimeout(deferredMsg, time.Hour)
+		channel.Lock()
+		deferredPri := channel.deferredMessages[deferredMsg.ID].Priority
+		channel.Unlock()
+
+		finishedMsg := NewMessage(<-nsqd.idChan, []byte("finished"))
+		channel.StartInFlightTimeout(finishedMsg, 0, time.Hour)
+		channel.FinishMessage(0, finishedMsg.ID)
+
+		nsqd.Exit()
+
+		_, _, nsqd = mustStartNSQD(opts)
+		nsqd.LoadMetadata()
+
+		topic, err := nsqd.GetExistingTopic(topicName)
+		equal(t, err, nil)
+		channel, err = topic.GetExistingChannel("ch")
+		equal(t, err, nil)
+
+		channel.Lock()
+		equal(t, len(channel.inFlightMessages), 0)
+		equal(t, len(channel.deferredMessages), 2)
+		item, ok := channel.deferredMessages[msg.ID]
+		equal(t, ok, true)
+		equal(t, item.Priority, inFlightPri)
+		equal(t, item.Value.(*Message).Attempts, uint16(1))
+		equal(t, item.Value.(*Message).Body, []byte("in-flight"))
+		item, ok = channel.deferredMessages[deferredMsg.ID]
+		equal(t, ok, true)
+		equal(t, item.Priority, deferredPri)
+		channel.Unlock()
+		equal(t, channel.backend.Depth(), int64(0))
+
+		nsqd.DeleteExistingTopic(topicName)
+		nsqd.Exit()
+	}
+}
+
+func TestChannelFilterMatch(t *testing.T) {
+	tests := []struct {
+		expr  string
+		body  string
+		match bool
+	}{
+		{"type=click", `{"type":"click"}`, true},
+		{"type=click", `{"type":"view"}`, false},
+		{"type=click", `{"kind":"click"}`, false},
+		{"type=click", `not json`, false},
+		{"user.id=42", `{"user":{"id":42}}`, true},
+		{"user.id=42", `{"user":{"id":"42"}}`, true},
+		{"user.id=42", `{"user":{"id":43}}`, false},
+		{"type~^cl", `{"type":"click"}`, true},
+		{"type~^cl", `{"type":"view"}`, false},
+		{"type~^4", `{"type":42}`, false},
+	}
+	for _, tt := range tests {
+		f, err := util.NewJSONFilter(tt.expr)
+		equal(t, err, nil)
+		equal(t, f.Match([]byte(tt.body)), tt.match)
+	}
+
+	for _, expr := range []string{"", "type", "=click", "a..b=c", "type~("} {
+		_, err := util.NewJSONFilter(expr)
+		nequal(t, err, nil)
+	}
+}
+
+func TestChannelFilter(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+
+	topicName := "test_channel_filter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	filtered := topic.GetChannel("filtered")
+	err := filtered.SetFilter("type=click")
+	equal(t, err, nil)
+	equal(t, filtered.Filter(), "type=click")
+	all := topic.GetChannel("all")
+
+	topic.PutMessage(NewMessage(<-nsqd.idChan, []byte(`{"type":"view"}`)))
+	msg := NewMessage(<-nsqd.idChan, []byte(`{"type":"click"}`))
+	topic.PutMessage(msg)
+
+	outputMsg := <-filtered.clientMsgChan
+	equal(t, outputMsg.ID, msg.ID)
+
+	time.Sleep(25 * time.Millisecond)
+
+	equal(t, atomic.LoadUint64(&filtered.messageCount), uint64(1))
+	equal(t, atomic.LoadUint64(&all.messageCount), uint64(2))
+
+	nsqd.Exit()
+
+	_, _, nsqd = mustStartNSQD(opts)
+	nsqd.LoadMetadata()
+
+	topic, err = nsqd.GetExistingTopic(topicName)
+	equal(t, err, nil)
+	filtered, err = topic.GetExistingChannel("filtered")
+	equal(t, err, nil)
+	equal(t, filtered.Filter(), "type=click")
+	all, err = topic.GetExistingChannel("all")
+	equal(t, err, nil)
+	equal(t, all.Filter(), "")
+
+	nsqd.DeleteExistingTopic(topicName)
+	nsqd.Exit()
+}
+
+func TestChannelReplay(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_replay" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	defer nsqd.DeleteExistingTopic(topicName)
+	err := topic.SetRetention(time.Hour, 0)
+	equal(t, err, nil)
+	channel := topic.GetChannel("ch")
+	err = channel.SetFilter("type=keep")
+	equal(t, err, nil)
+
+	topic.PutMessage(NewMessage(<-nsqd.idChan, []byte(`{"type":"keep"}`)))
+	topic.PutMessage(NewMessage(<-nsqd.idChan, []byte(`{"type":"drop"}`)))
+	expired := NewMessage(<-nsqd.idChan, []byte(`{"type":"keep","expired":true}`))
+	expired.Expires = time.Now().UnixNano()
+	topic.PutMessage(expired)
+
+	msg := <-channel.clientMsgChan
+	equal(t, msg.Body, []byte(`{"type":"keep"}`))
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+
+	err = topic.ReplayChannel(channel, 0)
+	equal(t, err, nil)
+
+	// the replay skips filtered and expired messages
+	msg = <-channel.clientMsgChan
+	equal(t, msg.Body, []byte(`{"type":"keep"}`))
+	select {
+	case msg = <-channel.clientMsgChan:
+		t.Fatalf("unexpected msg %s", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// and leaves in-flight messages alone
+	channel.Lock()
+	equal(t, len(channel.inFlightMessages), 1)
+	channel.Unlock()
+}
+
+func TestChannelReplayTopicTTL(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_replay_ttl" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	defer nsqd.DeleteExistingTopic(topicName)
+	err := topic.SetRetention(time.Hour, 0)
+	equal(t, err, nil)
+	topic.setMsgTTL(100 * time.Millisecond)
+	channel := topic.GetChannel("ch")
+
+	topic.PutMessage(NewMessage(<-nsqd.idChan, []byte("test")))
+	msg := <-channel.clientMsgChan
+	equal(t, msg.Body, []byte("test"))
+
+	time.Sleep(150 * time.Millisecond)
+
+	// the retained message expired with the topic's TTL
+	err = topic.ReplayChannel(channel, 0)
+	equal(t, err, nil)
+	select {
+	case msg = <-channel.clientMsgChan:
+		t.Fatalf("unexpected msg %s", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -42,6 +42,7 @@ type identifyDataV2 struct {
 	SampleRate          int32  `json:"sample_rate"`
 	UserAgent           string `json:"user_agent"`
 	MsgTimeout          int    `json:"msg_timeout"`
+	Headers             bool   `json:"headers"`
 }
 
 type identifyEvent struct {
@@ -100,6 +101,7 @@ type clientV2 struct {
 	TLS     int32
 	Snappy  int32
 	Deflate int32
+	Headers int32
 
 	// re-usable buffer for reading the 4-byte lengths off the wire
 	lenBuf   [4]byte
@@ -249,6 +251,7 @@ func (c *clientV2) Stats() ClientStats {
 		TLS:             atomic.LoadInt32(&c.TLS) == 1,
 		Deflate:         atomic.LoadInt32(&c.Deflate) == 1,
 		Snappy:          atomic.LoadInt32(&c.Snappy) == 1,
+		Headers:         atomic.LoadInt32(&c.Headers) == 1,
 		Authed:          c.HasAuthorizations(),
 		AuthIdentity:    identity,
 		AuthIdentityURL: identityUrl,
@@ -544,6 +547,19 @@ func (c *clientV2) UpgradeSnappy() error {
 	return nil
 }
 
+func (c *clientV2) EnableHeaders() {
+	atomic.StoreInt32(&c.Headers, 1)
+}
+
+// newMessage creates a message from a published body, which is prefixed
+// with a headers block when the client negotiated headers
+func (c *clientV2) newMessage(id MessageID, body []byte) (*Message, error) {
+	if atomic.LoadInt32(&c.Headers) != 1 {
+		return NewMessage(id, body), nil
+	}
+	return newMessageWithHeaders(id, body)
+}
+
 func (c *clientV2) Flush() error {
 	var zeroTime time.Time
 	if c.HeartbeatInterval > 0 {
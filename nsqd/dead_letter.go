@@ -0,0 +1,82 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/bitly/nsq/util"
+)
+
+// deadLetterMessage is the body of a message published to a dead-letter
+// topic, it wraps the original message with information about where
+// (and after how many attempts) it was given up on
+type deadLetterMessage struct {
+	ID        string            `json:"id"`
+	Topic     string            `json:"topic"`
+	Channel   string            `json:"channel"`
+	Attempts  uint16            `json:"attempts"`
+	Timestamp int64             `json:"timestamp"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      []byte            `json:"body"`
+}
+
+type deadLetter struct {
+	topicName string
+	body      []byte
+}
+
+func newDeadLetter(topicName string, channelName string, deadLetterTopicName string,
+	msg *Message) (*deadLetter, error) {
+	body, err := json.Marshal(deadLetterMessage{
+		ID:        string(msg.ID[:]),
+		Topic:     topicName,
+		Channel:   channelName,
+		Attempts:  msg.Attempts,
+		Timestamp: msg.Timestamp,
+		Headers:   msg.Headers,
+		Body:      msg.Body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetter{
+		topicName: deadLetterTopicName,
+		body:      body,
+	}, nil
+}
+
+// deadLetterTopicName expands the %s in a dead-letter topic format
+// to the name of the topic the message was originally published to
+func deadLetterTopicName(format string, topicName string) string {
+	return strings.Replace(format, "%s", topicName, -1)
+}
+
+// deadLetterLoop publishes dead letters handed off by channels
+//
+// this happens in its own goroutine (rather than in the channel) because
+// getting a topic requires the nsqd lock, which is held while channels are
+// closed during Exit()
+func (n *NSQD) deadLetterLoop() {
+	for {
+		select {
+		case dl := <-n.deadLetterChan:
+			if !util.IsValidTopicName(dl.topicName) {
+				n.logf("ERROR: dropping dead letter - invalid dead-letter topic(%s)", dl.topicName)
+				continue
+			}
+			topic := n.GetTopic(dl.topicName)
+			msg := NewMessage(<-n.idChan, dl.body)
+			err := topic.PutMessage(msg)
+			if err != nil {
+				n.logf("ERROR: failed to put msg(%s) to dead-letter topic(%s) - %s",
+					msg.ID, dl.topicName, err)
+			}
+		case <-n.deadLetterExitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logf("DEADLETTER: closing")
+	n.deadLetterExitSyncChan <- 1
+}
@@ -13,6 +13,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/bitly/nsq/util"
 )
 
 // diskQueue implements the BackendQueue interface
@@ -433,7 +435,7 @@ func (d *diskQueue) persistMetaData() error {
 	f.Close()
 
 	// atomically rename
-	return atomic_rename(tmpFileName, fileName)
+	return util.AtomicRename(tmpFileName, fileName)
 }
 
 func (d *diskQueue) metaDataFileName() string {
@@ -525,7 +527,7 @@ func (d *diskQueue) handleReadError() {
 		"NOTICE: diskqueue(%s) jump to next file and saving bad file as %s",
 		d.name, badRenameFn)
 
-	err := atomic_rename(badFn, badRenameFn)
+	err := util.AtomicRename(badFn, badRenameFn)
 	if err != nil {
 		d.logf(
 			"ERROR: diskqueue(%s) failed to rename bad diskqueue file %s to %s",
@@ -0,0 +1,97 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// how often a draining nsqd checks whether it has been drained
+const drainCheckInterval = 250 * time.Millisecond
+
+// DrainStats is the progress of a drain, the remaining messages
+// (across all topics and channels) that consumers have yet to finish
+type DrainStats struct {
+	StartedAt     int64 `json:"started_at"`
+	Depth         int64 `json:"depth"`
+	InFlightCount int   `json:"in_flight_count"`
+	DeferredCount int   `json:"deferred_count"`
+	Drained       bool  `json:"drained"`
+}
+
+// Drain takes nsqd out of rotation before it is decommissioned
+//
+// Every topic and channel is unregistered from nsqlookupd (so that new
+// consumers and lookupd-aware producers go elsewhere), publishing is
+// rejected, and consumers are served until all topics and channels are
+// empty, at which point the channel returned by Drained is closed.
+func (n *NSQD) Drain() {
+	if !atomic.CompareAndSwapInt32(&n.draining, 0, 1) {
+		return
+	}
+	atomic.StoreInt64(&n.drainStartedAt, time.Now().Unix())
+	n.logf("NSQ: draining")
+
+	// the lookupLoop unregisters topics and channels while draining
+	n.RLock()
+	for _, topic := range n.topicMap {
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			n.Notify(channel)
+		}
+		topic.RUnlock()
+		n.Notify(topic)
+	}
+	n.RUnlock()
+
+	n.waitGroup.Wrap(func() { n.drainLoop() })
+}
+
+func (n *NSQD) IsDraining() bool {
+	return atomic.LoadInt32(&n.draining) == 1
+}
+
+// Drained returns a channel that is closed once a drain has completed
+func (n *NSQD) Drained() <-chan int {
+	return n.drainedChan
+}
+
+// GetDrainStats returns the progress of the drain (or nil if
+// nsqd is not draining)
+func (n *NSQD) GetDrainStats() *DrainStats {
+	if !n.IsDraining() {
+		return nil
+	}
+
+	stats := &DrainStats{
+		StartedAt: atomic.LoadInt64(&n.drainStartedAt),
+	}
+	for _, t := range n.GetStats() {
+		stats.Depth += t.Depth
+		for _, c := range t.Channels {
+			stats.Depth += c.Depth
+			stats.InFlightCount += c.InFlightCount
+			stats.DeferredCount += c.DeferredCount
+		}
+	}
+	stats.Drained = stats.Depth == 0 && stats.InFlightCount == 0 && stats.DeferredCount == 0
+	return stats
+}
+
+func (n *NSQD) drainLoop() {
+	ticker := time.NewTicker(drainCheckInterval)
+	for {
+		select {
+		case <-ticker.C:
+			if n.GetDrainStats().Drained {
+				n.logf("NSQ: drained")
+				close(n.drainedChan)
+				goto exit
+			}
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	ticker.Stop()
+}
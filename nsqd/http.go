@@ -18,6 +18,9 @@ import (
 	"github.com/bitly/nsq/util"
 )
 
+// message headers are published as HTTP headers with this (canonical) prefix
+const httpMessageHeaderPrefix = "X-Nsq-Header-"
+
 type httpServer struct {
 	ctx         *context
 	tlsEnabled  bool
@@ -86,6 +89,11 @@ func (s *httpServer) v1Router(w http.ResponseWriter, req *http.Request) error {
 			func() (interface{}, error) { return s.doStats(req) })
 	case "/ping":
 		s.pingHandler(w, req)
+	case "/metrics":
+		util.PrometheusResponse(w, s.ctx.nsqd.PrometheusMetrics())
+	case "/drain":
+		util.V1APIResponseWrapper(w, req, util.POSTRequired(req,
+			func() (interface{}, error) { return s.doDrain(req) }))
 
 	case "/topic/create":
 		util.V1APIResponseWrapper(w, req, util.POSTRequired(req,
@@ -228,6 +236,10 @@ func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, e
 }
 
 func (s *httpServer) doPUB(req *http.Request) (interface{}, error) {
+	if s.ctx.nsqd.IsDraining() {
+		return nil, util.HTTPError{503, "DRAINING"}
+	}
+
 	// TODO: one day I'd really like to just error on chunked requests
 	// to be able to fail "too big" requests before we even read
 
@@ -250,13 +262,42 @@ func (s *httpServer) doPUB(req *http.Request) (interface{}, error) {
 		return nil, util.HTTPError{400, "MSG_EMPTY"}
 	}
 
-	_, topic, err := s.getTopicFromQuery(req)
+	reqParams, topic, err := s.getTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
 
+	var deferred time.Duration
+	if ds, ok := reqParams["defer"]; ok {
+		di, err := strconv.ParseInt(ds[0], 10, 64)
+		if err != nil {
+			return nil, util.HTTPError{400, "INVALID_DEFER"}
+		}
+		deferred = time.Duration(di) * time.Millisecond
+		if deferred < 0 || deferred > s.ctx.nsqd.opts.MaxReqTimeout {
+			return nil, util.HTTPError{400, "INVALID_DEFER"}
+		}
+	}
+
+	ttl, err := messageTTLFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := messageHeadersFromRequest(req)
+	err = validateMessageHeaders(headers)
+	if err != nil {
+		return nil, util.HTTPError{400, "INVALID_HEADER"}
+	}
+
 	msg := NewMessage(<-s.ctx.nsqd.idChan, body)
+	msg.Headers = headers
+	msg.deferred = deferred
+	msg.expireAfter(ttl)
 	err = topic.PutMessage(msg)
+	if err == errBacklogFull {
+		return nil, util.HTTPError{503, "BACKLOG_FULL"}
+	}
 	if err != nil {
 		return nil, util.HTTPError{503, "EXITING"}
 	}
@@ -264,10 +305,43 @@ func (s *httpServer) doPUB(req *http.Request) (interface{}, error) {
 	return "OK", nil
 }
 
+// messageTTLFromQuery parses the optional ttl (in milliseconds) of /pub and /mpub
+func messageTTLFromQuery(reqParams url.Values) (time.Duration, error) {
+	ts, ok := reqParams["ttl"]
+	if !ok {
+		return 0, nil
+	}
+	ti, err := strconv.ParseInt(ts[0], 10, 64)
+	if err != nil || ti < 0 {
+		return 0, util.HTTPError{400, "INVALID_TTL"}
+	}
+	return time.Duration(ti) * time.Millisecond, nil
+}
+
+// messageHeadersFromRequest maps HTTP headers prefixed with X-NSQ-Header-
+// to message headers (with lowercased keys)
+func messageHeadersFromRequest(req *http.Request) map[string]string {
+	var headers map[string]string
+	for k, v := range req.Header {
+		if !strings.HasPrefix(k, httpMessageHeaderPrefix) || len(v) == 0 {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[strings.ToLower(k[len(httpMessageHeaderPrefix):])] = v[0]
+	}
+	return headers
+}
+
 func (s *httpServer) doMPUB(req *http.Request) (interface{}, error) {
 	var msgs []*Message
 	var exit bool
 
+	if s.ctx.nsqd.IsDraining() {
+		return nil, util.HTTPError{503, "DRAINING"}
+	}
+
 	// TODO: one day I'd really like to just error on chunked requests
 	// to be able to fail "too big" requests before we even read
 
@@ -280,11 +354,18 @@ func (s *httpServer) doMPUB(req *http.Request) (interface{}, error) {
 		return nil, err
 	}
 
+	ttl, err := messageTTLFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
 	_, ok := reqParams["binary"]
 	if ok {
 		tmp := make([]byte, 4)
 		msgs, err = readMPUB(req.Body, tmp, s.ctx.nsqd.idChan,
-			s.ctx.nsqd.opts.MaxMsgSize)
+			s.ctx.nsqd.opts.MaxMsgSize, func(id MessageID, body []byte) (*Message, error) {
+				return NewMessage(id, body), nil
+			})
 		if err != nil {
 			return nil, util.HTTPError{413, err.(*util.FatalClientErr).Code[2:]}
 		}
@@ -326,7 +407,14 @@ func (s *httpServer) doMPUB(req *http.Request) (interface{}, error) {
 		}
 	}
 
+	for _, msg := range msgs {
+		msg.expireAfter(ttl)
+	}
+
 	err = topic.PutMessages(msgs)
+	if err == errBacklogFull {
+		return nil, util.HTTPError{503, "BACKLOG_FULL"}
+	}
 	if err != nil {
 		return nil, util.HTTPError{503, "EXITING"}
 	}
@@ -335,8 +423,156 @@ func (s *httpServer) doMPUB(req *http.Request) (interface{}, error) {
 }
 
 func (s *httpServer) doCreateTopic(req *http.Request) (interface{}, error) {
-	_, _, err := s.getTopicFromQuery(req)
-	return nil, err
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf("ERROR: failed to parse request params - %s", err)
+		return nil, util.HTTPError{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, util.HTTPError{400, "MISSING_ARG_TOPIC"}
+	}
+
+	if !util.IsValidTopicName(topicName) {
+		return nil, util.HTTPError{400, "INVALID_TOPIC"}
+	}
+
+	backendType, err := reqParams.Get("backend")
+	if err != nil {
+		backendType = s.ctx.nsqd.opts.BackendQueue
+	}
+	if _, ok := getBackendQueueFactory(backendType); !ok {
+		return nil, util.HTTPError{400, "INVALID_BACKEND"}
+	}
+
+	_, hasRetentionTime := reqParams.Values["retention_time"]
+	_, hasRetentionBytes := reqParams.Values["retention_bytes"]
+	var retentionTime time.Duration
+	var retentionBytes int64
+	if hasRetentionTime {
+		retentionTimeStr, _ := reqParams.Get("retention_time")
+		retentionTime, err = time.ParseDuration(retentionTimeStr)
+		if err != nil || retentionTime < 0 {
+			return nil, util.HTTPError{400, "INVALID_RETENTION_TIME"}
+		}
+	}
+	if hasRetentionBytes {
+		retentionBytesStr, _ := reqParams.Get("retention_bytes")
+		retentionBytes, err = strconv.ParseInt(retentionBytesStr, 10, 64)
+		if err != nil || retentionBytes < 0 {
+			return nil, util.HTTPError{400, "INVALID_RETENTION_BYTES"}
+		}
+	}
+
+	limits, hasLimits, err := backlogLimitsFromParams(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	msgTTL, hasMsgTTL, err := msgTTLFromParams(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := s.ctx.nsqd.GetTopicWithBackend(topicName, backendType)
+	if !topic.ephemeral && topic.backendType != backendType {
+		return nil, util.HTTPError{400, "BACKEND_MISMATCH"}
+	}
+
+	if len(hasLimits) > 0 {
+		// only update what was specified
+		topic.RLock()
+		limits = limits.merge(topic.limits, hasLimits)
+		topic.RUnlock()
+		err = topic.SetBacklogLimits(limits.maxDepth, limits.maxBytes, limits.policy)
+		if err != nil {
+			s.ctx.nsqd.logf("ERROR: failure in %s - %s", req.URL.Path, err)
+			return nil, util.HTTPError{500, "INTERNAL_ERROR"}
+		}
+	}
+
+	if hasMsgTTL {
+		err = topic.SetMsgTTL(msgTTL)
+		if err != nil {
+			s.ctx.nsqd.logf("ERROR: failure in %s - %s", req.URL.Path, err)
+			return nil, util.HTTPError{500, "INTERNAL_ERROR"}
+		}
+	}
+
+	if hasRetentionTime || hasRetentionBytes {
+		if topic.ephemeral {
+			return nil, util.HTTPError{400, "INVALID_RETENTION"}
+		}
+		// only update what was specified
+		currentTime, currentBytes := topic.Retention()
+		if !hasRetentionTime {
+			retentionTime = currentTime
+		}
+		if !hasRetentionBytes {
+			retentionBytes = currentBytes
+		}
+		err = topic.SetRetention(retentionTime, retentionBytes)
+		if err != nil {
+			s.ctx.nsqd.logf("ERROR: failure in %s - %s", req.URL.Path, err)
+			return nil, util.HTTPError{500, "INTERNAL_ERROR"}
+		}
+	}
+
+	return nil, nil
+}
+
+// backlogLimitsFromParams parses the max_depth, max_bytes and overflow_policy
+// params (used by both /topic/create and /channel/create), returning the
+// set of params that were specified
+func backlogLimitsFromParams(reqParams *util.ReqParams) (backlogLimits, map[string]bool, error) {
+	var limits backlogLimits
+	has := make(map[string]bool)
+
+	if _, ok := reqParams.Values["max_depth"]; ok {
+		maxDepthStr, _ := reqParams.Get("max_depth")
+		maxDepth, err := strconv.ParseInt(maxDepthStr, 10, 64)
+		if err != nil || maxDepth < 0 {
+			return limits, nil, util.HTTPError{400, "INVALID_MAX_DEPTH"}
+		}
+		limits.maxDepth = maxDepth
+		has["max_depth"] = true
+	}
+
+	if _, ok := reqParams.Values["max_bytes"]; ok {
+		maxBytesStr, _ := reqParams.Get("max_bytes")
+		maxBytes, err := strconv.ParseInt(maxBytesStr, 10, 64)
+		if err != nil || maxBytes < 0 {
+			return limits, nil, util.HTTPError{400, "INVALID_MAX_BYTES"}
+		}
+		limits.maxBytes = maxBytes
+		has["max_bytes"] = true
+	}
+
+	if _, ok := reqParams.Values["overflow_policy"]; ok {
+		policy, _ := reqParams.Get("overflow_policy")
+		if policy != "" && !isValidOverflowPolicy(policy) {
+			return limits, nil, util.HTTPError{400, "INVALID_OVERFLOW_POLICY"}
+		}
+		limits.policy = policy
+		has["overflow_policy"] = true
+	}
+
+	return limits, has, nil
+}
+
+// msgTTLFromParams parses the msg_ttl param (a duration) of
+// /topic/create and /channel/create
+func msgTTLFromParams(reqParams *util.ReqParams) (time.Duration, bool, error) {
+	if _, ok := reqParams.Values["msg_ttl"]; !ok {
+		return 0, false, nil
+	}
+	msgTTLStr, _ := reqParams.Get("msg_ttl")
+	msgTTL, err := time.ParseDuration(msgTTLStr)
+	if err != nil || msgTTL < 0 {
+		return 0, false, util.HTTPError{400, "INVALID_MSG_TTL"}
+	}
+	return msgTTL, true, nil
 }
 
 func (s *httpServer) doEmptyTopic(req *http.Request) (interface{}, error) {
@@ -419,11 +655,142 @@ func (s *httpServer) doPauseTopic(req *http.Request) (interface{}, error) {
 }
 
 func (s *httpServer) doCreateChannel(req *http.Request) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
-	topic.GetChannel(channelName)
+
+	var maxAttempts uint16
+	_, hasMaxAttempts := reqParams.Values["max_attempts"]
+	if hasMaxAttempts {
+		maxAttemptsStr, _ := reqParams.Get("max_attempts")
+		i, err := strconv.ParseUint(maxAttemptsStr, 10, 16)
+		if err != nil {
+			return nil, util.HTTPError{400, "INVALID_MAX_ATTEMPTS"}
+		}
+		maxAttempts = uint16(i)
+	}
+
+	deadLetterTopic, err := reqParams.Get("dead_letter_topic")
+	hasDeadLetterTopic := err == nil
+	if hasDeadLetterTopic && deadLetterTopic != "" &&
+		!util.IsValidTopicName(deadLetterTopicName(deadLetterTopic, topic.name)) {
+		return nil, util.HTTPError{400, "INVALID_DEAD_LETTER_TOPIC"}
+	}
+
+	var channelFilter *util.JSONFilter
+	filter, err := reqParams.Get("filter")
+	hasFilter := err == nil
+	if hasFilter && filter != "" {
+		channelFilter, err = util.NewJSONFilter(filter)
+		if err != nil {
+			return nil, util.HTTPError{400, "INVALID_FILTER"}
+		}
+	}
+
+	limits, hasLimits, err := backlogLimitsFromParams(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	msgTTL, hasMsgTTL, err := msgTTLFromParams(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	// position the channel in the topic's retained history
+	var replayOffset int64
+	var replayTimestamp int64
+	_, hasReplayOffset := reqParams.Values["replay_offset"]
+	_, hasReplayTimestamp := reqParams.Values["replay_timestamp"]
+	if hasReplayOffset {
+		replayOffsetStr, _ := reqParams.Get("replay_offset")
+		replayOffset, err = strconv.ParseInt(replayOffsetStr, 10, 64)
+		if err != nil || replayOffset < 0 {
+			return nil, util.HTTPError{400, "INVALID_REPLAY_OFFSET"}
+		}
+	} else if hasReplayTimestamp {
+		replayTimestampStr, _ := reqParams.Get("replay_timestamp")
+		replayTimestamp, err = strconv.ParseInt(replayTimestampStr, 10, 64)
+		if err != nil || replayTimestamp < 0 {
+			return nil, util.HTTPError{400, "INVALID_REPLAY_TIMESTAMP"}
+		}
+	}
+	if hasReplayOffset || hasReplayTimestamp {
+		retentionTime, retentionBytes := topic.Retention()
+		if retentionTime == 0 && retentionBytes == 0 {
+			return nil, util.HTTPError{400, "RETENTION_NOT_ENABLED"}
+		}
+	}
+
+	// a new channel is created with its filter, so that it isn't put
+	// any non-matching message before the filter is set below
+	channel := topic.GetChannelWithFilter(channelName, channelFilter)
+
+	if hasFilter {
+		err = channel.SetFilter(filter)
+		if err != nil {
+			s.ctx.nsqd.logf("ERROR: failure in %s - %s", req.URL.Path, err)
+			return nil, util.HTTPError{500, "INTERNAL_ERROR"}
+		}
+	}
+
+	if hasMaxAttempts || hasDeadLetterTopic {
+		if !hasMaxAttempts || !hasDeadLetterTopic {
+			// only update what was specified
+			channel.RLock()
+			if !hasMaxAttempts {
+				maxAttempts = channel.maxAttempts
+			}
+			if !hasDeadLetterTopic {
+				deadLetterTopic = channel.deadLetterTopic
+			}
+			channel.RUnlock()
+		}
+		err = channel.SetDeadLetterPolicy(maxAttempts, deadLetterTopic)
+		if err != nil {
+			s.ctx.nsqd.logf("ERROR: failure in %s - %s", req.URL.Path, err)
+			return nil, util.HTTPError{500, "INTERNAL_ERROR"}
+		}
+	}
+
+	if len(hasLimits) > 0 {
+		// only update what was specified
+		channel.RLock()
+		limits = limits.merge(channel.limits, hasLimits)
+		channel.RUnlock()
+		err = channel.SetBacklogLimits(limits.maxDepth, limits.maxBytes, limits.policy)
+		if err != nil {
+			s.ctx.nsqd.logf("ERROR: failure in %s - %s", req.URL.Path, err)
+			return nil, util.HTTPError{500, "INTERNAL_ERROR"}
+		}
+	}
+
+	if hasMsgTTL {
+		err = channel.SetMsgTTL(msgTTL)
+		if err != nil {
+			s.ctx.nsqd.logf("ERROR: failure in %s - %s", req.URL.Path, err)
+			return nil, util.HTTPError{500, "INTERNAL_ERROR"}
+		}
+	}
+
+	if hasReplayOffset || hasReplayTimestamp {
+		err = nil
+		if !hasReplayOffset {
+			replayOffset, err = topic.OffsetForTimestamp(time.Unix(replayTimestamp, 0))
+		}
+		if err == nil {
+			err = topic.ReplayChannel(channel, replayOffset)
+		}
+		if err == errRetentionDisabled {
+			return nil, util.HTTPError{400, "RETENTION_NOT_ENABLED"}
+		}
+		if err != nil {
+			s.ctx.nsqd.logf("ERROR: failure in %s - %s", req.URL.Path, err)
+			return nil, util.HTTPError{500, "INTERNAL_ERROR"}
+		}
+	}
+
 	return nil, nil
 }
 
@@ -484,6 +851,13 @@ func (s *httpServer) doPauseChannel(req *http.Request) (interface{}, error) {
 	return nil, nil
 }
 
+// doDrain starts draining nsqd (see NSQD.Drain), progress is
+// reported in /stats
+func (s *httpServer) doDrain(req *http.Request) (interface{}, error) {
+	s.ctx.nsqd.Drain()
+	return nil, nil
+}
+
 func (s *httpServer) doStats(req *http.Request) (interface{}, error) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
@@ -494,23 +868,33 @@ func (s *httpServer) doStats(req *http.Request) (interface{}, error) {
 	jsonFormat := formatString == "json"
 	stats := s.ctx.nsqd.GetStats()
 	health := s.ctx.nsqd.GetHealth()
+	drain := s.ctx.nsqd.GetDrainStats()
 
 	if !jsonFormat {
-		return s.printStats(stats, health), nil
+		return s.printStats(stats, health, drain), nil
 	}
 
 	return struct {
-		Version string       `json:"version"`
-		Health  string       `json:"health"`
-		Topics  []TopicStats `json:"topics"`
-	}{util.BINARY_VERSION, health, stats}, nil
+		Version  string       `json:"version"`
+		Health   string       `json:"health"`
+		Draining *DrainStats  `json:"draining,omitempty"`
+		Topics   []TopicStats `json:"topics"`
+	}{util.BINARY_VERSION, health, drain, stats}, nil
 }
 
-func (s *httpServer) printStats(stats []TopicStats, health string) []byte {
+func (s *httpServer) printStats(stats []TopicStats, health string, drain *DrainStats) []byte {
 	var buf bytes.Buffer
 	w := &buf
 	now := time.Now()
 	io.WriteString(w, fmt.Sprintf("%s\n", util.Version("nsqd")))
+	if drain != nil {
+		io.WriteString(w, fmt.Sprintf("\nDraining: since: %s depth: %d inflt: %d def: %d drained: %t\n",
+			time.Unix(drain.StartedAt, 0).Format(time.RFC3339),
+			drain.Depth,
+			drain.InFlightCount,
+			drain.DeferredCount,
+			drain.Drained))
+	}
 	if len(stats) == 0 {
 		io.WriteString(w, "\nNO_TOPICS\n")
 		return buf.Bytes()
@@ -530,6 +914,20 @@ func (s *httpServer) printStats(stats []TopicStats, health string) []byte {
 			t.BackendDepth,
 			t.MessageCount,
 			t.E2eProcessingLatency))
+		if t.MaxDepth > 0 || t.MaxBytes > 0 || t.DroppedCount > 0 {
+			io.WriteString(w, fmt.Sprintf("    backlog: bytes: %d max-depth: %d max-bytes: %d policy: %s dropped: %d\n",
+				t.Bytes,
+				t.MaxDepth,
+				t.MaxBytes,
+				t.OverflowPolicy,
+				t.DroppedCount))
+		}
+		if t.Retention != nil {
+			io.WriteString(w, fmt.Sprintf("    retention: offsets: %d-%d bytes: %d\n",
+				t.Retention.StartOffset,
+				t.Retention.EndOffset,
+				t.Retention.Bytes))
+		}
 		for _, c := range t.Channels {
 			if c.Paused {
 				pausedPrefix = "   *P "
@@ -537,7 +935,7 @@ func (s *httpServer) printStats(stats []TopicStats, health string) []byte {
 				pausedPrefix = "      "
 			}
 			io.WriteString(w,
-				fmt.Sprintf("%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d e2e%%: %s\n",
+				fmt.Sprintf("%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d dlq: %-5d expired: %-5d msgs: %-8d e2e%%: %s\n",
 					pausedPrefix,
 					c.ChannelName,
 					c.Depth,
@@ -546,8 +944,21 @@ func (s *httpServer) printStats(stats []TopicStats, health string) []byte {
 					c.DeferredCount,
 					c.RequeueCount,
 					c.TimeoutCount,
+					c.DeadLetterCount,
+					c.ExpiredCount,
 					c.MessageCount,
 					c.E2eProcessingLatency))
+			if c.MaxDepth > 0 || c.MaxBytes > 0 || c.DroppedCount > 0 {
+				io.WriteString(w, fmt.Sprintf("        backlog: bytes: %d max-depth: %d max-bytes: %d policy: %s dropped: %d\n",
+					c.Bytes,
+					c.MaxDepth,
+					c.MaxBytes,
+					c.OverflowPolicy,
+					c.DroppedCount))
+			}
+			if c.Filter != "" {
+				io.WriteString(w, fmt.Sprintf("        filter: %s\n", c.Filter))
+			}
 			for _, client := range c.Clients {
 				connectTime := time.Unix(client.ConnectTime, 0)
 				// truncate to the second
@@ -7,13 +7,16 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/bitly/go-nsq"
+	"github.com/bitly/nsq/util"
 )
 
 func TestHTTPput(t *testing.T) {
@@ -38,6 +41,71 @@ func TestHTTPput(t *testing.T) {
 	equal(t, topic.Depth(), int64(1))
 }
 
+func TestHTTPpubDefer(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_defer" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	ch1 := topic.GetChannel("ch1")
+	ch2 := topic.GetChannel("ch2")
+
+	buf := bytes.NewBuffer([]byte("test message"))
+	url := fmt.Sprintf("http://%s/pub?topic=%s&defer=%d", httpAddr, topicName, 1000)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	equal(t, err, nil)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	equal(t, string(body), "OK")
+
+	time.Sleep(25 * time.Millisecond)
+
+	for _, c := range []*Channel{ch1, ch2} {
+		c.Lock()
+		numDeferred := len(c.deferredMessages)
+		c.Unlock()
+		equal(t, numDeferred, 1)
+		equal(t, NewChannelStats(c, nil).DeferredCount, 1)
+	}
+
+	buf = bytes.NewBuffer([]byte("test message"))
+	url = fmt.Sprintf("http://%s/pub?topic=%s&defer=%d", httpAddr, topicName,
+		int64((opts.MaxReqTimeout+time.Second)/time.Millisecond))
+	resp, err = http.Post(url, "application/octet-stream", buf)
+	equal(t, err, nil)
+	defer resp.Body.Close()
+	body, _ = ioutil.ReadAll(resp.Body)
+	equal(t, resp.StatusCode, 500)
+	equal(t, string(body), `{"status_code":500,"status_txt":"INVALID_DEFER","data":null}`)
+}
+
+func TestHTTPpubHeaders(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_headers" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer([]byte("test message")))
+	req.Header.Set("X-NSQ-Header-Trace-Id", "abc123")
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	equal(t, err, nil)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	equal(t, string(body), "OK")
+
+	msg := <-channel.clientMsgChan
+	equal(t, msg.Headers, map[string]string{"trace-id": "abc123"})
+	equal(t, msg.Body, []byte("test message"))
+}
+
 func TestHTTPputEmpty(t *testing.T) {
 	opts := NewNSQDOptions()
 	opts.Logger = newTestLogger(t)
@@ -575,6 +643,185 @@ func TestHTTPV1TopicChannel(t *testing.T) {
 	nequal(t, err, nil)
 }
 
+func TestHTTPChannelCreateDeadLetter(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxAttempts = 5
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_create_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&max_attempts=3&dead_letter_topic=dead", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+
+	channel, err := topic.GetExistingChannel("ch")
+	equal(t, err, nil)
+	maxAttempts, deadLetterTopic := channel.deadLetterPolicy()
+	equal(t, maxAttempts, uint16(3))
+	equal(t, deadLetterTopic, "dead")
+
+	// only the specified setting is updated
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&max_attempts=0", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+
+	maxAttempts, deadLetterTopic = channel.deadLetterPolicy()
+	equal(t, maxAttempts, uint16(5))
+	equal(t, deadLetterTopic, "dead")
+
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&max_attempts=-1", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 400)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&dead_letter_topic=bad!", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 400)
+	resp.Body.Close()
+}
+
+func TestHTTPChannelCreateFilter(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_create_filter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&filter=%s",
+		httpAddr, topicName, neturl.QueryEscape("user.type~^(admin|staff)$"))
+	resp, err := http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+
+	channel, err := topic.GetExistingChannel("ch")
+	equal(t, err, nil)
+	equal(t, channel.Filter(), "user.type~^(admin|staff)$")
+
+	stats := nsqd.GetStats()
+	equal(t, stats[0].Channels[0].Filter, "user.type~^(admin|staff)$")
+
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&filter=user", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 400)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&filter=", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+
+	equal(t, channel.Filter(), "")
+}
+
+func TestHTTPChannelCreateFilterBuffered(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_create_filter_buffered" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	defer nsqd.DeleteExistingTopic(topicName)
+
+	// buffered in the topic until it has a channel
+	for i := 0; i < 1000; i++ {
+		topic.PutMessage(NewMessage(<-nsqd.idChan, []byte(`{"type":"view"}`)))
+	}
+
+	url := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&filter=type=click",
+		httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+
+	time.Sleep(25 * time.Millisecond)
+
+	channel, err := topic.GetExistingChannel("ch")
+	equal(t, err, nil)
+	equal(t, channel.Filter(), "type=click")
+	equal(t, atomic.LoadUint64(&channel.messageCount), uint64(0))
+	equal(t, topic.Depth(), int64(0))
+}
+
+func TestHTTPChannelCreateReplay(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_create_replay" + strconv.Itoa(int(time.Now().Unix()))
+
+	url := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&replay_offset=0", httpAddr, topicName)
+	nsqd.GetTopic(topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 400)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/topic/create?topic=%s&retention_time=1h", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+
+	topic := nsqd.GetTopic(topicName)
+	retentionTime, _ := topic.Retention()
+	equal(t, retentionTime, time.Hour)
+	channel := topic.GetChannel("ch")
+
+	for i := 0; i < 10; i++ {
+		topic.PutMessage(NewMessage(<-nsqd.idChan, []byte(strconv.Itoa(i))))
+	}
+	for i := 0; i < 10; i++ {
+		msg := <-channel.clientMsgChan
+		equal(t, msg.Body, []byte(strconv.Itoa(i)))
+	}
+
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=replay&replay_offset=5", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+
+	replay, err := topic.GetExistingChannel("replay")
+	equal(t, err, nil)
+	for i := 5; i < 10; i++ {
+		msg := <-replay.clientMsgChan
+		equal(t, msg.Body, []byte(strconv.Itoa(i)))
+	}
+
+	// re-position the existing channel at the start of history
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=replay&replay_timestamp=0", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+
+	for i := 0; i < 10; i++ {
+		msg := <-replay.clientMsgChan
+		equal(t, msg.Body, []byte(strconv.Itoa(i)))
+	}
+
+	stats := nsqd.GetStats()
+	nequal(t, stats[0].Retention, nil)
+	equal(t, stats[0].Retention.EndOffset, int64(10))
+}
+
 func BenchmarkHTTPput(b *testing.B) {
 	var wg sync.WaitGroup
 	b.StopTimer()
@@ -615,3 +862,79 @@ func BenchmarkHTTPput(b *testing.B) {
 	b.StopTimer()
 	nsqd.Exit()
 }
+
+func TestHTTPMetrics(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_http_metrics" + strconv.Itoa(int(time.Now().UnixNano()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(<-nsqd.idChan, []byte("test")))
+
+	time.Sleep(25 * time.Millisecond)
+
+	url := fmt.Sprintf("http://%s/metrics", httpAddr)
+	resp, err := http.Get(url)
+	equal(t, err, nil)
+	defer resp.Body.Close()
+	equal(t, resp.StatusCode, 200)
+	equal(t, resp.Header.Get("Content-Type"), util.PrometheusContentType)
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	for _, line := range []string{
+		"# TYPE nsqd_topic_depth gauge",
+		fmt.Sprintf(`nsqd_topic_message_count{topic="%s"} 1`, topicName),
+		fmt.Sprintf(`nsqd_channel_depth{topic="%s",channel="ch"} 1`, topicName),
+		"# TYPE nsqd_mem_gc_runs counter",
+	} {
+		equal(t, bytes.Contains(body, []byte(line+"\n")), true)
+	}
+}
+
+func TestHTTPDrain(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_http_drain" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	equal(t, err, nil)
+	resp.Body.Close()
+	equal(t, resp.StatusCode, 200)
+
+	_, err = util.APIRequestNegotiateV1("POST", fmt.Sprintf("http://%s/drain", httpAddr), nil)
+	equal(t, err, nil)
+	equal(t, nsqd.IsDraining(), true)
+
+	_, err = util.APIRequestNegotiateV1("POST", url, bytes.NewBufferString("test message"))
+	equal(t, err.Error(), `got response 503 Service Unavailable "{\"message\":\"DRAINING\"}"`)
+
+	time.Sleep(5 * time.Millisecond)
+
+	data, err := util.APIRequestNegotiateV1("GET", fmt.Sprintf("http://%s/stats?format=json", httpAddr), nil)
+	equal(t, err, nil)
+	equal(t, data.Get("draining").Get("depth").MustInt64(), int64(1))
+	equal(t, data.Get("draining").Get("drained").MustBool(), false)
+
+	select {
+	case <-nsqd.Drained():
+		t.Fatal("drained with messages remaining")
+	case <-time.After(2 * drainCheckInterval):
+	}
+
+	channel.Empty()
+
+	select {
+	case <-nsqd.Drained():
+	case <-time.After(5 * drainCheckInterval):
+		t.Fatal("timed out waiting for drain")
+	}
+}
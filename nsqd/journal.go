@@ -0,0 +1,417 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/bitly/nsq/util"
+)
+
+const (
+	journalOpAdd    = byte('A')
+	journalOpRemove = byte('R')
+
+	// the journal is rewritten once it contains this many
+	// records *and* more than twice as many records as live entries
+	journalCompactThreshold = 1024
+)
+
+type journalEntry struct {
+	msg *Message
+	pri int64
+}
+
+// journal is an append-only log of the messages a channel is holding
+// outside of its queues (in-flight and deferred) along with the time
+// (as a priority) they should next be eligible for delivery
+//
+// records are either an "add" (the full message and its priority) or a
+// "remove" (just the message ID), replaying the file yields the set of
+// outstanding messages
+type journal struct {
+	sync.Mutex
+
+	// instantiation time metadata
+	name        string
+	dataPath    string
+	syncEvery   int64         // number of writes per fsync
+	syncTimeout time.Duration // duration of time per fsync
+
+	file     *os.File
+	writeBuf bytes.Buffer
+	entries  map[MessageID]journalEntry
+	records  int64
+	count    int64
+	exitFlag int32
+
+	exitChan     chan int
+	exitSyncChan chan int
+
+	logger logger
+}
+
+// newJournal instantiates a new instance of journal, replaying any
+// existing journal file from the filesystem and starting the sync goroutine
+func newJournal(name string, dataPath string, syncEvery int64,
+	syncTimeout time.Duration, logger logger) *journal {
+	j := &journal{
+		name:         name,
+		dataPath:     dataPath,
+		syncEvery:    syncEvery,
+		syncTimeout:  syncTimeout,
+		entries:      make(map[MessageID]journalEntry),
+		exitChan:     make(chan int),
+		exitSyncChan: make(chan int),
+		logger:       logger,
+	}
+
+	// no need to lock here, nothing else could possibly be touching this instance
+	err := j.replay()
+	if err != nil && !os.IsNotExist(err) {
+		j.logf("ERROR: journal(%s) failed to replay - %s", j.name, err)
+	}
+
+	// always start from a compacted file, this also
+	// discards any trailing partial record
+	err = j.compact()
+	if err != nil {
+		j.logf("ERROR: journal(%s) failed to compact - %s", j.name, err)
+	}
+
+	go j.syncLoop()
+
+	return j
+}
+
+func (j *journal) logf(f string, args ...interface{}) {
+	if j.logger == nil {
+		return
+	}
+	j.logger.Output(2, fmt.Sprintf(f, args...))
+}
+
+// Entries returns the messages currently recorded in the journal
+func (j *journal) Entries() []journalEntry {
+	j.Lock()
+	defer j.Unlock()
+
+	entries := make([]journalEntry, 0, len(j.entries))
+	for _, e := range j.entries {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Add records a message (replacing any previous record with the same ID)
+// that should next be eligible for delivery at the specified priority
+func (j *journal) Add(msg *Message, pri int64) error {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	j.entries[msg.ID] = journalEntry{msg: msg, pri: pri}
+
+	j.writeBuf.Reset()
+	err := writeJournalAdd(&j.writeBuf, msg, pri)
+	if err != nil {
+		return err
+	}
+	return j.writeOne()
+}
+
+// Remove records that a message is no longer outstanding
+func (j *journal) Remove(id MessageID) error {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	if _, ok := j.entries[id]; !ok {
+		return nil
+	}
+	delete(j.entries, id)
+
+	j.writeBuf.Reset()
+	j.writeBuf.WriteByte(journalOpRemove)
+	j.writeBuf.Write(id[:])
+	err := j.writeOne()
+	if err != nil {
+		return err
+	}
+
+	if j.records > journalCompactThreshold && j.records > int64(2*len(j.entries)) {
+		return j.compact()
+	}
+	return nil
+}
+
+// Empty destructively clears all records from the journal
+func (j *journal) Empty() error {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	j.entries = make(map[MessageID]journalEntry)
+	return j.compact()
+}
+
+// Close compacts and syncs the journal
+func (j *journal) Close() error {
+	err := j.exit()
+	if err != nil {
+		return err
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	err = j.compact()
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	return err
+}
+
+// Delete closes the journal and removes its file
+func (j *journal) Delete() error {
+	err := j.exit()
+	if err != nil {
+		return err
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+
+	err = os.Remove(j.fileName())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (j *journal) exit() error {
+	j.Lock()
+	if j.exitFlag == 1 {
+		j.Unlock()
+		return errors.New("exiting")
+	}
+	j.exitFlag = 1
+	j.Unlock()
+
+	close(j.exitChan)
+	<-j.exitSyncChan
+
+	return nil
+}
+
+// writeOne writes the contents of writeBuf to the journal file
+// and fsyncs every syncEvery writes
+func (j *journal) writeOne() error {
+	if j.file == nil {
+		return errors.New("journal file not open")
+	}
+
+	_, err := j.file.Write(j.writeBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	j.records++
+
+	j.count++
+	if j.count >= j.syncEvery {
+		return j.sync()
+	}
+	return nil
+}
+
+func (j *journal) sync() error {
+	j.count = 0
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Sync()
+}
+
+// compact atomically rewrites the journal file so that it only
+// contains records for the current set of entries
+func (j *journal) compact() error {
+	var buf bytes.Buffer
+
+	fileName := j.fileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, e := range j.entries {
+		buf.Reset()
+		err = writeJournalAdd(&buf, e.msg, e.pri)
+		if err == nil {
+			_, err = w.Write(buf.Bytes())
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmpFileName)
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+
+	err = util.AtomicRename(tmpFileName, fileName)
+	if err != nil {
+		return err
+	}
+
+	j.file, err = os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.records = int64(len(j.entries))
+	j.count = 0
+
+	return nil
+}
+
+// replay reads the journal file (if any) and rebuilds the set of entries
+func (j *journal) replay() error {
+	f, err := os.OpenFile(j.fileName(), os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var header [12]byte
+	var id MessageID
+	r := bufio.NewReader(f)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case journalOpAdd:
+			_, err = io.ReadFull(r, header[:])
+			if err != nil {
+				return j.truncated(err)
+			}
+			pri := int64(binary.BigEndian.Uint64(header[:8]))
+			size := binary.BigEndian.Uint32(header[8:12])
+			data := make([]byte, size)
+			_, err = io.ReadFull(r, data)
+			if err != nil {
+				return j.truncated(err)
+			}
+			msg, err := decodeMessage(data)
+			if err != nil {
+				return err
+			}
+			j.entries[msg.ID] = journalEntry{msg: msg, pri: pri}
+		case journalOpRemove:
+			_, err = io.ReadFull(r, id[:])
+			if err != nil {
+				return j.truncated(err)
+			}
+			delete(j.entries, id)
+		default:
+			return fmt.Errorf("invalid record type %q", op)
+		}
+	}
+}
+
+func (j *journal) truncated(err error) error {
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// the last record was only partially written, this is expected
+		// when we did not exit cleanly so just drop it
+		j.logf("WARNING: journal(%s) discarding partial trailing record", j.name)
+		return nil
+	}
+	return err
+}
+
+func (j *journal) fileName() string {
+	return fmt.Sprintf(path.Join(j.dataPath, "%s.journal.dat"), j.name)
+}
+
+// syncLoop periodically fsyncs the journal file
+func (j *journal) syncLoop() {
+	syncTicker := time.NewTicker(j.syncTimeout)
+	for {
+		select {
+		case <-syncTicker.C:
+			j.Lock()
+			if j.count > 0 {
+				err := j.sync()
+				if err != nil {
+					j.logf("ERROR: journal(%s) failed to sync - %s", j.name, err)
+				}
+			}
+			j.Unlock()
+		case <-j.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	syncTicker.Stop()
+	j.exitSyncChan <- 1
+}
+
+func writeJournalAdd(buf *bytes.Buffer, msg *Message, pri int64) error {
+	var header [13]byte
+
+	// the message size is filled in once the message has been written
+	offset := buf.Len()
+	header[0] = journalOpAdd
+	binary.BigEndian.PutUint64(header[1:9], uint64(pri))
+	buf.Write(header[:])
+
+	n, err := msg.writeToBackend(buf)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(buf.Bytes()[offset+9:offset+13], uint32(n))
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJournalReplay(t *testing.T) {
+	l := newTestLogger(t)
+	jName := "test_journal_replay" + strconv.Itoa(int(time.Now().Unix()))
+	j := newJournal(jName, os.TempDir(), 2500, 2*time.Second, l)
+	defer j.Delete()
+
+	var msgs []*Message
+	for i := 0; i < 10; i++ {
+		var id MessageID
+		id[0] = byte(i)
+		msg := NewMessage(id, []byte("test"))
+		msg.Attempts = uint16(i)
+		msgs = append(msgs, msg)
+		err := j.Add(msg, int64(i))
+		equal(t, err, nil)
+	}
+	for i := 0; i < 5; i++ {
+		err := j.Remove(msgs[i].ID)
+		equal(t, err, nil)
+	}
+	// re-adding replaces the previous record
+	err := j.Add(msgs[9], 100)
+	equal(t, err, nil)
+
+	// simulate a crash by reading the file from under the open journal
+	j2 := newJournal(jName, os.TempDir(), 2500, 2*time.Second, l)
+	entries := j2.Entries()
+	j2.Close()
+	equal(t, len(entries), 5)
+	for _, e := range entries {
+		i := int(e.msg.ID[0])
+		assert(t, i >= 5, "removed message %d was replayed", i)
+		equal(t, e.msg.Body, []byte("test"))
+		equal(t, e.msg.Attempts, uint16(i))
+		if i == 9 {
+			equal(t, e.pri, int64(100))
+		} else {
+			equal(t, e.pri, int64(i))
+		}
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	l := newTestLogger(t)
+	jName := "test_journal_compact" + strconv.Itoa(int(time.Now().Unix()))
+	j := newJournal(jName, os.TempDir(), 2500, 2*time.Second, l)
+	defer j.Delete()
+
+	for i := 0; i < journalCompactThreshold; i++ {
+		var id MessageID
+		id[0] = byte(i)
+		id[1] = byte(i >> 8)
+		msg := NewMessage(id, []byte("test"))
+		j.Add(msg, 0)
+		j.Remove(msg.ID)
+	}
+	assert(t, j.records < journalCompactThreshold, "journal was not compacted (%d records)", j.records)
+
+	j2 := newJournal(jName, os.TempDir(), 2500, 2*time.Second, l)
+	equal(t, len(j2.Entries()), 0)
+	equal(t, j2.records, int64(0))
+	j2.Close()
+}
@@ -23,13 +23,24 @@ func (n *NSQD) lookupLoop() {
 
 	for _, host := range n.opts.NSQLookupdTCPAddresses {
 		n.logf("LOOKUP: adding peer %s", host)
-		lookupPeer := newLookupPeer(host, n.opts.Logger, func(lp *lookupPeer) {
+		tlsConfig, err := buildLookupdTLSConfig(n.opts, host)
+		if err != nil {
+			n.logf("ERROR: failed to build TLS config for peer %s - %s", host, err)
+			continue
+		}
+		lookupPeer := newLookupPeer(host, tlsConfig, n.opts.Logger, func(lp *lookupPeer) {
 			ci := make(map[string]interface{})
 			ci["version"] = util.BINARY_VERSION
 			ci["tcp_port"] = n.tcpAddr.Port
 			ci["http_port"] = n.httpAddr.Port
 			ci["hostname"] = hostname
 			ci["broadcast_address"] = n.opts.BroadcastAddress
+			if len(n.labels) > 0 {
+				ci["labels"] = n.labels
+			}
+			if n.opts.NSQLookupdAuthSecret != "" {
+				ci["auth_secret"] = n.opts.NSQLookupdAuthSecret
+			}
 
 			cmd, err := nsq.Identify(ci)
 			if err != nil {
@@ -39,7 +50,7 @@ func (n *NSQD) lookupLoop() {
 			resp, err := lp.Command(cmd)
 			if err != nil {
 				n.logf("LOOKUPD(%s): ERROR %s - %s", lp, cmd, err)
-			} else if bytes.Equal(resp, []byte("E_INVALID")) {
+			} else if bytes.HasPrefix(resp, []byte("E_")) {
 				n.logf("LOOKUPD(%s): lookupd returned %s", lp, resp)
 			} else {
 				err = json.Unmarshal(resp, &lp.Info)
@@ -81,7 +92,7 @@ func (n *NSQD) lookupLoop() {
 				// notify all nsqlookupds that a new channel exists, or that it's removed
 				branch = "channel"
 				channel := val.(*Channel)
-				if channel.Exiting() == true {
+				if channel.Exiting() == true || n.IsDraining() {
 					cmd = nsq.UnRegister(channel.topicName, channel.name)
 				} else {
 					cmd = nsq.Register(channel.topicName, channel.name)
@@ -90,7 +101,7 @@ func (n *NSQD) lookupLoop() {
 				// notify all nsqlookupds that a new topic exists, or that it's removed
 				branch = "topic"
 				topic := val.(*Topic)
-				if topic.Exiting() == true {
+				if topic.Exiting() == true || n.IsDraining() {
 					cmd = nsq.UnRegister(topic.name, "")
 				} else {
 					cmd = nsq.Register(topic.name, "")
@@ -107,8 +118,12 @@ func (n *NSQD) lookupLoop() {
 		case lookupPeer := <-syncTopicChan:
 			commands := make([]*nsq.Command, 0)
 			// build all the commands first so we exit the lock(s) as fast as possible
+			// (nothing is registered with a lookupd we reconnect to while draining)
 			n.RLock()
 			for _, topic := range n.topicMap {
+				if n.IsDraining() {
+					break
+				}
 				topic.RLock()
 				if len(topic.channelMap) == 0 {
 					commands = append(commands, nsq.Register(topic.name, ""))
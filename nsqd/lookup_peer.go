@@ -1,6 +1,7 @@
 package nsqd
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"time"
@@ -16,6 +17,7 @@ import (
 type lookupPeer struct {
 	l               logger
 	addr            string
+	tlsConfig       *tls.Config
 	conn            net.Conn
 	state           int32
 	connectCallback func(*lookupPeer)
@@ -30,13 +32,15 @@ type peerInfo struct {
 	BroadcastAddress string `json:"broadcast_address"`
 }
 
-// newLookupPeer creates a new lookupPeer instance connecting to the supplied address.
+// newLookupPeer creates a new lookupPeer instance connecting to the supplied address
+// (with TLS, when tlsConfig is not nil).
 //
 // The supplied connectCallback will be called *every* time the instance connects.
-func newLookupPeer(addr string, l logger, connectCallback func(*lookupPeer)) *lookupPeer {
+func newLookupPeer(addr string, tlsConfig *tls.Config, l logger, connectCallback func(*lookupPeer)) *lookupPeer {
 	return &lookupPeer{
 		l:               l,
 		addr:            addr,
+		tlsConfig:       tlsConfig,
 		state:           stateDisconnected,
 		connectCallback: connectCallback,
 	}
@@ -49,6 +53,17 @@ func (lp *lookupPeer) Connect() error {
 	if err != nil {
 		return err
 	}
+	if lp.tlsConfig != nil {
+		tlsConn := tls.Client(conn, lp.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(time.Second))
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
 	lp.conn = conn
 	return nil
 }
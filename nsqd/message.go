@@ -7,11 +7,32 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"sort"
 	"time"
 )
 
 const MsgIDLength = 16
 
+// messages are written to the backend as
+//
+//	[msgFormatMagic][1-byte version][1-byte flags][wire format message]
+//
+// where the flags indicate that an 8-byte expiration, an 8-byte deferral
+// deadline and/or a headers block follow the ID (in that order), messages
+// written before the format was versioned start with their timestamp, the
+// first byte of which is never msgFormatMagic
+const (
+	msgFormatMagic = byte(0xff)
+	msgFormatV1    = byte(1)
+)
+
+const (
+	msgHeadersFlag  = byte(1 << 0)
+	msgExpiresFlag  = byte(1 << 1)
+	msgDeferredFlag = byte(1 << 2)
+)
+
 type MessageID [MsgIDLength]byte
 
 type Message struct {
@@ -19,8 +40,13 @@ type Message struct {
 	Body      []byte
 	Timestamp int64
 	Attempts  uint16
+	Headers   map[string]string
+	Expires   int64 // in nanoseconds, zero if the message never expires
 	Delegate  MessageDelegate
 
+	// for deferred publishing
+	deferred time.Duration
+
 	// for in-flight handling
 	deliveryTS time.Time
 	clientID   int64
@@ -37,10 +63,48 @@ func NewMessage(id MessageID, body []byte) *Message {
 	}
 }
 
+// WriteTo writes the message in the original wire format, without headers
 func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	return m.writeTo(w, false, false)
+}
+
+// WriteToWithHeaders writes the message in the wire format used for clients
+// that negotiated headers, the headers block always follows the ID
+func (m *Message) WriteToWithHeaders(w io.Writer) (int64, error) {
+	return m.writeTo(w, true, false)
+}
+
+// writeToBackend writes the message in the versioned format understood by
+// decodeMessage, which only includes an expiration, deferral and headers
+// block when set
+func (m *Message) writeToBackend(w io.Writer) (int64, error) {
+	return m.writeTo(w, len(m.Headers) > 0, true)
+}
+
+func (m *Message) writeTo(w io.Writer, withHeaders bool, backend bool) (int64, error) {
 	var buf [10]byte
 	var total int64
 
+	withExpires := backend && m.Expires != 0
+	withDeferred := backend && m.deferred > 0
+	if backend {
+		var flags byte
+		if withHeaders {
+			flags |= msgHeadersFlag
+		}
+		if withExpires {
+			flags |= msgExpiresFlag
+		}
+		if withDeferred {
+			flags |= msgDeferredFlag
+		}
+		n, err := w.Write([]byte{msgFormatMagic, msgFormatV1, flags})
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
 	binary.BigEndian.PutUint64(buf[:8], uint64(m.Timestamp))
 	binary.BigEndian.PutUint16(buf[8:10], uint16(m.Attempts))
 
@@ -56,6 +120,36 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 		return total, err
 	}
 
+	if withExpires {
+		var expiresBuf [8]byte
+		binary.BigEndian.PutUint64(expiresBuf[:], uint64(m.Expires))
+		n, err = w.Write(expiresBuf[:])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if withDeferred {
+		// the deferral is persisted as a deadline, so that the time
+		// spent in the backend counts towards it
+		var deferredBuf [8]byte
+		binary.BigEndian.PutUint64(deferredBuf[:], uint64(m.Timestamp+int64(m.deferred)))
+		n, err = w.Write(deferredBuf[:])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if withHeaders {
+		n, err = w.Write(encodeMessageHeaders(m.Headers))
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
 	n, err = w.Write(m.Body)
 	total += int64(n)
 	if err != nil {
@@ -65,9 +159,23 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 	return total, nil
 }
 
+// decodeMessage decodes a message written by writeToBackend, or in the
+// wire format (which messages were persisted in before it was versioned)
 func decodeMessage(b []byte) (*Message, error) {
 	var msg Message
 
+	var flags byte
+	if len(b) > 0 && b[0] == msgFormatMagic {
+		if len(b) < 3 {
+			return nil, errors.New(fmt.Sprintf("invalid message buffer size (%d)", len(b)))
+		}
+		if b[1] != msgFormatV1 {
+			return nil, fmt.Errorf("unsupported message format version (%d)", b[1])
+		}
+		flags = b[2]
+		b = b[3:]
+	}
+
 	if len(b) < 26 {
 		return nil, errors.New(fmt.Sprintf("invalid message buffer size (%d)", len(b)))
 	}
@@ -82,6 +190,34 @@ func decodeMessage(b []byte) (*Message, error) {
 		return nil, err
 	}
 
+	if flags&msgExpiresFlag != 0 {
+		var expiresBuf [8]byte
+		_, err = io.ReadFull(buf, expiresBuf[:])
+		if err != nil {
+			return nil, err
+		}
+		msg.Expires = int64(binary.BigEndian.Uint64(expiresBuf[:]))
+	}
+
+	if flags&msgDeferredFlag != 0 {
+		var deferredBuf [8]byte
+		_, err = io.ReadFull(buf, deferredBuf[:])
+		if err != nil {
+			return nil, err
+		}
+		deadline := int64(binary.BigEndian.Uint64(deferredBuf[:]))
+		if remaining := deadline - time.Now().UnixNano(); remaining > 0 {
+			msg.deferred = time.Duration(remaining)
+		}
+	}
+
+	if flags&msgHeadersFlag != 0 {
+		msg.Headers, err = readMessageHeaders(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	msg.Body, err = ioutil.ReadAll(buf)
 	if err != nil {
 		return nil, err
@@ -90,9 +226,119 @@ func decodeMessage(b []byte) (*Message, error) {
 	return &msg, nil
 }
 
+// expireAfter limits the lifetime of the message to ttl from when it
+// was published, an earlier expiration is kept
+func (m *Message) expireAfter(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	expires := m.Timestamp + int64(ttl)
+	if m.Expires == 0 || expires < m.Expires {
+		m.Expires = expires
+	}
+}
+
+// isExpired returns whether or not the message has expired as of now
+// (in nanoseconds) or is older than ttl (when non-zero)
+func (m *Message) isExpired(now int64, ttl time.Duration) bool {
+	if m.Expires != 0 && now >= m.Expires {
+		return true
+	}
+	return ttl > 0 && now >= m.Timestamp+int64(ttl)
+}
+
+// newMessageWithHeaders creates a message from a published body
+// that is prefixed with a headers block
+func newMessageWithHeaders(id MessageID, b []byte) (*Message, error) {
+	buf := bytes.NewBuffer(b)
+	headers, err := readMessageHeaders(buf)
+	if err != nil {
+		return nil, err
+	}
+	msg := NewMessage(id, buf.Bytes())
+	msg.Headers = headers
+	return msg, nil
+}
+
+// encodeMessageHeaders returns the headers block for the specified headers:
+//
+//	[2-byte count]([2-byte key size][key][2-byte value size][value])...
+//
+// keys are written in sorted order
+func encodeMessageHeaders(headers map[string]string) []byte {
+	keys := make([]string, 0, len(headers))
+	size := 2
+	for k, v := range headers {
+		keys = append(keys, k)
+		size += 4 + len(k) + len(v)
+	}
+	sort.Strings(keys)
+
+	b := make([]byte, 2, size)
+	binary.BigEndian.PutUint16(b, uint16(len(keys)))
+	var lenBuf [2]byte
+	for _, k := range keys {
+		binary.BigEndian.PutUint16(lenBuf[:], uint16(len(k)))
+		b = append(b, lenBuf[:]...)
+		b = append(b, k...)
+		binary.BigEndian.PutUint16(lenBuf[:], uint16(len(headers[k])))
+		b = append(b, lenBuf[:]...)
+		b = append(b, headers[k]...)
+	}
+	return b
+}
+
+// readMessageHeaders reads a headers block (see encodeMessageHeaders)
+func readMessageHeaders(r io.Reader) (map[string]string, error) {
+	var lenBuf [2]byte
+
+	_, err := io.ReadFull(r, lenBuf[:])
+	if err != nil {
+		return nil, errors.New("invalid headers block")
+	}
+	count := int(binary.BigEndian.Uint16(lenBuf[:]))
+	if count == 0 {
+		return nil, nil
+	}
+
+	headers := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		var kv [2][]byte
+		for j := range kv {
+			_, err = io.ReadFull(r, lenBuf[:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid header(%d)", i)
+			}
+			kv[j] = make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+			_, err = io.ReadFull(r, kv[j])
+			if err != nil {
+				return nil, fmt.Errorf("invalid header(%d)", i)
+			}
+		}
+		if len(kv[0]) == 0 {
+			return nil, fmt.Errorf("invalid header(%d) empty key", i)
+		}
+		headers[string(kv[0])] = string(kv[1])
+	}
+	return headers, nil
+}
+
+// validateMessageHeaders ensures the headers can be represented in a headers block
+func validateMessageHeaders(headers map[string]string) error {
+	if len(headers) > math.MaxUint16 {
+		return fmt.Errorf("too many headers %d > %d", len(headers), math.MaxUint16)
+	}
+	for k, v := range headers {
+		if len(k) == 0 || len(k) > math.MaxUint16 || len(v) > math.MaxUint16 {
+			return fmt.Errorf("invalid header %q", k)
+		}
+	}
+	return nil
+}
+
 func writeMessageToBackend(buf *bytes.Buffer, msg *Message, bq BackendQueue) error {
 	buf.Reset()
-	_, err := msg.WriteTo(buf)
+	_, err := msg.writeToBackend(buf)
 	if err != nil {
 		return err
 	}
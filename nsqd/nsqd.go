@@ -32,6 +32,7 @@ const (
 type NSQD struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	clientIDSequence int64
+	drainStartedAt   int64
 
 	sync.RWMutex
 
@@ -41,9 +42,13 @@ type NSQD struct {
 	healthy   int32
 	err       error
 
+	draining    int32
+	drainedChan chan int
+
 	topicMap map[string]*Topic
 
 	lookupPeers []*lookupPeer
+	labels      map[string]string
 
 	tcpAddr       *net.TCPAddr
 	httpAddr      *net.TCPAddr
@@ -57,6 +62,10 @@ type NSQD struct {
 	notifyChan chan interface{}
 	exitChan   chan int
 	waitGroup  util.WaitGroupWrapper
+
+	deadLetterChan         chan *deadLetter
+	deadLetterExitChan     chan int
+	deadLetterExitSyncChan chan int
 }
 
 func NewNSQD(opts *nsqdOptions) *NSQD {
@@ -67,6 +76,12 @@ func NewNSQD(opts *nsqdOptions) *NSQD {
 		idChan:     make(chan MessageID, 4096),
 		exitChan:   make(chan int),
 		notifyChan: make(chan interface{}),
+
+		drainedChan: make(chan int),
+
+		deadLetterChan:         make(chan *deadLetter),
+		deadLetterExitChan:     make(chan int),
+		deadLetterExitSyncChan: make(chan int),
 	}
 
 	if opts.MaxDeflateLevel < 1 || opts.MaxDeflateLevel > 9 {
@@ -79,6 +94,30 @@ func NewNSQD(opts *nsqdOptions) *NSQD {
 		os.Exit(1)
 	}
 
+	if _, ok := getBackendQueueFactory(opts.BackendQueue); !ok {
+		n.logf("FATAL: --backend-queue (%s) must be one of %s",
+			opts.BackendQueue, strings.Join(BackendQueues(), ", "))
+		os.Exit(1)
+	}
+
+	if !isValidOverflowPolicy(opts.OverflowPolicy) {
+		n.logf("FATAL: --overflow-policy (%s) must be one of %s, %s or %s",
+			opts.OverflowPolicy, OverflowReject, OverflowDropOldest, OverflowDropNewest)
+		os.Exit(1)
+	}
+
+	labels, err := util.ParseLabels(opts.Labels)
+	if err != nil {
+		n.logf("FATAL: --label %s", err)
+		os.Exit(1)
+	}
+	n.labels = labels
+
+	if !util.IsValidTopicName(deadLetterTopicName(opts.DeadLetterTopic, "test")) {
+		n.logf("FATAL: --dead-letter-topic (%s) is not a valid topic name", opts.DeadLetterTopic)
+		os.Exit(1)
+	}
+
 	tcpAddr, err := net.ResolveTCPAddr("tcp", opts.TCPAddress)
 	if err != nil {
 		n.logf("FATAL: failed to resolve TCP address (%s) - %s", opts.TCPAddress, err)
@@ -127,7 +166,14 @@ func NewNSQD(opts *nsqdOptions) *NSQD {
 	}
 	n.tlsConfig = tlsConfig
 
+	_, err = buildLookupdTLSConfig(opts, "")
+	if err != nil {
+		n.logf("FATAL: failed to build lookupd TLS config - %s", err)
+		os.Exit(1)
+	}
+
 	n.waitGroup.Wrap(func() { n.idPump() })
+	go n.deadLetterLoop()
 
 	n.logf(util.Version("nsqd"))
 	n.logf("ID: %d", n.opts.ID)
@@ -259,7 +305,42 @@ func (n *NSQD) LoadMetadata() {
 			n.logf("WARNING: skipping creation of invalid topic %s", topicName)
 			continue
 		}
-		topic := n.GetTopic(topicName)
+		// topics persisted before backends were configurable are on disk
+		backendType, err := topicJs.Get("backend").String()
+		if err != nil {
+			backendType = "disk"
+		}
+		if _, ok := getBackendQueueFactory(backendType); !ok {
+			n.logf("ERROR: skipping creation of topic %s with unknown backend queue %s",
+				topicName, backendType)
+			continue
+		}
+		topic := n.GetTopicWithBackend(topicName, backendType)
+
+		retentionTime, _ := topicJs.Get("retention_time").Int64()
+		retentionBytes, _ := topicJs.Get("retention_bytes").Int64()
+		if retentionTime > 0 || retentionBytes > 0 {
+			err = topic.setRetention(time.Duration(retentionTime), retentionBytes)
+			if err != nil {
+				n.logf("ERROR: failed to enable retention for topic(%s) - %s", topicName, err)
+			}
+		}
+
+		maxDepth, _ := topicJs.Get("max_depth").Int64()
+		maxBytes, _ := topicJs.Get("max_bytes").Int64()
+		overflowPolicy, _ := topicJs.Get("overflow_policy").String()
+		if overflowPolicy != "" && !isValidOverflowPolicy(overflowPolicy) {
+			n.logf("ERROR: ignoring invalid overflow policy (%s) for topic(%s)", overflowPolicy, topicName)
+			overflowPolicy = ""
+		}
+		topic.setBacklogLimits(maxDepth, maxBytes, overflowPolicy)
+		backlogBytes, _ := topicJs.Get("backlog_bytes").Int64()
+		topic.backlog.restore(backlogBytes)
+
+		msgTTL, _ := topicJs.Get("msg_ttl").Int64()
+		if msgTTL > 0 {
+			topic.setMsgTTL(time.Duration(msgTTL))
+		}
 
 		paused, _ := topicJs.Get("paused").Bool()
 		if paused {
@@ -286,6 +367,32 @@ func (n *NSQD) LoadMetadata() {
 			}
 			channel := topic.GetChannel(channelName)
 
+			maxAttempts, _ := channelJs.Get("max_attempts").Int()
+			deadLetterTopic, _ := channelJs.Get("dead_letter_topic").String()
+			channel.setDeadLetterPolicy(uint16(maxAttempts), deadLetterTopic)
+
+			filter, _ := channelJs.Get("filter").String()
+			err = channel.setFilter(filter)
+			if err != nil {
+				n.logf("ERROR: failed to set filter (%s) for channel(%s) - %s",
+					filter, channelName, err)
+			}
+
+			maxDepth, _ := channelJs.Get("max_depth").Int64()
+			maxBytes, _ := channelJs.Get("max_bytes").Int64()
+			overflowPolicy, _ := channelJs.Get("overflow_policy").String()
+			if overflowPolicy != "" && !isValidOverflowPolicy(overflowPolicy) {
+				n.logf("ERROR: ignoring invalid overflow policy (%s) for channel(%s)",
+					overflowPolicy, channelName)
+				overflowPolicy = ""
+			}
+			channel.setBacklogLimits(maxDepth, maxBytes, overflowPolicy)
+			backlogBytes, _ := channelJs.Get("backlog_bytes").Int64()
+			channel.backlog.restore(backlogBytes)
+
+			msgTTL, _ := channelJs.Get("msg_ttl").Int64()
+			channel.setMsgTTL(time.Duration(msgTTL))
+
 			paused, _ = channelJs.Get("paused").Bool()
 			if paused {
 				channel.Pause()
@@ -306,14 +413,37 @@ func (n *NSQD) PersistMetadata() error {
 		topicData := make(map[string]interface{})
 		topicData["name"] = topic.name
 		topicData["paused"] = topic.IsPaused()
+		topicData["backend"] = topic.backendType
+		retentionTime, retentionBytes := topic.Retention()
+		if retentionTime > 0 || retentionBytes > 0 {
+			topicData["retention_time"] = int64(retentionTime)
+			topicData["retention_bytes"] = retentionBytes
+		}
 		channels := make([]interface{}, 0)
 		topic.Lock()
+		addBacklogMetadata(topicData, topic.limits, &topic.backlog)
+		if topic.msgTTL > 0 {
+			topicData["msg_ttl"] = int64(topic.msgTTL)
+		}
 		for _, channel := range topic.channelMap {
 			channel.Lock()
 			if !channel.ephemeral {
 				channelData := make(map[string]interface{})
 				channelData["name"] = channel.name
 				channelData["paused"] = channel.IsPaused()
+				if channel.maxAttempts > 0 {
+					channelData["max_attempts"] = channel.maxAttempts
+				}
+				if channel.deadLetterTopic != "" {
+					channelData["dead_letter_topic"] = channel.deadLetterTopic
+				}
+				if channel.filter != nil {
+					channelData["filter"] = channel.filter.String()
+				}
+				addBacklogMetadata(channelData, channel.limits, &channel.backlog)
+				if msgTTL := channel.MsgTTL(); msgTTL > 0 {
+					channelData["msg_ttl"] = int64(msgTTL)
+				}
 				channels = append(channels, channelData)
 			}
 			channel.Unlock()
@@ -344,7 +474,7 @@ func (n *NSQD) PersistMetadata() error {
 	f.Sync()
 	f.Close()
 
-	err = atomic_rename(tmpFileName, fileName)
+	err = util.AtomicRename(tmpFileName, fileName)
 	if err != nil {
 		return err
 	}
@@ -365,6 +495,11 @@ func (n *NSQD) Exit() {
 		n.httpsListener.Close()
 	}
 
+	// stop dead-lettering before closing topics, channels fall back
+	// to requeueing messages they are unable to hand off
+	close(n.deadLetterExitChan)
+	<-n.deadLetterExitSyncChan
+
 	n.Lock()
 	err := n.PersistMetadata()
 	if err != nil {
@@ -385,6 +520,13 @@ func (n *NSQD) Exit() {
 // GetTopic performs a thread safe operation
 // to return a pointer to a Topic object (potentially new)
 func (n *NSQD) GetTopic(topicName string) *Topic {
+	return n.GetTopicWithBackend(topicName, n.opts.BackendQueue)
+}
+
+// GetTopicWithBackend performs a thread safe operation
+// to return a pointer to a Topic object (potentially new), which
+// uses the specified BackendQueue implementation if it is created
+func (n *NSQD) GetTopicWithBackend(topicName string, backendType string) *Topic {
 	n.Lock()
 	t, ok := n.topicMap[topicName]
 	if ok {
@@ -394,7 +536,7 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 		deleteCallback := func(t *Topic) {
 			n.DeleteExistingTopic(t.name)
 		}
-		t = NewTopic(topicName, &context{n}, deleteCallback)
+		t = NewTopic(topicName, backendType, &context{n}, deleteCallback)
 		n.topicMap[topicName] = t
 
 		n.logf("TOPIC(%s): created", t.name)
@@ -408,7 +550,7 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 		if len(n.lookupPeers) > 0 {
 			channelNames, _ := lookupd.GetLookupdTopicChannels(t.name, n.lookupHttpAddrs())
 			for _, channelName := range channelNames {
-				t.getOrCreateChannel(channelName)
+				t.getOrCreateChannel(channelName, nil)
 			}
 		}
 		t.Unlock()
@@ -554,6 +696,44 @@ func buildTLSConfig(opts *nsqdOptions) (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// buildLookupdTLSConfig returns the config to connect to the nsqlookupd
+// at addr with (or nil when connecting without TLS)
+func buildLookupdTLSConfig(opts *nsqdOptions, addr string) (*tls.Config, error) {
+	if !opts.NSQLookupdTLS {
+		return nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	tlsConfig := &tls.Config{
+		ServerName: host,
+	}
+
+	if opts.NSQLookupdTLSCert != "" || opts.NSQLookupdTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.NSQLookupdTLSCert, opts.NSQLookupdTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.NSQLookupdTLSRootCAFile != "" {
+		tlsCertPool := x509.NewCertPool()
+		caCertFile, err := ioutil.ReadFile(opts.NSQLookupdTLSRootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
+			return nil, errors.New("failed to append certificate to pool")
+		}
+		tlsConfig.RootCAs = tlsCertPool
+	}
+
+	return tlsConfig, nil
+}
+
 func (n *NSQD) IsAuthEnabled() bool {
 	return len(n.opts.AuthHTTPAddresses) != 0
 }
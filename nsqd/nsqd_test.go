@@ -1,7 +1,9 @@
 package nsqd
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"path"
 	"path/filepath"
@@ -255,3 +257,45 @@ func TestPauseMetadata(t *testing.T) {
 	b, _ = metadataForChannel(nsqd, 0, 0).Get("paused").Bool()
 	equal(t, b, false)
 }
+
+func TestLookupPeerTLS(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("./test/certs/server.pem", "./test/certs/server.key")
+	equal(t, err, nil)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	equal(t, err, nil)
+	defer listener.Close()
+
+	magicChan := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4)
+		io.ReadFull(conn, buf)
+		magicChan <- buf
+	}()
+
+	connected := make(chan bool, 1)
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	lp := newLookupPeer(listener.Addr().String(), tlsConfig, newTestLogger(t), func(lp *lookupPeer) {
+		connected <- true
+	})
+	_, err = lp.Command(nil)
+	equal(t, err, nil)
+	defer lp.Close()
+	equal(t, <-connected, true)
+
+	_, ok := lp.conn.(*tls.Conn)
+	equal(t, ok, true)
+
+	select {
+	case magic := <-magicChan:
+		equal(t, magic, []byte("  V1"))
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for protocol magic")
+	}
+}
@@ -18,7 +18,9 @@ type nsqdOptions struct {
 	HTTPSAddress           string   `flag:"https-address"`
 	BroadcastAddress       string   `flag:"broadcast-address"`
 	NSQLookupdTCPAddresses []string `flag:"lookupd-tcp-address" cfg:"nsqlookupd_tcp_addresses"`
+	NSQLookupdAuthSecret   string   `flag:"lookupd-auth-secret" cfg:"nsqlookupd_auth_secret"`
 	AuthHTTPAddresses      []string `flag:"auth-http-address" cfg:"auth_http_addresses"`
+	Labels                 []string `flag:"label" cfg:"labels"`
 
 	// diskqueue options
 	DataPath        string        `flag:"data-path"`
@@ -26,6 +28,15 @@ type nsqdOptions struct {
 	MaxBytesPerFile int64         `flag:"max-bytes-per-file"`
 	SyncEvery       int64         `flag:"sync-every"`
 	SyncTimeout     time.Duration `flag:"sync-timeout"`
+	BackendQueue    string        `flag:"backend-queue"`
+	JournalInFlight bool          `flag:"journal-in-flight"`
+
+	// backlog limits
+	MaxTopicDepth   int64  `flag:"max-topic-depth"`
+	MaxTopicBytes   int64  `flag:"max-topic-bytes"`
+	MaxChannelDepth int64  `flag:"max-channel-depth"`
+	MaxChannelBytes int64  `flag:"max-channel-bytes"`
+	OverflowPolicy  string `flag:"overflow-policy"`
 
 	// msg and command options
 	MsgTimeout    time.Duration `flag:"msg-timeout" arg:"1ms"`
@@ -33,8 +44,13 @@ type nsqdOptions struct {
 	MaxMsgSize    int64         `flag:"max-msg-size" deprecated:"max-message-size" cfg:"max_msg_size"`
 	MaxBodySize   int64         `flag:"max-body-size"`
 	MaxReqTimeout time.Duration `flag:"max-req-timeout"`
+	MsgTTL        time.Duration `flag:"msg-ttl"`
 	ClientTimeout time.Duration
 
+	// dead-lettering
+	MaxAttempts     uint16 `flag:"max-attempts"`
+	DeadLetterTopic string `flag:"dead-letter-topic"`
+
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
 	MaxRdyCount            int64         `flag:"max-rdy-count"`
@@ -58,6 +74,12 @@ type nsqdOptions struct {
 	TLSRootCAFile       string `flag:"tls-root-ca-file"`
 	TLSRequired         int    `flag:"tls-required"`
 
+	// TLS config for connections to nsqlookupd
+	NSQLookupdTLS           bool   `flag:"lookupd-tls" cfg:"nsqlookupd_tls"`
+	NSQLookupdTLSCert       string `flag:"lookupd-tls-cert" cfg:"nsqlookupd_tls_cert"`
+	NSQLookupdTLSKey        string `flag:"lookupd-tls-key" cfg:"nsqlookupd_tls_key"`
+	NSQLookupdTLSRootCAFile string `flag:"lookupd-tls-root-ca-file" cfg:"nsqlookupd_tls_root_ca_file"`
+
 	// compression
 	DeflateEnabled  bool `flag:"deflate"`
 	MaxDeflateLevel int  `flag:"max-deflate-level"`
@@ -82,6 +104,9 @@ func NewNSQDOptions() *nsqdOptions {
 		MaxBytesPerFile: 104857600,
 		SyncEvery:       2500,
 		SyncTimeout:     2 * time.Second,
+		BackendQueue:    "disk",
+
+		OverflowPolicy: OverflowReject,
 
 		MsgTimeout:    60 * time.Second,
 		MaxMsgTimeout: 15 * time.Minute,
@@ -90,6 +115,8 @@ func NewNSQDOptions() *nsqdOptions {
 		MaxReqTimeout: 1 * time.Hour,
 		ClientTimeout: 60 * time.Second,
 
+		DeadLetterTopic: "%s.dlq",
+
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
 		MaxOutputBufferSize:    64 * 1024,
@@ -0,0 +1,119 @@
+package nsqd
+
+import (
+	"github.com/bitly/nsq/util"
+)
+
+// PrometheusMetrics returns the data in GetStats() (and memory statistics)
+// for exposition to Prometheus
+func (n *NSQD) PrometheusMetrics() *util.PrometheusMetrics {
+	m := util.NewPrometheusMetrics("nsqd_")
+
+	healthy := 0.0
+	if n.IsHealthy() {
+		healthy = 1
+	}
+	m.Gauge("healthy", "Whether or not nsqd is healthy (1 or 0).", healthy)
+
+	draining := 0.0
+	if n.IsDraining() {
+		draining = 1
+	}
+	m.Gauge("draining", "Whether or not nsqd is draining (1 or 0).", draining)
+
+	for _, t := range n.GetStats() {
+		paused := 0.0
+		if t.Paused {
+			paused = 1
+		}
+
+		m.Gauge("topic_depth", "Number of messages queued in the topic.",
+			float64(t.Depth), "topic", t.TopicName)
+		m.Gauge("topic_backend_depth", "Number of messages queued in the topic's backend.",
+			float64(t.BackendDepth), "topic", t.TopicName)
+		m.Gauge("topic_bytes", "Number of message body bytes queued in the topic.",
+			float64(t.Bytes), "topic", t.TopicName)
+		m.Counter("topic_message_count", "Number of messages published to the topic.",
+			float64(t.MessageCount), "topic", t.TopicName)
+		m.Counter("topic_dropped_count", "Number of messages dropped by the topic's overflow policy.",
+			float64(t.DroppedCount), "topic", t.TopicName)
+		m.Gauge("topic_paused", "Whether or not the topic is paused (1 or 0).",
+			paused, "topic", t.TopicName)
+		m.Gauge("topic_channels", "Number of channels in the topic.",
+			float64(len(t.Channels)), "topic", t.TopicName)
+		if t.E2eProcessingLatency != nil {
+			for _, item := range t.E2eProcessingLatency.Percentiles {
+				m.Gauge("topic_e2e_processing_latency_seconds",
+					"End to end processing latency of the topic's channels.",
+					item["value"]/1e9,
+					"topic", t.TopicName,
+					"quantile", util.FormatPrometheusValue(item["quantile"]))
+			}
+		}
+
+		for _, c := range t.Channels {
+			if c.Paused {
+				paused = 1
+			} else {
+				paused = 0
+			}
+
+			labels := []string{"topic", t.TopicName, "channel", c.ChannelName}
+			m.Gauge("channel_depth", "Number of messages queued in the channel.",
+				float64(c.Depth), labels...)
+			m.Gauge("channel_backend_depth", "Number of messages queued in the channel's backend.",
+				float64(c.BackendDepth), labels...)
+			m.Gauge("channel_bytes", "Number of message body bytes queued in the channel.",
+				float64(c.Bytes), labels...)
+			m.Gauge("channel_in_flight_count", "Number of messages in-flight to clients.",
+				float64(c.InFlightCount), labels...)
+			m.Gauge("channel_deferred_count", "Number of deferred messages.",
+				float64(c.DeferredCount), labels...)
+			m.Counter("channel_message_count", "Number of messages put to the channel.",
+				float64(c.MessageCount), labels...)
+			m.Counter("channel_requeue_count", "Number of messages requeued.",
+				float64(c.RequeueCount), labels...)
+			m.Counter("channel_timeout_count", "Number of in-flight messages that timed out.",
+				float64(c.TimeoutCount), labels...)
+			m.Counter("channel_dead_letter_count", "Number of messages moved to the dead-letter topic.",
+				float64(c.DeadLetterCount), labels...)
+			m.Counter("channel_expired_count", "Number of expired messages discarded.",
+				float64(c.ExpiredCount), labels...)
+			m.Counter("channel_dropped_count", "Number of messages dropped by the channel's overflow policy.",
+				float64(c.DroppedCount), labels...)
+			m.Gauge("channel_paused", "Whether or not the channel is paused (1 or 0).",
+				paused, labels...)
+			m.Gauge("channel_clients", "Number of clients subscribed to the channel.",
+				float64(len(c.Clients)), labels...)
+			if c.E2eProcessingLatency != nil {
+				for _, item := range c.E2eProcessingLatency.Percentiles {
+					m.Gauge("channel_e2e_processing_latency_seconds",
+						"End to end processing latency of the channel.",
+						item["value"]/1e9,
+						append(labels, "quantile", util.FormatPrometheusValue(item["quantile"]))...)
+				}
+			}
+
+			for _, client := range c.Clients {
+				clientLabels := append(labels[:4:4],
+					"client_id", client.ClientID,
+					"hostname", client.Hostname,
+					"remote_address", client.RemoteAddress)
+				m.Gauge("client_ready_count", "Number of messages the client is ready to receive.",
+					float64(client.ReadyCount), clientLabels...)
+				m.Gauge("client_in_flight_count", "Number of messages in-flight to the client.",
+					float64(client.InFlightCount), clientLabels...)
+				m.Counter("client_message_count", "Number of messages sent to the client.",
+					float64(client.MessageCount), clientLabels...)
+				m.Counter("client_finish_count", "Number of messages finished by the client.",
+					float64(client.FinishCount), clientLabels...)
+				m.Counter("client_requeue_count", "Number of messages requeued by the client.",
+					float64(client.RequeueCount), clientLabels...)
+			}
+		}
+	}
+
+	m.AddMemStats()
+
+	return m
+}
@@ -122,8 +122,13 @@ func (p *protocolV2) SendMessage(client *clientV2, msg *Message, buf *bytes.Buff
 			msg.ID, client, msg.Body)
 	}
 
+	var err error
 	buf.Reset()
-	_, err := msg.WriteTo(buf)
+	if atomic.LoadInt32(&client.Headers) == 1 {
+		_, err = msg.WriteToWithHeaders(buf)
+	} else {
+		_, err = msg.WriteTo(buf)
+	}
 	if err != nil {
 		return err
 	}
@@ -180,6 +185,8 @@ func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
 		return p.PUB(client, params)
 	case bytes.Equal(params[0], []byte("MPUB")):
 		return p.MPUB(client, params)
+	case bytes.Equal(params[0], []byte("DPUB")):
+		return p.DPUB(client, params)
 	case bytes.Equal(params[0], []byte("NOP")):
 		return p.NOP(client, params)
 	case bytes.Equal(params[0], []byte("TOUCH")):
@@ -300,6 +307,11 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 				continue
 			}
 
+			// the message may have expired while waiting for a ready client
+			if subChannel.discardExpired(msg) {
+				continue
+			}
+
 			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
 			client.SendingMessage()
 			err = p.SendMessage(client, msg, &buf)
@@ -380,6 +392,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		deflateLevel = int(math.Min(float64(deflateLevel), float64(p.ctx.nsqd.opts.MaxDeflateLevel)))
 	}
 	snappy := p.ctx.nsqd.opts.SnappyEnabled && identifyData.Snappy
+	headers := identifyData.Headers
 
 	if deflate && snappy {
 		return nil, util.NewFatalClientErr(nil, "E_IDENTIFY_FAILED", "cannot enable both deflate and snappy compression")
@@ -399,6 +412,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		AuthRequired        bool   `json:"auth_required"`
 		OutputBufferSize    int    `json:"output_buffer_size"`
 		OutputBufferTimeout int64  `json:"output_buffer_timeout"`
+		Headers             bool   `json:"headers"`
 	}{
 		MaxRdyCount:         p.ctx.nsqd.opts.MaxRdyCount,
 		Version:             util.BINARY_VERSION,
@@ -413,6 +427,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		AuthRequired:        p.ctx.nsqd.IsAuthEnabled(),
 		OutputBufferSize:    client.OutputBufferSize,
 		OutputBufferTimeout: int64(client.OutputBufferTimeout / time.Millisecond),
+		Headers:             headers,
 	})
 	if err != nil {
 		return nil, util.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -423,6 +438,11 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		return nil, util.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
 	}
 
+	if headers {
+		p.ctx.nsqd.logf("PROTOCOL(V2): [%s] enabling message headers", client)
+		client.EnableHeaders()
+	}
+
 	if tlsv1 {
 		p.ctx.nsqd.logf("PROTOCOL(V2): [%s] upgrading connection to TLS", client)
 		err = client.UpgradeTLS()
@@ -726,6 +746,14 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("PUB topic name %q is not valid", topicName))
 	}
 
+	var ttl time.Duration
+	if len(params) > 2 {
+		ttl, err = parseMessageTTL("PUB", params[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
 		return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE", "PUB failed to read message body size")
@@ -751,9 +779,21 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if p.ctx.nsqd.IsDraining() {
+		return nil, util.NewClientErr(nil, "E_DRAINING", "PUB failed nsqd is draining")
+	}
+
+	msg, err := client.newMessage(<-p.ctx.nsqd.idChan, messageBody)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE", "PUB "+err.Error())
+	}
+	msg.expireAfter(ttl)
+
 	topic := p.ctx.nsqd.GetTopic(topicName)
-	msg := NewMessage(<-p.ctx.nsqd.idChan, messageBody)
 	err = topic.PutMessage(msg)
+	if err == errBacklogFull {
+		return nil, util.NewClientErr(err, "E_BACKLOG_FULL", "PUB failed "+err.Error())
+	}
 	if err != nil {
 		return nil, util.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed "+err.Error())
 	}
@@ -774,6 +814,14 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("E_BAD_TOPIC MPUB topic name %q is not valid", topicName))
 	}
 
+	var ttl time.Duration
+	if len(params) > 2 {
+		ttl, err = parseMessageTTL("MPUB", params[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
 		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "MPUB failed to read body size")
@@ -790,7 +838,7 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	}
 
 	messages, err := readMPUB(client.Reader, client.lenSlice, p.ctx.nsqd.idChan,
-		p.ctx.nsqd.opts.MaxMsgSize)
+		p.ctx.nsqd.opts.MaxMsgSize, client.newMessage)
 	if err != nil {
 		return nil, err
 	}
@@ -799,12 +847,23 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if p.ctx.nsqd.IsDraining() {
+		return nil, util.NewClientErr(nil, "E_DRAINING", "MPUB failed nsqd is draining")
+	}
+
+	for _, msg := range messages {
+		msg.expireAfter(ttl)
+	}
+
 	topic := p.ctx.nsqd.GetTopic(topicName)
 
 	// if we've made it this far we've validated all the input,
-	// the only possible error is that the topic is exiting during
-	// this next call (and no messages will be queued in that case)
+	// the only possible errors are that the topic is exiting or its backlog
+	// is full during this next call (and no messages will be queued in that case)
 	err = topic.PutMessages(messages)
+	if err == errBacklogFull {
+		return nil, util.NewClientErr(err, "E_BACKLOG_FULL", "MPUB failed "+err.Error())
+	}
 	if err != nil {
 		return nil, util.NewFatalClientErr(err, "E_MPUB_FAILED", "MPUB failed "+err.Error())
 	}
@@ -812,6 +871,87 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	return okBytes, nil
 }
 
+func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
+	var err error
+
+	if len(params) < 3 {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID", "DPUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	if !util.IsValidTopicName(topicName) {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("DPUB topic name %q is not valid", topicName))
+	}
+
+	timeoutMs, err := util.ByteToBase10(params[2])
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_INVALID",
+			fmt.Sprintf("DPUB could not parse timeout %s", params[2]))
+	}
+	timeoutDuration := time.Duration(timeoutMs) * time.Millisecond
+
+	if timeoutDuration < 0 || timeoutDuration > p.ctx.nsqd.opts.MaxReqTimeout {
+		return nil, util.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("DPUB timeout %d out of range 0-%d", timeoutDuration, p.ctx.nsqd.opts.MaxReqTimeout))
+	}
+
+	var ttl time.Duration
+	if len(params) > 3 {
+		ttl, err = parseMessageTTL("DPUB", params[3])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE", "DPUB failed to read message body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("DPUB invalid message body size %d", bodyLen))
+	}
+
+	if int64(bodyLen) > p.ctx.nsqd.opts.MaxMsgSize {
+		return nil, util.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("DPUB message too big %d > %d", bodyLen, p.ctx.nsqd.opts.MaxMsgSize))
+	}
+
+	messageBody := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, messageBody)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE", "DPUB failed to read message body")
+	}
+
+	if err := p.CheckAuth(client, "DPUB", topicName, ""); err != nil {
+		return nil, err
+	}
+
+	if p.ctx.nsqd.IsDraining() {
+		return nil, util.NewClientErr(nil, "E_DRAINING", "DPUB failed nsqd is draining")
+	}
+
+	msg, err := client.newMessage(<-p.ctx.nsqd.idChan, messageBody)
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE", "DPUB "+err.Error())
+	}
+	msg.deferred = timeoutDuration
+	msg.expireAfter(ttl)
+
+	topic := p.ctx.nsqd.GetTopic(topicName)
+	err = topic.PutMessage(msg)
+	if err == errBacklogFull {
+		return nil, util.NewClientErr(err, "E_BACKLOG_FULL", "DPUB failed "+err.Error())
+	}
+	if err != nil {
+		return nil, util.NewFatalClientErr(err, "E_DPUB_FAILED", "DPUB failed "+err.Error())
+	}
+
+	return okBytes, nil
+}
+
 func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 	if state != stateSubscribed && state != stateClosing {
@@ -839,7 +979,18 @@ func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
 	return nil, nil
 }
 
-func readMPUB(r io.Reader, tmp []byte, idChan chan MessageID, maxMessageSize int64) ([]*Message, error) {
+// parseMessageTTL parses the optional TTL (in milliseconds) of PUB, MPUB and DPUB
+func parseMessageTTL(cmd string, param []byte) (time.Duration, error) {
+	ttlMs, err := util.ByteToBase10(param)
+	if err != nil {
+		return 0, util.NewFatalClientErr(err, "E_INVALID",
+			fmt.Sprintf("%s could not parse ttl %s", cmd, param))
+	}
+	return time.Duration(ttlMs) * time.Millisecond, nil
+}
+
+func readMPUB(r io.Reader, tmp []byte, idChan chan MessageID, maxMessageSize int64,
+	newMessage func(MessageID, []byte) (*Message, error)) ([]*Message, error) {
 	numMessages, err := readLen(r, tmp)
 	if err != nil {
 		return nil, util.NewFatalClientErr(err, "E_BAD_BODY", "MPUB failed to read message count")
@@ -874,7 +1025,13 @@ func readMPUB(r io.Reader, tmp []byte, idChan chan MessageID, maxMessageSize int
 			return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE", "MPUB failed to read message body")
 		}
 
-		messages = append(messages, NewMessage(<-idChan, msgBody))
+		msg, err := newMessage(<-idChan, msgBody)
+		if err != nil {
+			return nil, util.NewFatalClientErr(err, "E_BAD_MESSAGE",
+				fmt.Sprintf("MPUB message(%d) %s", i, err))
+		}
+
+		messages = append(messages, msg)
 	}
 
 	return messages, nil
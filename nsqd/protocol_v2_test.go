@@ -17,7 +17,9 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -420,6 +422,46 @@ func TestEmptyCommand(t *testing.T) {
 	// if we didn't panic here we're good, see issue #120
 }
 
+func TestBacklogFull(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxTopicDepth = 2
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	equal(t, err, nil)
+	defer conn.Close()
+
+	topicName := "test_backlog_full_v2" + strconv.Itoa(int(time.Now().UnixNano()))
+
+	identify(t, conn, nil, frameTypeResponse)
+
+	nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	// MPUB is all or nothing
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{[]byte("test body"), []byte("test body")})
+	cmd.WriteTo(conn)
+	resp, _ := nsq.ReadResponse(conn)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	equal(t, frameType, frameTypeError)
+	equal(t, string(data), "E_BACKLOG_FULL MPUB failed backlog full")
+
+	// the connection remains usable
+	nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	resp, _ = nsq.ReadResponse(conn)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	equal(t, frameType, frameTypeError)
+	equal(t, string(data), "E_BACKLOG_FULL PUB failed backlog full")
+
+	topic, _ := nsqd.GetExistingTopic(topicName)
+	equal(t, topic.Depth(), int64(2))
+}
+
 func TestSizeLimits(t *testing.T) {
 	opts := NewNSQDOptions()
 	opts.Logger = newTestLogger(t)
@@ -581,6 +623,360 @@ func TestTouch(t *testing.T) {
 	equal(t, channel.timeoutCount, uint64(0))
 }
 
+func TestDPUB(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	opts.Verbose = true
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_dpub" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	equal(t, err, nil)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	dpub := &nsq.Command{[]byte("DPUB"), [][]byte{[]byte(topicName), []byte("100")}, []byte("test body")}
+	_, err = dpub.WriteTo(conn)
+	equal(t, err, nil)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	time.Sleep(25 * time.Millisecond)
+
+	channel.Lock()
+	numDeferred := len(channel.deferredMessages)
+	channel.Unlock()
+	equal(t, numDeferred, 1)
+	equal(t, channel.Depth(), int64(0))
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	equal(t, err, nil)
+
+	resp, err := nsq.ReadResponse(conn)
+	equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	msgOut, _ := decodeMessage(data)
+	equal(t, frameType, frameTypeMessage)
+	equal(t, msgOut.Body, []byte("test body"))
+	equal(t, msgOut.Attempts, uint16(1))
+	equal(t, channel.requeueCount, uint64(0))
+
+	// timeout out of range
+	dpub = &nsq.Command{[]byte("DPUB"), [][]byte{[]byte(topicName),
+		[]byte(strconv.Itoa(int(opts.MaxReqTimeout/time.Millisecond) + 100))}, []byte("test body")}
+	_, err = dpub.WriteTo(conn)
+	equal(t, err, nil)
+	resp, _ = nsq.ReadResponse(conn)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	equal(t, frameType, frameTypeError)
+	equal(t, string(data), fmt.Sprintf("E_INVALID DPUB timeout %d out of range 0-%d",
+		opts.MaxReqTimeout+100*time.Millisecond, opts.MaxReqTimeout))
+}
+
+func TestDeadLetter(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	opts.Verbose = true
+	opts.MaxAttempts = 2
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	equal(t, err, nil)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	dlqChannel := nsqd.GetTopic(topicName + ".dlq").GetChannel("ch")
+
+	msg := NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic.PutMessage(msg)
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	equal(t, err, nil)
+
+	for i := 1; i <= 2; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		msgOut, _ := decodeMessage(data)
+		equal(t, frameType, frameTypeMessage)
+		equal(t, msgOut.Attempts, uint16(i))
+
+		_, err = nsq.Requeue(nsq.MessageID(msgOut.ID), 0).WriteTo(conn)
+		equal(t, err, nil)
+	}
+
+	dlqMsg := <-dlqChannel.clientMsgChan
+	var dl deadLetterMessage
+	err = json.Unmarshal(dlqMsg.Body, &dl)
+	equal(t, err, nil)
+	equal(t, dl.ID, string(msg.ID[:]))
+	equal(t, dl.Topic, topicName)
+	equal(t, dl.Channel, "ch")
+	equal(t, dl.Attempts, uint16(2))
+	equal(t, dl.Body, []byte("test body"))
+
+	equal(t, channel.Depth(), int64(0))
+	equal(t, atomic.LoadUint64(&channel.requeueCount), uint64(1))
+	equal(t, atomic.LoadUint64(&channel.deadLetterCount), uint64(1))
+}
+
+func TestDeadLetterInvalidTopic(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxAttempts = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	// a long topic name expands to a dead-letter topic name that's too long
+	topicName := strings.Repeat("t", 60) + strconv.Itoa(int(time.Now().Unix()%100))
+	channel := nsqd.GetTopic(topicName).GetChannel("ch")
+
+	// dead-lettering is disabled for the channel, so the message is requeued
+	msg := NewMessage(<-nsqd.idChan, []byte("test body"))
+	msg.Attempts = 2
+	equal(t, channel.maybeDeadLetter(msg), false)
+	equal(t, atomic.LoadUint64(&channel.deadLetterCount), uint64(0))
+
+	nsqd.RLock()
+	_, ok := nsqd.topicMap[topicName+".dlq"]
+	nsqd.RUnlock()
+	equal(t, ok, false)
+}
+
+func TestHeaders(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	opts.Verbose = true
+	// ensure messages round trip through the backend
+	opts.MemQueueSize = 0
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_headers" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	equal(t, err, nil)
+	defer conn.Close()
+
+	data := identify(t, conn, map[string]interface{}{"headers": true}, frameTypeResponse)
+	r := struct {
+		Headers bool `json:"headers"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	equal(t, err, nil)
+	equal(t, r.Headers, true)
+	sub(t, conn, topicName, "ch")
+
+	oldConn, err := mustConnectNSQD(tcpAddr)
+	equal(t, err, nil)
+	defer oldConn.Close()
+
+	identify(t, oldConn, nil, frameTypeResponse)
+	sub(t, oldConn, topicName, "old_ch")
+
+	headers := map[string]string{"trace-id": "abc123", "content-type": "text/plain"}
+	body := append(encodeMessageHeaders(headers), []byte("test body")...)
+	_, err = nsq.Publish(topicName, body).WriteTo(conn)
+	equal(t, err, nil)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	mpub, _ := nsq.MultiPublish(topicName, [][]byte{encodeMessageHeaders(nil)})
+	_, err = mpub.WriteTo(conn)
+	equal(t, err, nil)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	_, err = nsq.Ready(2).WriteTo(conn)
+	equal(t, err, nil)
+
+	for i := 0; i < 2; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		equal(t, frameType, frameTypeMessage)
+		equal(t, len(data) >= 28, true)
+		buf := bytes.NewBuffer(data[26:])
+		h, err := readMessageHeaders(buf)
+		equal(t, err, nil)
+		if i == 0 {
+			equal(t, h, headers)
+			equal(t, buf.Bytes(), []byte("test body"))
+		} else {
+			equal(t, len(h), 0)
+			equal(t, buf.Len(), 0)
+		}
+	}
+
+	_, err = nsq.Ready(1).WriteTo(oldConn)
+	equal(t, err, nil)
+
+	resp, err := nsq.ReadResponse(oldConn)
+	equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	msgOut, _ := decodeMessage(data)
+	equal(t, frameType, frameTypeMessage)
+	equal(t, len(msgOut.Headers), 0)
+	equal(t, msgOut.Body, []byte("test body"))
+
+	// malformed headers block
+	_, err = nsq.Publish(topicName, []byte{0, 1, 0}).WriteTo(conn)
+	equal(t, err, nil)
+	resp, _ = nsq.ReadResponse(conn)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	equal(t, frameType, frameTypeError)
+	equal(t, string(data), "E_BAD_MESSAGE PUB invalid header(0)")
+}
+
+func TestMessageTTL(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	// ensure expirations round trip through the backend
+	opts.MemQueueSize = 0
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_message_ttl" + strconv.Itoa(int(time.Now().UnixNano()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	equal(t, err, nil)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+
+	pub := &nsq.Command{[]byte("PUB"), [][]byte{[]byte(topicName), []byte("1")}, []byte("stale")}
+	_, err = pub.WriteTo(conn)
+	equal(t, err, nil)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	pub = &nsq.Command{[]byte("PUB"), [][]byte{[]byte(topicName), []byte("60000")}, []byte("fresh")}
+	_, err = pub.WriteTo(conn)
+	equal(t, err, nil)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	time.Sleep(5 * time.Millisecond)
+
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(2).WriteTo(conn)
+	equal(t, err, nil)
+
+	resp, err := nsq.ReadResponse(conn)
+	equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	msgOut, _ := decodeMessage(data)
+	equal(t, frameType, frameTypeMessage)
+	equal(t, msgOut.Body, []byte("fresh"))
+
+	topic, _ := nsqd.GetExistingTopic(topicName)
+	channel, _ := topic.GetExistingChannel("ch")
+	equal(t, atomic.LoadUint64(&channel.expiredCount), uint64(1))
+
+	// a channel TTL applies to messages without one of their own
+	channel.setMsgTTL(time.Millisecond)
+	msg := NewMessage(<-nsqd.idChan, []byte("stale"))
+	msg.Timestamp -= int64(time.Second)
+	err = channel.PutMessage(msg)
+	equal(t, err, nil)
+	for atomic.LoadUint64(&channel.expiredCount) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMessageExpiresRoundTrip(t *testing.T) {
+	msg := NewMessage(MessageID{'a'}, []byte("test body"))
+	msg.Headers = map[string]string{"key": "value"}
+	msg.expireAfter(time.Minute)
+	msg.expireAfter(time.Hour)
+	equal(t, msg.Expires, msg.Timestamp+int64(time.Minute))
+
+	var buf bytes.Buffer
+	_, err := msg.writeToBackend(&buf)
+	equal(t, err, nil)
+	msgOut, err := decodeMessage(buf.Bytes())
+	equal(t, err, nil)
+	equal(t, msgOut.Timestamp, msg.Timestamp)
+	equal(t, msgOut.Expires, msg.Expires)
+	equal(t, msgOut.Headers, msg.Headers)
+	equal(t, msgOut.Body, msg.Body)
+
+	// the expiration is never sent to clients
+	buf.Reset()
+	_, err = msg.WriteTo(&buf)
+	equal(t, err, nil)
+	equal(t, buf.Len(), 26+len(msg.Body))
+
+	equal(t, msg.isExpired(msg.Timestamp, 0), false)
+	equal(t, msg.isExpired(msg.Expires, 0), true)
+	equal(t, msg.isExpired(msg.Timestamp+int64(time.Second), time.Second), true)
+}
+
+func TestMessageDeferredRoundTrip(t *testing.T) {
+	msg := NewMessage(MessageID{'a'}, []byte("test body"))
+	msg.Headers = map[string]string{"key": "value"}
+	msg.Expires = msg.Timestamp + int64(time.Hour)
+	msg.deferred = time.Minute
+
+	var buf bytes.Buffer
+	_, err := msg.writeToBackend(&buf)
+	equal(t, err, nil)
+	msgOut, err := decodeMessage(buf.Bytes())
+	equal(t, err, nil)
+	equal(t, msgOut.Timestamp, msg.Timestamp)
+	equal(t, msgOut.Expires, msg.Expires)
+	equal(t, msgOut.Headers, msg.Headers)
+	equal(t, msgOut.Body, msg.Body)
+	equal(t, msgOut.deferred > 0 && msgOut.deferred <= time.Minute, true)
+
+	// a deferral that elapsed while persisted is dropped
+	msg.Timestamp -= int64(time.Hour)
+	buf.Reset()
+	_, err = msg.writeToBackend(&buf)
+	equal(t, err, nil)
+	msgOut, err = decodeMessage(buf.Bytes())
+	equal(t, err, nil)
+	equal(t, msgOut.deferred, time.Duration(0))
+}
+
+func TestMessageBackendFormat(t *testing.T) {
+	// timestamps from 2043 on have bit 61 set
+	msg := NewMessage(MessageID{'a'}, []byte("test body"))
+	msg.Timestamp = int64(1<<61 | 1<<60)
+
+	var buf bytes.Buffer
+	_, err := msg.writeToBackend(&buf)
+	equal(t, err, nil)
+	msgOut, err := decodeMessage(buf.Bytes())
+	equal(t, err, nil)
+	equal(t, msgOut.Timestamp, msg.Timestamp)
+	equal(t, msgOut.Expires, int64(0))
+	equal(t, msgOut.deferred, time.Duration(0))
+	equal(t, msgOut.Headers, map[string]string(nil))
+	equal(t, msgOut.Body, msg.Body)
+
+	// messages persisted before the format was versioned
+	buf.Reset()
+	_, err = msg.WriteTo(&buf)
+	equal(t, err, nil)
+	msgOut, err = decodeMessage(buf.Bytes())
+	equal(t, err, nil)
+	equal(t, msgOut.Timestamp, msg.Timestamp)
+	equal(t, msgOut.Body, msg.Body)
+
+	_, err = decodeMessage(append([]byte{msgFormatMagic, msgFormatV1 + 1, 0}, buf.Bytes()...))
+	equal(t, err != nil, true)
+}
+
 func TestMaxRdyCount(t *testing.T) {
 	opts := NewNSQDOptions()
 	opts.Logger = newTestLogger(t)
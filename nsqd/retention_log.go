@@ -0,0 +1,459 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retentionLog is a segmented append-only log of the messages a topic has
+// written to its channels, it is kept for a configured amount of time
+// and/or bytes so that channels can be positioned (by offset or timestamp)
+// to replay history
+//
+// segments are named after the offset of their first message and contain
+//
+//	[4-byte size][message]...
+//
+// where the offset of a message is its (0-based) index in the log
+type retentionLog struct {
+	sync.RWMutex
+
+	// instantiation time metadata
+	name            string
+	dataPath        string
+	maxBytesPerFile int64 // size at which a new segment is started
+	syncEvery       int64 // number of writes per fsync
+
+	retentionTime  time.Duration
+	retentionBytes int64
+
+	segments  []*retentionSegment
+	file      *os.File
+	endOffset int64
+	count     int64
+	writeBuf  bytes.Buffer
+
+	logger logger
+}
+
+type retentionSegment struct {
+	offset    int64 // of the first message
+	timestamp int64 // of the first message (0 when empty)
+	size      int64
+}
+
+// newRetentionLog instantiates a new instance of retentionLog, resuming
+// from any segments that exist on the filesystem
+func newRetentionLog(name string, dataPath string, maxBytesPerFile int64, syncEvery int64,
+	retentionTime time.Duration, retentionBytes int64, logger logger) (*retentionLog, error) {
+	l := &retentionLog{
+		name:            name,
+		dataPath:        dataPath,
+		maxBytesPerFile: maxBytesPerFile,
+		syncEvery:       syncEvery,
+		retentionTime:   retentionTime,
+		retentionBytes:  retentionBytes,
+		logger:          logger,
+	}
+
+	// no need to lock here, nothing else could possibly be touching this instance
+	err := l.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *retentionLog) logf(f string, args ...interface{}) {
+	if l.logger == nil {
+		return
+	}
+	l.logger.Output(2, fmt.Sprintf(f, args...))
+}
+
+// SetLimits changes the amount of time and bytes that are retained,
+// (zero values are unlimited)
+func (l *retentionLog) SetLimits(retentionTime time.Duration, retentionBytes int64) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.retentionTime = retentionTime
+	l.retentionBytes = retentionBytes
+	l.prune()
+}
+
+// Limits returns the amount of time and bytes that are retained
+func (l *retentionLog) Limits() (time.Duration, int64) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.retentionTime, l.retentionBytes
+}
+
+// Offsets returns the offset of the oldest retained message
+// and the offset that the next message will be written at
+func (l *retentionLog) Offsets() (int64, int64) {
+	l.RLock()
+	defer l.RUnlock()
+	if len(l.segments) == 0 {
+		return l.endOffset, l.endOffset
+	}
+	return l.segments[0].offset, l.endOffset
+}
+
+// Size returns the number of bytes retained
+func (l *retentionLog) Size() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.size()
+}
+
+// Append writes a message to the end of the log
+func (l *retentionLog) Append(msg *Message) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.file == nil || l.segments[len(l.segments)-1].size >= l.maxBytesPerFile {
+		err := l.roll()
+		if err != nil {
+			return err
+		}
+	}
+
+	l.writeBuf.Reset()
+	l.writeBuf.Write([]byte{0, 0, 0, 0})
+	n, err := msg.writeToBackend(&l.writeBuf)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(l.writeBuf.Bytes()[:4], uint32(n))
+
+	_, err = l.file.Write(l.writeBuf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	seg := l.segments[len(l.segments)-1]
+	seg.size += int64(l.writeBuf.Len())
+	if seg.timestamp == 0 {
+		seg.timestamp = msg.Timestamp
+	}
+	l.endOffset++
+
+	l.count++
+	if l.count >= l.syncEvery {
+		l.count = 0
+		err = l.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	l.prune()
+	return nil
+}
+
+// OffsetForTimestamp returns the offset of the first retained message
+// published at or after the specified timestamp (in nanoseconds)
+func (l *retentionLog) OffsetForTimestamp(ts int64) (int64, error) {
+	l.RLock()
+	start := l.endOffset
+	end := l.endOffset
+	// start at the last segment that began before the timestamp
+	for i, seg := range l.segments {
+		if i == 0 || (seg.timestamp != 0 && seg.timestamp <= ts) {
+			start = seg.offset
+		}
+	}
+	l.RUnlock()
+
+	offset := end
+	err := l.Read(start, end, func(o int64, msg *Message) bool {
+		if msg.Timestamp >= ts {
+			offset = o
+			return false
+		}
+		return true
+	})
+	return offset, err
+}
+
+// Read calls fn for every retained message in the range [from, to)
+// until it returns false, messages that have since been pruned are skipped
+func (l *retentionLog) Read(from int64, to int64, fn func(int64, *Message) bool) error {
+	var header [4]byte
+
+	offset := from
+	for offset < to {
+		l.RLock()
+		if len(l.segments) == 0 {
+			l.RUnlock()
+			return nil
+		}
+		if offset < l.segments[0].offset {
+			offset = l.segments[0].offset
+		}
+		var seg *retentionSegment
+		segEnd := l.endOffset
+		for i, s := range l.segments {
+			if s.offset > offset {
+				break
+			}
+			seg = s
+			if i+1 < len(l.segments) {
+				segEnd = l.segments[i+1].offset
+			} else {
+				segEnd = l.endOffset
+			}
+		}
+		fileName := l.fileName(seg.offset)
+		l.RUnlock()
+
+		if segEnd > to {
+			segEnd = to
+		}
+		if offset >= segEnd {
+			return nil
+		}
+
+		f, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		r := bufio.NewReader(f)
+		for o := seg.offset; o < segEnd; o++ {
+			_, err = io.ReadFull(r, header[:])
+			if err != nil {
+				f.Close()
+				return err
+			}
+			size := int64(binary.BigEndian.Uint32(header[:]))
+			if o < offset {
+				_, err = io.CopyN(ioutil.Discard, r, size)
+				if err != nil {
+					f.Close()
+					return err
+				}
+				continue
+			}
+
+			data := make([]byte, size)
+			_, err = io.ReadFull(r, data)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			msg, err := decodeMessage(data)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			if !fn(o, msg) {
+				f.Close()
+				return nil
+			}
+		}
+		f.Close()
+		offset = segEnd
+	}
+
+	return nil
+}
+
+// Close syncs and closes the current segment
+func (l *retentionLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Sync()
+	l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Delete closes the log and removes all of its segments
+func (l *retentionLog) Delete() error {
+	l.Close()
+
+	l.Lock()
+	defer l.Unlock()
+
+	for _, seg := range l.segments {
+		err := os.Remove(l.fileName(seg.offset))
+		if err != nil && !os.IsNotExist(err) {
+			l.logf("ERROR: retention log(%s) failed to remove segment - %s", l.name, err)
+		}
+	}
+	l.segments = nil
+	return nil
+}
+
+func (l *retentionLog) size() int64 {
+	var size int64
+	for _, seg := range l.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// roll starts a new segment at the current end of the log
+func (l *retentionLog) roll() error {
+	if l.file != nil {
+		l.file.Sync()
+		l.file.Close()
+		l.file = nil
+	}
+
+	seg := &retentionSegment{offset: l.endOffset}
+	f, err := os.OpenFile(l.fileName(seg.offset), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	l.count = 0
+	l.segments = append(l.segments, seg)
+
+	l.logf("RETENTION(%s): new segment at offset %d", l.name, seg.offset)
+	return nil
+}
+
+// prune removes the oldest segments that are beyond the retention limits,
+// the current segment is never removed
+func (l *retentionLog) prune() {
+	for len(l.segments) > 1 {
+		// every message in a segment is older than the first message of the next
+		next := l.segments[1]
+		expired := l.retentionTime > 0 && next.timestamp != 0 &&
+			next.timestamp < time.Now().Add(-l.retentionTime).UnixNano()
+		oversized := l.retentionBytes > 0 && l.size() > l.retentionBytes
+		if !expired && !oversized {
+			return
+		}
+
+		seg := l.segments[0]
+		err := os.Remove(l.fileName(seg.offset))
+		if err != nil && !os.IsNotExist(err) {
+			l.logf("ERROR: retention log(%s) failed to remove segment - %s", l.name, err)
+			return
+		}
+		l.segments = l.segments[1:]
+	}
+}
+
+// load discovers existing segments and re-opens the last one for writing
+func (l *retentionLog) load() error {
+	prefix := fmt.Sprintf("%s.retention.", l.name)
+	fileNames, err := filepath.Glob(path.Join(l.dataPath, prefix+"*.dat"))
+	if err != nil {
+		return err
+	}
+
+	for _, fileName := range fileNames {
+		s := strings.TrimSuffix(strings.TrimPrefix(path.Base(fileName), prefix), ".dat")
+		offset, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &retentionSegment{offset: offset})
+	}
+	sort.Sort(retentionSegmentsByOffset(l.segments))
+
+	if len(l.segments) == 0 {
+		return nil
+	}
+
+	for i, seg := range l.segments {
+		count, size, ts, err := l.scan(seg, i == len(l.segments)-1)
+		if err != nil {
+			return err
+		}
+		seg.size = size
+		seg.timestamp = ts
+		l.endOffset = seg.offset + count
+	}
+
+	last := l.segments[len(l.segments)-1]
+	l.file, err = os.OpenFile(l.fileName(last.offset), os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	// discard any partially written trailing record
+	return l.file.Truncate(last.size)
+}
+
+// scan returns the number of messages, the size (of the complete records),
+// and the timestamp of the first message in a segment, only reading
+// past the first message when full is set
+func (l *retentionLog) scan(seg *retentionSegment, full bool) (int64, int64, int64, error) {
+	var header [4]byte
+	var count, size, ts int64
+
+	f, err := os.Open(l.fileName(seg.offset))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		_, err = io.ReadFull(r, header[:])
+		if err != nil {
+			break
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[:]))
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			break
+		}
+		if count == 0 {
+			msg, err := decodeMessage(data)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			ts = msg.Timestamp
+		}
+		count++
+		size += int64(4 + len(data))
+		if !full {
+			return count, stat.Size(), ts, nil
+		}
+	}
+	if err != io.EOF {
+		l.logf("WARNING: retention log(%s) discarding partial trailing record", l.name)
+	}
+
+	return count, size, ts, nil
+}
+
+func (l *retentionLog) fileName(offset int64) string {
+	return fmt.Sprintf(path.Join(l.dataPath, "%s.retention.%020d.dat"), l.name, offset)
+}
+
+type retentionSegmentsByOffset []*retentionSegment
+
+func (s retentionSegmentsByOffset) Len() int           { return len(s) }
+func (s retentionSegmentsByOffset) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s retentionSegmentsByOffset) Less(i, j int) bool { return s[i].offset < s[j].offset }
+
+var errRetentionDisabled = errors.New("retention is not enabled")
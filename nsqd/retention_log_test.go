@@ -0,0 +1,82 @@
+package nsqd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetentionLog(t *testing.T) {
+	l := newTestLogger(t)
+	name := "test_retention_log" + strconv.Itoa(int(time.Now().UnixNano()))
+	rl, err := newRetentionLog(name, os.TempDir(), 200, 2500, 0, 0, l)
+	equal(t, err, nil)
+	defer rl.Delete()
+
+	now := time.Now().UnixNano()
+	for i := 0; i < 20; i++ {
+		msg := NewMessage(MessageID{}, []byte(fmt.Sprintf("msg%02d", i)))
+		msg.Timestamp = now + int64(i)
+		err := rl.Append(msg)
+		equal(t, err, nil)
+	}
+
+	start, end := rl.Offsets()
+	equal(t, start, int64(0))
+	equal(t, end, int64(20))
+	equal(t, len(rl.segments) > 1, true)
+
+	var bodies []string
+	err = rl.Read(5, 8, func(offset int64, msg *Message) bool {
+		bodies = append(bodies, string(msg.Body))
+		return true
+	})
+	equal(t, err, nil)
+	equal(t, bodies, []string{"msg05", "msg06", "msg07"})
+
+	offset, err := rl.OffsetForTimestamp(now + 12)
+	equal(t, err, nil)
+	equal(t, offset, int64(12))
+	offset, err = rl.OffsetForTimestamp(now + 100)
+	equal(t, err, nil)
+	equal(t, offset, int64(20))
+
+	// resume from the existing segments
+	rl.Close()
+	rl, err = newRetentionLog(name, os.TempDir(), 200, 2500, 0, 0, l)
+	equal(t, err, nil)
+
+	start, end = rl.Offsets()
+	equal(t, start, int64(0))
+	equal(t, end, int64(20))
+	msg := NewMessage(MessageID{}, []byte("msg20"))
+	err = rl.Append(msg)
+	equal(t, err, nil)
+
+	bodies = nil
+	err = rl.Read(19, 21, func(offset int64, msg *Message) bool {
+		bodies = append(bodies, string(msg.Body))
+		return true
+	})
+	equal(t, err, nil)
+	equal(t, bodies, []string{"msg19", "msg20"})
+
+	// prune the oldest segments
+	size := rl.Size()
+	rl.SetLimits(0, size/2)
+	start, end = rl.Offsets()
+	equal(t, start > 0, true)
+	equal(t, end, int64(21))
+	equal(t, rl.Size() <= size/2, true)
+
+	// reading from a pruned offset starts at the oldest retained message
+	var first int64 = -1
+	err = rl.Read(0, end, func(offset int64, msg *Message) bool {
+		first = offset
+		return false
+	})
+	equal(t, err, nil)
+	equal(t, first, start)
+}
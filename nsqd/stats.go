@@ -14,10 +14,35 @@ type TopicStats struct {
 	MessageCount uint64         `json:"message_count"`
 	Paused       bool           `json:"paused"`
 
+	Bytes          int64  `json:"bytes"`
+	DroppedCount   uint64 `json:"dropped_count"`
+	MaxDepth       int64  `json:"max_depth"`
+	MaxBytes       int64  `json:"max_bytes"`
+	OverflowPolicy string `json:"overflow_policy"`
+
+	Retention *RetentionStats `json:"retention,omitempty"`
+
 	E2eProcessingLatency *util.PercentileResult `json:"e2e_processing_latency"`
 }
 
+type RetentionStats struct {
+	StartOffset int64 `json:"start_offset"`
+	EndOffset   int64 `json:"end_offset"`
+	Bytes       int64 `json:"bytes"`
+}
+
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
+	var retention *RetentionStats
+	if t.retention != nil {
+		start, end := t.retention.Offsets()
+		retention = &RetentionStats{
+			StartOffset: start,
+			EndOffset:   end,
+			Bytes:       t.retention.Size(),
+		}
+	}
+	limits := t.effectiveBacklogLimits()
+
 	return TopicStats{
 		TopicName:    t.name,
 		Channels:     channels,
@@ -26,37 +51,67 @@ func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
 		MessageCount: t.messageCount,
 		Paused:       t.IsPaused(),
 
+		Bytes:          t.backlog.Bytes(),
+		DroppedCount:   t.backlog.DroppedCount(),
+		MaxDepth:       limits.maxDepth,
+		MaxBytes:       limits.maxBytes,
+		OverflowPolicy: limits.policy,
+
+		Retention: retention,
+
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().PercentileResult(),
 	}
 }
 
 type ChannelStats struct {
-	ChannelName   string        `json:"channel_name"`
-	Depth         int64         `json:"depth"`
-	BackendDepth  int64         `json:"backend_depth"`
-	InFlightCount int           `json:"in_flight_count"`
-	DeferredCount int           `json:"deferred_count"`
-	MessageCount  uint64        `json:"message_count"`
-	RequeueCount  uint64        `json:"requeue_count"`
-	TimeoutCount  uint64        `json:"timeout_count"`
-	Clients       []ClientStats `json:"clients"`
-	Paused        bool          `json:"paused"`
+	ChannelName     string        `json:"channel_name"`
+	Depth           int64         `json:"depth"`
+	BackendDepth    int64         `json:"backend_depth"`
+	InFlightCount   int           `json:"in_flight_count"`
+	DeferredCount   int           `json:"deferred_count"`
+	MessageCount    uint64        `json:"message_count"`
+	RequeueCount    uint64        `json:"requeue_count"`
+	TimeoutCount    uint64        `json:"timeout_count"`
+	DeadLetterCount uint64        `json:"dead_letter_count"`
+	ExpiredCount    uint64        `json:"expired_count"`
+	Bytes           int64         `json:"bytes"`
+	DroppedCount    uint64        `json:"dropped_count"`
+	MaxDepth        int64         `json:"max_depth"`
+	MaxBytes        int64         `json:"max_bytes"`
+	OverflowPolicy  string        `json:"overflow_policy"`
+	Filter          string        `json:"filter,omitempty"`
+	Clients         []ClientStats `json:"clients"`
+	Paused          bool          `json:"paused"`
 
 	E2eProcessingLatency *util.PercentileResult `json:"e2e_processing_latency"`
 }
 
 func NewChannelStats(c *Channel, clients []ClientStats) ChannelStats {
+	var filter string
+	if c.filter != nil {
+		filter = c.filter.String()
+	}
+	limits := c.effectiveBacklogLimits()
+
 	return ChannelStats{
-		ChannelName:   c.name,
-		Depth:         c.Depth(),
-		BackendDepth:  c.backend.Depth(),
-		InFlightCount: len(c.inFlightMessages),
-		DeferredCount: len(c.deferredMessages),
-		MessageCount:  c.messageCount,
-		RequeueCount:  c.requeueCount,
-		TimeoutCount:  c.timeoutCount,
-		Clients:       clients,
-		Paused:        c.IsPaused(),
+		ChannelName:     c.name,
+		Depth:           c.Depth(),
+		BackendDepth:    c.backend.Depth(),
+		InFlightCount:   len(c.inFlightMessages),
+		DeferredCount:   len(c.deferredMessages),
+		MessageCount:    c.messageCount,
+		RequeueCount:    c.requeueCount,
+		TimeoutCount:    c.timeoutCount,
+		DeadLetterCount: c.deadLetterCount,
+		ExpiredCount:    c.expiredCount,
+		Bytes:           c.backlog.Bytes(),
+		DroppedCount:    c.backlog.DroppedCount(),
+		MaxDepth:        limits.maxDepth,
+		MaxBytes:        limits.maxBytes,
+		OverflowPolicy:  limits.policy,
+		Filter:          filter,
+		Clients:         clients,
+		Paused:          c.IsPaused(),
 
 		E2eProcessingLatency: c.e2eProcessingLatencyStream.PercentileResult(),
 	}
@@ -80,6 +135,7 @@ type ClientStats struct {
 	SampleRate      int32  `json:"sample_rate"`
 	Deflate         bool   `json:"deflate"`
 	Snappy          bool   `json:"snappy"`
+	Headers         bool   `json:"headers"`
 	UserAgent       string `json:"user_agent"`
 	Authed          bool   `json:"authed,omitempty"`
 	AuthIdentity    string `json:"auth_identity,omitempty"`
@@ -62,6 +62,13 @@ func (n *NSQD) statsdLoop() {
 				stat = fmt.Sprintf("topic.%s.backend_depth", topic.TopicName)
 				statsd.Gauge(stat, topic.BackendDepth)
 
+				stat = fmt.Sprintf("topic.%s.bytes", topic.TopicName)
+				statsd.Gauge(stat, topic.Bytes)
+
+				diff = topic.DroppedCount - lastTopic.DroppedCount
+				stat = fmt.Sprintf("topic.%s.dropped_count", topic.TopicName)
+				statsd.Incr(stat, int64(diff))
+
 				for _, item := range topic.E2eProcessingLatency.Percentiles {
 					stat = fmt.Sprintf("topic.%s.e2e_processing_latency_%.0f", topic.TopicName, item["quantile"]*100.0)
 					// We can cast the value to int64 since a value of 1 is the
@@ -89,6 +96,13 @@ func (n *NSQD) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.backend_depth", topic.TopicName, channel.ChannelName)
 					statsd.Gauge(stat, channel.BackendDepth)
 
+					stat = fmt.Sprintf("topic.%s.channel.%s.bytes", topic.TopicName, channel.ChannelName)
+					statsd.Gauge(stat, channel.Bytes)
+
+					diff = channel.DroppedCount - lastChannel.DroppedCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.dropped_count", topic.TopicName, channel.ChannelName)
+					statsd.Incr(stat, int64(diff))
+
 					stat = fmt.Sprintf("topic.%s.channel.%s.in_flight_count", topic.TopicName, channel.ChannelName)
 					statsd.Gauge(stat, int64(channel.InFlightCount))
 
@@ -103,6 +117,14 @@ func (n *NSQD) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", topic.TopicName, channel.ChannelName)
 					statsd.Incr(stat, int64(diff))
 
+					diff = channel.DeadLetterCount - lastChannel.DeadLetterCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.dead_letter_count", topic.TopicName, channel.ChannelName)
+					statsd.Incr(stat, int64(diff))
+
+					diff = channel.ExpiredCount - lastChannel.ExpiredCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.expired_count", topic.TopicName, channel.ChannelName)
+					statsd.Incr(stat, int64(diff))
+
 					stat = fmt.Sprintf("topic.%s.channel.%s.clients", topic.TopicName, channel.ChannelName)
 					statsd.Gauge(stat, int64(len(channel.Clients)))
 
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/bitly/nsq/util"
 )
@@ -13,6 +14,7 @@ import (
 type Topic struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	messageCount uint64
+	backlog      backlog
 
 	sync.RWMutex
 
@@ -29,6 +31,17 @@ type Topic struct {
 	deleteCallback func(*Topic)
 	deleter        sync.Once
 
+	// the registered BackendQueue implementation used by the topic and its channels
+	backendType string
+
+	// overrides the nsqd defaults when set
+	limits backlogLimits
+	msgTTL time.Duration
+
+	// history kept for replaying channels (when enabled)
+	retention  *retentionLog
+	replayChan chan replayRequest
+
 	paused    int32
 	pauseChan chan bool
 
@@ -36,7 +49,7 @@ type Topic struct {
 }
 
 // Topic constructor
-func NewTopic(topicName string, ctx *context, deleteCallback func(*Topic)) *Topic {
+func NewTopic(topicName string, backendType string, ctx *context, deleteCallback func(*Topic)) *Topic {
 	t := &Topic{
 		name:              topicName,
 		channelMap:        make(map[string]*Channel),
@@ -46,18 +59,20 @@ func NewTopic(topicName string, ctx *context, deleteCallback func(*Topic)) *Topi
 		ctx:               ctx,
 		pauseChan:         make(chan bool),
 		deleteCallback:    deleteCallback,
+		backendType:       backendType,
+		replayChan:        make(chan replayRequest),
 	}
 
 	if strings.HasSuffix(topicName, "#ephemeral") {
 		t.ephemeral = true
 		t.backend = newDummyBackendQueue()
 	} else {
-		t.backend = newDiskQueue(topicName,
-			ctx.nsqd.opts.DataPath,
-			ctx.nsqd.opts.MaxBytesPerFile,
-			ctx.nsqd.opts.SyncEvery,
-			ctx.nsqd.opts.SyncTimeout,
-			ctx.nsqd.opts.Logger)
+		backend, err := newBackendQueue(backendType, topicName, ctx.nsqd.opts)
+		if err != nil {
+			// backend types are validated before topics are created
+			panic(err)
+		}
+		t.backend = backend
 	}
 
 	t.waitGroup.Wrap(func() { t.messagePump() })
@@ -76,8 +91,15 @@ func (t *Topic) Exiting() bool {
 // to return a pointer to a Channel object (potentially new)
 // for the given Topic
 func (t *Topic) GetChannel(channelName string) *Channel {
+	return t.GetChannelWithFilter(channelName, nil)
+}
+
+// GetChannelWithFilter is like GetChannel except that a new Channel is
+// created with the given filter, so that it is never put a non-matching
+// message (the filter of an existing Channel is left unchanged)
+func (t *Topic) GetChannelWithFilter(channelName string, filter *util.JSONFilter) *Channel {
 	t.Lock()
-	channel, isNew := t.getOrCreateChannel(channelName)
+	channel, isNew := t.getOrCreateChannel(channelName, filter)
 	t.Unlock()
 
 	if isNew {
@@ -92,13 +114,15 @@ func (t *Topic) GetChannel(channelName string) *Channel {
 }
 
 // this expects the caller to handle locking
-func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
+func (t *Topic) getOrCreateChannel(channelName string, filter *util.JSONFilter) (*Channel, bool) {
 	channel, ok := t.channelMap[channelName]
 	if !ok {
 		deleteCallback := func(c *Channel) {
 			t.DeleteExistingChannel(c.name)
 		}
-		channel = NewChannel(t.name, channelName, t.ctx, deleteCallback)
+		channel = NewChannel(t.name, channelName, t.backendType, t.ctx, deleteCallback)
+		// before the channel is visible to messagePump
+		channel.filter = filter
 		t.channelMap[channelName] = channel
 		t.ctx.nsqd.logf("TOPIC(%s): new channel(%s)", t.name, channel.name)
 		return channel, true
@@ -156,11 +180,16 @@ func (t *Topic) PutMessage(m *Message) error {
 		return errors.New("exiting")
 	}
 
+	err := t.checkBacklog(1, int64(len(m.Body)))
+	if err != nil {
+		return err
+	}
+
 	if m.Delegate != nil {
 		m.Delegate.OnQueue(m, t.name)
 	}
 
-	err := t.put(m)
+	err = t.put(m)
 	if err != nil {
 		return err
 	}
@@ -175,6 +204,16 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
+
+	var size int64
+	for _, m := range msgs {
+		size += int64(len(m.Body))
+	}
+	err := t.checkBacklog(int64(len(msgs)), size)
+	if err != nil {
+		return err
+	}
+
 	for _, m := range msgs {
 		err := t.put(m)
 		if err != nil {
@@ -186,6 +225,10 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 }
 
 func (t *Topic) put(m *Message) error {
+	if !t.backlog.makeRoom(t.effectiveBacklogLimits(), m, t.Depth, t.memoryMsgChan, t.backend) {
+		return nil
+	}
+
 	select {
 	case t.memoryMsgChan <- m:
 	default:
@@ -200,6 +243,26 @@ func (t *Topic) put(m *Message) error {
 			return err
 		}
 	}
+	t.backlog.queued(m)
+	return nil
+}
+
+// checkBacklog returns errBacklogFull if queueing count messages totaling size
+// bytes would exceed the limits of the topic, or any of its channels, when
+// the policy in effect is to reject publishes
+//
+// it must be called with the topic's lock held
+func (t *Topic) checkBacklog(count int64, size int64) error {
+	limits := t.effectiveBacklogLimits()
+	if limits.policy == OverflowReject &&
+		limits.exceeded(t.Depth(), t.backlog.Bytes(), count, size) {
+		return errBacklogFull
+	}
+	for _, c := range t.channelMap {
+		if c.rejectsBacklog(count, size) {
+			return errBacklogFull
+		}
+	}
 	return nil
 }
 
@@ -207,6 +270,68 @@ func (t *Topic) Depth() int64 {
 	return int64(len(t.memoryMsgChan)) + t.backend.Depth()
 }
 
+// SetMsgTTL sets the default lifetime of messages published to the topic,
+// a zero value reverts to the nsqd default
+func (t *Topic) SetMsgTTL(ttl time.Duration) error {
+	t.setMsgTTL(ttl)
+
+	t.ctx.nsqd.Lock()
+	defer t.ctx.nsqd.Unlock()
+	// pro-actively persist metadata so in case of process failure
+	// nsqd won't lose the topic's TTL
+	return t.ctx.nsqd.PersistMetadata()
+}
+
+func (t *Topic) setMsgTTL(ttl time.Duration) {
+	t.Lock()
+	t.msgTTL = ttl
+	t.Unlock()
+
+	// update messagePump state
+	select {
+	case t.channelUpdateChan <- 1:
+	case <-t.exitChan:
+	}
+}
+
+// effectiveMsgTTL returns the default lifetime of messages published
+// to this topic, it must be called with the topic's lock held
+func (t *Topic) effectiveMsgTTL() time.Duration {
+	if t.msgTTL == 0 {
+		return t.ctx.nsqd.opts.MsgTTL
+	}
+	return t.msgTTL
+}
+
+// SetBacklogLimits overrides the maximum depth and bytes of the topic and the
+// policy applied when they are reached, zero values revert to the nsqd defaults
+func (t *Topic) SetBacklogLimits(maxDepth int64, maxBytes int64, policy string) error {
+	t.setBacklogLimits(maxDepth, maxBytes, policy)
+
+	t.ctx.nsqd.Lock()
+	defer t.ctx.nsqd.Unlock()
+	// pro-actively persist metadata so in case of process failure
+	// nsqd won't lose the topic's limits
+	return t.ctx.nsqd.PersistMetadata()
+}
+
+func (t *Topic) setBacklogLimits(maxDepth int64, maxBytes int64, policy string) {
+	t.Lock()
+	t.limits = backlogLimits{maxDepth, maxBytes, policy}
+	t.Unlock()
+}
+
+// effectiveBacklogLimits returns the limits in effect for this topic,
+// it must be called with the topic's lock held
+func (t *Topic) effectiveBacklogLimits() backlogLimits {
+	opts := t.ctx.nsqd.opts
+	return t.limits.withDefaults(backlogLimits{
+		maxDepth: opts.MaxTopicDepth,
+		maxBytes: opts.MaxTopicBytes,
+		policy:   opts.OverflowPolicy,
+	})
+}
+
 // messagePump selects over the in-memory and backend queue and
 // writes messages to every channel for this topic
 func (t *Topic) messagePump() {
@@ -216,11 +341,15 @@ func (t *Topic) messagePump() {
 	var chans []*Channel
 	var memoryMsgChan chan *Message
 	var backendChan chan []byte
+	var retention *retentionLog
+	var msgTTL time.Duration
 
 	t.RLock()
 	for _, c := range t.channelMap {
 		chans = append(chans, c)
 	}
+	retention = t.retention
+	msgTTL = t.effectiveMsgTTL()
 	t.RUnlock()
 
 	if len(chans) > 0 {
@@ -231,18 +360,22 @@ func (t *Topic) messagePump() {
 	for {
 		select {
 		case msg = <-memoryMsgChan:
+			t.backlog.dequeued(msg, t.Depth())
 		case buf = <-backendChan:
 			msg, err = decodeMessage(buf)
 			if err != nil {
 				t.ctx.nsqd.logf("ERROR: failed to decode message - %s", err)
 				continue
 			}
+			t.backlog.dequeued(msg, t.Depth())
 		case <-t.channelUpdateChan:
 			chans = make([]*Channel, 0)
 			t.RLock()
 			for _, c := range t.channelMap {
 				chans = append(chans, c)
 			}
+			retention = t.retention
+			msgTTL = t.effectiveMsgTTL()
 			t.RUnlock()
 			if len(chans) == 0 || t.IsPaused() {
 				memoryMsgChan = nil
@@ -261,11 +394,39 @@ func (t *Topic) messagePump() {
 				backendChan = t.backend.ReadChan()
 			}
 			continue
+		case req := <-t.replayChan:
+			// this happens here so that every message is either written to
+			// the channel by this loop or replayed (and never both)
+			if retention == nil {
+				req.errChan <- errRetentionDisabled
+				continue
+			}
+			_, end := retention.Offsets()
+			req.channel.startReplay(retention, req.offset, end)
+			req.errChan <- nil
+			continue
 		case <-t.exitChan:
 			goto exit
 		}
 
+		// before retention, so that replayed messages expire with the topic's TTL
+		msg.expireAfter(msgTTL)
+
+		if retention != nil {
+			err = retention.Append(msg)
+			if err != nil {
+				t.ctx.nsqd.logf("TOPIC(%s) ERROR: failed to append msg(%s) to retention log - %s",
+					t.name, msg.ID, err)
+			}
+		}
+
+		// channels clear the deferral of the message they're given
+		deferred := msg.deferred
 		for i, channel := range chans {
+			if !channel.matchesFilter(msg) {
+				continue
+			}
+
 			chanMsg := msg
 			// copy the message because each channel
 			// needs a unique instance but...
@@ -274,8 +435,14 @@ func (t *Topic) messagePump() {
 			if i > 0 {
 				chanMsg = NewMessage(msg.ID, msg.Body)
 				chanMsg.Timestamp = msg.Timestamp
+				chanMsg.Headers = msg.Headers
+				chanMsg.Expires = msg.Expires
+			}
+			if deferred != 0 {
+				err = channel.PutMessageDeferred(chanMsg, deferred)
+			} else {
+				err = channel.PutMessage(chanMsg)
 			}
-			err := channel.PutMessage(chanMsg)
 			if err != nil {
 				t.ctx.nsqd.logf(
 					"TOPIC(%s) ERROR: failed to put msg(%s) to channel(%s) - %s",
@@ -326,11 +493,22 @@ func (t *Topic) exit(deleted bool) error {
 		}
 		t.Unlock()
 
+		if t.retention != nil {
+			t.retention.Delete()
+		}
+
 		// empty the queue (deletes the backend files, too)
 		t.Empty()
 		return t.backend.Delete()
 	}
 
+	if t.retention != nil {
+		err := t.retention.Close()
+		if err != nil {
+			t.ctx.nsqd.logf("ERROR: topic(%s) retention log close - %s", t.name, err)
+		}
+	}
+
 	// close all the channels
 	for _, channel := range t.channelMap {
 		err := channel.Close()
@@ -345,6 +523,112 @@ func (t *Topic) exit(deleted bool) error {
 	return t.backend.Close()
 }
 
+type replayRequest struct {
+	channel *Channel
+	offset  int64
+	errChan chan error
+}
+
+// SetRetention keeps the messages written to the topic's channels for the
+// specified amount of time and/or bytes (zero values are unlimited) so that
+// channels can replay them, disabling retention (both zero) discards history
+func (t *Topic) SetRetention(retentionTime time.Duration, retentionBytes int64) error {
+	err := t.setRetention(retentionTime, retentionBytes)
+	if err != nil {
+		return err
+	}
+
+	t.ctx.nsqd.Lock()
+	defer t.ctx.nsqd.Unlock()
+	// pro-actively persist metadata so in case of process failure
+	// nsqd won't lose the topic's retention settings
+	return t.ctx.nsqd.PersistMetadata()
+}
+
+func (t *Topic) setRetention(retentionTime time.Duration, retentionBytes int64) error {
+	var disabled *retentionLog
+	enable := retentionTime > 0 || retentionBytes > 0
+
+	t.Lock()
+	if t.ephemeral {
+		t.Unlock()
+		return errors.New("ephemeral topics do not support retention")
+	}
+	switch {
+	case t.retention == nil && enable:
+		l, err := newRetentionLog(t.name,
+			t.ctx.nsqd.opts.DataPath,
+			t.ctx.nsqd.opts.MaxBytesPerFile,
+			t.ctx.nsqd.opts.SyncEvery,
+			retentionTime,
+			retentionBytes,
+			t.ctx.nsqd.opts.Logger)
+		if err != nil {
+			t.Unlock()
+			return err
+		}
+		t.retention = l
+	case t.retention != nil && enable:
+		t.retention.SetLimits(retentionTime, retentionBytes)
+	case t.retention != nil:
+		disabled = t.retention
+		t.retention = nil
+	}
+	t.Unlock()
+
+	// update messagePump state
+	select {
+	case t.channelUpdateChan <- 1:
+	case <-t.exitChan:
+	}
+
+	// the messagePump is no longer appending to it
+	if disabled != nil {
+		disabled.Delete()
+	}
+
+	return nil
+}
+
+// Retention returns the amount of time and bytes retained
+// (zero values when retention is not enabled)
+func (t *Topic) Retention() (time.Duration, int64) {
+	t.RLock()
+	defer t.RUnlock()
+	if t.retention == nil {
+		return 0, 0
+	}
+	return t.retention.Limits()
+}
+
+// OffsetForTimestamp returns the offset of the first retained
+// message published at or after the specified time
+func (t *Topic) OffsetForTimestamp(ts time.Time) (int64, error) {
+	t.RLock()
+	retention := t.retention
+	t.RUnlock()
+	if retention == nil {
+		return 0, errRetentionDisabled
+	}
+	return retention.OffsetForTimestamp(ts.UnixNano())
+}
+
+// ReplayChannel empties the channel's queue and replays the retained
+// messages starting at the specified offset
+func (t *Topic) ReplayChannel(channel *Channel, offset int64) error {
+	req := replayRequest{
+		channel: channel,
+		offset:  offset,
+		errChan: make(chan error, 1),
+	}
+	select {
+	case t.replayChan <- req:
+	case <-t.exitChan:
+		return errors.New("exiting")
+	}
+	return <-req.errChan
+}
+
 func (t *Topic) Empty() error {
 	for {
 		select {
@@ -355,6 +639,7 @@ func (t *Topic) Empty() error {
 	}
 
 finish:
+	t.backlog.reset()
 	return t.backend.Empty()
 }
 
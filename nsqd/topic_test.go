@@ -1,6 +1,7 @@
 package nsqd
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -169,6 +170,137 @@ func TestPause(t *testing.T) {
 	equal(t, channel.Depth(), int64(1))
 }
 
+func TestDeferredBackend(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_deferred_backend" + strconv.Itoa(int(time.Now().UnixNano()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	topic.Pause()
+
+	// the message overflows to the topic's backend, and keeps its deferral
+	msg := NewMessage(<-nsqd.idChan, []byte("deferred"))
+	msg.deferred = time.Hour
+	err := topic.PutMessage(msg)
+	equal(t, err, nil)
+	equal(t, topic.backend.Depth(), int64(1))
+
+	err = topic.UnPause()
+	equal(t, err, nil)
+
+	for topic.Depth() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(15 * time.Millisecond)
+	equal(t, channel.Depth(), int64(0))
+	channel.Lock()
+	equal(t, len(channel.deferredMessages), 1)
+	channel.Unlock()
+}
+
+func TestBacklogLimits(t *testing.T) {
+	opts := NewNSQDOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MemQueueSize = 2
+	opts.MaxTopicDepth = 3
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topicName := "test_backlog_limits" + strconv.Itoa(int(time.Now().UnixNano()))
+	topic := nsqd.GetTopic(topicName)
+	// keep messages queued in the topic
+	topic.Pause()
+	topic.GetChannel("ch")
+
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(<-nsqd.idChan, []byte(strconv.Itoa(i)))
+		err := topic.PutMessage(msg)
+		equal(t, err, nil)
+	}
+	equal(t, topic.Depth(), int64(3))
+	equal(t, topic.backlog.Bytes(), int64(3))
+
+	// the default policy is to reject
+	err := topic.PutMessage(NewMessage(<-nsqd.idChan, []byte("3")))
+	equal(t, err, errBacklogFull)
+	err = topic.PutMessages([]*Message{NewMessage(<-nsqd.idChan, []byte("3"))})
+	equal(t, err, errBacklogFull)
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	req, _ := http.NewRequest("POST", url, bytes.NewBufferString("3"))
+	req.Header.Set("Accept", "application/vnd.nsq; version=1.0")
+	resp, err := http.DefaultClient.Do(req)
+	equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	equal(t, resp.StatusCode, 503)
+	equal(t, string(body), `{"message":"BACKLOG_FULL"}`)
+
+	err = topic.SetBacklogLimits(0, 0, OverflowDropNewest)
+	equal(t, err, nil)
+	err = topic.PutMessage(NewMessage(<-nsqd.idChan, []byte("3")))
+	equal(t, err, nil)
+	equal(t, topic.Depth(), int64(3))
+	equal(t, topic.backlog.DroppedCount(), uint64(1))
+
+	err = topic.SetBacklogLimits(0, 0, OverflowDropOldest)
+	equal(t, err, nil)
+	err = topic.PutMessage(NewMessage(<-nsqd.idChan, []byte("4")))
+	equal(t, err, nil)
+	equal(t, topic.Depth(), int64(3))
+	equal(t, topic.backlog.DroppedCount(), uint64(2))
+
+	// a per-topic byte limit on top of the nsqd depth limit
+	err = topic.SetBacklogLimits(0, 2, OverflowDropOldest)
+	equal(t, err, nil)
+	err = topic.PutMessage(NewMessage(<-nsqd.idChan, []byte("5")))
+	equal(t, err, nil)
+	equal(t, topic.Depth(), int64(2))
+	equal(t, topic.backlog.Bytes(), int64(2))
+	equal(t, topic.backlog.DroppedCount(), uint64(4))
+
+	stats := nsqd.GetStats()
+	for _, s := range stats {
+		if s.TopicName != topicName {
+			continue
+		}
+		equal(t, s.MaxDepth, int64(3))
+		equal(t, s.MaxBytes, int64(2))
+		equal(t, s.OverflowPolicy, OverflowDropOldest)
+		equal(t, s.DroppedCount, uint64(4))
+	}
+
+	// a full channel that rejects publishes applies back-pressure to the topic
+	topicName = "test_backlog_limits_channel" + strconv.Itoa(int(time.Now().UnixNano()))
+	topic = nsqd.GetTopic(topicName)
+	err = topic.SetBacklogLimits(100, 0, "")
+	equal(t, err, nil)
+	channel := topic.GetChannel("ch")
+	err = channel.SetBacklogLimits(1, 0, OverflowReject)
+	equal(t, err, nil)
+
+	err = topic.PutMessage(NewMessage(<-nsqd.idChan, []byte("0")))
+	equal(t, err, nil)
+	for channel.Depth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	err = topic.PutMessage(NewMessage(<-nsqd.idChan, []byte("1")))
+	equal(t, err, errBacklogFull)
+
+	err = channel.SetBacklogLimits(1, 0, OverflowDropNewest)
+	equal(t, err, nil)
+	err = topic.PutMessage(NewMessage(<-nsqd.idChan, []byte("1")))
+	equal(t, err, nil)
+	for channel.backlog.DroppedCount() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	equal(t, channel.Depth(), int64(1))
+}
+
 func BenchmarkTopicPut(b *testing.B) {
 	b.StopTimer()
 	topicName := "bench_topic_put" + strconv.Itoa(b.N)
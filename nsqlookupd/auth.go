@@ -0,0 +1,80 @@
+package nsqlookupd
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+
+	"github.com/bitly/nsq/util/auth"
+)
+
+var (
+	errAuthRequired = errors.New("auth secret required")
+	errAuthFailed   = errors.New("auth failed")
+	errUnauthorized = errors.New("not authorized")
+)
+
+// lookupdAuth is the result of authenticating a client's secret, a nil
+// AuthState means the shared --auth-secret was given (which grants
+// unrestricted access)
+type lookupdAuth struct {
+	remoteIP   string
+	tlsEnabled bool
+	secret     string
+	state      *auth.AuthState
+}
+
+func (l *NSQLookupd) IsAuthEnabled() bool {
+	return l.opts.AuthSecret != "" || len(l.opts.AuthHTTPAddresses) != 0
+}
+
+// authenticate checks secret against the shared secret and then (if any
+// are configured) the auth servers
+func (l *NSQLookupd) authenticate(remoteIP string, tlsEnabled bool, secret string) (*lookupdAuth, error) {
+	if secret == "" {
+		return nil, errAuthRequired
+	}
+
+	if l.opts.AuthSecret != "" &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(l.opts.AuthSecret)) == 1 {
+		return &lookupdAuth{remoteIP: remoteIP, tlsEnabled: tlsEnabled, secret: secret}, nil
+	}
+
+	if len(l.opts.AuthHTTPAddresses) == 0 {
+		return nil, errAuthFailed
+	}
+
+	state, err := auth.QueryAnyAuthd(l.opts.AuthHTTPAddresses, remoteIP,
+		strconv.FormatBool(tlsEnabled), secret)
+	if err != nil {
+		// we don't want to leak errors contacting the auth server to untrusted clients
+		l.logf("ERROR: auth failed for %s - %s", remoteIP, err)
+		return nil, errAuthFailed
+	}
+	if len(state.Authorizations) == 0 {
+		return nil, errUnauthorized
+	}
+
+	return &lookupdAuth{remoteIP: remoteIP, tlsEnabled: tlsEnabled, secret: secret, state: state}, nil
+}
+
+// isAllowed returns whether the authenticated client has permission on
+// topic (and channel), refetching expired authorizations
+func (l *NSQLookupd) isAllowed(a *lookupdAuth, permission, topic, channel string) (bool, error) {
+	if a.state == nil {
+		return true, nil
+	}
+
+	if a.state.IsExpired() {
+		refreshed, err := l.authenticate(a.remoteIP, a.tlsEnabled, a.secret)
+		if err != nil {
+			return false, err
+		}
+		*a = *refreshed
+		if a.state == nil {
+			return true, nil
+		}
+	}
+
+	return a.state.HasAccess(permission, topic, channel), nil
+}
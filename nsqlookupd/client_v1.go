@@ -7,6 +7,7 @@ import (
 type ClientV1 struct {
 	net.Conn
 	peerInfo *PeerInfo
+	auth     *lookupdAuth
 }
 
 func NewClientV1(conn net.Conn) *ClientV1 {
@@ -1,9 +1,11 @@
 package nsqlookupd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	httpprof "net/http/pprof"
 	"sync/atomic"
@@ -64,6 +66,8 @@ func (s *httpServer) v1Router(w http.ResponseWriter, req *http.Request) error {
 	switch req.URL.Path {
 	case "/ping":
 		s.pingHandler(w, req)
+	case "/metrics":
+		util.PrometheusResponse(w, s.ctx.nsqlookupd.PrometheusMetrics())
 
 	case "/lookup":
 		util.NegotiateAPIResponseWrapper(w, req,
@@ -77,6 +81,8 @@ func (s *httpServer) v1Router(w http.ResponseWriter, req *http.Request) error {
 	case "/nodes":
 		util.NegotiateAPIResponseWrapper(w, req,
 			func() (interface{}, error) { return s.doNodes(req) })
+	case "/topology/events":
+		s.topologyEventsHandler(w, req)
 
 	case "/topic/create":
 		util.V1APIResponseWrapper(w, req, util.POSTRequired(req,
@@ -87,6 +93,9 @@ func (s *httpServer) v1Router(w http.ResponseWriter, req *http.Request) error {
 	case "/topic/tombstone":
 		util.V1APIResponseWrapper(w, req, util.POSTRequired(req,
 			func() (interface{}, error) { return s.doTombstoneTopicProducer(req) }))
+	case "/topic/metadata":
+		util.V1APIResponseWrapper(w, req, util.POSTRequired(req,
+			func() (interface{}, error) { return s.doTopicMetadata(req) }))
 
 	case "/channel/create":
 		util.V1APIResponseWrapper(w, req, util.POSTRequired(req,
@@ -94,6 +103,13 @@ func (s *httpServer) v1Router(w http.ResponseWriter, req *http.Request) error {
 	case "/channel/delete":
 		util.V1APIResponseWrapper(w, req, util.POSTRequired(req,
 			func() (interface{}, error) { return s.doDeleteChannel(req) }))
+	case "/channel/metadata":
+		util.V1APIResponseWrapper(w, req, util.POSTRequired(req,
+			func() (interface{}, error) { return s.doChannelMetadata(req) }))
+
+	case "/peer/registrations":
+		util.V1APIResponseWrapper(w, req,
+			func() (interface{}, error) { return s.doPeerRegistrations(req) })
 
 	default:
 		return errors.New(fmt.Sprintf("404 %s", req.URL.Path))
@@ -141,9 +157,10 @@ func (s *httpServer) doInfo(req *http.Request) (interface{}, error) {
 }
 
 func (s *httpServer) doTopics(req *http.Request) (interface{}, error) {
-	topics := s.ctx.nsqlookupd.DB.FindRegistrations("topic", "*", "").Keys()
+	registrations := s.ctx.nsqlookupd.DB.FindRegistrations("topic", "*", "")
 	return map[string]interface{}{
-		"topics": topics,
+		"topics":   registrations.Keys(),
+		"metadata": s.registrationMetadata(registrations, Registration.key),
 	}, nil
 }
 
@@ -158,9 +175,11 @@ func (s *httpServer) doChannels(req *http.Request) (interface{}, error) {
 		return nil, util.HTTPError{400, "MISSING_ARG_TOPIC"}
 	}
 
-	channels := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
+	registrations := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*")
 	return map[string]interface{}{
-		"channels": channels,
+		"channels":       registrations.SubKeys(),
+		"metadata":       s.registrationMetadata(registrations, Registration.subKey),
+		"topic_metadata": s.ctx.nsqlookupd.DB.GetMetadata(Registration{"topic", topicName, ""}),
 	}, nil
 }
 
@@ -180,13 +199,19 @@ func (s *httpServer) doLookup(req *http.Request) (interface{}, error) {
 		return nil, util.HTTPError{404, "TOPIC_NOT_FOUND"}
 	}
 
-	channels := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
+	channels := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*")
 	producers := s.ctx.nsqlookupd.DB.FindProducers("topic", topicName, "")
 	producers = producers.FilterByActive(s.ctx.nsqlookupd.opts.InactiveProducerTimeout,
 		s.ctx.nsqlookupd.opts.TombstoneLifetime)
+	producers, err = filterProducersByParams(producers, reqParams)
+	if err != nil {
+		return nil, err
+	}
 	return map[string]interface{}{
-		"channels":  channels,
-		"producers": producers.PeerInfo(),
+		"channels":         channels.SubKeys(),
+		"producers":        producers.PeerInfo(),
+		"metadata":         s.ctx.nsqlookupd.DB.GetMetadata(registration[0]),
+		"channel_metadata": s.registrationMetadata(channels, Registration.subKey),
 	}, nil
 }
 
@@ -205,9 +230,19 @@ func (s *httpServer) doCreateTopic(req *http.Request) (interface{}, error) {
 		return nil, util.HTTPError{400, "INVALID_ARG_TOPIC"}
 	}
 
+	err = s.checkAuth(req, reqParams, topicName, "")
+	if err != nil {
+		return nil, err
+	}
+
 	s.ctx.nsqlookupd.logf("DB: adding topic(%s)", topicName)
 	key := Registration{"topic", topicName, ""}
-	s.ctx.nsqlookupd.DB.AddRegistration(key)
+	if s.ctx.nsqlookupd.DB.AddRegistration(key) {
+		s.ctx.nsqlookupd.notifier.Notify(TopologyRegister, key, nil)
+	}
+
+	s.ctx.nsqlookupd.persistMetadata()
+	s.forwardToPeers(req, reqParams)
 
 	return nil, nil
 }
@@ -223,18 +258,28 @@ func (s *httpServer) doDeleteTopic(req *http.Request) (interface{}, error) {
 		return nil, util.HTTPError{400, "MISSING_ARG_TOPIC"}
 	}
 
+	err = s.checkAuth(req, reqParams, topicName, "")
+	if err != nil {
+		return nil, err
+	}
+
 	registrations := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*")
 	for _, registration := range registrations {
 		s.ctx.nsqlookupd.logf("DB: removing channel(%s) from topic(%s)", registration.SubKey, topicName)
 		s.ctx.nsqlookupd.DB.RemoveRegistration(registration)
+		s.ctx.nsqlookupd.notifier.Notify(TopologyUnregister, registration, nil)
 	}
 
 	registrations = s.ctx.nsqlookupd.DB.FindRegistrations("topic", topicName, "")
 	for _, registration := range registrations {
 		s.ctx.nsqlookupd.logf("DB: removing topic(%s)", topicName)
 		s.ctx.nsqlookupd.DB.RemoveRegistration(registration)
+		s.ctx.nsqlookupd.notifier.Notify(TopologyUnregister, registration, nil)
 	}
 
+	s.ctx.nsqlookupd.persistMetadata()
+	s.forwardToPeers(req, reqParams)
+
 	return nil, nil
 }
 
@@ -254,15 +299,25 @@ func (s *httpServer) doTombstoneTopicProducer(req *http.Request) (interface{}, e
 		return nil, util.HTTPError{400, "MISSING_ARG_NODE"}
 	}
 
+	err = s.checkAuth(req, reqParams, topicName, "")
+	if err != nil {
+		return nil, err
+	}
+
 	s.ctx.nsqlookupd.logf("DB: setting tombstone for producer@%s of topic(%s)", node, topicName)
 	producers := s.ctx.nsqlookupd.DB.FindProducers("topic", topicName, "")
 	for _, p := range producers {
 		thisNode := fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HttpPort)
 		if thisNode == node {
 			p.Tombstone()
+			s.ctx.nsqlookupd.notifier.Notify(TopologyTombstone,
+				Registration{"topic", topicName, ""}, p.peerInfo)
 		}
 	}
 
+	s.ctx.nsqlookupd.persistMetadata()
+	s.forwardToPeers(req, reqParams)
+
 	return nil, nil
 }
 
@@ -277,13 +332,25 @@ func (s *httpServer) doCreateChannel(req *http.Request) (interface{}, error) {
 		return nil, util.HTTPError{400, err.Error()}
 	}
 
+	err = s.checkAuth(req, reqParams, topicName, channelName)
+	if err != nil {
+		return nil, err
+	}
+
 	s.ctx.nsqlookupd.logf("DB: adding channel(%s) in topic(%s)", channelName, topicName)
 	key := Registration{"channel", topicName, channelName}
-	s.ctx.nsqlookupd.DB.AddRegistration(key)
+	if s.ctx.nsqlookupd.DB.AddRegistration(key) {
+		s.ctx.nsqlookupd.notifier.Notify(TopologyRegister, key, nil)
+	}
 
 	s.ctx.nsqlookupd.logf("DB: adding topic(%s)", topicName)
 	key = Registration{"topic", topicName, ""}
-	s.ctx.nsqlookupd.DB.AddRegistration(key)
+	if s.ctx.nsqlookupd.DB.AddRegistration(key) {
+		s.ctx.nsqlookupd.notifier.Notify(TopologyRegister, key, nil)
+	}
+
+	s.ctx.nsqlookupd.persistMetadata()
+	s.forwardToPeers(req, reqParams)
 
 	return nil, nil
 }
@@ -299,6 +366,11 @@ func (s *httpServer) doDeleteChannel(req *http.Request) (interface{}, error) {
 		return nil, util.HTTPError{400, err.Error()}
 	}
 
+	err = s.checkAuth(req, reqParams, topicName, channelName)
+	if err != nil {
+		return nil, err
+	}
+
 	registrations := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, channelName)
 	if len(registrations) == 0 {
 		return nil, util.HTTPError{404, "CHANNEL_NOT_FOUND"}
@@ -307,11 +379,157 @@ func (s *httpServer) doDeleteChannel(req *http.Request) (interface{}, error) {
 	s.ctx.nsqlookupd.logf("DB: removing channel(%s) from topic(%s)", channelName, topicName)
 	for _, registration := range registrations {
 		s.ctx.nsqlookupd.DB.RemoveRegistration(registration)
+		s.ctx.nsqlookupd.notifier.Notify(TopologyUnregister, registration, nil)
+	}
+
+	s.ctx.nsqlookupd.persistMetadata()
+	s.forwardToPeers(req, reqParams)
+
+	return nil, nil
+}
+
+func (s *httpServer) doTopicMetadata(req *http.Request) (interface{}, error) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		return nil, util.HTTPError{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, util.HTTPError{400, "MISSING_ARG_TOPIC"}
+	}
+
+	err = s.checkAuth(req, reqParams, topicName, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return s.setMetadata(req, reqParams, Registration{"topic", topicName, ""}, "TOPIC_NOT_FOUND")
+}
+
+func (s *httpServer) doChannelMetadata(req *http.Request) (interface{}, error) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		return nil, util.HTTPError{400, "INVALID_REQUEST"}
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		return nil, util.HTTPError{400, err.Error()}
+	}
+
+	err = s.checkAuth(req, reqParams, topicName, channelName)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.setMetadata(req, reqParams, Registration{"channel", topicName, channelName}, "CHANNEL_NOT_FOUND")
+}
+
+// setMetadata replaces the metadata of a registration with the JSON object
+// of strings in the request body (an empty object clears it)
+func (s *httpServer) setMetadata(req *http.Request, reqParams *util.ReqParams,
+	k Registration, notFound string) (interface{}, error) {
+	var metadata map[string]string
+	err := json.Unmarshal(reqParams.Body, &metadata)
+	if err != nil {
+		return nil, util.HTTPError{400, "INVALID_METADATA"}
+	}
+
+	if !s.ctx.nsqlookupd.DB.SetMetadata(k, metadata) {
+		return nil, util.HTTPError{404, notFound}
 	}
+	s.ctx.nsqlookupd.logf("DB: setting metadata of category:%s key:%s subkey:%s",
+		k.Category, k.Key, k.SubKey)
+
+	s.ctx.nsqlookupd.persistMetadata()
+	s.forwardToPeers(req, reqParams)
 
 	return nil, nil
 }
 
+// registrationMetadata returns the metadata of registrations keyed by name
+func (s *httpServer) registrationMetadata(registrations Registrations,
+	name func(Registration) string) map[string]map[string]string {
+	results := make(map[string]map[string]string)
+	for _, k := range registrations {
+		if metadata := s.ctx.nsqlookupd.DB.GetMetadata(k); metadata != nil {
+			results[name(k)] = metadata
+		}
+	}
+	return results
+}
+
+// checkAuth requires the "admin" permission on topic (and channel) of
+// administrative requests when auth is enabled, the secret is given in the
+// X-NSQ-Auth-Secret header (or, for older clients, as ?auth_secret=)
+func (s *httpServer) checkAuth(req *http.Request, reqParams *util.ReqParams,
+	topicName string, channelName string) error {
+	if !s.ctx.nsqlookupd.IsAuthEnabled() {
+		return nil
+	}
+
+	secret := req.Header.Get(util.AuthSecretHeader)
+	if secret == "" {
+		secret, _ = reqParams.Get("auth_secret")
+	}
+	remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+	a, err := s.ctx.nsqlookupd.authenticate(remoteIP, req.TLS != nil, secret)
+	if err == nil {
+		var ok bool
+		ok, err = s.ctx.nsqlookupd.isAllowed(a, "admin", topicName, channelName)
+		if err == nil && !ok {
+			err = errUnauthorized
+		}
+	}
+
+	switch err {
+	case nil:
+		return nil
+	case errAuthRequired:
+		return util.HTTPError{401, "AUTH_REQUIRED"}
+	case errUnauthorized:
+		return util.HTTPError{403, "UNAUTHORIZED"}
+	}
+	return util.HTTPError{403, "AUTH_FAILED"}
+}
+
+// forwardToPeers repeats a successful administrative request on peers,
+// unless it was itself forwarded by a peer
+func (s *httpServer) forwardToPeers(req *http.Request, reqParams *util.ReqParams) {
+	if _, err := reqParams.Get("replicated"); err == nil {
+		return
+	}
+	s.ctx.nsqlookupd.forwardToPeers(req.Method, req.URL.Path, reqParams.Values, reqParams.Body)
+}
+
+func (s *httpServer) doPeerRegistrations(req *http.Request) (interface{}, error) {
+	return map[string]interface{}{
+		"registrations": s.ctx.nsqlookupd.DB.LocalRegistrations(),
+		"deletions":     s.ctx.nsqlookupd.DB.Deletions(),
+	}, nil
+}
+
+// filterProducersByParams applies the label selector(s) and preferred zone
+// (ie. ?selector=region=us-east&preferred_zone=us-east-1a) of a request
+func filterProducersByParams(producers Producers, reqParams *util.ReqParams) (Producers, error) {
+	selectors, _ := reqParams.GetAll("selector")
+	for _, s := range selectors {
+		selector, err := parseLabelSelector(s)
+		if err != nil {
+			return nil, util.HTTPError{400, "INVALID_ARG_SELECTOR"}
+		}
+		producers = producers.FilterByLabels(selector)
+	}
+
+	zone, err := reqParams.Get("preferred_zone")
+	if err == nil {
+		producers = producers.PreferLabel("zone", zone)
+	}
+
+	return producers, nil
+}
+
 type node struct {
 	RemoteAddress    string   `json:"remote_address"`
 	Hostname         string   `json:"hostname"`
@@ -321,12 +539,23 @@ type node struct {
 	Version          string   `json:"version"`
 	Tombstones       []bool   `json:"tombstones"`
 	Topics           []string `json:"topics"`
+
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 func (s *httpServer) doNodes(req *http.Request) (interface{}, error) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		return nil, util.HTTPError{400, "INVALID_REQUEST"}
+	}
+
 	// dont filter out tombstoned nodes
 	producers := s.ctx.nsqlookupd.DB.FindProducers("client", "", "").FilterByActive(
 		s.ctx.nsqlookupd.opts.InactiveProducerTimeout, 0)
+	producers, err = filterProducersByParams(producers, reqParams)
+	if err != nil {
+		return nil, err
+	}
 	nodes := make([]*node, len(producers))
 	for i, p := range producers {
 		topics := s.ctx.nsqlookupd.DB.LookupRegistrations(p.peerInfo.id).Filter("topic", "*", "").Keys()
@@ -350,6 +579,7 @@ func (s *httpServer) doNodes(req *http.Request) (interface{}, error) {
 			TcpPort:          p.peerInfo.TcpPort,
 			HttpPort:         p.peerInfo.HttpPort,
 			Version:          p.peerInfo.Version,
+			Labels:           p.peerInfo.Labels,
 			Tombstones:       tombstones,
 			Topics:           topics,
 		}
@@ -378,6 +608,7 @@ func (s *httpServer) doDebug(req *http.Request) (interface{}, error) {
 				"last_update":       atomic.LoadInt64(&p.peerInfo.lastUpdate),
 				"tombstoned":        p.tombstoned,
 				"tombstoned_at":     p.tombstonedAt.UnixNano(),
+				"peer":              p.peer,
 			}
 			data[key] = append(data[key], m)
 		}
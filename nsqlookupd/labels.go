@@ -0,0 +1,82 @@
+package nsqlookupd
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/bitly/nsq/util"
+)
+
+type labelRequirement struct {
+	key    string
+	value  string
+	negate bool
+}
+
+// labelSelector matches producers whose labels satisfy every requirement
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses a comma separated list of key=value
+// and key!=value requirements (ie. region=us-east,zone!=us-east-1c)
+func parseLabelSelector(s string) (labelSelector, error) {
+	var selector labelSelector
+	for _, term := range strings.Split(s, ",") {
+		var r labelRequirement
+		parts := strings.SplitN(term, "!=", 2)
+		if len(parts) == 2 {
+			r.negate = true
+		} else {
+			parts = strings.SplitN(term, "=", 2)
+		}
+		if len(parts) != 2 || !util.IsValidLabel(parts[0]) || !util.IsValidLabel(parts[1]) {
+			return nil, errors.New("invalid label selector " + term)
+		}
+		r.key = parts[0]
+		r.value = parts[1]
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+func (ls labelSelector) Matches(labels map[string]string) bool {
+	for _, r := range ls {
+		if (labels[r.key] == r.value) == r.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (pp Producers) FilterByLabels(selector labelSelector) Producers {
+	results := make(Producers, 0)
+	for _, p := range pp {
+		if selector.Matches(p.peerInfo.Labels) {
+			results = append(results, p)
+		}
+	}
+	return results
+}
+
+// PreferLabel orders producers with the given label value first
+func (pp Producers) PreferLabel(key string, value string) Producers {
+	results := make(Producers, len(pp))
+	copy(results, pp)
+	sort.Stable(producersByPreference{results, key, value})
+	return results
+}
+
+type producersByPreference struct {
+	Producers
+	key   string
+	value string
+}
+
+func (p producersByPreference) Len() int { return len(p.Producers) }
+func (p producersByPreference) Swap(i, j int) {
+	p.Producers[i], p.Producers[j] = p.Producers[j], p.Producers[i]
+}
+func (p producersByPreference) Less(i, j int) bool {
+	return p.Producers[i].peerInfo.Labels[p.key] == p.value &&
+		p.Producers[j].peerInfo.Labels[p.key] != p.value
+}
@@ -2,6 +2,7 @@ package nsqlookupd
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -71,6 +72,7 @@ func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
 			if removed, _ := p.ctx.nsqlookupd.DB.RemoveProducer(r, client.peerInfo.id); removed {
 				p.ctx.nsqlookupd.logf("DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
 					client, r.Category, r.Key, r.SubKey)
+				p.ctx.nsqlookupd.notifier.Notify(TopologyUnregister, r, client.peerInfo)
 			}
 		}
 	}
@@ -123,17 +125,32 @@ func (p *LookupProtocolV1) REGISTER(client *ClientV1, reader *bufio.Reader, para
 		return nil, err
 	}
 
+	err = p.CheckAuth(client, "REGISTER", topic, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
 	if channel != "" {
 		key := Registration{"channel", topic, channel}
 		if p.ctx.nsqlookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
 			p.ctx.nsqlookupd.logf("DB: client(%s) REGISTER category:%s key:%s subkey:%s",
 				client, "channel", topic, channel)
+			p.ctx.nsqlookupd.notifier.Notify(TopologyRegister, key, client.peerInfo)
+			changed = true
 		}
 	}
 	key := Registration{"topic", topic, ""}
 	if p.ctx.nsqlookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
 		p.ctx.nsqlookupd.logf("DB: client(%s) REGISTER category:%s key:%s subkey:%s",
 			client, "topic", topic, "")
+		p.ctx.nsqlookupd.notifier.Notify(TopologyRegister, key, client.peerInfo)
+		changed = true
+	}
+
+	// nsqd re-registers periodically, only persist actual changes
+	if changed {
+		p.ctx.nsqlookupd.persistMetadata()
 	}
 
 	return []byte("OK"), nil
@@ -149,12 +166,20 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		return nil, err
 	}
 
+	err = p.CheckAuth(client, "UNREGISTER", topic, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
 	if channel != "" {
 		key := Registration{"channel", topic, channel}
 		removed, left := p.ctx.nsqlookupd.DB.RemoveProducer(key, client.peerInfo.id)
 		if removed {
 			p.ctx.nsqlookupd.logf("DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
 				client, "channel", topic, channel)
+			p.ctx.nsqlookupd.notifier.Notify(TopologyUnregister, key, client.peerInfo)
+			changed = true
 		}
 		// for ephemeral channels, remove the channel as well if it has no producers
 		if left == 0 && strings.HasSuffix(channel, "#ephemeral") {
@@ -170,6 +195,8 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 			if removed, _ := p.ctx.nsqlookupd.DB.RemoveProducer(r, client.peerInfo.id); removed {
 				p.ctx.nsqlookupd.logf("WARNING: client(%s) unexpected UNREGISTER category:%s key:%s subkey:%s",
 					client, "channel", topic, r.SubKey)
+				p.ctx.nsqlookupd.notifier.Notify(TopologyUnregister, r, client.peerInfo)
+				changed = true
 			}
 		}
 
@@ -177,9 +204,15 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		if removed, _ := p.ctx.nsqlookupd.DB.RemoveProducer(key, client.peerInfo.id); removed {
 			p.ctx.nsqlookupd.logf("DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
 				client, "topic", topic, "")
+			p.ctx.nsqlookupd.notifier.Notify(TopologyUnregister, key, client.peerInfo)
+			changed = true
 		}
 	}
 
+	if changed {
+		p.ctx.nsqlookupd.persistMetadata()
+	}
+
 	return []byte("OK"), nil
 }
 
@@ -216,6 +249,26 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 		return nil, util.NewFatalClientErr(nil, "E_BAD_BODY", "IDENTIFY missing fields")
 	}
 
+	for k, v := range peerInfo.Labels {
+		if !util.IsValidLabel(k) || !util.IsValidLabel(v) {
+			return nil, util.NewFatalClientErr(nil, "E_BAD_BODY",
+				fmt.Sprintf("IDENTIFY invalid label %s=%s", k, v))
+		}
+	}
+
+	if p.ctx.nsqlookupd.IsAuthEnabled() {
+		var identify struct {
+			AuthSecret string `json:"auth_secret"`
+		}
+		json.Unmarshal(body, &identify)
+		remoteIP, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+		_, tlsEnabled := client.Conn.(*tls.Conn)
+		client.auth, err = p.ctx.nsqlookupd.authenticate(remoteIP, tlsEnabled, identify.AuthSecret)
+		if err != nil {
+			return nil, authError("IDENTIFY", err)
+		}
+	}
+
 	atomic.StoreInt64(&peerInfo.lastUpdate, time.Now().UnixNano())
 
 	p.ctx.nsqlookupd.logf("CLIENT(%s): IDENTIFY Address:%s TCP:%d HTTP:%d Version:%s",
@@ -246,6 +299,37 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	return response, nil
 }
 
+// CheckAuth requires the "register" permission on topic (and channel)
+// when auth is enabled, refetching expired authorizations
+func (p *LookupProtocolV1) CheckAuth(client *ClientV1, cmd, topic, channel string) error {
+	if !p.ctx.nsqlookupd.IsAuthEnabled() {
+		return nil
+	}
+	if client.auth == nil {
+		return authError(cmd, errAuthRequired)
+	}
+	ok, err := p.ctx.nsqlookupd.isAllowed(client.auth, "register", topic, channel)
+	if err != nil {
+		return authError(cmd, err)
+	}
+	if !ok {
+		return util.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+			fmt.Sprintf("AUTH failed for %s on %q %q", cmd, topic, channel))
+	}
+	return nil
+}
+
+func authError(cmd string, err error) error {
+	switch err {
+	case errAuthRequired:
+		return util.NewFatalClientErr(nil, "E_AUTH_FIRST",
+			fmt.Sprintf("%s auth_secret required", cmd))
+	case errUnauthorized:
+		return util.NewFatalClientErr(nil, "E_UNAUTHORIZED", "AUTH No authorizations found")
+	}
+	return util.NewFatalClientErr(nil, "E_AUTH_FAILED", "AUTH failed")
+}
+
 func (p *LookupProtocolV1) PING(client *ClientV1, params []string) ([]byte, error) {
 	if client.peerInfo != nil {
 		// we could get a PING before other commands on the same client connection
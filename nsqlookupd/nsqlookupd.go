@@ -1,27 +1,51 @@
 package nsqlookupd
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bitly/nsq/util"
 )
 
 type NSQLookupd struct {
-	opts         *nsqlookupdOptions
-	tcpAddr      *net.TCPAddr
-	httpAddr     *net.TCPAddr
-	tcpListener  net.Listener
-	httpListener net.Listener
-	waitGroup    util.WaitGroupWrapper
-	DB           *RegistrationDB
+	opts          *nsqlookupdOptions
+	tcpAddr       *net.TCPAddr
+	httpAddr      *net.TCPAddr
+	httpsAddr     *net.TCPAddr
+	tcpListener   net.Listener
+	httpListener  net.Listener
+	httpsListener net.Listener
+	tlsConfig     *tls.Config
+	peerOpts      *util.RequestOptions
+	waitGroup     util.WaitGroupWrapper
+	exitChan      chan int
+	DB            *RegistrationDB
+	notifier      *topologyNotifier
+
+	metadataLock sync.Mutex
+	lastMetadata []byte
 }
 
 func NewNSQLookupd(opts *nsqlookupdOptions) *NSQLookupd {
 	n := &NSQLookupd{
-		opts: opts,
-		DB:   NewRegistrationDB(),
+		opts:     opts,
+		exitChan: make(chan int),
+		DB:       NewRegistrationDB(),
+		notifier: newTopologyNotifier(),
 	}
 
 	tcpAddr, err := net.ResolveTCPAddr("tcp", opts.TCPAddress)
@@ -38,6 +62,56 @@ func NewNSQLookupd(opts *nsqlookupdOptions) *NSQLookupd {
 	}
 	n.httpAddr = httpAddr
 
+	if opts.HTTPSAddress != "" {
+		httpsAddr, err := net.ResolveTCPAddr("tcp", opts.HTTPSAddress)
+		if err != nil {
+			n.logf("FATAL: failed to resolve HTTPS address (%s) - %s", opts.HTTPSAddress, err)
+			os.Exit(1)
+		}
+		n.httpsAddr = httpsAddr
+	}
+
+	if opts.TLSClientAuthPolicy != "" {
+		opts.TLSRequired = true
+	}
+
+	tlsConfig, err := buildTLSConfig(opts)
+	if err != nil {
+		n.logf("FATAL: failed to build TLS config - %s", err)
+		os.Exit(1)
+	}
+	if tlsConfig == nil && opts.TLSRequired {
+		n.logf("FATAL: cannot require TLS client connections without TLS key and cert")
+		os.Exit(1)
+	}
+	n.tlsConfig = tlsConfig
+
+	// peers authenticate to each other with the shared secret only, an auth
+	// server would deny their forwarded and replication requests
+	if len(opts.PeerHTTPAddresses) > 0 && len(opts.AuthHTTPAddresses) > 0 && opts.AuthSecret == "" {
+		n.logf("FATAL: --peer-http-address with --auth-http-address requires a shared --auth-secret")
+		os.Exit(1)
+	}
+
+	if len(opts.PeerHTTPAddresses) > 0 {
+		// long enough for every peer to have synced a deletion
+		n.DB.deletionLifetime = peerDeletionSyncs * opts.PeerSyncInterval
+	}
+
+	peerTLSConfig, err := buildPeerTLSConfig(opts)
+	if err != nil {
+		n.logf("FATAL: failed to build peer TLS config - %s", err)
+		os.Exit(1)
+	}
+	n.peerOpts = &util.RequestOptions{
+		Header:    http.Header{},
+		TLSConfig: peerTLSConfig,
+	}
+	// peers are expected to share the secret
+	if opts.AuthSecret != "" {
+		n.peerOpts.Header.Set(util.AuthSecretHeader, opts.AuthSecret)
+	}
+
 	n.logf(util.Version("nsqlookupd"))
 
 	return n
@@ -64,6 +138,19 @@ func (l *NSQLookupd) Main() {
 		util.TCPServer(tcpListener, tcpServer, l.opts.Logger)
 	})
 
+	if l.tlsConfig != nil && l.httpsAddr != nil {
+		httpsListener, err := tls.Listen("tcp", l.httpsAddr.String(), l.tlsConfig)
+		if err != nil {
+			l.logf("FATAL: listen (%s) failed - %s", l.httpsAddr, err)
+			os.Exit(1)
+		}
+		l.httpsListener = httpsListener
+		httpsServer := &httpServer{ctx: ctx}
+		l.waitGroup.Wrap(func() {
+			util.HTTPServer(httpsListener, httpsServer, l.opts.Logger, "HTTPS")
+		})
+	}
+
 	httpListener, err := net.Listen("tcp", l.httpAddr.String())
 	if err != nil {
 		l.logf("FATAL: listen (%s) failed - %s", l.httpAddr, err)
@@ -74,6 +161,209 @@ func (l *NSQLookupd) Main() {
 	l.waitGroup.Wrap(func() {
 		util.HTTPServer(httpListener, httpServer, l.opts.Logger, "HTTP")
 	})
+
+	if len(l.opts.PeerHTTPAddresses) > 0 {
+		l.waitGroup.Wrap(func() { l.peerLoop() })
+	}
+}
+
+type metadataRegistration struct {
+	Category string `json:"category"`
+	Key      string `json:"key"`
+	SubKey   string `json:"subkey"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type metadataTombstone struct {
+	metadataRegistration
+	Address      string `json:"address"`
+	TombstonedAt int64  `json:"tombstoned_at"`
+}
+
+func (r metadataRegistration) less(o metadataRegistration) bool {
+	if r.Category != o.Category {
+		return r.Category < o.Category
+	}
+	if r.Key != o.Key {
+		return r.Key < o.Key
+	}
+	return r.SubKey < o.SubKey
+}
+
+// metadata is sorted so that unchanged metadata is written identically
+type metadataRegistrations []metadataRegistration
+
+func (s metadataRegistrations) Len() int           { return len(s) }
+func (s metadataRegistrations) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s metadataRegistrations) Less(i, j int) bool { return s[i].less(s[j]) }
+
+type metadataTombstones []metadataTombstone
+
+func (s metadataTombstones) Len() int      { return len(s) }
+func (s metadataTombstones) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s metadataTombstones) Less(i, j int) bool {
+	if s[i].less(s[j].metadataRegistration) {
+		return true
+	}
+	if s[j].less(s[i].metadataRegistration) {
+		return false
+	}
+	if s[i].Address != s[j].Address {
+		return s[i].Address < s[j].Address
+	}
+	return s[i].TombstonedAt < s[j].TombstonedAt
+}
+
+func (l *NSQLookupd) metadataFile() string {
+	return path.Join(l.opts.DataPath, "nsqlookupd.dat")
+}
+
+// LoadMetadata restores the topics and channels (and active tombstones)
+// persisted by PersistMetadata
+func (l *NSQLookupd) LoadMetadata() {
+	if l.opts.DataPath == "" {
+		return
+	}
+
+	fn := l.metadataFile()
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			l.logf("ERROR: failed to read metadata from %s - %s", fn, err)
+		}
+		return
+	}
+
+	var metadata struct {
+		Registrations []metadataRegistration `json:"registrations"`
+		Tombstones    []metadataTombstone    `json:"tombstones"`
+	}
+	err = json.Unmarshal(data, &metadata)
+	if err != nil {
+		l.logf("ERROR: failed to parse metadata - %s", err)
+		return
+	}
+
+	for _, r := range metadata.Registrations {
+		if r.Category != "topic" && r.Category != "channel" {
+			l.logf("WARNING: skipping registration with invalid category %s", r.Category)
+			continue
+		}
+		if !util.IsValidTopicName(r.Key) ||
+			(r.Category == "channel" && !util.IsValidChannelName(r.SubKey)) {
+			l.logf("WARNING: skipping invalid registration %s:%s:%s", r.Category, r.Key, r.SubKey)
+			continue
+		}
+		l.logf("DB: loading category:%s key:%s subkey:%s", r.Category, r.Key, r.SubKey)
+		k := Registration{r.Category, r.Key, r.SubKey}
+		l.DB.AddRegistration(k)
+		l.DB.SetMetadata(k, r.Metadata)
+	}
+
+	now := time.Now()
+	for _, t := range metadata.Tombstones {
+		tombstonedAt := time.Unix(0, t.TombstonedAt)
+		if now.Sub(tombstonedAt) >= l.opts.TombstoneLifetime {
+			continue
+		}
+		l.logf("DB: loading tombstone for producer@%s of category:%s key:%s subkey:%s",
+			t.Address, t.Category, t.Key, t.SubKey)
+		l.DB.AddTombstone(Registration{t.Category, t.Key, t.SubKey}, t.Address, tombstonedAt)
+	}
+}
+
+// PersistMetadata writes the topics and channels (and active tombstones)
+// in the RegistrationDB to the data path, if configured, so that upon
+// restart we can get back to the same state
+func (l *NSQLookupd) PersistMetadata() error {
+	if l.opts.DataPath == "" {
+		return nil
+	}
+
+	l.metadataLock.Lock()
+	defer l.metadataLock.Unlock()
+
+	registrations := make(metadataRegistrations, 0)
+	tombstones := make(metadataTombstones, 0)
+	now := time.Now()
+
+	l.DB.RLock()
+	for k, producers := range l.DB.registrationMap {
+		if k.Category != "topic" && k.Category != "channel" {
+			continue
+		}
+		// ephemeral channels go away with their last producer
+		if strings.HasSuffix(k.SubKey, "#ephemeral") {
+			continue
+		}
+		r := metadataRegistration{k.Category, k.Key, k.SubKey, l.DB.metadata[k]}
+		registrations = append(registrations, r)
+		// tombstones only identify the registration
+		r.Metadata = nil
+		for _, p := range producers {
+			if p.IsTombstoned(l.opts.TombstoneLifetime) {
+				tombstones = append(tombstones,
+					metadataTombstone{r, p.peerInfo.address(), p.tombstonedAt.UnixNano()})
+			}
+		}
+		for address, tombstonedAt := range l.DB.tombstones[k] {
+			if now.Sub(tombstonedAt) < l.opts.TombstoneLifetime {
+				tombstones = append(tombstones,
+					metadataTombstone{r, address, tombstonedAt.UnixNano()})
+			}
+		}
+	}
+	l.DB.RUnlock()
+
+	sort.Sort(registrations)
+	sort.Sort(tombstones)
+
+	data, err := json.Marshal(map[string]interface{}{
+		"registrations": registrations,
+		"tombstones":    tombstones,
+	})
+	if err != nil {
+		return err
+	}
+
+	// eg. a producer registering a topic that already exists doesn't
+	// change the metadata, skip unchanged writes
+	if bytes.Equal(data, l.lastMetadata) {
+		return nil
+	}
+
+	fileName := l.metadataFile()
+	l.logf("DB: persisting metadata to %s", fileName)
+
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	err = util.AtomicRename(tmpFileName, fileName)
+	if err != nil {
+		return err
+	}
+
+	l.lastMetadata = data
+	return nil
+}
+
+func (l *NSQLookupd) persistMetadata() {
+	err := l.PersistMetadata()
+	if err != nil {
+		l.logf("ERROR: failed to persist metadata - %s", err)
+	}
 }
 
 func (l *NSQLookupd) Exit() {
@@ -84,5 +374,89 @@ func (l *NSQLookupd) Exit() {
 	if l.httpListener != nil {
 		l.httpListener.Close()
 	}
+
+	if l.httpsListener != nil {
+		l.httpsListener.Close()
+	}
+
+	close(l.exitChan)
 	l.waitGroup.Wait()
+
+	l.persistMetadata()
+}
+
+func buildTLSConfig(opts *nsqlookupdOptions) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+
+	if opts.TLSCert == "" && opts.TLSKey == "" {
+		return nil, nil
+	}
+
+	tlsClientAuthPolicy := tls.VerifyClientCertIfGiven
+
+	cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	switch opts.TLSClientAuthPolicy {
+	case "require":
+		tlsClientAuthPolicy = tls.RequireAnyClientCert
+	case "require-verify":
+		tlsClientAuthPolicy = tls.RequireAndVerifyClientCert
+	default:
+		tlsClientAuthPolicy = tls.NoClientCert
+	}
+
+	tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tlsClientAuthPolicy,
+	}
+
+	if opts.TLSRootCAFile != "" {
+		tlsCertPool, err := loadCertPool(opts.TLSRootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = tlsCertPool
+	}
+
+	tlsConfig.BuildNameToCertificate()
+
+	return tlsConfig, nil
+}
+
+// buildPeerTLSConfig returns the client TLS config for https:// peers, which
+// are verified with the root CA file (if given) and presented with our cert
+func buildPeerTLSConfig(opts *nsqlookupdOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if opts.TLSCert != "" || opts.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.TLSRootCAFile != "" {
+		tlsCertPool, err := loadCertPool(opts.TLSRootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = tlsCertPool
+	}
+
+	return tlsConfig, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	tlsCertPool := x509.NewCertPool()
+	caCertFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
+		return nil, errors.New("failed to append certificate to pool")
+	}
+	return tlsCertPool, nil
 }
@@ -1,11 +1,21 @@
 package nsqlookupd
 
 import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -381,3 +391,653 @@ func TestTombstonedNodes(t *testing.T) {
 	equal(t, producers[0].Topics[0].Topic, topicName)
 	equal(t, producers[0].Topics[0].Tombstoned, true)
 }
+
+func TestMetrics(t *testing.T) {
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "metrics"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn, "ip.address", 5000, 5555, "fake-version")
+
+	nsq.Register(topicName, "ch1").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	equal(t, err, nil)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", httpAddr))
+	equal(t, err, nil)
+	defer resp.Body.Close()
+	equal(t, resp.StatusCode, 200)
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	for _, line := range []string{
+		"nsqlookupd_producers 1",
+		"nsqlookupd_topics 1",
+		"nsqlookupd_channels 1",
+		`nsqlookupd_topic_producers{topic="metrics"} 1`,
+		`nsqlookupd_channel_producers{topic="metrics",channel="ch1"} 1`,
+	} {
+		equal(t, strings.Contains(string(body), line+"\n"), true)
+	}
+}
+
+func TestPeerReplication(t *testing.T) {
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	peerOpts := NewNSQLookupdOptions()
+	peerOpts.Logger = newTestLogger(t)
+	peerOpts.PeerHTTPAddresses = []string{httpAddr.String()}
+	peerOpts.PeerSyncInterval = 25 * time.Millisecond
+	_, peerHTTPAddr, peer := mustStartLookupd(peerOpts)
+	defer peer.Exit()
+
+	topicName := "peer_replication"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn, "ip.address", 5000, 5555, "fake-version")
+	nsq.Register(topicName, "ch1").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	equal(t, err, nil)
+
+	endpoint := fmt.Sprintf("http://%s/topic/create?topic=%s_created", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err, nil)
+
+	time.Sleep(100 * time.Millisecond)
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s", peerHTTPAddr, topicName)
+	data, err := util.APIRequestNegotiateV1("GET", endpoint, nil)
+	equal(t, err, nil)
+	equal(t, len(data.Get("channels").MustArray()), 1)
+	producers := data.Get("producers").MustArray()
+	equal(t, len(producers), 1)
+	producer := producers[0].(map[string]interface{})
+	equal(t, producer["broadcast_address"], "ip.address")
+
+	topics := peer.DB.FindRegistrations("topic", topicName+"_created", "")
+	equal(t, len(topics), 1)
+
+	endpoint = fmt.Sprintf("http://%s/topic/tombstone?topic=%s&node=ip.address:5555", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err, nil)
+
+	time.Sleep(100 * time.Millisecond)
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s", peerHTTPAddr, topicName)
+	data, err = util.APIRequestNegotiateV1("GET", endpoint, nil)
+	equal(t, err, nil)
+	equal(t, len(data.Get("producers").MustArray()), 0)
+
+	// deletes are forwarded to peers
+	endpoint = fmt.Sprintf("http://%s/topic/delete?topic=%s_created", peerHTTPAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err, nil)
+
+	time.Sleep(100 * time.Millisecond)
+
+	topics = nsqlookupd.DB.FindRegistrations("topic", topicName+"_created", "")
+	equal(t, len(topics), 0)
+	topics = peer.DB.FindRegistrations("topic", topicName+"_created", "")
+	equal(t, len(topics), 0)
+
+	// producers that go away are removed from peers
+	conn.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	producers = nil
+	for _, p := range peer.DB.FindProducers("client", "", "") {
+		if p.peer != "" {
+			producers = append(producers, p)
+		}
+	}
+	equal(t, len(producers), 0)
+}
+
+func TestPeerForwardHTTPS(t *testing.T) {
+	reqChan := make(chan *http.Request, 1)
+	peerServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/topic/create" {
+			reqChan <- req
+		}
+		w.Write([]byte(`{"status_code":200,"status_txt":"OK","data":{}}`))
+	}))
+	defer peerServer.Close()
+
+	caFile, err := ioutil.TempFile("", "nsqlookupd-test-ca-")
+	equal(t, err, nil)
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: peerServer.Certificate().Raw})
+	caFile.Close()
+
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	opts.AuthSecret = "s3cret"
+	opts.TLSRootCAFile = caFile.Name()
+	opts.PeerHTTPAddresses = []string{peerServer.URL}
+	opts.PeerSyncInterval = time.Hour
+	_, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	header := http.Header{}
+	header.Set(util.AuthSecretHeader, "s3cret")
+	endpoint := fmt.Sprintf("http://%s/topic/create?topic=peer_https", httpAddr)
+	_, err = util.APIRequestNegotiateV1WithOptions("POST", endpoint, nil,
+		&util.RequestOptions{Header: header})
+	equal(t, err, nil)
+
+	select {
+	case req := <-reqChan:
+		equal(t, req.TLS != nil, true)
+		equal(t, req.Header.Get(util.AuthSecretHeader), "s3cret")
+		equal(t, req.URL.Query().Get("topic"), "peer_https")
+		equal(t, req.URL.Query().Get("replicated"), "true")
+		equal(t, req.URL.Query().Get("auth_secret"), "")
+	case <-time.After(time.Second):
+		t.Fatal("request was not forwarded to peer")
+	}
+}
+
+func TestPersistMetadata(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsqlookupd-test-")
+	equal(t, err, nil)
+	defer os.RemoveAll(dataPath)
+
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	opts.DataPath = dataPath
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+
+	topicName := "persist_metadata"
+
+	endpoint := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err, nil)
+
+	endpoint = fmt.Sprintf("http://%s/topic/metadata?topic=%s", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, strings.NewReader(`{"owner":"data-team"}`))
+	equal(t, err, nil)
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	identify(t, conn, "ip.address", 5000, 5555, "fake-version")
+	nsq.Register(topicName, "ch#ephemeral").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	equal(t, err, nil)
+
+	endpoint = fmt.Sprintf("http://%s/topic/tombstone?topic=%s&node=ip.address:5555", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err, nil)
+
+	conn.Close()
+	nsqlookupd.Exit()
+
+	tcpAddr, httpAddr, nsqlookupd = mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+	nsqlookupd.LoadMetadata()
+
+	equal(t, len(nsqlookupd.DB.FindRegistrations("topic", topicName, "")), 1)
+	channels := nsqlookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
+	equal(t, channels, []string{"ch"})
+	equal(t, nsqlookupd.DB.GetMetadata(Registration{"topic", topicName, ""}),
+		map[string]string{"owner": "data-team"})
+
+	// the tombstone applies once the producer registers again
+	conn = mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn, "ip.address", 5000, 5555, "fake-version")
+	nsq.Register(topicName, "").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	equal(t, err, nil)
+
+	producers := nsqlookupd.DB.FindProducers("topic", topicName, "")
+	equal(t, len(producers), 1)
+	equal(t, producers[0].IsTombstoned(opts.TombstoneLifetime), true)
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	data, err := util.APIRequestNegotiateV1("GET", endpoint, nil)
+	equal(t, err, nil)
+	equal(t, len(data.Get("producers").MustArray()), 0)
+}
+
+func TestPersistMetadataUnchanged(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsqlookupd-test-")
+	equal(t, err, nil)
+	defer os.RemoveAll(dataPath)
+
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	opts.DataPath = dataPath
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "persist_unchanged"
+
+	for i := 0; i < 20; i++ {
+		endpoint := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch%d", httpAddr, topicName, i)
+		_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+		equal(t, err, nil)
+	}
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	identify(t, conn, "ip.address", 5000, 5555, "fake-version")
+	nsq.Register(topicName, "ch0").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	equal(t, err, nil)
+
+	// the file is only rewritten when the metadata changes
+	fileName := nsqlookupd.metadataFile()
+	err = os.Remove(fileName)
+	equal(t, err, nil)
+
+	nsq.Register(topicName, "ch0").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	equal(t, err, nil)
+	err = nsqlookupd.PersistMetadata()
+	equal(t, err, nil)
+	_, err = os.Stat(fileName)
+	equal(t, os.IsNotExist(err), true)
+
+	endpoint := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch20", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err, nil)
+	_, err = os.Stat(fileName)
+	equal(t, err, nil)
+
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestLookupLabels(t *testing.T) {
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "lookup_labels"
+
+	for i, zone := range []string{"us-east-1a", "us-east-1b", "us-west-1a"} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+
+		ci := make(map[string]interface{})
+		ci["tcp_port"] = 5000 + i
+		ci["http_port"] = 5555 + i
+		ci["broadcast_address"] = zone
+		ci["hostname"] = zone
+		ci["version"] = "fake-version"
+		ci["labels"] = map[string]string{
+			"zone":   zone,
+			"region": zone[:len(zone)-3],
+		}
+		cmd, _ := nsq.Identify(ci)
+		_, err := cmd.WriteTo(conn)
+		equal(t, err, nil)
+		_, err = nsq.ReadResponse(conn)
+		equal(t, err, nil)
+
+		nsq.Register(topicName, "").WriteTo(conn)
+		_, err = nsq.ReadResponse(conn)
+		equal(t, err, nil)
+	}
+
+	lookup := func(endpoint string) []string {
+		data, err := util.APIRequestNegotiateV1("GET", endpoint, nil)
+		equal(t, err, nil)
+		var addresses []string
+		for i := range data.Get("producers").MustArray() {
+			producer := data.Get("producers").GetIndex(i)
+			addresses = append(addresses, producer.Get("broadcast_address").MustString())
+		}
+		return addresses
+	}
+
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s&selector=region=us-east", httpAddr, topicName)
+	producers := lookup(endpoint)
+	equal(t, len(producers), 2)
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s&selector=region=us-east,zone!=us-east-1a",
+		httpAddr, topicName)
+	equal(t, lookup(endpoint), []string{"us-east-1b"})
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s&preferred_zone=us-west-1a", httpAddr, topicName)
+	producers = lookup(endpoint)
+	equal(t, len(producers), 3)
+	equal(t, producers[0], "us-west-1a")
+
+	endpoint = fmt.Sprintf("http://%s/nodes?selector=zone=us-west-1a", httpAddr)
+	data, err := util.APIRequestNegotiateV1("GET", endpoint, nil)
+	equal(t, err, nil)
+	equal(t, len(data.Get("producers").MustArray()), 1)
+	equal(t, data.Get("producers").GetIndex(0).Get("labels").Get("region").MustString(), "us-west")
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s&selector=zone", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("GET", endpoint, nil)
+	equal(t, err != nil, true)
+}
+
+func TestTopologyEvents(t *testing.T) {
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "topology_events"
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/topology/events?topic=%s", httpAddr, topicName))
+	equal(t, err, nil)
+	defer resp.Body.Close()
+	equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+	reader := bufio.NewReader(resp.Body)
+
+	readEvent := func() (string, map[string]interface{}) {
+		var eventType string
+		var event map[string]interface{}
+		for {
+			line, err := reader.ReadString('\n')
+			equal(t, err, nil)
+			line = strings.TrimSpace(line)
+			if line == "" && eventType != "" {
+				return eventType, event
+			}
+			if strings.HasPrefix(line, "event: ") {
+				eventType = line[len("event: "):]
+			} else if strings.HasPrefix(line, "data: ") {
+				err = json.Unmarshal([]byte(line[len("data: "):]), &event)
+				equal(t, err, nil)
+			}
+		}
+	}
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	identify(t, conn, "ip.address", 5000, 5555, "fake-version")
+
+	// events for other topics are filtered out
+	nsq.Register(topicName+"_other", "").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	equal(t, err, nil)
+
+	nsq.Register(topicName, "ch").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	equal(t, err, nil)
+
+	eventType, event := readEvent()
+	equal(t, eventType, TopologyRegister)
+	equal(t, event["category"], "channel")
+	equal(t, event["channel"], "ch")
+	equal(t, event["producer"].(map[string]interface{})["broadcast_address"], "ip.address")
+
+	eventType, event = readEvent()
+	equal(t, eventType, TopologyRegister)
+	equal(t, event["category"], "topic")
+	equal(t, event["topic"], topicName)
+
+	endpoint := fmt.Sprintf("http://%s/topic/tombstone?topic=%s&node=ip.address:5555", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err, nil)
+
+	eventType, _ = readEvent()
+	equal(t, eventType, TopologyTombstone)
+
+	conn.Close()
+
+	eventType, _ = readEvent()
+	equal(t, eventType, TopologyUnregister)
+	eventType, _ = readEvent()
+	equal(t, eventType, TopologyUnregister)
+
+	// administrative changes
+	topicName = "topology_events_http"
+	resp, err = http.Get(fmt.Sprintf("http://%s/topology/events?topic=%s", httpAddr, topicName))
+	equal(t, err, nil)
+	defer resp.Body.Close()
+	reader = bufio.NewReader(resp.Body)
+
+	endpoint = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err, nil)
+
+	eventType, event = readEvent()
+	equal(t, eventType, TopologyRegister)
+	equal(t, event["category"], "channel")
+	equal(t, event["producer"], nil)
+	eventType, event = readEvent()
+	equal(t, eventType, TopologyRegister)
+	equal(t, event["category"], "topic")
+
+	endpoint = fmt.Sprintf("http://%s/topic/delete?topic=%s", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err, nil)
+
+	eventType, event = readEvent()
+	equal(t, eventType, TopologyUnregister)
+	equal(t, event["category"], "channel")
+	eventType, event = readEvent()
+	equal(t, eventType, TopologyUnregister)
+	equal(t, event["category"], "topic")
+}
+
+func TestRegistrationMetadata(t *testing.T) {
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "registration_metadata"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn, "ip.address", 5000, 5555, "fake-version")
+	nsq.Register(topicName, "ch").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	equal(t, err, nil)
+
+	endpoint := fmt.Sprintf("http://%s/topic/metadata?topic=%s", httpAddr, topicName)
+	body := strings.NewReader(`{"owner":"data-team","description":"page views"}`)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, body)
+	equal(t, err, nil)
+
+	endpoint = fmt.Sprintf("http://%s/channel/metadata?topic=%s&channel=ch", httpAddr, topicName)
+	body = strings.NewReader(`{"owner":"search-team"}`)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, body)
+	equal(t, err, nil)
+
+	endpoint = fmt.Sprintf("http://%s/topics", httpAddr)
+	data, err := util.APIRequestNegotiateV1("GET", endpoint, nil)
+	equal(t, err, nil)
+	equal(t, data.Get("metadata").Get(topicName).Get("owner").MustString(), "data-team")
+
+	endpoint = fmt.Sprintf("http://%s/channels?topic=%s", httpAddr, topicName)
+	data, err = util.APIRequestNegotiateV1("GET", endpoint, nil)
+	equal(t, err, nil)
+	equal(t, data.Get("metadata").Get("ch").Get("owner").MustString(), "search-team")
+	equal(t, data.Get("topic_metadata").Get("description").MustString(), "page views")
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	data, err = util.APIRequestNegotiateV1("GET", endpoint, nil)
+	equal(t, err, nil)
+	equal(t, data.Get("metadata").Get("description").MustString(), "page views")
+	equal(t, data.Get("channel_metadata").Get("ch").Get("owner").MustString(), "search-team")
+
+	// an empty object clears the metadata
+	endpoint = fmt.Sprintf("http://%s/channel/metadata?topic=%s&channel=ch", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, strings.NewReader(`{}`))
+	equal(t, err, nil)
+	equal(t, nsqlookupd.DB.GetMetadata(Registration{"channel", topicName, "ch"}) == nil, true)
+
+	endpoint = fmt.Sprintf("http://%s/topic/metadata?topic=%s", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, strings.NewReader(`{"owner":1}`))
+	equal(t, err != nil, true)
+
+	endpoint = fmt.Sprintf("http://%s/topic/metadata?topic=%s_missing", httpAddr, topicName)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, strings.NewReader(`{"owner":"x"}`))
+	equal(t, err != nil, true)
+}
+
+func identifyWithSecret(t *testing.T, conn net.Conn, address string, secret string) []byte {
+	ci := make(map[string]interface{})
+	ci["tcp_port"] = 5000
+	ci["http_port"] = 5555
+	ci["broadcast_address"] = address
+	ci["hostname"] = address
+	ci["version"] = "fake-version"
+	if secret != "" {
+		ci["auth_secret"] = secret
+	}
+	cmd, _ := nsq.Identify(ci)
+	_, err := cmd.WriteTo(conn)
+	equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	equal(t, err, nil)
+	return resp
+}
+
+func TestAuthSecret(t *testing.T) {
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	opts.AuthSecret = "s3cret"
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	resp := identifyWithSecret(t, conn, "ip.address", "")
+	equal(t, strings.HasPrefix(string(resp), "E_AUTH_FIRST"), true)
+	conn.Close()
+
+	conn = mustConnectLookupd(t, tcpAddr)
+	resp = identifyWithSecret(t, conn, "ip.address", "wrong")
+	equal(t, strings.HasPrefix(string(resp), "E_AUTH_FAILED"), true)
+	conn.Close()
+
+	conn = mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	resp = identifyWithSecret(t, conn, "ip.address", "s3cret")
+	equal(t, strings.HasPrefix(string(resp), "E_"), false)
+	nsq.Register("auth_secret", "ch").WriteTo(conn)
+	resp, err := nsq.ReadResponse(conn)
+	equal(t, err, nil)
+	equal(t, resp, []byte("OK"))
+
+	endpoint := fmt.Sprintf("http://%s/topic/tombstone?topic=auth_secret&node=ip.address:5555", httpAddr)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err != nil && strings.Contains(err.Error(), "401"), true)
+
+	_, err = util.APIRequestNegotiateV1("POST", endpoint+"&auth_secret=wrong", nil)
+	equal(t, err != nil && strings.Contains(err.Error(), "403"), true)
+
+	header := http.Header{}
+	header.Set(util.AuthSecretHeader, "wrong")
+	_, err = util.APIRequestNegotiateV1WithOptions("POST", endpoint, nil,
+		&util.RequestOptions{Header: header})
+	equal(t, err != nil && strings.Contains(err.Error(), "403"), true)
+
+	header.Set(util.AuthSecretHeader, "s3cret")
+	_, err = util.APIRequestNegotiateV1WithOptions("POST", endpoint, nil,
+		&util.RequestOptions{Header: header})
+	equal(t, err, nil)
+
+	_, err = util.APIRequestNegotiateV1("POST", endpoint+"&auth_secret=s3cret", nil)
+	equal(t, err, nil)
+	producers := nsqlookupd.DB.FindProducers("topic", "auth_secret", "")
+	equal(t, len(producers), 1)
+	equal(t, producers[0].tombstoned, true)
+
+	// reads don't require auth
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=auth_secret", httpAddr)
+	_, err = util.APIRequestNegotiateV1("GET", endpoint, nil)
+	equal(t, err, nil)
+}
+
+func TestAuthServer(t *testing.T) {
+	authd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("secret") != "token" {
+			http.Error(w, "FORBIDDEN", 403)
+			return
+		}
+		io.WriteString(w, `{"ttl":3600,"identity":"nsqd","authorizations":[`+
+			`{"topic":"^allowed","channels":[".*"],"permissions":["register"]},`+
+			`{"topic":"^allowed","channels":["^admin"],"permissions":["admin"]}]}`)
+	}))
+	defer authd.Close()
+
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	opts.AuthHTTPAddresses = []string{strings.TrimPrefix(authd.URL, "http://")}
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	resp := identifyWithSecret(t, conn, "ip.address", "bad-token")
+	equal(t, strings.HasPrefix(string(resp), "E_AUTH_FAILED"), true)
+	conn.Close()
+
+	conn = mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	resp = identifyWithSecret(t, conn, "ip.address", "token")
+	equal(t, strings.HasPrefix(string(resp), "E_"), false)
+
+	nsq.Register("allowed_topic", "ch").WriteTo(conn)
+	resp, err := nsq.ReadResponse(conn)
+	equal(t, err, nil)
+	equal(t, resp, []byte("OK"))
+
+	nsq.Register("other_topic", "").WriteTo(conn)
+	resp, err = nsq.ReadResponse(conn)
+	equal(t, err, nil)
+	equal(t, strings.HasPrefix(string(resp), "E_UNAUTHORIZED"), true)
+	equal(t, len(nsqlookupd.DB.FindRegistrations("topic", "other_topic", "")), 0)
+
+	endpoint := fmt.Sprintf("http://%s/channel/create?topic=allowed_topic&channel=admin_ch&auth_secret=token", httpAddr)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err, nil)
+	equal(t, len(nsqlookupd.DB.FindRegistrations("channel", "allowed_topic", "admin_ch")), 1)
+
+	endpoint = fmt.Sprintf("http://%s/channel/delete?topic=allowed_topic&channel=ch&auth_secret=token", httpAddr)
+	_, err = util.APIRequestNegotiateV1("POST", endpoint, nil)
+	equal(t, err != nil && strings.Contains(err.Error(), "403"), true)
+	equal(t, len(nsqlookupd.DB.FindRegistrations("channel", "allowed_topic", "ch")), 1)
+}
+
+func TestTLS(t *testing.T) {
+	opts := NewNSQLookupdOptions()
+	opts.Logger = newTestLogger(t)
+	opts.HTTPSAddress = "127.0.0.1:0"
+	opts.TLSCert = "../nsqd/test/certs/server.pem"
+	opts.TLSKey = "../nsqd/test/certs/server.key"
+	opts.TLSRequired = true
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	resp, err := nsq.ReadResponse(conn)
+	equal(t, err, nil)
+	equal(t, resp, []byte("E_TLS_REQUIRED"))
+	conn.Close()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	tlsConn, err := tls.Dial("tcp", tcpAddr.String(), tlsConfig)
+	equal(t, err, nil)
+	defer tlsConn.Close()
+	tlsConn.Write(nsq.MagicV1)
+	identify(t, tlsConn, "ip.address", 5000, 5555, "fake-version")
+	nsq.Register("tls_topic", "").WriteTo(tlsConn)
+	resp, err = nsq.ReadResponse(tlsConn)
+	equal(t, err, nil)
+	equal(t, resp, []byte("OK"))
+	equal(t, len(nsqlookupd.DB.FindProducers("topic", "tls_topic", "")), 1)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	httpsAddr := nsqlookupd.httpsListener.Addr().(*net.TCPAddr)
+	httpResp, err := client.Get(fmt.Sprintf("https://%s/lookup?topic=tls_topic", httpsAddr))
+	equal(t, err, nil)
+	httpResp.Body.Close()
+	equal(t, httpResp.StatusCode, 200)
+}
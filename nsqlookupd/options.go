@@ -11,11 +11,25 @@ type nsqlookupdOptions struct {
 
 	TCPAddress       string `flag:"tcp-address"`
 	HTTPAddress      string `flag:"http-address"`
+	HTTPSAddress     string `flag:"https-address"`
 	BroadcastAddress string `flag:"broadcast-address"`
+	DataPath         string `flag:"data-path"`
 
 	InactiveProducerTimeout time.Duration `flag:"inactive-producer-timeout"`
 	TombstoneLifetime       time.Duration `flag:"tombstone-lifetime"`
 
+	PeerHTTPAddresses []string      `flag:"peer-http-address" cfg:"peer_http_addresses"`
+	PeerSyncInterval  time.Duration `flag:"peer-sync-interval"`
+
+	AuthSecret        string   `flag:"auth-secret"`
+	AuthHTTPAddresses []string `flag:"auth-http-address" cfg:"auth_http_addresses"`
+
+	TLSCert             string `flag:"tls-cert"`
+	TLSKey              string `flag:"tls-key"`
+	TLSClientAuthPolicy string `flag:"tls-client-auth-policy"`
+	TLSRootCAFile       string `flag:"tls-root-ca-file"`
+	TLSRequired         bool   `flag:"tls-required"`
+
 	Logger logger
 }
 
@@ -33,6 +47,11 @@ func NewNSQLookupdOptions() *nsqlookupdOptions {
 		InactiveProducerTimeout: 300 * time.Second,
 		TombstoneLifetime:       45 * time.Second,
 
+		PeerHTTPAddresses: make([]string, 0),
+		PeerSyncInterval:  15 * time.Second,
+
+		AuthHTTPAddresses: make([]string, 0),
+
 		Logger: log.New(os.Stderr, "[nsqlookupd] ", log.Ldate|log.Ltime|log.Lmicroseconds),
 	}
 }
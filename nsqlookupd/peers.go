@@ -0,0 +1,312 @@
+package nsqlookupd
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/nsq/util"
+)
+
+// how many peer sync intervals deleted topics and channels are
+// replicated to peers for
+const peerDeletionSyncs = 10
+
+// peerRegistration is a registration (and the producers connected directly
+// to an nsqlookupd) as exchanged with peer nsqlookupd instances
+type peerRegistration struct {
+	Category  string          `json:"category"`
+	Key       string          `json:"key"`
+	SubKey    string          `json:"subkey"`
+	Producers []*peerProducer `json:"producers"`
+	AddedAt   int64           `json:"added_at"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// peerDeletion is a topic or channel recently removed from an nsqlookupd
+type peerDeletion struct {
+	Category  string `json:"category"`
+	Key       string `json:"key"`
+	SubKey    string `json:"subkey"`
+	DeletedAt int64  `json:"deleted_at"`
+}
+
+type peerProducer struct {
+	ID               string            `json:"id"`
+	Hostname         string            `json:"hostname"`
+	BroadcastAddress string            `json:"broadcast_address"`
+	TcpPort          int               `json:"tcp_port"`
+	HttpPort         int               `json:"http_port"`
+	Version          string            `json:"version"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	LastUpdate       int64             `json:"last_update"`
+	Tombstoned       bool              `json:"tombstoned"`
+	TombstonedAt     int64             `json:"tombstoned_at"`
+}
+
+// LocalRegistrations returns every registration along with the producers
+// connected directly to this nsqlookupd (ie. not replicated from a peer)
+func (r *RegistrationDB) LocalRegistrations() []*peerRegistration {
+	r.RLock()
+	defer r.RUnlock()
+	results := make([]*peerRegistration, 0, len(r.registrationMap))
+	for k, producers := range r.registrationMap {
+		pr := &peerRegistration{
+			Category:  k.Category,
+			Key:       k.Key,
+			SubKey:    k.SubKey,
+			Producers: make([]*peerProducer, 0, len(producers)),
+			AddedAt:   r.addedAt[k].UnixNano(),
+			Metadata:  r.metadata[k],
+		}
+		for _, p := range producers {
+			if p.peer != "" {
+				continue
+			}
+			pp := &peerProducer{
+				ID:               p.peerInfo.id,
+				Hostname:         p.peerInfo.Hostname,
+				BroadcastAddress: p.peerInfo.BroadcastAddress,
+				TcpPort:          p.peerInfo.TcpPort,
+				HttpPort:         p.peerInfo.HttpPort,
+				Version:          p.peerInfo.Version,
+				Labels:           p.peerInfo.Labels,
+				LastUpdate:       atomic.LoadInt64(&p.peerInfo.lastUpdate),
+				Tombstoned:       p.tombstoned,
+			}
+			if p.tombstoned {
+				pp.TombstonedAt = p.tombstonedAt.UnixNano()
+			}
+			pr.Producers = append(pr.Producers, pp)
+		}
+		results = append(results, pr)
+	}
+	return results
+}
+
+// Deletions returns the topics and channels removed within the deletion
+// lifetime (forgetting older ones)
+func (r *RegistrationDB) Deletions() []*peerDeletion {
+	r.Lock()
+	defer r.Unlock()
+	results := make([]*peerDeletion, 0, len(r.deletions))
+	for k, deletedAt := range r.deletions {
+		if time.Now().Sub(deletedAt) >= r.deletionLifetime {
+			delete(r.deletions, k)
+			continue
+		}
+		results = append(results, &peerDeletion{k.Category, k.Key, k.SubKey, deletedAt.UnixNano()})
+	}
+	return results
+}
+
+// registrationChange is a change Replicate made to the registrations,
+// as a topology event
+type registrationChange struct {
+	eventType    string
+	registration Registration
+	peerInfo     *PeerInfo
+}
+
+// Replicate merges the local registrations (and deletions) of the nsqlookupd
+// at peer and returns the changes made
+//
+// Registrations deleted on the peer are removed, unless added here since.
+// Registrations are added (so topics and channels created on the peer are
+// known here), except those deleted here since the peer added them,
+// producers only known to the peer are added as replicas (and replicas the
+// peer no longer knows of are removed), and tombstones are applied to any
+// producer for the same nsqd.
+func (r *RegistrationDB) Replicate(peer string, registrations []*peerRegistration,
+	deletions []*peerDeletion) []registrationChange {
+	r.Lock()
+	defer r.Unlock()
+
+	var changes []registrationChange
+
+	for _, pd := range deletions {
+		k := Registration{pd.Category, pd.Key, pd.SubKey}
+		deletedAt := time.Unix(0, pd.DeletedAt)
+		if _, ok := r.registrationMap[k]; ok {
+			if r.addedAt[k].After(deletedAt) {
+				continue
+			}
+			r.remove(k, deletedAt)
+			changes = append(changes, registrationChange{TopologyUnregister, k, nil})
+			continue
+		}
+		// pass it on to our other peers
+		if r.deletionLifetime > 0 && deletedAt.After(r.deletions[k]) {
+			r.deletions[k] = deletedAt
+		}
+	}
+
+	// replicas of a producer share a PeerInfo, like the producers of a connection
+	peerInfos := make(map[string]*PeerInfo)
+	for _, producers := range r.registrationMap {
+		for _, p := range producers {
+			if p.peer == peer {
+				peerInfos[p.peerInfo.id] = p.peerInfo
+			}
+		}
+	}
+
+	seen := make(map[Registration]map[string]bool)
+	for _, pr := range registrations {
+		k := Registration{pr.Category, pr.Key, pr.SubKey}
+		addedAt := time.Unix(0, pr.AddedAt)
+		producers, ok := r.registrationMap[k]
+		if !ok {
+			if deletedAt, ok := r.deletions[k]; ok && !addedAt.After(deletedAt) {
+				// the peer has yet to apply the deletion
+				continue
+			}
+			producers = make(Producers, 0)
+			r.added(k, addedAt)
+			changes = append(changes, registrationChange{TopologyRegister, k, nil})
+		}
+		seen[k] = make(map[string]bool)
+
+		// metadata set here (or forwarded to us) takes precedence
+		if _, ok := r.metadata[k]; !ok && len(pr.Metadata) > 0 {
+			r.metadata[k] = pr.Metadata
+		}
+
+		for _, pp := range pr.Producers {
+			id := peer + "/" + pp.ID
+			seen[k][id] = true
+
+			peerInfo, ok := peerInfos[id]
+			if !ok {
+				peerInfo = &PeerInfo{
+					id:               id,
+					RemoteAddress:    pp.ID,
+					Hostname:         pp.Hostname,
+					BroadcastAddress: pp.BroadcastAddress,
+					TcpPort:          pp.TcpPort,
+					HttpPort:         pp.HttpPort,
+					Version:          pp.Version,
+					Labels:           pp.Labels,
+				}
+				peerInfos[id] = peerInfo
+			}
+			atomic.StoreInt64(&peerInfo.lastUpdate, pp.LastUpdate)
+
+			var producer *Producer
+			for _, p := range producers {
+				if p.peerInfo.id == id || p.peerInfo.address() == peerInfo.address() {
+					producer = p
+					break
+				}
+			}
+			if producer == nil {
+				producer = &Producer{peerInfo: peerInfo, peer: peer}
+				producers = append(producers, producer)
+				changes = append(changes, registrationChange{TopologyRegister, k, peerInfo})
+			}
+
+			tombstonedAt := time.Unix(0, pp.TombstonedAt)
+			if pp.Tombstoned && (!producer.tombstoned || producer.tombstonedAt.Before(tombstonedAt)) {
+				if !producer.tombstoned {
+					changes = append(changes, registrationChange{TopologyTombstone, k, producer.peerInfo})
+				}
+				producer.tombstoned = true
+				producer.tombstonedAt = tombstonedAt
+			}
+		}
+
+		r.registrationMap[k] = producers
+	}
+
+	// drop replicas of producers that have gone away on the peer
+	for k, producers := range r.registrationMap {
+		cleaned := make(Producers, 0, len(producers))
+		for _, p := range producers {
+			if p.peer == peer && !seen[k][p.peerInfo.id] {
+				changes = append(changes, registrationChange{TopologyUnregister, k, p.peerInfo})
+				continue
+			}
+			cleaned = append(cleaned, p)
+		}
+		r.registrationMap[k] = cleaned
+	}
+
+	return changes
+}
+
+func (l *NSQLookupd) peerLoop() {
+	ticker := time.NewTicker(l.opts.PeerSyncInterval)
+	for {
+		for _, peer := range l.opts.PeerHTTPAddresses {
+			l.syncPeer(peer)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-l.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	l.logf("PEERS: closing")
+	ticker.Stop()
+}
+
+func (l *NSQLookupd) syncPeer(peer string) {
+	var state struct {
+		Registrations []*peerRegistration `json:"registrations"`
+		Deletions     []*peerDeletion     `json:"deletions"`
+	}
+	err := util.ApiRequestV1WithOptions(peerURL(peer, "/peer/registrations"), &state, l.peerOpts)
+	if err != nil {
+		l.logf("ERROR: PEER(%s) - failed to get registrations - %s", peer, err)
+		return
+	}
+	for _, c := range l.DB.Replicate(peer, state.Registrations, state.Deletions) {
+		l.notifier.Notify(c.eventType, c.registration, c.peerInfo)
+	}
+	l.persistMetadata()
+}
+
+// forwardToPeers repeats an administrative request (ie. /topic/create) on
+// every peer so that it takes effect across the cluster immediately
+func (l *NSQLookupd) forwardToPeers(method string, path string, params url.Values, body []byte) {
+	if len(l.opts.PeerHTTPAddresses) == 0 {
+		return
+	}
+
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	// peers must not forward the request again
+	query.Set("replicated", "true")
+	// the secret is sent in a header instead
+	query.Del("auth_secret")
+
+	for _, peer := range l.opts.PeerHTTPAddresses {
+		peer := peer
+		endpoint := fmt.Sprintf("%s?%s", peerURL(peer, path), query.Encode())
+		l.waitGroup.Wrap(func() {
+			_, err := util.APIRequestNegotiateV1WithOptions(method, endpoint,
+				bytes.NewReader(body), l.peerOpts)
+			if err != nil {
+				l.logf("ERROR: PEER(%s) - failed to forward %s %s - %s", peer, method, path, err)
+			}
+		})
+	}
+}
+
+// peerURL returns the URL of path on a peer, peers are HTTP addresses
+// (ie. 10.0.0.1:4161) or, to use HTTPS, https:// URLs
+func peerURL(peer string, path string) string {
+	if strings.HasPrefix(peer, "https://") || strings.HasPrefix(peer, "http://") {
+		return strings.TrimSuffix(peer, "/") + path
+	}
+	return "http://" + peer + path
+}
@@ -0,0 +1,47 @@
+package nsqlookupd
+
+import (
+	"github.com/bitly/nsq/util"
+)
+
+// PrometheusMetrics returns registration counts (and memory statistics)
+// for exposition to Prometheus
+func (l *NSQLookupd) PrometheusMetrics() *util.PrometheusMetrics {
+	m := util.NewPrometheusMetrics("nsqlookupd_")
+
+	producers := l.DB.FindProducers("client", "", "")
+	active := producers.FilterByActive(l.opts.InactiveProducerTimeout, 0)
+	m.Gauge("producers", "Number of registered nsqd producers.",
+		float64(len(producers)))
+	m.Gauge("active_producers", "Number of nsqd producers that have not timed out.",
+		float64(len(active)))
+
+	topics := l.DB.FindRegistrations("topic", "*", "")
+	channels := l.DB.FindRegistrations("channel", "*", "*")
+	m.Gauge("topics", "Number of registered topics.", float64(len(topics)))
+	m.Gauge("channels", "Number of registered channels.", float64(len(channels)))
+
+	for _, topic := range topics {
+		topicProducers := l.DB.FindProducers("topic", topic.Key, "")
+		tombstoned := 0
+		for _, p := range topicProducers {
+			if p.IsTombstoned(l.opts.TombstoneLifetime) {
+				tombstoned++
+			}
+		}
+		m.Gauge("topic_producers", "Number of nsqd producers registered for the topic.",
+			float64(len(topicProducers)), "topic", topic.Key)
+		m.Gauge("topic_tombstoned_producers", "Number of nsqd producers tombstoned for the topic.",
+			float64(tombstoned), "topic", topic.Key)
+	}
+
+	for _, channel := range channels {
+		channelProducers := l.DB.FindProducers("channel", channel.Key, channel.SubKey)
+		m.Gauge("channel_producers", "Number of nsqd producers registered for the channel.",
+			float64(len(channelProducers)), "topic", channel.Key, "channel", channel.SubKey)
+	}
+
+	m.AddMemStats()
+
+	return m
+}
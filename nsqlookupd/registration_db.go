@@ -10,6 +10,18 @@ import (
 type RegistrationDB struct {
 	sync.RWMutex
 	registrationMap map[Registration]Producers
+	// tombstones (loaded from disk) waiting for their producer to register,
+	// keyed by producer address
+	tombstones map[Registration]map[string]time.Time
+	// free-form metadata (ie. owner, description) of topics and channels
+	metadata map[Registration]map[string]string
+	// when each registration was added, so that a deletion replicated from
+	// a peer doesn't remove a registration added again since
+	addedAt map[Registration]time.Time
+	// recently removed topics and channels, replicated to peers so that they
+	// don't add the registrations back (only kept when deletionLifetime is set)
+	deletions        map[Registration]time.Time
+	deletionLifetime time.Duration
 }
 
 type Registration struct {
@@ -28,12 +40,17 @@ type PeerInfo struct {
 	TcpPort          int    `json:"tcp_port"`
 	HttpPort         int    `json:"http_port"`
 	Version          string `json:"version"`
+	// topology labels (ie. zone, region, rack) advertised by nsqd
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type Producer struct {
 	peerInfo     *PeerInfo
 	tombstoned   bool
 	tombstonedAt time.Time
+	// the HTTP address of the nsqlookupd this producer was replicated from
+	// (empty for producers connected to this nsqlookupd)
+	peer string
 }
 
 type Producers []*Producer
@@ -42,6 +59,12 @@ func (p *Producer) String() string {
 	return fmt.Sprintf("%s [%d, %d]", p.peerInfo.BroadcastAddress, p.peerInfo.TcpPort, p.peerInfo.HttpPort)
 }
 
+// address identifies the nsqd behind a producer across nsqlookupd
+// instances (the id is only unique to a connection)
+func (p *PeerInfo) address() string {
+	return fmt.Sprintf("%s:%d:%d", p.BroadcastAddress, p.TcpPort, p.HttpPort)
+}
+
 func (p *Producer) Tombstone() {
 	p.tombstoned = true
 	p.tombstonedAt = time.Now()
@@ -54,24 +77,40 @@ func (p *Producer) IsTombstoned(lifetime time.Duration) bool {
 func NewRegistrationDB() *RegistrationDB {
 	return &RegistrationDB{
 		registrationMap: make(map[Registration]Producers),
+		tombstones:      make(map[Registration]map[string]time.Time),
+		metadata:        make(map[Registration]map[string]string),
+		addedAt:         make(map[Registration]time.Time),
+		deletions:       make(map[Registration]time.Time),
 	}
 }
 
-// add a registration key
-func (r *RegistrationDB) AddRegistration(k Registration) {
+// add a registration key, returns whether it was added
+func (r *RegistrationDB) AddRegistration(k Registration) bool {
 	r.Lock()
 	defer r.Unlock()
 	_, ok := r.registrationMap[k]
 	if !ok {
 		r.registrationMap[k] = make(Producers, 0)
+		r.added(k, time.Now())
 	}
+	return !ok
+}
+
+// added records when a registration was added, it expects the caller to
+// handle locking
+func (r *RegistrationDB) added(k Registration, addedAt time.Time) {
+	r.addedAt[k] = addedAt
+	delete(r.deletions, k)
 }
 
 // add a producer to a registration
 func (r *RegistrationDB) AddProducer(k Registration, p *Producer) bool {
 	r.Lock()
 	defer r.Unlock()
-	producers := r.registrationMap[k]
+	producers, ok := r.registrationMap[k]
+	if !ok {
+		r.added(k, time.Now())
+	}
 	found := false
 	for _, producer := range producers {
 		if producer.peerInfo.id == p.peerInfo.id {
@@ -79,11 +118,30 @@ func (r *RegistrationDB) AddProducer(k Registration, p *Producer) bool {
 		}
 	}
 	if found == false {
+		if tombstonedAt, ok := r.tombstones[k][p.peerInfo.address()]; ok {
+			p.tombstoned = true
+			p.tombstonedAt = tombstonedAt
+			delete(r.tombstones[k], p.peerInfo.address())
+		}
+		if p.peer == "" {
+			// a direct registration supersedes copies replicated from peers
+			producers = producers.withoutReplicasOf(p.peerInfo.address())
+		}
 		r.registrationMap[k] = append(producers, p)
 	}
 	return !found
 }
 
+// add a tombstone for a producer that has yet to register
+func (r *RegistrationDB) AddTombstone(k Registration, address string, tombstonedAt time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.tombstones[k]; !ok {
+		r.tombstones[k] = make(map[string]time.Time)
+	}
+	r.tombstones[k][address] = tombstonedAt
+}
+
 // remove a producer from a registration
 func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
 	r.Lock()
@@ -110,7 +168,40 @@ func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
 func (r *RegistrationDB) RemoveRegistration(k Registration) {
 	r.Lock()
 	defer r.Unlock()
+	r.remove(k, time.Now())
+}
+
+// remove expects the caller to handle locking
+func (r *RegistrationDB) remove(k Registration, removedAt time.Time) {
 	delete(r.registrationMap, k)
+	delete(r.tombstones, k)
+	delete(r.metadata, k)
+	delete(r.addedAt, k)
+	if r.deletionLifetime > 0 && (k.Category == "topic" || k.Category == "channel") {
+		r.deletions[k] = removedAt
+	}
+}
+
+// set (replace) the metadata of an existing registration
+func (r *RegistrationDB) SetMetadata(k Registration, metadata map[string]string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.registrationMap[k]; !ok {
+		return false
+	}
+	if len(metadata) == 0 {
+		delete(r.metadata, k)
+		return true
+	}
+	r.metadata[k] = metadata
+	return true
+}
+
+// get the metadata of a registration (nil if there is none)
+func (r *RegistrationDB) GetMetadata(k Registration) map[string]string {
+	r.RLock()
+	defer r.RUnlock()
+	return r.metadata[k]
 }
 
 func (r *RegistrationDB) FindRegistrations(category string, key string, subkey string) Registrations {
@@ -187,6 +278,14 @@ func (rr Registrations) Filter(category string, key string, subkey string) Regis
 	return output
 }
 
+func (k Registration) key() string {
+	return k.Key
+}
+
+func (k Registration) subKey() string {
+	return k.SubKey
+}
+
 func (rr Registrations) Keys() []string {
 	keys := make([]string, len(rr))
 	for i, k := range rr {
@@ -216,6 +315,17 @@ func (pp Producers) FilterByActive(inactivityTimeout time.Duration, tombstoneLif
 	return results
 }
 
+func (pp Producers) withoutReplicasOf(address string) Producers {
+	results := make(Producers, 0, len(pp))
+	for _, p := range pp {
+		if p.peer != "" && p.peerInfo.address() == address {
+			continue
+		}
+		results = append(results, p)
+	}
+	return results
+}
+
 func (pp Producers) PeerInfo() []*PeerInfo {
 	results := make([]*PeerInfo, 0)
 	for _, p := range pp {
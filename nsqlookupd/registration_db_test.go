@@ -8,13 +8,13 @@ import (
 func TestRegistrationDB(t *testing.T) {
 	sec30 := 30 * time.Second
 	beginningOfTime := time.Unix(1348797047, 0)
-	pi1 := &PeerInfo{beginningOfTime.UnixNano(), "1", "remote_addr:1", "host", "b_addr", 1, 2, "v1"}
-	pi2 := &PeerInfo{beginningOfTime.UnixNano(), "2", "remote_addr:2", "host", "b_addr", 2, 3, "v1"}
-	pi3 := &PeerInfo{beginningOfTime.UnixNano(), "3", "remote_addr:3", "host", "b_addr", 3, 4, "v1"}
-	p1 := &Producer{pi1, false, beginningOfTime}
-	p2 := &Producer{pi2, false, beginningOfTime}
-	p3 := &Producer{pi3, false, beginningOfTime}
-	p4 := &Producer{pi1, false, beginningOfTime}
+	pi1 := &PeerInfo{beginningOfTime.UnixNano(), "1", "remote_addr:1", "host", "b_addr", 1, 2, "v1", nil}
+	pi2 := &PeerInfo{beginningOfTime.UnixNano(), "2", "remote_addr:2", "host", "b_addr", 2, 3, "v1", nil}
+	pi3 := &PeerInfo{beginningOfTime.UnixNano(), "3", "remote_addr:3", "host", "b_addr", 3, 4, "v1", nil}
+	p1 := &Producer{pi1, false, beginningOfTime, ""}
+	p2 := &Producer{pi2, false, beginningOfTime, ""}
+	p3 := &Producer{pi3, false, beginningOfTime, ""}
+	p4 := &Producer{pi1, false, beginningOfTime, ""}
 
 	db := NewRegistrationDB()
 
@@ -87,3 +87,128 @@ func TestRegistrationDB(t *testing.T) {
 	k = db.FindRegistrations("c", "*", "*").Keys()
 	equal(t, len(k), 0)
 }
+
+func TestRegistrationDBReplicate(t *testing.T) {
+	db := NewRegistrationDB()
+	topic := Registration{"topic", "a", ""}
+	channel := Registration{"channel", "a", "b"}
+
+	pp := &peerProducer{ID: "remote_addr:1", BroadcastAddress: "b_addr", TcpPort: 1, HttpPort: 2}
+	changes := db.Replicate("peer", []*peerRegistration{
+		{Category: "topic", Key: "a", Producers: []*peerProducer{pp}},
+		{Category: "channel", Key: "a", SubKey: "b"},
+	}, nil)
+	equal(t, len(changes), 3)
+	equal(t, changes[0].eventType, TopologyRegister)
+	equal(t, changes[0].registration, topic)
+	equal(t, changes[0].peerInfo == nil, true)
+	equal(t, changes[1].eventType, TopologyRegister)
+	equal(t, changes[1].registration, topic)
+	equal(t, changes[1].peerInfo.id, "peer/remote_addr:1")
+	equal(t, changes[2].eventType, TopologyRegister)
+	equal(t, changes[2].registration, channel)
+
+	// nothing changed
+	changes = db.Replicate("peer", []*peerRegistration{
+		{Category: "topic", Key: "a", Producers: []*peerProducer{pp}},
+		{Category: "channel", Key: "a", SubKey: "b"},
+	}, nil)
+	equal(t, len(changes), 0)
+
+	tombstoned := *pp
+	tombstoned.Tombstoned = true
+	tombstoned.TombstonedAt = time.Now().UnixNano()
+	changes = db.Replicate("peer", []*peerRegistration{
+		{Category: "topic", Key: "a", Producers: []*peerProducer{&tombstoned}},
+		{Category: "channel", Key: "a", SubKey: "b"},
+	}, nil)
+	equal(t, len(changes), 1)
+	equal(t, changes[0].eventType, TopologyTombstone)
+
+	changes = db.Replicate("peer", []*peerRegistration{
+		{Category: "topic", Key: "a"},
+		{Category: "channel", Key: "a", SubKey: "b"},
+	}, nil)
+	equal(t, len(changes), 1)
+	equal(t, changes[0].eventType, TopologyUnregister)
+	equal(t, changes[0].registration, topic)
+	equal(t, changes[0].peerInfo.id, "peer/remote_addr:1")
+}
+
+func TestRegistrationDBReplicateDeletions(t *testing.T) {
+	a := NewRegistrationDB()
+	a.deletionLifetime = time.Minute
+	b := NewRegistrationDB()
+	b.deletionLifetime = time.Minute
+	sync := func(dst *RegistrationDB, src *RegistrationDB, peer string) {
+		dst.Replicate(peer, src.LocalRegistrations(), src.Deletions())
+	}
+	sizeOf := func(db *RegistrationDB, k Registration) int {
+		return len(db.FindRegistrations(k.Category, k.Key, k.SubKey))
+	}
+
+	topic := Registration{"topic", "a", ""}
+	channel := Registration{"channel", "a", "b"}
+	a.AddRegistration(topic)
+	a.AddRegistration(channel)
+	sync(b, a, "a")
+	sync(a, b, "b")
+	equal(t, sizeOf(b, channel), 1)
+
+	// ie. a /channel/delete that wasn't forwarded to a
+	b.RemoveRegistration(channel)
+	sync(b, a, "a")
+	equal(t, sizeOf(b, channel), 0)
+	sync(a, b, "b")
+	equal(t, sizeOf(a, channel), 0)
+	sync(b, a, "a")
+	equal(t, sizeOf(b, channel), 0)
+	equal(t, sizeOf(a, topic), 1)
+	equal(t, sizeOf(b, topic), 1)
+
+	// an ephemeral channel going away with its last producer
+	ephemeral := Registration{"channel", "a", "b#ephemeral"}
+	pi := &PeerInfo{id: "1", BroadcastAddress: "b_addr", TcpPort: 1, HttpPort: 2}
+	a.AddProducer(ephemeral, &Producer{peerInfo: pi})
+	sync(b, a, "a")
+	sync(a, b, "b")
+	equal(t, len(b.FindProducers("channel", "a", "b#ephemeral")), 1)
+
+	a.RemoveProducer(ephemeral, pi.id)
+	a.RemoveRegistration(ephemeral)
+	sync(a, b, "b")
+	equal(t, sizeOf(a, ephemeral), 0)
+	sync(b, a, "a")
+	equal(t, sizeOf(b, ephemeral), 0)
+	sync(a, b, "b")
+	equal(t, sizeOf(a, ephemeral), 0)
+
+	// added again after the deletion
+	time.Sleep(time.Millisecond)
+	a.AddRegistration(channel)
+	sync(b, a, "a")
+	equal(t, sizeOf(b, channel), 1)
+	sync(a, b, "b")
+	equal(t, sizeOf(a, channel), 1)
+}
+
+func TestTopologyNotifierOverflow(t *testing.T) {
+	n := newTopologyNotifier()
+	events := n.Subscribe()
+	k := Registration{"topic", "a", ""}
+
+	for i := 0; i < cap(events)+1; i++ {
+		n.Notify(TopologyRegister, k, nil)
+	}
+
+	count := 0
+	for _ = range events {
+		count++
+	}
+	equal(t, count, cap(events))
+	equal(t, len(n.subscribers), 0)
+
+	// already unsubscribed
+	n.Unsubscribe(events)
+	n.Notify(TopologyRegister, k, nil)
+}
@@ -1,24 +1,71 @@
 package nsqlookupd
 
 import (
+	"bufio"
+	"crypto/tls"
 	"io"
 	"net"
 
 	"github.com/bitly/nsq/util"
 )
 
+// the first byte of a TLS handshake record, which clients connecting with
+// TLS send instead of the protocol magic
+const tlsHandshakeRecord = 0x16
+
 type tcpServer struct {
 	ctx *Context
 }
 
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader, so that
+// the start of a connection can be peeked at
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 func (p *tcpServer) Handle(clientConn net.Conn) {
 	p.ctx.nsqlookupd.logf("TCP: new client(%s)", clientConn.RemoteAddr())
 
+	conn := &bufferedConn{Conn: clientConn, r: bufio.NewReader(clientConn)}
+	start, err := conn.r.Peek(1)
+	if err != nil {
+		p.ctx.nsqlookupd.logf("ERROR: failed to read protocol version - %s", err)
+		return
+	}
+
+	tlsConfig := p.ctx.nsqlookupd.tlsConfig
+	if tlsConfig != nil && start[0] == tlsHandshakeRecord {
+		tlsConn := tls.Server(conn, tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			p.ctx.nsqlookupd.logf("ERROR: client(%s) TLS handshake failed - %s",
+				clientConn.RemoteAddr(), err)
+			clientConn.Close()
+			return
+		}
+		p.ctx.nsqlookupd.logf("CLIENT(%s): TLS %#x", clientConn.RemoteAddr(),
+			tlsConn.ConnectionState().Version)
+		clientConn = tlsConn
+	} else if p.ctx.nsqlookupd.opts.TLSRequired {
+		util.SendResponse(clientConn, []byte("E_TLS_REQUIRED"))
+		clientConn.Close()
+		p.ctx.nsqlookupd.logf("ERROR: client(%s) did not connect with TLS",
+			clientConn.RemoteAddr())
+		return
+	} else {
+		clientConn = conn
+	}
+
 	// The client should initialize itself by sending a 4 byte sequence indicating
 	// the version of the protocol that it intends to communicate, this will allow us
 	// to gracefully upgrade the protocol away from text/line oriented to whatever...
 	buf := make([]byte, 4)
-	_, err := io.ReadFull(clientConn, buf)
+	_, err = io.ReadFull(clientConn, buf)
 	if err != nil {
 		p.ctx.nsqlookupd.logf("ERROR: failed to read protocol version - %s", err)
 		return
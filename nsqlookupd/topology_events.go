@@ -0,0 +1,145 @@
+package nsqlookupd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// topology event types
+const (
+	TopologyRegister   = "register"
+	TopologyUnregister = "unregister"
+	TopologyTombstone  = "tombstone"
+
+	// sent before closing the stream of a subscriber that fell behind,
+	// the client has missed events and should look the topology up again
+	TopologyResync = "resync"
+)
+
+// how often a comment is sent on idle event streams so that
+// clients (and proxies) can tell the connection is still alive
+const topologyEventsHeartbeat = 15 * time.Second
+
+type topologyEvent struct {
+	Type     string    `json:"type"`
+	Category string    `json:"category"`
+	Topic    string    `json:"topic"`
+	Channel  string    `json:"channel"`
+	Producer *PeerInfo `json:"producer"`
+}
+
+// topologyNotifier fans out topology events to subscribers (ie. the
+// /topology/events streams), subscribers that can't keep up are
+// unsubscribed (and their channel closed) rather than blocking registrations
+type topologyNotifier struct {
+	sync.Mutex
+	subscribers map[chan *topologyEvent]bool
+}
+
+func newTopologyNotifier() *topologyNotifier {
+	return &topologyNotifier{
+		subscribers: make(map[chan *topologyEvent]bool),
+	}
+}
+
+func (n *topologyNotifier) Subscribe() chan *topologyEvent {
+	ch := make(chan *topologyEvent, 128)
+	n.Lock()
+	n.subscribers[ch] = true
+	n.Unlock()
+	return ch
+}
+
+// Unsubscribe is safe to call for a subscriber that has already been
+// unsubscribed for falling behind
+func (n *topologyNotifier) Unsubscribe(ch chan *topologyEvent) {
+	n.Lock()
+	delete(n.subscribers, ch)
+	n.Unlock()
+}
+
+func (n *topologyNotifier) Notify(eventType string, k Registration, peerInfo *PeerInfo) {
+	// topology events are about topics and channels
+	if k.Category == "client" {
+		return
+	}
+
+	event := &topologyEvent{
+		Type:     eventType,
+		Category: k.Category,
+		Topic:    k.Key,
+		Channel:  k.SubKey,
+		Producer: peerInfo,
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	for ch := range n.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(n.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// topologyEventsHandler streams topology events as Server-Sent Events,
+// optionally only those for ?topic=
+func (s *httpServer) topologyEventsHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "STREAMING_UNSUPPORTED", 500)
+		return
+	}
+
+	topicName := req.URL.Query().Get("topic")
+
+	events := s.ctx.nsqlookupd.notifier.Subscribe()
+	defer s.ctx.nsqlookupd.notifier.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	closeChan := w.(http.CloseNotifier).CloseNotify()
+	ticker := time.NewTicker(topologyEventsHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				fmt.Fprintf(w, "event: %s\ndata: {}\n\n", TopologyResync)
+				flusher.Flush()
+				return
+			}
+			if topicName != "" && event.Topic != topicName {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				s.ctx.nsqlookupd.logf("ERROR: failed to marshal topology event - %s", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+		case <-closeChan:
+			return
+		case <-s.ctx.nsqlookupd.exitChan:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -41,17 +42,61 @@ func NewDeadlineTransport(timeout time.Duration) *http.Transport {
 	return transport
 }
 
+// AuthSecretHeader is the request header that carries the shared secret
+// for nsqlookupd's admin endpoints (so that it doesn't end up in logged URLs)
+const AuthSecretHeader = "X-NSQ-Auth-Secret"
+
+// RequestOptions are the optional headers and TLS configuration (for
+// https:// endpoints) of the API request helpers
+type RequestOptions struct {
+	Header    http.Header
+	TLSConfig *tls.Config
+}
+
+func newAPIRequest(method string, endpoint string, body io.Reader,
+	opts *RequestOptions) (*http.Client, *http.Request, error) {
+	transport := NewDeadlineTransport(2 * time.Second)
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts != nil {
+		for k, v := range opts.Header {
+			req.Header[k] = v
+		}
+		transport.TLSClientConfig = opts.TLSConfig
+	}
+	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
+	return &http.Client{Transport: transport}, req, nil
+}
+
+// StatusError is returned by the API request helpers when the response
+// status is anything other than 200 OK
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("got response %s %q", e.Status, e.Body)
+}
+
 // APIRequestNegotiateV1 is a helper function to perform a v1 HTTP request
 // and fallback to parsing the old backwards-compatible response format
 func APIRequestNegotiateV1(method string, endpoint string, body io.Reader) (*simplejson.Json, error) {
-	httpclient := &http.Client{Transport: NewDeadlineTransport(2 * time.Second)}
-	req, err := http.NewRequest(method, endpoint, body)
+	return APIRequestNegotiateV1WithOptions(method, endpoint, body, nil)
+}
+
+// APIRequestNegotiateV1WithOptions is APIRequestNegotiateV1 with additional
+// headers and/or TLS configuration
+func APIRequestNegotiateV1WithOptions(method string, endpoint string, body io.Reader,
+	opts *RequestOptions) (*simplejson.Json, error) {
+	httpclient, req, err := newAPIRequest(method, endpoint, body, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
-
 	resp, err := httpclient.Do(req)
 	if err != nil {
 		return nil, err
@@ -63,7 +108,7 @@ func APIRequestNegotiateV1(method string, endpoint string, body io.Reader) (*sim
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("got response %s %q", resp.Status, respBody)
+		return nil, &StatusError{resp.StatusCode, resp.Status, respBody}
 	}
 
 	if len(respBody) == 0 {
@@ -84,14 +129,17 @@ func APIRequestNegotiateV1(method string, endpoint string, body io.Reader) (*sim
 // ApiRequestV1 is a helper function to perform a v1 HTTP request
 // and parse our NSQ daemon's expected response format, with deadlines.
 func ApiRequestV1(endpoint string, v interface{}) error {
-	httpclient := &http.Client{Transport: NewDeadlineTransport(2 * time.Second)}
-	req, err := http.NewRequest("GET", endpoint, nil)
+	return ApiRequestV1WithOptions(endpoint, v, nil)
+}
+
+// ApiRequestV1WithOptions is ApiRequestV1 with additional headers and/or
+// TLS configuration
+func ApiRequestV1WithOptions(endpoint string, v interface{}, opts *RequestOptions) error {
+	httpclient, req, err := newAPIRequest("GET", endpoint, nil, opts)
 	if err != nil {
 		return err
 	}
 
-	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
-
 	resp, err := httpclient.Do(req)
 	if err != nil {
 		return err
@@ -103,7 +151,7 @@ func ApiRequestV1(endpoint string, v interface{}) error {
 		return err
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("got response %s %q", resp.Status, body)
+		return &StatusError{resp.StatusCode, resp.Status, body}
 	}
 	err = json.Unmarshal(body, &v)
 	if err != nil {
@@ -60,6 +60,32 @@ func (a *Authorization) IsAllowed(topic, channel string) bool {
 	return false
 }
 
+// HasAccess returns whether the authorization grants permission on
+// topic (and channel, if not empty), ie. nsqlookupd's "register" and "admin"
+func (a *Authorization) HasAccess(permission, topic, channel string) bool {
+	if !a.HasPermission(permission) {
+		return false
+	}
+
+	topicRegex := regexp.MustCompile(a.Topic)
+
+	if !topicRegex.MatchString(topic) {
+		return false
+	}
+
+	if channel == "" {
+		return true
+	}
+
+	for _, c := range a.Channels {
+		channelRegex := regexp.MustCompile(c)
+		if channelRegex.MatchString(channel) {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *AuthState) IsAllowed(topic, channel string) bool {
 	for _, aa := range a.Authorizations {
 		if aa.IsAllowed(topic, channel) {
@@ -69,6 +95,15 @@ func (a *AuthState) IsAllowed(topic, channel string) bool {
 	return false
 }
 
+func (a *AuthState) HasAccess(permission, topic, channel string) bool {
+	for _, aa := range a.Authorizations {
+		if aa.HasAccess(permission, topic, channel) {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *AuthState) IsExpired() bool {
 	if a.Expires.Before(time.Now()) {
 		return true
@@ -106,7 +141,7 @@ func QueryAuthd(authd, remoteIp, tlsEnabled, authSecret string) (*AuthState, err
 	for _, auth := range authState.Authorizations {
 		for _, p := range auth.Permissions {
 			switch p {
-			case "subscribe", "publish":
+			case "subscribe", "publish", "register", "admin":
 			default:
 				return nil, fmt.Errorf("unknown permission %s", p)
 			}
@@ -0,0 +1,102 @@
+package util
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bitly/go-simplejson"
+)
+
+// JSONFilter matches JSON messages in which a field matches a value (it's
+// used to filter the messages put to a channel), the expression is either
+//
+//	<field>=<value>   (the field is equal to the string or number value)
+//	<field>~<regexp>  (the field is a string matching the regular expression)
+//
+// where nested fields are separated by "."
+type JSONFilter struct {
+	expr string
+	path []string
+
+	value    string
+	isNumber bool
+	number   float64
+
+	regexp *regexp.Regexp
+}
+
+func NewJSONFilter(expr string) (*JSONFilter, error) {
+	i := strings.IndexAny(expr, "=~")
+	if i <= 0 {
+		return nil, errors.New("filter must be of the form <field>=<value> or <field>~<regexp>")
+	}
+
+	f := &JSONFilter{
+		expr:  expr,
+		path:  strings.Split(expr[:i], "."),
+		value: expr[i+1:],
+	}
+	for _, p := range f.path {
+		if p == "" {
+			return nil, errors.New("filter field must not contain empty path elements")
+		}
+	}
+
+	if expr[i] == '~' {
+		re, err := regexp.Compile(f.value)
+		if err != nil {
+			return nil, err
+		}
+		f.regexp = re
+		return f, nil
+	}
+
+	// if the value can't convert to float, then it can't match a number
+	number, err := strconv.ParseFloat(f.value, 64)
+	if err == nil {
+		f.isNumber = true
+		f.number = number
+	}
+
+	return f, nil
+}
+
+func (f *JSONFilter) String() string {
+	return f.expr
+}
+
+// Match returns whether or not the message body passes the filter,
+// bodies that are not JSON objects never match
+func (f *JSONFilter) Match(body []byte) bool {
+	js, err := simplejson.NewJson(body)
+	if err != nil {
+		return false
+	}
+
+	val := js
+	for _, p := range f.path {
+		var ok bool
+		val, ok = val.CheckGet(p)
+		if !ok {
+			return false
+		}
+	}
+
+	if strVal, err := val.String(); err == nil {
+		if f.regexp != nil {
+			return f.regexp.MatchString(strVal)
+		}
+		return strVal == f.value
+	}
+
+	if f.regexp == nil && f.isNumber {
+		// integers (up to 2^53 or so) can be compared as float64
+		floatVal, err := val.Float64()
+		return err == nil && floatVal == f.number
+	}
+
+	// give up on comparisons of other types
+	return false
+}
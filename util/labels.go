@@ -0,0 +1,30 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var validLabelRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+$`)
+
+// IsValidLabel checks a topology label key (or value) for correctness
+func IsValidLabel(s string) bool {
+	if len(s) > 64 || len(s) < 1 {
+		return false
+	}
+	return validLabelRegex.MatchString(s)
+}
+
+// ParseLabels parses a list of key=value pairs (ie. zone=us-east-1a)
+func ParseLabels(pairs []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !IsValidLabel(parts[0]) || !IsValidLabel(parts[1]) {
+			return nil, fmt.Errorf("invalid label %q (expected key=value)", pair)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
@@ -97,6 +97,57 @@ func GetLookupdTopicChannels(topic string, lookupdHTTPAddrs []string) ([]string,
 	return allChannels, nil
 }
 
+// GetLookupdTopicMetadata returns the union of the metadata of the given topic
+// and of its channels (keyed by channel name) from all the given lookupd
+func GetLookupdTopicMetadata(topic string, lookupdHTTPAddrs []string) (map[string]string, map[string]map[string]string, error) {
+	success := false
+	topicMetadata := make(map[string]string)
+	channelMetadata := make(map[string]map[string]string)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, addr := range lookupdHTTPAddrs {
+		wg.Add(1)
+		endpoint := fmt.Sprintf("http://%s/channels?topic=%s", addr, url.QueryEscape(topic))
+		log.Printf("LOOKUPD: querying %s", endpoint)
+		go func(endpoint string) {
+			data, err := util.APIRequestNegotiateV1("GET", endpoint, nil)
+			lock.Lock()
+			defer lock.Unlock()
+			defer wg.Done()
+			if err != nil {
+				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				return
+			}
+			success = true
+			// {"data":{"channels":["test"],"metadata":{"test":{"owner":"..."}},"topic_metadata":{...}}}
+			mergeMetadata(topicMetadata, data.Get("topic_metadata").MustMap())
+			for channel, m := range data.Get("metadata").MustMap() {
+				if _, ok := channelMetadata[channel]; !ok {
+					channelMetadata[channel] = make(map[string]string)
+				}
+				metadata, _ := m.(map[string]interface{})
+				mergeMetadata(channelMetadata[channel], metadata)
+			}
+		}(endpoint)
+	}
+	wg.Wait()
+	if success == false {
+		return nil, nil, errors.New("unable to query any lookupd")
+	}
+	return topicMetadata, channelMetadata, nil
+}
+
+func mergeMetadata(metadata map[string]string, m map[string]interface{}) {
+	for k, v := range m {
+		if _, ok := metadata[k]; ok {
+			continue
+		}
+		if s, ok := v.(string); ok {
+			metadata[k] = s
+		}
+	}
+}
+
 // GetLookupdProducers returns a slice of pointers to Producer structs
 // containing metadata for each node connected to given lookupds
 func GetLookupdProducers(lookupdHTTPAddrs []string) ([]*Producer, error) {
@@ -217,6 +268,11 @@ func GetLookupdTopicProducers(topic string, lookupdHTTPAddrs []string) ([]string
 			lock.Lock()
 			defer lock.Unlock()
 			defer wg.Done()
+			if statusErr, ok := err.(*util.StatusError); ok && statusErr.StatusCode == 404 {
+				// the lookupd doesn't know of the topic, so it has no producers
+				success = true
+				return
+			}
 			if err != nil {
 				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
 				return
@@ -369,6 +425,10 @@ func GetNSQDStats(nsqdHTTPAddrs []string, selectedTopic string) ([]*TopicStats,
 					ChannelCount: len(channels),
 					Paused:       t.Get("paused").MustBool(),
 
+					MaxDepth:       t.Get("max_depth").MustInt64(),
+					MaxBytes:       t.Get("max_bytes").MustInt64(),
+					OverflowPolicy: t.Get("overflow_policy").MustString(),
+
 					E2eProcessingLatency: e2eProcessingLatency,
 				}
 				topicStatsList = append(topicStatsList, topicStats)
@@ -412,6 +472,11 @@ func GetNSQDStats(nsqdHTTPAddrs []string, selectedTopic string) ([]*TopicStats,
 						RequeueCount:  c.Get("requeue_count").MustInt64(),
 						TimeoutCount:  c.Get("timeout_count").MustInt64(),
 
+						MaxDepth:       c.Get("max_depth").MustInt64(),
+						MaxBytes:       c.Get("max_bytes").MustInt64(),
+						OverflowPolicy: c.Get("overflow_policy").MustString(),
+						Filter:         c.Get("filter").MustString(),
+
 						E2eProcessingLatency: e2eProcessingLatency,
 						// TODO: this is sort of wrong; clients should be de-duped
 						// client A that connects to NSQD-a and NSQD-b should only be counted once. right?
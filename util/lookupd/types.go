@@ -59,6 +59,11 @@ type TopicStats struct {
 	Channels     []*ChannelStats
 	Paused       bool
 
+	// backlog limits are per host (ie. not aggregated)
+	MaxDepth       int64
+	MaxBytes       int64
+	OverflowPolicy string
+
 	E2eProcessingLatency *util.E2eProcessingLatencyAggregate
 	numAggregates        int
 }
@@ -115,6 +120,12 @@ type ChannelStats struct {
 	Clients       []*ClientStats
 	Paused        bool
 
+	// backlog limits and filter are per host (ie. not aggregated)
+	MaxDepth       int64
+	MaxBytes       int64
+	OverflowPolicy string
+	Filter         string
+
 	E2eProcessingLatency *util.E2eProcessingLatencyAggregate
 }
 
@@ -191,6 +191,14 @@ func (e *E2eProcessingLatencyAggregate) Less(i, j int) bool {
 func (A *E2eProcessingLatencyAggregate) Add(B *E2eProcessingLatencyAggregate, N int) *E2eProcessingLatencyAggregate {
 	if A == nil {
 		a := *B
+		// copy the percentiles so that aggregating doesn't modify B
+		a.Percentiles = make([]map[string]float64, len(B.Percentiles))
+		for i, p := range B.Percentiles {
+			a.Percentiles[i] = make(map[string]float64, len(p))
+			for k, v := range p {
+				a.Percentiles[i][k] = v
+			}
+		}
 		A = &a
 	} else {
 		ap := A.Percentiles
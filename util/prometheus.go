@@ -0,0 +1,170 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// PrometheusMetrics collects samples and writes them in the Prometheus
+// text exposition format, samples are grouped by metric (in the order
+// each metric was first added) as the format requires
+type PrometheusMetrics struct {
+	prefix   string
+	metrics  []*prometheusMetric
+	byName   map[string]*prometheusMetric
+	labelBuf bytes.Buffer
+}
+
+type prometheusMetric struct {
+	name    string
+	help    string
+	kind    string
+	samples []string
+}
+
+// NewPrometheusMetrics returns an empty set of metrics whose names
+// will be prefixed with prefix (ie. "nsqd_")
+func NewPrometheusMetrics(prefix string) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		prefix: prefix,
+		byName: make(map[string]*prometheusMetric),
+	}
+}
+
+// Gauge adds a sample of a metric that can go up and down, labels
+// are pairs of label names and values
+func (m *PrometheusMetrics) Gauge(name string, help string, value float64, labels ...string) {
+	m.add(name, help, "gauge", value, labels)
+}
+
+// Counter adds a sample of a metric that only ever increases (until a restart),
+// labels are pairs of label names and values
+func (m *PrometheusMetrics) Counter(name string, help string, value float64, labels ...string) {
+	m.add(name, help, "counter", value, labels)
+}
+
+func (m *PrometheusMetrics) add(name string, help string, kind string, value float64, labels []string) {
+	name = m.prefix + name
+	metric, ok := m.byName[name]
+	if !ok {
+		metric = &prometheusMetric{
+			name: name,
+			help: help,
+			kind: kind,
+		}
+		m.byName[name] = metric
+		m.metrics = append(m.metrics, metric)
+	}
+
+	m.labelBuf.Reset()
+	if len(labels) > 1 {
+		m.labelBuf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.labelBuf.WriteByte(',')
+			}
+			m.labelBuf.WriteString(labels[i])
+			m.labelBuf.WriteString(`="`)
+			m.labelBuf.WriteString(prometheusLabelEscaper.Replace(labels[i+1]))
+			m.labelBuf.WriteByte('"')
+		}
+		m.labelBuf.WriteByte('}')
+	}
+
+	metric.samples = append(metric.samples,
+		fmt.Sprintf("%s%s %s", name, m.labelBuf.String(), FormatPrometheusValue(value)))
+}
+
+// AddMemStats adds the same memory statistics that are sent to statsd
+func (m *PrometheusMetrics) AddMemStats() {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	length := len(memStats.PauseNs)
+	if int(memStats.NumGC) < length {
+		length = int(memStats.NumGC)
+	}
+	gcPauses := make(uint64Slice, length)
+	copy(gcPauses, memStats.PauseNs[:length])
+	sort.Sort(gcPauses)
+
+	m.Gauge("mem_heap_objects", "Number of allocated heap objects.",
+		float64(memStats.HeapObjects))
+	m.Gauge("mem_heap_idle_bytes", "Bytes in idle heap spans.",
+		float64(memStats.HeapIdle))
+	m.Gauge("mem_heap_in_use_bytes", "Bytes in in-use heap spans.",
+		float64(memStats.HeapInuse))
+	m.Gauge("mem_heap_released_bytes", "Bytes of heap released to the OS.",
+		float64(memStats.HeapReleased))
+	m.Gauge("mem_next_gc_bytes", "Heap size at which the next GC will run.",
+		float64(memStats.NextGC))
+	m.Counter("mem_gc_runs", "Number of completed GC cycles.",
+		float64(memStats.NumGC))
+	for _, q := range []float64{0.95, 0.99, 1.0} {
+		m.Gauge("mem_gc_pause_usec", "Recent GC pause durations in microseconds.",
+			float64(gcPausePercentile(q, gcPauses)/1000), "quantile", FormatPrometheusValue(q))
+	}
+}
+
+// WriteTo writes the metrics in the text exposition format
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, metric := range m.metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", metric.name, prometheusHelpEscaper.Replace(metric.help))
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", metric.name, metric.kind)
+		for _, sample := range metric.samples {
+			buf.WriteString(sample)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+// PrometheusResponse writes the metrics as an HTTP response
+func PrometheusResponse(w http.ResponseWriter, m *PrometheusMetrics) {
+	w.Header().Set("Content-Type", PrometheusContentType)
+	w.WriteHeader(200)
+	m.WriteTo(w)
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var prometheusHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// FormatPrometheusValue formats a sample value (or a quantile label)
+func FormatPrometheusValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+
+func gcPausePercentile(q float64, arr uint64Slice) uint64 {
+	if len(arr) == 0 {
+		return 0
+	}
+	i := int(math.Floor(q*float64(len(arr)) + 0.5))
+	if i >= len(arr) {
+		i = len(arr) - 1
+	}
+	return arr[i]
+}
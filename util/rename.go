@@ -0,0 +1,12 @@
+// +build !windows
+
+package util
+
+import (
+	"os"
+)
+
+// AtomicRename renames source_file to target_file, replacing it if it exists
+func AtomicRename(source_file, target_file string) error {
+	return os.Rename(source_file, target_file)
+}
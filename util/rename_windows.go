@@ -1,6 +1,6 @@
 // +build windows
 
-package nsqd
+package util
 
 import (
 	"syscall"
@@ -27,7 +27,8 @@ func moveFileEx(source_file, target_file *uint16, flags uint32) error {
 	return nil
 }
 
-func atomic_rename(source_file, target_file string) error {
+// AtomicRename renames source_file to target_file, replacing it if it exists
+func AtomicRename(source_file, target_file string) error {
 	lpReplacedFileName, err := syscall.UTF16PtrFromString(target_file)
 	if err != nil {
 		return err
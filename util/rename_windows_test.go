@@ -1,6 +1,6 @@
 // +build windows
 
-package nsqd
+package util
 
 import (
 	"fmt"
@@ -11,18 +11,16 @@ import (
 	"strings"
 	"testing"
 	"time"
-
-	"github.com/bitly/nsq/util"
 )
 
 const TEST_FILE_COUNT = 500
 
 func TestConcurrentRenames(t *testing.T) {
-	var waitGroup util.WaitGroupWrapper
+	var waitGroup WaitGroupWrapper
 
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	trigger := make(chan struct{})
-	testDir := filepath.Join(os.TempDir(), fmt.Sprintf("nsqd_TestConcurrentRenames_%d", r.Int()))
+	testDir := filepath.Join(os.TempDir(), fmt.Sprintf("util_TestConcurrentRenames_%d", r.Int()))
 
 	err := os.MkdirAll(testDir, 644)
 	if err != nil {
@@ -55,11 +53,11 @@ func TestConcurrentRenames(t *testing.T) {
 
 		waitGroup.Wrap(func() {
 			_, _ = <-trigger
-			err := atomic_rename(sourcePath1, targetPath)
+			err := AtomicRename(sourcePath1, targetPath)
 			if err != nil {
 				t.Error(err)
 			}
-			err = atomic_rename(sourcePath2, targetPath)
+			err = AtomicRename(sourcePath2, targetPath)
 			if err != nil {
 				t.Error(err)
 			}